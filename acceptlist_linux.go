@@ -0,0 +1,152 @@
+//go:build linux
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+
+	"example.com/m/scanner"
+	"golang.org/x/sys/unix"
+	"tinygo.org/x/bluetooth"
+)
+
+// The filter accept list of the controller is managed by the kernel: devices
+// added with the Add Device management command go on it, and while there are
+// any and no discovery runs, the kernel scans passively with a filter policy
+// that makes the controller drop the advertisements of all other devices.
+// Their advertisements are reported on the management socket as Device Found
+// events, which the scan reads there, as BlueZ doesn't pass them on outside
+// of discovery. The address types aren't known, so addresses are added as
+// both public and random. If the list is full, or a device uses a private
+// address the controller can't resolve, the kernel scans without the list
+// and drops the other devices itself.
+
+const (
+	mgmtAddDevice        = 0x0033
+	mgmtRemoveDevice     = 0x0034
+	mgmtEventDeviceFound = 0x0012
+)
+
+const (
+	mgmtAddressLEPublic = 0x01
+	mgmtAddressLERandom = 0x02
+)
+
+// acceptListScan is a scanner.Backend that scans for the devices on the
+// accept list of the controller.
+type acceptListScan struct {
+	adapter   *bluetooth.Adapter
+	index     uint16
+	addresses []bluetooth.MAC
+
+	mu     sync.Mutex
+	cancel chan struct{} // non-nil while scanning
+}
+
+func acceptListBackend(a *bluetooth.Adapter, addresses []bluetooth.MAC) (scanner.Backend, error) {
+	index, err := controllerIndex(scanAdapterID)
+	if err != nil {
+		return nil, err
+	}
+	return &acceptListScan{adapter: a, index: index, addresses: addresses}, nil
+}
+
+func (s *acceptListScan) Scan(callback func(*bluetooth.Adapter, bluetooth.ScanResult)) error {
+	s.mu.Lock()
+	if s.cancel != nil {
+		s.mu.Unlock()
+		return errors.New("already scanning")
+	}
+	cancel := make(chan struct{})
+	s.cancel = cancel
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.cancel = nil
+		s.mu.Unlock()
+	}()
+
+	m, err := openMgmt()
+	if err != nil {
+		return err
+	}
+	defer m.Close()
+	for _, mac := range s.addresses {
+		for _, typ := range []byte{mgmtAddressLEPublic, mgmtAddressLERandom} {
+			address := append(mac[:], typ)
+			// Action 0 scans for the device in the background and
+			// reports it, without connecting.
+			if _, err := m.command(mgmtAddDevice, s.index, append(address, 0x00)); err != nil {
+				return wrapError("adding "+mac.String()+" to the accept list", err)
+			}
+			defer m.command(mgmtRemoveDevice, s.index, address)
+		}
+	}
+	scanLog.Debug("scanning with the accept list", "devices", len(s.addresses))
+
+	// Reads time out quickly, so that the scan stops soon after StopScan.
+	timeout := unix.NsecToTimeval(int64(250 * time.Millisecond))
+	if err := unix.SetsockoptTimeval(m.fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &timeout); err != nil {
+		return err
+	}
+	buf := make([]byte, 4096)
+	for {
+		select {
+		case <-cancel:
+			return nil
+		default:
+		}
+		n, err := unix.Read(m.fd, buf)
+		if err == unix.EAGAIN || err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		// Devices found by discoveries of other programs are reported too;
+		// the filter of the command drops them.
+		if n < 6 || binary.LittleEndian.Uint16(buf) != mgmtEventDeviceFound || binary.LittleEndian.Uint16(buf[2:]) != s.index {
+			continue
+		}
+		if result, ok := deviceFoundResult(buf[6:n]); ok {
+			callback(s.adapter, result)
+		}
+	}
+}
+
+func (s *acceptListScan) StopScan() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cancel == nil {
+		return errors.New("not scanning")
+	}
+	close(s.cancel)
+	s.cancel = nil
+	return nil
+}
+
+// deviceFoundResult makes a scan result of the parameters of a Device Found
+// event: the address and its type, the RSSI, flags, and the advertising data.
+func deviceFoundResult(params []byte) (bluetooth.ScanResult, bool) {
+	if len(params) < 14 {
+		return bluetooth.ScanResult{}, false
+	}
+	typ := params[6]
+	length := int(binary.LittleEndian.Uint16(params[12:]))
+	if (typ != mgmtAddressLEPublic && typ != mgmtAddressLERandom) || len(params) < 14+length {
+		return bluetooth.ScanResult{}, false
+	}
+	var mac bluetooth.MAC
+	copy(mac[:], params)
+	address := bluetooth.Address{MACAddress: bluetooth.MACAddress{MAC: mac}}
+	address.SetRandom(typ == mgmtAddressLERandom)
+	raw := append([]byte(nil), params[14:14+length]...)
+	return bluetooth.ScanResult{
+		Address:              address,
+		RSSI:                 int16(int8(params[7])),
+		AdvertisementPayload: scanner.RawPayload(raw),
+	}, true
+}
@@ -0,0 +1,325 @@
+// Package ad parses and builds Bluetooth LE advertising data (AD structures),
+// as defined in the Core Specification Supplement, Part A.
+//
+// An advertisement payload is a sequence of structures, each encoded as a
+// length byte, a type byte and length-1 bytes of data.
+package ad
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+
+	"tinygo.org/x/bluetooth"
+)
+
+// ErrTruncated is returned by Parse when the last structure in the payload is
+// longer than the remaining data.
+var ErrTruncated = errors.New("ad: truncated AD structure")
+
+// Type is an AD type, the second byte of every AD structure.
+type Type uint8
+
+// AD types, from the Bluetooth SIG Assigned Numbers document.
+const (
+	Flags                       Type = 0x01
+	IncompleteServiceUUIDs16    Type = 0x02
+	CompleteServiceUUIDs16      Type = 0x03
+	IncompleteServiceUUIDs32    Type = 0x04
+	CompleteServiceUUIDs32      Type = 0x05
+	IncompleteServiceUUIDs128   Type = 0x06
+	CompleteServiceUUIDs128     Type = 0x07
+	ShortenedLocalName          Type = 0x08
+	CompleteLocalName           Type = 0x09
+	TxPowerLevel                Type = 0x0A
+	ClassOfDevice               Type = 0x0D
+	PeripheralConnIntervalRange Type = 0x12
+	ServiceSolicitationUUIDs16  Type = 0x14
+	ServiceSolicitationUUIDs128 Type = 0x15
+	ServiceData16               Type = 0x16
+	PublicTargetAddress         Type = 0x17
+	RandomTargetAddress         Type = 0x18
+	Appearance                  Type = 0x19
+	AdvertisingInterval         Type = 0x1A
+	LEDeviceAddress             Type = 0x1B
+	LERole                      Type = 0x1C
+	ServiceSolicitationUUIDs32  Type = 0x1F
+	ServiceData32               Type = 0x20
+	ServiceData128              Type = 0x21
+	URI                         Type = 0x24
+	ManufacturerData            Type = 0xFF
+)
+
+var typeNames = map[Type]string{
+	Flags:                       "Flags",
+	IncompleteServiceUUIDs16:    "Incomplete List of 16-bit Service UUIDs",
+	CompleteServiceUUIDs16:      "Complete List of 16-bit Service UUIDs",
+	IncompleteServiceUUIDs32:    "Incomplete List of 32-bit Service UUIDs",
+	CompleteServiceUUIDs32:      "Complete List of 32-bit Service UUIDs",
+	IncompleteServiceUUIDs128:   "Incomplete List of 128-bit Service UUIDs",
+	CompleteServiceUUIDs128:     "Complete List of 128-bit Service UUIDs",
+	ShortenedLocalName:          "Shortened Local Name",
+	CompleteLocalName:           "Complete Local Name",
+	TxPowerLevel:                "Tx Power Level",
+	ClassOfDevice:               "Class of Device",
+	PeripheralConnIntervalRange: "Peripheral Connection Interval Range",
+	ServiceSolicitationUUIDs16:  "List of 16-bit Service Solicitation UUIDs",
+	ServiceSolicitationUUIDs128: "List of 128-bit Service Solicitation UUIDs",
+	ServiceData16:               "Service Data - 16-bit UUID",
+	PublicTargetAddress:         "Public Target Address",
+	RandomTargetAddress:         "Random Target Address",
+	Appearance:                  "Appearance",
+	AdvertisingInterval:         "Advertising Interval",
+	LEDeviceAddress:             "LE Bluetooth Device Address",
+	LERole:                      "LE Role",
+	ServiceSolicitationUUIDs32:  "List of 32-bit Service Solicitation UUIDs",
+	ServiceData32:               "Service Data - 32-bit UUID",
+	ServiceData128:              "Service Data - 128-bit UUID",
+	URI:                         "URI",
+	ManufacturerData:            "Manufacturer Specific Data",
+}
+
+func (t Type) String() string {
+	if name, ok := typeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("Unknown (0x%02X)", uint8(t))
+}
+
+// Structure is a single AD structure. Data excludes the length and type bytes.
+type Structure struct {
+	Type Type
+	Data []byte
+}
+
+// String returns a human-readable form of the structure, decoding the value
+// for the types this package knows about.
+func (s Structure) String() string {
+	return s.Type.String() + ": " + s.value()
+}
+
+func (s Structure) value() string {
+	switch s.Type {
+	case Flags:
+		if len(s.Data) >= 1 {
+			return formatFlags(s.Data[0])
+		}
+	case ShortenedLocalName, CompleteLocalName:
+		return fmt.Sprintf("%q", s.Data)
+	case TxPowerLevel:
+		if len(s.Data) == 1 {
+			return fmt.Sprintf("%d dBm", int8(s.Data[0]))
+		}
+	case Appearance:
+		if len(s.Data) == 2 {
+			return fmt.Sprintf("0x%04X", binary.LittleEndian.Uint16(s.Data))
+		}
+	case AdvertisingInterval:
+		if len(s.Data) == 2 {
+			return fmt.Sprintf("%.3f ms", float64(binary.LittleEndian.Uint16(s.Data))*0.625)
+		}
+	case IncompleteServiceUUIDs16, CompleteServiceUUIDs16,
+		IncompleteServiceUUIDs32, CompleteServiceUUIDs32,
+		IncompleteServiceUUIDs128, CompleteServiceUUIDs128:
+		var uuids []string
+		for _, uuid := range s.uuids() {
+			uuids = append(uuids, uuid.String())
+		}
+		return strings.Join(uuids, ", ")
+	case ServiceData16, ServiceData32, ServiceData128:
+		if element, ok := s.serviceData(); ok {
+			return fmt.Sprintf("%s: %x", element.UUID.String(), element.Data)
+		}
+	case ManufacturerData:
+		if len(s.Data) >= 2 {
+			return fmt.Sprintf("0x%04X: %x", binary.LittleEndian.Uint16(s.Data), s.Data[2:])
+		}
+	}
+	return fmt.Sprintf("%x", s.Data)
+}
+
+var flagNames = []string{
+	"LE Limited Discoverable",
+	"LE General Discoverable",
+	"BR/EDR Not Supported",
+	"Simultaneous LE and BR/EDR (Controller)",
+	"Simultaneous LE and BR/EDR (Host)",
+}
+
+func formatFlags(flags byte) string {
+	var names []string
+	for i, name := range flagNames {
+		if flags&(1<<i) != 0 {
+			names = append(names, name)
+		}
+	}
+	return fmt.Sprintf("0x%02X [%s]", flags, strings.Join(names, ", "))
+}
+
+// uuidSize returns the size in bytes of the UUIDs in a UUID list or service
+// data structure, or 0 for other types.
+func (s Structure) uuidSize() int {
+	switch s.Type {
+	case IncompleteServiceUUIDs16, CompleteServiceUUIDs16, ServiceSolicitationUUIDs16, ServiceData16:
+		return 2
+	case IncompleteServiceUUIDs32, CompleteServiceUUIDs32, ServiceSolicitationUUIDs32, ServiceData32:
+		return 4
+	case IncompleteServiceUUIDs128, CompleteServiceUUIDs128, ServiceSolicitationUUIDs128, ServiceData128:
+		return 16
+	}
+	return 0
+}
+
+func (s Structure) uuids() []bluetooth.UUID {
+	size := s.uuidSize()
+	if size == 0 {
+		return nil
+	}
+	var uuids []bluetooth.UUID
+	for i := 0; i+size <= len(s.Data); i += size {
+		uuids = append(uuids, decodeUUID(s.Data[i:i+size]))
+	}
+	return uuids
+}
+
+func (s Structure) serviceData() (bluetooth.ServiceDataElement, bool) {
+	size := s.uuidSize()
+	if size == 0 || len(s.Data) < size {
+		return bluetooth.ServiceDataElement{}, false
+	}
+	return bluetooth.ServiceDataElement{
+		UUID: decodeUUID(s.Data[:size]),
+		Data: s.Data[size:],
+	}, true
+}
+
+// decodeUUID decodes a little-endian 16, 32 or 128-bit UUID.
+func decodeUUID(b []byte) bluetooth.UUID {
+	switch len(b) {
+	case 2:
+		return bluetooth.New16BitUUID(binary.LittleEndian.Uint16(b))
+	case 4:
+		return bluetooth.New32BitUUID(binary.LittleEndian.Uint32(b))
+	}
+	var uuid [16]byte
+	for i := range uuid {
+		uuid[i] = b[15-i]
+	}
+	return bluetooth.NewUUID(uuid)
+}
+
+// Payload is a parsed advertisement payload.
+type Payload []Structure
+
+// Parse splits a raw advertisement payload into its AD structures. A zero
+// length byte ends the payload, as controllers pad short payloads with zeros.
+// If the payload is malformed, the structures before the malformed one are
+// returned together with ErrTruncated.
+func Parse(data []byte) (Payload, error) {
+	var p Payload
+	for len(data) > 0 {
+		length := int(data[0])
+		if length == 0 {
+			break
+		}
+		if length >= len(data) {
+			return p, ErrTruncated
+		}
+		p = append(p, Structure{Type: Type(data[1]), Data: data[2 : length+1]})
+		data = data[length+1:]
+	}
+	return p, nil
+}
+
+// Find returns the first structure of the given type.
+func (p Payload) Find(t Type) (Structure, bool) {
+	for _, s := range p {
+		if s.Type == t {
+			return s, true
+		}
+	}
+	return Structure{}, false
+}
+
+// Flags returns the value of the Flags structure.
+func (p Payload) Flags() (byte, bool) {
+	s, ok := p.Find(Flags)
+	if !ok || len(s.Data) < 1 {
+		return 0, false
+	}
+	return s.Data[0], true
+}
+
+// TxPower returns the advertised TX power level in dBm.
+func (p Payload) TxPower() (int8, bool) {
+	s, ok := p.Find(TxPowerLevel)
+	if !ok || len(s.Data) != 1 {
+		return 0, false
+	}
+	return int8(s.Data[0]), true
+}
+
+// LocalName returns the complete local name, or the shortened local name if
+// there is no complete one.
+func (p Payload) LocalName() (name string, complete bool) {
+	if s, ok := p.Find(CompleteLocalName); ok {
+		return string(s.Data), true
+	}
+	if s, ok := p.Find(ShortenedLocalName); ok {
+		return string(s.Data), false
+	}
+	return "", false
+}
+
+// Appearance returns the GAP appearance value.
+func (p Payload) Appearance() (uint16, bool) {
+	s, ok := p.Find(Appearance)
+	if !ok || len(s.Data) != 2 {
+		return 0, false
+	}
+	return binary.LittleEndian.Uint16(s.Data), true
+}
+
+// ServiceUUIDs returns all service class UUIDs from the (complete and
+// incomplete) UUID lists.
+func (p Payload) ServiceUUIDs() []bluetooth.UUID {
+	var uuids []bluetooth.UUID
+	for _, s := range p {
+		switch s.Type {
+		case IncompleteServiceUUIDs16, CompleteServiceUUIDs16,
+			IncompleteServiceUUIDs32, CompleteServiceUUIDs32,
+			IncompleteServiceUUIDs128, CompleteServiceUUIDs128:
+			uuids = append(uuids, s.uuids()...)
+		}
+	}
+	return uuids
+}
+
+// ServiceData returns all service data elements.
+func (p Payload) ServiceData() []bluetooth.ServiceDataElement {
+	var elements []bluetooth.ServiceDataElement
+	for _, s := range p {
+		switch s.Type {
+		case ServiceData16, ServiceData32, ServiceData128:
+			if element, ok := s.serviceData(); ok {
+				elements = append(elements, element)
+			}
+		}
+	}
+	return elements
+}
+
+// ManufacturerData returns all manufacturer specific data elements.
+func (p Payload) ManufacturerData() []bluetooth.ManufacturerDataElement {
+	var elements []bluetooth.ManufacturerDataElement
+	for _, s := range p {
+		if s.Type == ManufacturerData && len(s.Data) >= 2 {
+			elements = append(elements, bluetooth.ManufacturerDataElement{
+				CompanyID: binary.LittleEndian.Uint16(s.Data),
+				Data:      s.Data[2:],
+			})
+		}
+	}
+	return elements
+}
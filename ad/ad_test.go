@@ -0,0 +1,97 @@
+package ad
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+
+	"tinygo.org/x/bluetooth"
+)
+
+// readCorpus reads the payloads of testdata/payloads.txt.
+func readCorpus(tb testing.TB, path string) [][]byte {
+	tb.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer f.Close()
+	var payloads [][]byte
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(strings.SplitN(scanner.Text(), "#", 2)[0])
+		if line == "" {
+			continue
+		}
+		payload, err := hex.DecodeString(line)
+		if err != nil {
+			tb.Fatalf("%s: %q: %v", path, line, err)
+		}
+		payloads = append(payloads, payload)
+	}
+	if err := scanner.Err(); err != nil {
+		tb.Fatal(err)
+	}
+	return payloads
+}
+
+func FuzzParse(f *testing.F) {
+	for _, payload := range readCorpus(f, "testdata/payloads.txt") {
+		f.Add(payload)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		p, err := Parse(data)
+		if err != nil && !errors.Is(err, ErrTruncated) {
+			t.Fatalf("unexpected error %v", err)
+		}
+		for _, s := range p {
+			_ = s.String()
+		}
+		p.Flags()
+		p.TxPower()
+		p.LocalName()
+		p.Appearance()
+		p.ServiceUUIDs()
+		for _, element := range p.ServiceData() {
+			_ = element.UUID.String()
+		}
+		p.ManufacturerData()
+
+		// The structures are encoded as they were received, up to where
+		// parsing stopped.
+		b := p.Bytes()
+		if !bytes.HasPrefix(data, b) {
+			t.Fatalf("Bytes() = %x, not a prefix of %x", b, data)
+		}
+		again, err := Parse(b)
+		if err != nil || len(again) != len(p) {
+			t.Fatalf("parsing %x again: %d structures, %v; want %d", b, len(again), err, len(p))
+		}
+	})
+}
+
+func FuzzFromFields(f *testing.F) {
+	f.Add("Thingy", uint16(0x0059), []byte{0x01, 0x02}, uint16(0xfcd2), []byte{0x40, 0x02, 0xc4, 0x09})
+	// Extended advertisements can carry more than a structure holds.
+	f.Add("", uint16(0x004c), bytes.Repeat([]byte{0xaa}, 300), uint16(0x180f), []byte{})
+	f.Fuzz(func(t *testing.T, name string, companyID uint16, manufacturerData []byte, uuid uint16, serviceData []byte) {
+		p := FromFields(name,
+			[]bluetooth.ManufacturerDataElement{{CompanyID: companyID, Data: manufacturerData}},
+			[]bluetooth.ServiceDataElement{{UUID: bluetooth.New16BitUUID(uuid), Data: serviceData}})
+		parsed, err := Parse(p.Bytes())
+		if err != nil {
+			t.Fatalf("parsing %x: %v", p.Bytes(), err)
+		}
+		if len(parsed) != len(p) {
+			t.Fatalf("parsed %d structures, want %d", len(parsed), len(p))
+		}
+		elements := parsed.ManufacturerData()
+		if len(elements) != 1 || elements[0].CompanyID != companyID || !bytes.HasPrefix(manufacturerData, elements[0].Data) {
+			t.Fatalf("manufacturer data %v, want 0x%04X %x", elements, companyID, manufacturerData)
+		}
+	})
+}
@@ -0,0 +1,53 @@
+package ad
+
+import (
+	"encoding/binary"
+
+	"tinygo.org/x/bluetooth"
+)
+
+// Append appends a single AD structure to buf. Data beyond 254 bytes, more
+// than the length byte can count, is dropped.
+func Append(buf []byte, t Type, data []byte) []byte {
+	if len(data) > 254 {
+		data = data[:254]
+	}
+	buf = append(buf, byte(len(data)+1), byte(t))
+	return append(buf, data...)
+}
+
+// Bytes encodes the payload in the on-air format.
+func (p Payload) Bytes() []byte {
+	var buf []byte
+	for _, s := range p {
+		buf = Append(buf, s.Type, s.Data)
+	}
+	return buf
+}
+
+// FromFields reconstructs a payload from the structured fields that some
+// platforms (such as BlueZ) report instead of the raw advertisement. The
+// structures are not necessarily in the order of the original packet and any
+// field the platform didn't report is missing.
+func FromFields(localName string, manufacturerData []bluetooth.ManufacturerDataElement, serviceData []bluetooth.ServiceDataElement) Payload {
+	var p Payload
+	if localName != "" {
+		p = append(p, Structure{Type: CompleteLocalName, Data: []byte(localName)})
+	}
+	for _, element := range serviceData {
+		t, uuid := ServiceData128, element.UUID.Bytes()
+		data := uuid[:]
+		switch {
+		case element.UUID.Is16Bit():
+			t, data = ServiceData16, binary.LittleEndian.AppendUint16(nil, element.UUID.Get16Bit())
+		case element.UUID.Is32Bit():
+			t, data = ServiceData32, binary.LittleEndian.AppendUint32(nil, element.UUID.Get32Bit())
+		}
+		p = append(p, Structure{Type: t, Data: append(data, element.Data...)})
+	}
+	for _, element := range manufacturerData {
+		data := binary.LittleEndian.AppendUint16(nil, element.CompanyID)
+		p = append(p, Structure{Type: ManufacturerData, Data: append(data, element.Data...)})
+	}
+	return p
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"tinygo.org/x/bluetooth"
+)
+
+// adapter is used for everything but scanning, which uses scanAdapter. They
+// are the same adapter unless -scan-adapter picks another one, so that a scan
+// can run uninterrupted while the other adapter connects or advertises.
+var (
+	adapter     = bluetooth.DefaultAdapter
+	scanAdapter = adapter
+)
+
+// adapterFlags are the global flags that choose the adapters.
+type adapterFlags struct {
+	id     string
+	scanID string
+	dbus   string
+}
+
+func (f *adapterFlags) registerFlags(fs *flag.FlagSet) {
+	fs.StringVar(&f.id, "adapter", "", "use this adapter, such as hci1 or /org/bluez/hci1 (default: the first adapter; Linux only)")
+	fs.StringVar(&f.scanID, "scan-adapter", "", "scan with this adapter instead of -adapter, leaving that one free to connect and advertise (Linux only)")
+	fs.StringVar(&f.dbus, "dbus", "", "talk to BlueZ on this D-Bus system bus, e.g. unix:path=/tmp/bus.sock for a bus forwarded with ssh -L, or tcp:host=H,port=P; "+
+		"the features that need CAP_NET_ADMIN still use the local controllers (default: $DBUS_SYSTEM_BUS_ADDRESS, or the local bus; Linux only)")
+}
+
+// setup selects the adapters, and the bus to find them on.
+func (f *adapterFlags) setup() error {
+	if f.dbus != "" {
+		if !strings.Contains(f.dbus, ":") {
+			return fmt.Errorf("invalid -dbus address %q: expected TRANSPORT:KEY=VALUE,..., e.g. unix:path=/run/dbus/system_bus_socket", f.dbus)
+		}
+		// The bluetooth package connects to the system bus, which the
+		// variable points at.
+		os.Setenv("DBUS_SYSTEM_BUS_ADDRESS", f.dbus)
+	}
+	if f.id != "" {
+		a, err := selectAdapter(f.id)
+		if err != nil {
+			return err
+		}
+		adapter = a
+	}
+	scanAdapter = adapter
+	if f.scanID != "" && f.scanID != f.id {
+		a, err := selectScanAdapter(f.scanID)
+		if err != nil {
+			return err
+		}
+		scanAdapter = a
+	}
+	scans.Adapter = scanAdapter
+	return nil
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"tinygo.org/x/bluetooth"
+)
+
+func runAdvertise(args []string) error {
+	fs := newFlagSet("advertise", "")
+	var opts bluetooth.AdvertisementOptions
+	fs.StringVar(&opts.LocalName, "name", "Go Bluetooth", "local name to advertise")
+	var interval time.Duration
+	fs.Func("interval", "advertising interval, 20ms-10.24s (plain numbers are ms; 0 leaves the choice to the stack)", durationFlag(&interval))
+	fs.Func("service", "service UUID to advertise (repeatable)", func(s string) error {
+		uuid, err := bluetooth.ParseUUID(s)
+		if err != nil {
+			return err
+		}
+		opts.ServiceUUIDs = append(opts.ServiceUUIDs, uuid)
+		return nil
+	})
+	fs.Func("manufacturer", "manufacturer data to advertise, as COMPANY:HEX, e.g. 0xFFFF:0102 (repeatable)", func(s string) error {
+		element, err := parseManufacturerData(s)
+		if err != nil {
+			return err
+		}
+		opts.ManufacturerData = append(opts.ManufacturerData, element)
+		return nil
+	})
+	var response bluetooth.AdvertisementOptions
+	fs.Func("response-service", "service UUID to send in the scan response, for those that don't fit in the advertisement (repeatable, Linux only)", func(s string) error {
+		uuid, err := bluetooth.ParseUUID(s)
+		if err != nil {
+			return err
+		}
+		response.ServiceUUIDs = append(response.ServiceUUIDs, uuid)
+		return nil
+	})
+	fs.Func("response-manufacturer", "manufacturer data to send in the scan response, as COMPANY:HEX (repeatable, Linux only)", func(s string) error {
+		element, err := parseManufacturerData(s)
+		if err != nil {
+			return err
+		}
+		response.ManufacturerData = append(response.ManufacturerData, element)
+		return nil
+	})
+	fs.Func("response-service-data", "service data to send in the scan response, as UUID:HEX (repeatable, Linux only)", func(s string) error {
+		element, err := parseServiceData(s)
+		if err != nil {
+			return err
+		}
+		response.ServiceData = append(response.ServiceData, element)
+		return nil
+	})
+	extended := fs.Bool("extended", false, "use Bluetooth 5 extended advertising, which allows more than 31 bytes of advertising data (Linux only)")
+	secondaryPHY := fs.String("secondary-phy", "1M", "with -extended, the PHY to send the advertising data on: 1M, 2M or Coded "+
+		"(long range, which the advertisement is then sent on entirely; BlueZ leaves the choice of S=2 or S=8 coding to the controller)")
+	acceptFlag(fs)
+	parseFlags(fs, args)
+	if *secondaryPHY != "1M" && *secondaryPHY != "2M" && *secondaryPHY != "Coded" {
+		return fmt.Errorf("unknown -secondary-phy %q (known: 1M, 2M, Coded)", *secondaryPHY)
+	}
+	if *extended {
+		extendedAdvertising = *secondaryPHY
+	}
+	if response.ServiceUUIDs != nil || response.ManufacturerData != nil || response.ServiceData != nil {
+		if *extended {
+			return errors.New("-response-* don't go with -extended: connectable extended advertisements have no scan response, but take more advertising data")
+		}
+		scanResponse = &response
+	}
+	if interval != 0 && (interval < 20*time.Millisecond || interval > 10240*time.Millisecond) {
+		return errors.New("-interval must be between 20ms and 10.24s")
+	}
+	if interval != 0 {
+		// Only the bare-metal HCI and Nordic SoftDevice stacks of the
+		// bluetooth package pass the interval on; BlueZ, Windows and macOS
+		// pick their own.
+		peripheralLog.Warn("the advertising interval can't be set on this platform and is ignored")
+		opts.Interval = bluetooth.NewDuration(interval)
+	}
+
+	if err := enableAdapter(); err != nil {
+		return err
+	}
+	return advertise(opts)
+}
+
+// extendedAdvertising is the secondary PHY of the extended advertisement
+// that advertise uses, or empty for a legacy advertisement.
+var extendedAdvertising string
+
+// scanResponse is the scan response data of the advertisement that
+// advertise uses, or nil to leave the scan response to the stack. BlueZ sends
+// the local name in the scan response either way.
+var scanResponse *bluetooth.AdvertisementOptions
+
+// acceptedCentrals are the addresses of the centrals that may connect while
+// advertising, or nil to accept every central.
+var acceptedCentrals map[string]bool
+
+// acceptFlag registers -accept, for the commands that advertise.
+func acceptFlag(fs *flag.FlagSet) {
+	fs.Func("accept", "only let this central connect (repeatable); BlueZ doesn't let advertisements use the accept list of the controller, "+
+		"so other centrals are disconnected as soon as they connect", func(s string) error {
+		return addAddress(&acceptedCentrals, s)
+	})
+}
+
+// acceptCentral returns whether a central may stay connected. A private
+// address is accepted by its identity address.
+func acceptCentral(address string) bool {
+	if acceptedCentrals == nil || acceptedCentrals[address] {
+		return true
+	}
+	identity, ok := resolvePrivateAddress(address)
+	return ok && acceptedCentrals[identity]
+}
+
+// advertise advertises until interrupted, reporting centrals that connect.
+func advertise(opts bluetooth.AdvertisementOptions) error {
+	stop, err := startAdvertisement(opts)
+	if err != nil {
+		return err
+	}
+	defer stop()
+	return waitAdvertising()
+}
+
+// startAdvertisement starts advertising, as an extended advertisement with
+// -extended or with the scan response of -response-*, and returns a function
+// that stops it.
+func startAdvertisement(opts bluetooth.AdvertisementOptions) (stop func(), err error) {
+	if extendedAdvertising != "" {
+		return startExtendedAdvertisement(opts, extendedAdvertising)
+	}
+	if scanResponse != nil {
+		return startScanResponseAdvertisement(opts, *scanResponse)
+	}
+
+	adapter.SetConnectHandler(func(device bluetooth.Device, connected bool) {
+		if connected && !acceptCentral(device.Address.String()) {
+			peripheralLog.Warn("disconnecting a central that isn't accepted", "address", device.Address.String())
+			// Disconnect calls this handler again.
+			go device.Disconnect()
+			return
+		}
+		if connected {
+			peripheralLog.Info("device connected", "address", device.Address.String())
+		} else {
+			peripheralLog.Info("device disconnected", "address", device.Address.String())
+		}
+	})
+
+	// Define the peripheral device info.
+	adv := adapter.DefaultAdvertisement()
+	if err := adv.Configure(opts); err != nil {
+		return nil, err
+	}
+
+	// Start advertising
+	if err := adv.Start(); err != nil {
+		return nil, err
+	}
+
+	// Stop advertising to release resources
+	return func() { adv.Stop() }, nil
+}
+
+// advertFrame is one of the advertisements that advertiseFrames rotates
+// through. Its options are built every time it is advertised, so that they
+// can change, as the counters of Eddystone-TLM do.
+type advertFrame struct {
+	name     string
+	options  func() (bluetooth.AdvertisementOptions, error)
+	duration time.Duration
+}
+
+// advertiseFrames advertises the frames in turn, each for its duration,
+// until interrupted. An advertisement can't be changed while it is
+// advertised, so the advertisement is stopped, configured with the next
+// frame and started again.
+func advertiseFrames(frames []advertFrame) error {
+	ctx, stopWaiting := shutdownContext()
+	defer stopWaiting()
+	var stop func()
+	defer func() {
+		if stop != nil {
+			stop()
+		}
+	}()
+	peripheralLog.Info("advertising, press Ctrl-C to stop", "frames", len(frames))
+	for i := 0; ; i = (i + 1) % len(frames) {
+		frame := frames[i]
+		opts, err := frame.options()
+		if err != nil {
+			return fmt.Errorf("%s: %w", frame.name, err)
+		}
+		if stop != nil {
+			stop()
+		}
+		if stop, err = startAdvertisement(opts); err != nil {
+			return fmt.Errorf("%s: %w", frame.name, err)
+		}
+		notifyReady()
+		peripheralLog.Debug("advertising frame", "frame", frame.name, "for", frame.duration)
+		select {
+		case <-time.After(frame.duration):
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// waitAdvertising waits until interrupted.
+func waitAdvertising() error {
+	ctx, stop := shutdownContext()
+	defer stop()
+	notifyReady()
+	peripheralLog.Info("advertising, press Ctrl-C to stop")
+	<-ctx.Done()
+	return nil
+}
+
+// parseManufacturerData parses manufacturer data given on the command line as
+// COMPANY:HEX, where the company ID is a number in any base Go understands.
+func parseManufacturerData(s string) (bluetooth.ManufacturerDataElement, error) {
+	company, data, ok := strings.Cut(s, ":")
+	if !ok {
+		return bluetooth.ManufacturerDataElement{}, errors.New("expected COMPANY:HEX")
+	}
+	id, err := strconv.ParseUint(company, 0, 16)
+	if err != nil {
+		return bluetooth.ManufacturerDataElement{}, fmt.Errorf("invalid company ID: %w", err)
+	}
+	b, err := hex.DecodeString(data)
+	if err != nil {
+		return bluetooth.ManufacturerDataElement{}, fmt.Errorf("invalid data: %w", err)
+	}
+	return bluetooth.ManufacturerDataElement{CompanyID: uint16(id), Data: b}, nil
+}
+
+// parseServiceData parses service data given as UUID:HEX, where the UUID is
+// a 16-bit or full one.
+func parseServiceData(s string) (bluetooth.ServiceDataElement, error) {
+	uuid, data, ok := strings.Cut(s, ":")
+	if !ok {
+		return bluetooth.ServiceDataElement{}, errors.New("expected UUID:HEX")
+	}
+	u, err := bluetooth.ParseUUID(uuid)
+	if err != nil {
+		return bluetooth.ServiceDataElement{}, err
+	}
+	b, err := hex.DecodeString(data)
+	if err != nil {
+		return bluetooth.ServiceDataElement{}, fmt.Errorf("invalid data: %w", err)
+	}
+	return bluetooth.ServiceDataElement{UUID: u, Data: b}, nil
+}
@@ -0,0 +1,498 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+
+	"example.com/m/decode"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"gopkg.in/yaml.v3"
+)
+
+// Alert rules turn a scan into monitoring: each rule watches a condition of
+// devices and runs its actions when the condition starts to hold (the alert
+// fires) and when it no longer does (the alert is resolved). The rules are
+// read from a YAML file:
+//
+//	rules:
+//	  - name: freezer-warm
+//	    device: freezer          # an address or alias; or tag: sensors; or neither for every device
+//	    value: temperature       # a decoded measurement...
+//	    above: -10               # ...above and/or below a limit
+//	    actions:
+//	      - stdout
+//	      - webhook: https://example.com/hook
+//	  - name: battery-low
+//	    tag: sensors
+//	    value: battery
+//	    unit: "%"                # only measurements in this unit, if given
+//	    below: 15
+//	    repeat: 24h              # fire again daily while it holds
+//	    actions:
+//	      - mqtt: ble/alerts     # needs -mqtt
+//	  - name: gone
+//	    device: kitchen-ruuvi
+//	    missing: 10m             # not seen for this long; needs device or tag
+//	    actions:
+//	      - exec: notify-send "ble: $BLE_ALERT_MESSAGE"
+//	  - name: weak
+//	    tag: mine
+//	    rssi-below: -90          # the smoothed RSSI, with -smooth
+//
+// Rules without actions print to stdout. Webhooks get the alert as JSON, and
+// so do MQTT topics and commands on stdin; commands also get it in the
+// environment, as BLE_ALERT_RULE, BLE_ALERT_STATE, BLE_ALERT_ADDRESS,
+// BLE_ALERT_ALIAS, BLE_ALERT_MESSAGE and BLE_ALERT_VALUE. A command given as a
+// string is run by the shell, and as a list without one.
+
+// alertExecTimeout is how long an exec action may run before it is killed.
+const alertExecTimeout = time.Minute
+
+// alertDeviceTTL is how long a firing alert is kept for a device that is no
+// longer seen. Random addresses come and go, and their alerts never resolve.
+const alertDeviceTTL = time.Hour
+
+// alertsFlag registers the -alerts flag.
+func alertsFlag(fs *flag.FlagSet) *string {
+	return fs.String("alerts", "", "evaluate the alert rules in this YAML file and run their actions (see alerts.go)")
+}
+
+type alertFile struct {
+	Rules []*alertRule `yaml:"rules"`
+}
+
+type alertRule struct {
+	Name      string        `yaml:"name"`
+	Device    string        `yaml:"device"`
+	Tag       string        `yaml:"tag"`
+	Missing   time.Duration `yaml:"missing"`
+	RSSIBelow *float64      `yaml:"rssi-below"`
+	Value     string        `yaml:"value"`
+	Unit      string        `yaml:"unit"`
+	Above     *float64      `yaml:"above"`
+	Below     *float64      `yaml:"below"`
+	Repeat    time.Duration `yaml:"repeat"`
+	Actions   []alertAction `yaml:"actions"`
+
+	// devices are the addresses of Device or Tag, nil for every device.
+	devices map[string]bool
+}
+
+// alertAction is one of the actions of a rule, of which exactly one field is
+// set.
+type alertAction struct {
+	stdout  bool
+	webhook string
+	mqtt    string
+	exec    []string
+}
+
+func (a *alertAction) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		if node.Value != "stdout" {
+			return fmt.Errorf("line %d: unknown action %q", node.Line, node.Value)
+		}
+		a.stdout = true
+		return nil
+	}
+	var action struct {
+		Webhook string    `yaml:"webhook"`
+		MQTT    string    `yaml:"mqtt"`
+		Exec    yaml.Node `yaml:"exec"`
+	}
+	if err := node.Decode(&action); err != nil {
+		return err
+	}
+	a.webhook, a.mqtt = action.Webhook, action.MQTT
+	switch action.Exec.Kind {
+	case 0:
+	case yaml.ScalarNode:
+		if runtime.GOOS == "windows" {
+			a.exec = []string{"cmd", "/C", action.Exec.Value}
+		} else {
+			a.exec = []string{"sh", "-c", action.Exec.Value}
+		}
+	default:
+		if err := action.Exec.Decode(&a.exec); err != nil {
+			return err
+		}
+		if len(a.exec) == 0 {
+			return fmt.Errorf("line %d: empty exec", node.Line)
+		}
+	}
+	set := 0
+	for _, ok := range []bool{a.webhook != "", a.mqtt != "", a.exec != nil} {
+		if ok {
+			set++
+		}
+	}
+	if set != 1 {
+		return fmt.Errorf("line %d: expected one of stdout, webhook, mqtt or exec", node.Line)
+	}
+	return nil
+}
+
+// loadAlertRules reads and checks the rules of an alerts file.
+func loadAlertRules(path string) ([]*alertRule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	var file alertFile
+	if err := dec.Decode(&file); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if len(file.Rules) == 0 {
+		return nil, fmt.Errorf("%s: no rules", path)
+	}
+	names := make(map[string]bool)
+	for i, rule := range file.Rules {
+		if rule.Name == "" {
+			rule.Name = "rule-" + strconv.Itoa(i+1)
+		}
+		if names[rule.Name] {
+			return nil, fmt.Errorf("%s: two rules named %q", path, rule.Name)
+		}
+		names[rule.Name] = true
+		if err := rule.check(); err != nil {
+			return nil, fmt.Errorf("%s: rule %s: %w", path, rule.Name, err)
+		}
+	}
+	return file.Rules, nil
+}
+
+// check validates a rule and looks up its devices.
+func (r *alertRule) check() error {
+	conditions := 0
+	if r.Missing != 0 {
+		conditions++
+		if r.Missing < 0 {
+			return errors.New("missing must be positive")
+		}
+		// Every device that goes out of range, or changes its random
+		// address, would go missing otherwise.
+		if r.Device == "" && r.Tag == "" {
+			return errors.New("missing needs device or tag")
+		}
+	}
+	if r.RSSIBelow != nil {
+		conditions++
+	}
+	if r.Value != "" {
+		conditions++
+		if r.Above == nil && r.Below == nil {
+			return errors.New("value needs above or below")
+		}
+	} else if r.Above != nil || r.Below != nil || r.Unit != "" {
+		return errors.New("above, below and unit need value")
+	}
+	if conditions != 1 {
+		return errors.New("expected one of missing, rssi-below or value")
+	}
+	if r.Repeat < 0 {
+		return errors.New("repeat must not be negative")
+	}
+	if len(r.Actions) == 0 {
+		r.Actions = []alertAction{{stdout: true}}
+	}
+
+	switch {
+	case r.Device != "" && r.Tag != "":
+		return errors.New("device and tag don't go together")
+	case r.Device != "":
+		address, err := parseAddress(r.Device)
+		if err != nil {
+			return fmt.Errorf("device: %w", err)
+		}
+		r.devices = map[string]bool{address.String(): true}
+	case r.Tag != "":
+		addresses, err := tagsFlag{r.Tag}.addresses()
+		if err != nil {
+			return err
+		}
+		r.devices = make(map[string]bool)
+		for _, address := range addresses {
+			r.devices[address.String()] = true
+		}
+	}
+	return nil
+}
+
+// watches returns whether the rule applies to a device.
+func (r *alertRule) watches(addresses ...string) bool {
+	if r.devices == nil {
+		return true
+	}
+	for _, address := range addresses {
+		if r.devices[address] {
+			return true
+		}
+	}
+	return false
+}
+
+// alertEvent is an alert firing or being resolved, as actions get it.
+type alertEvent struct {
+	Time    time.Time `json:"time"`
+	Rule    string    `json:"rule"`
+	State   string    `json:"state"` // "firing" or "resolved"
+	Address string    `json:"address"`
+	Alias   string    `json:"alias,omitempty"`
+	Message string    `json:"message"`
+	Value   *float64  `json:"value,omitempty"`
+}
+
+// alertOutput evaluates the alert rules on the sightings of a scan. A ticker
+// checks for missing devices in between.
+type alertOutput struct {
+	rules []*alertRule
+	mqtt  mqtt.Client // for mqtt actions, nil without -mqtt
+	qos   byte
+
+	mu       sync.Mutex
+	started  time.Time
+	lastSeen map[string]time.Time     // by device, of the devices of missing rules
+	states   map[alertKey]*alertState // of the firing alerts
+	pruned   time.Time
+	pending  sync.WaitGroup // webhooks and commands
+	done     chan struct{}
+}
+
+type alertKey struct {
+	rule   *alertRule
+	device string
+}
+
+type alertState struct {
+	lastFired time.Time
+	lastSeen  time.Time // of the device, when the rule was last evaluated
+}
+
+// newAlertOutput loads the rules of an alerts file. The MQTT client is that of
+// the MQTT sink, if there is one.
+func newAlertOutput(path string, client mqtt.Client, flags *mqttFlags) (*alertOutput, error) {
+	rules, err := loadAlertRules(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, rule := range rules {
+		for _, action := range rule.Actions {
+			if action.mqtt != "" && client == nil {
+				return nil, fmt.Errorf("%s: rule %s: the mqtt action needs -mqtt", path, rule.Name)
+			}
+		}
+	}
+	o := &alertOutput{
+		rules:    rules,
+		mqtt:     client,
+		qos:      byte(flags.qos),
+		started:  time.Now(),
+		lastSeen: make(map[string]time.Time),
+		states:   make(map[alertKey]*alertState),
+		done:     make(chan struct{}),
+	}
+	go o.watchMissing()
+	return o, nil
+}
+
+// sinkMQTTClient returns the client of the MQTT sink among sinks, or nil.
+func sinkMQTTClient(sinks multiOutput) mqtt.Client {
+	for _, sink := range sinks {
+		if m, ok := sink.(*mqttOutput); ok {
+			return m.client
+		}
+	}
+	return nil
+}
+
+func (o *alertOutput) write(s *sighting) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	device := cmp.Or(s.Identity, s.Address)
+	for _, rule := range o.rules {
+		if !rule.watches(device, s.Address) {
+			continue
+		}
+		switch {
+		case rule.Missing != 0:
+			// Missing devices are checked against the clock, also
+			// when replaying.
+			o.lastSeen[device] = time.Now()
+			o.evaluate(rule, device, false, "seen again", nil, s.Time)
+		case rule.RSSIBelow != nil:
+			rssi := math.Round(s.SmoothedRSSI)
+			o.evaluate(rule, device, rssi < *rule.RSSIBelow,
+				fmt.Sprintf("RSSI %g dBm, below %g", rssi, *rule.RSSIBelow), &rssi, s.Time)
+		default:
+			m, ok := findMeasurement(s, rule.Value, rule.Unit)
+			if !ok {
+				continue
+			}
+			var message string
+			firing := false
+			if rule.Above != nil && m.Value > *rule.Above {
+				message, firing = fmt.Sprintf("%s %s, above %g", m.Name, m, *rule.Above), true
+			} else if rule.Below != nil && m.Value < *rule.Below {
+				message, firing = fmt.Sprintf("%s %s, below %g", m.Name, m, *rule.Below), true
+			} else {
+				message = fmt.Sprintf("%s %s", m.Name, m)
+			}
+			value := m.Value
+			o.evaluate(rule, device, firing, message, &value, s.Time)
+		}
+	}
+	return nil
+}
+
+// watchMissing evaluates the missing rules every second, until the output is
+// closed. The devices of a rule are missing from the start, until they are
+// seen.
+func (o *alertOutput) watchMissing() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			o.mu.Lock()
+			for _, rule := range o.rules {
+				if rule.Missing == 0 {
+					continue
+				}
+				for device := range rule.devices {
+					last, ok := o.lastSeen[device]
+					if !ok {
+						last = o.started
+					}
+					if since := now.Sub(last); since >= rule.Missing {
+						o.evaluate(rule, device, true, "not seen for "+since.Round(time.Second).String(), nil, now)
+					}
+				}
+			}
+			o.prune(now)
+			o.mu.Unlock()
+		case <-o.done:
+			return
+		}
+	}
+}
+
+// prune drops the firing alerts of devices that haven't been seen for
+// alertDeviceTTL, at most once a minute. o.mu must be held.
+func (o *alertOutput) prune(now time.Time) {
+	if now.Sub(o.pruned) < time.Minute {
+		return
+	}
+	o.pruned = now
+	for key, state := range o.states {
+		if key.rule.Missing == 0 && now.Sub(state.lastSeen) > alertDeviceTTL {
+			delete(o.states, key)
+		}
+	}
+}
+
+// findMeasurement returns a decoded measurement of a sighting by name, and
+// by unit unless it is empty.
+func findMeasurement(s *sighting, name, unit string) (m decode.Measurement, ok bool) {
+	for _, f := range s.Frames {
+		if sensor, ok := f.(decode.SensorFrame); ok {
+			for _, m := range sensor.Measurements() {
+				if m.Name == name && (unit == "" || m.Unit == unit) {
+					return m, true
+				}
+			}
+		}
+	}
+	return m, false
+}
+
+// evaluate updates the state of a rule for a device, and runs the actions
+// when the alert fires, fires again after repeat, or is resolved. Only firing
+// alerts have a state. o.mu must be held.
+func (o *alertOutput) evaluate(rule *alertRule, device string, firing bool, message string, value *float64, now time.Time) {
+	key := alertKey{rule, device}
+	state := o.states[key]
+	switch {
+	case firing && state == nil:
+		o.states[key] = &alertState{lastFired: now, lastSeen: time.Now()}
+		o.run(rule, alertEvent{Time: now, Rule: rule.Name, State: "firing", Address: device, Message: message, Value: value})
+	case firing:
+		state.lastSeen = time.Now()
+		if rule.Repeat > 0 && now.Sub(state.lastFired) >= rule.Repeat {
+			state.lastFired = now
+			o.run(rule, alertEvent{Time: now, Rule: rule.Name, State: "firing", Address: device, Message: message, Value: value})
+		}
+	case state != nil:
+		delete(o.states, key)
+		o.run(rule, alertEvent{Time: now, Rule: rule.Name, State: "resolved", Address: device, Message: message, Value: value})
+	}
+}
+
+// run runs the actions of a rule for an event. Webhooks and commands run in
+// the background, so as not to hold up the scan.
+func (o *alertOutput) run(rule *alertRule, e alertEvent) {
+	e.Alias = deviceAlias(e.Address)
+	sinkLog.Info("alert", "rule", e.Rule, "state", e.State, "address", e.Address, "message", e.Message)
+	body, _ := json.Marshal(e)
+	for _, action := range rule.Actions {
+		switch {
+		case action.stdout:
+			fmt.Printf("%s alert %s %s %s: %s\n", e.Time.Format(time.RFC3339), e.State, e.Rule, deviceLabel(e.Address), e.Message)
+		case action.webhook != "":
+			postWebhook(action.webhook, body, &o.pending)
+		case action.mqtt != "":
+			o.mqtt.Publish(action.mqtt, o.qos, false, body)
+		case action.exec != nil:
+			o.pending.Add(1)
+			go func(argv []string) {
+				defer o.pending.Done()
+				runAlertCommand(argv, e, body)
+			}(action.exec)
+		}
+	}
+}
+
+// runAlertCommand runs the command of an exec action.
+func runAlertCommand(argv []string, e alertEvent, body []byte) {
+	ctx, cancel := context.WithTimeout(context.Background(), alertExecTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, argv[0], argv[1:]...)
+	cmd.Stdin = bytes.NewReader(body)
+	cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+	value := ""
+	if e.Value != nil {
+		value = strconv.FormatFloat(*e.Value, 'f', -1, 64)
+	}
+	cmd.Env = append(os.Environ(),
+		"BLE_ALERT_RULE="+e.Rule,
+		"BLE_ALERT_STATE="+e.State,
+		"BLE_ALERT_ADDRESS="+e.Address,
+		"BLE_ALERT_ALIAS="+e.Alias,
+		"BLE_ALERT_MESSAGE="+e.Message,
+		"BLE_ALERT_VALUE="+value,
+	)
+	if err := cmd.Run(); err != nil {
+		sinkLog.Error("alert command failed", "rule", e.Rule, "command", argv[0], "err", err)
+	}
+}
+
+// close stops checking for missing devices, and waits for the webhooks and
+// commands that are running.
+func (o *alertOutput) close() error {
+	close(o.done)
+	o.pending.Wait()
+	return nil
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"tinygo.org/x/bluetooth"
+)
+
+// Aliases are friendly names for devices, such as kitchen-ruuvi, that are
+// shown instead of their address: in text output, in MQTT topics, as a tag in
+// InfluxDB, and in JSON and the APIs next to the address. Wherever a command
+// takes an address, it also takes an alias.
+//
+// They come from the aliases file, of one KEY=NAME per line, and from the
+// aliases section of the configuration file. A key is an address or, for
+// devices with changing random addresses, the identity address their
+// addresses resolve to with an IRK or the device ID of -fingerprint.
+
+// deviceAliases are the aliases of devices, by address or device ID.
+var deviceAliases = map[string]string{}
+
+// aliasesFlag registers the global -aliases flag.
+func aliasesFlag(fs *flag.FlagSet) *string {
+	return fs.String("aliases", os.Getenv("BLE_ALIASES"), "read device aliases from this file, one ADDRESS=NAME per line (default: $BLE_ALIASES, or aliases.txt in the user configuration directory if it exists)")
+}
+
+// loadAliasesFile reads the aliases file. Without one given, the one in the
+// user configuration directory is read if it exists.
+func loadAliasesFile(path string) error {
+	explicit := path != ""
+	if !explicit {
+		dir, err := os.UserConfigDir()
+		if err != nil {
+			return nil
+		}
+		path = filepath.Join(dir, "ble", "aliases.txt")
+	}
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) && !explicit {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, alias, ok := strings.Cut(line, "=")
+		if !ok {
+			return fmt.Errorf("%s:%d: expected ADDRESS=NAME", path, lineno)
+		}
+		if err := addAlias(strings.TrimSpace(key), strings.TrimSpace(alias)); err != nil {
+			return fmt.Errorf("%s:%d: %w", path, lineno, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// loadAliases adds the aliases section of the configuration to the device
+// aliases.
+func loadAliases(section any) error {
+	if section == nil {
+		return nil
+	}
+	aliases, ok := section.(map[string]any)
+	if !ok {
+		return errors.New("expected a mapping of addresses to names")
+	}
+	for key, alias := range aliases {
+		if err := addAlias(key, fmt.Sprint(alias)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addAlias sets the alias of a device. Addresses are normalized, so that
+// they match however they are written.
+func addAlias(key, alias string) error {
+	if key == "" || alias == "" {
+		return errors.New("expected an address and a name")
+	}
+	if strings.ContainsAny(alias, " \t") {
+		return fmt.Errorf("alias %q contains spaces", alias)
+	}
+	if _, err := bluetooth.ParseMAC(alias); err == nil {
+		return fmt.Errorf("alias %q is an address", alias)
+	}
+	if mac, err := bluetooth.ParseMAC(key); err == nil {
+		key = mac.String()
+	}
+	deviceAliases[key] = alias
+	return nil
+}
+
+// deviceAlias returns the alias of the first of the addresses and device IDs
+// of a device that has one, or "".
+func deviceAlias(keys ...string) string {
+	for _, key := range keys {
+		if alias, ok := deviceAliases[key]; ok && key != "" {
+			return alias
+		}
+	}
+	return ""
+}
+
+// deviceLabel returns how to refer to a device in text output: its alias,
+// or its address if it has none.
+func deviceLabel(address string) string {
+	if alias := deviceAlias(address); alias != "" {
+		return alias
+	}
+	return address
+}
+
+// aliasAddress returns the address of the device with the given alias.
+func aliasAddress(alias string) (string, bool) {
+	for address, a := range deviceAliases {
+		if a == alias {
+			if _, err := bluetooth.ParseMAC(address); err == nil {
+				return address, true
+			}
+		}
+	}
+	return "", false
+}
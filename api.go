@@ -0,0 +1,331 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"example.com/m/decode"
+	"example.com/m/gattclient"
+	"tinygo.org/x/bluetooth"
+)
+
+// apiDeviceTTL is how long a device that is no longer seen is listed by the
+// API.
+const apiDeviceTTL = 10 * time.Minute
+
+func runAPI(args []string) error {
+	fs := newFlagSet("api", "")
+	listen := fs.String("listen", "localhost:8080", "address to serve the HTTP API on")
+	var conn connectFlags
+	conn.registerFlags(fs)
+	fs.Var(decode.BTHomeKeys, "bthome-key", "decrypt BTHome advertisements of a device, as ADDRESS=KEY (repeatable)")
+	fs.Var(decode.MiBeaconKeys, "mibeacon-key", "decrypt Xiaomi MiBeacon advertisements of a device with its bind key, as ADDRESS=KEY (repeatable)")
+	var distance distanceFlags
+	distance.registerFlags(fs)
+	var locating locateFlags
+	locating.registerFlags(fs)
+	metricsAddr := metricsFlag(fs)
+	var scanning scanFlags
+	scanning.registerFlags(fs)
+	parseFlags(fs, args)
+	if err := serveMetrics(*metricsAddr); err != nil {
+		return err
+	}
+	if err := scanning.setup(); err != nil {
+		return err
+	}
+	if err := conn.validate(); err != nil {
+		return err
+	}
+	if err := distance.setup(); err != nil {
+		return err
+	}
+	if err := locating.setup(); err != nil {
+		return err
+	}
+
+	l, err := net.Listen("tcp", *listen)
+	if err != nil {
+		return err
+	}
+	ctx, stop := shutdownContext()
+	defer stop()
+
+	if err := enableAdapter(); err != nil {
+		return err
+	}
+	api := newAPIServer(&conn)
+	defer api.connections.disconnectAll()
+	server := &http.Server{Handler: api.handler()}
+	server.RegisterOnShutdown(api.stream.close)
+	go func() {
+		<-ctx.Done()
+		stopScan()
+		server.Shutdown(context.Background())
+	}()
+
+	scanErr := scanInBackground(func(result bluetooth.ScanResult, s *sighting) {
+		api.seen(s)
+		api.stream.publish(result, s)
+	})
+
+	apiLog.Info("serving the API, press Ctrl-C to stop", "url", "http://"+l.Addr().String())
+	if err := server.Serve(l); err != http.ErrServerClosed {
+		stop()
+		return err
+	}
+	if err := <-scanErr; err != nil {
+		return err
+	}
+	return nil
+}
+
+// scanInBackground scans until stopScan is called, passing every
+// advertisement to seen. The returned channel receives the result of the
+// scan.
+func scanInBackground(seen func(bluetooth.ScanResult, *sighting)) <-chan error {
+	scanErr := make(chan error, 1)
+	go func() {
+		scanErr <- scan(func(adapter *bluetooth.Adapter, result bluetooth.ScanResult) {
+			metrics.scanCallback()
+			s := newSighting(result, time.Now())
+			metrics.observe(s)
+			seen(result, s)
+		})
+	}()
+	return scanErr
+}
+
+// apiServer serves the HTTP API: the devices seen by a background scan, a
+// live stream of their advertisements, and GATT operations on the devices it
+// is connected to.
+type apiServer struct {
+	connections *connections
+	stream      *streamHub
+
+	devices deviceRegistry
+}
+
+func newAPIServer(conn *connectFlags) *apiServer {
+	return &apiServer{
+		connections: newConnections(conn),
+		stream:      newStreamHub(),
+	}
+}
+
+// apiDevice is the JSON form of a device: its last advertisement and history,
+// and whether the API is connected to it. Connected devices that were never
+// seen advertising have neither.
+type apiDevice struct {
+	jsonSighting
+	*jsonHistory
+	Connected bool `json:"connected"`
+}
+
+// apiValue is the JSON form of a characteristic value, as read or written.
+// Writes take either Hex or String.
+type apiValue struct {
+	Hex     string `json:"hex"`
+	String  string `json:"string,omitempty"`
+	Decoded string `json:"decoded,omitempty"`
+
+	// WithoutResponse requests a write command, for writes.
+	WithoutResponse bool `json:"without_response,omitempty"`
+}
+
+func (a *apiServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /stream", a.stream.serveStream)
+	mux.HandleFunc("GET /devices", a.listDevices)
+	mux.HandleFunc("GET /devices/{addr}", a.getDevice)
+	mux.HandleFunc("POST /devices/{addr}/connect", a.connectDevice)
+	mux.HandleFunc("POST /devices/{addr}/disconnect", a.disconnectDevice)
+	mux.HandleFunc("POST /devices/{addr}/gatt/{char}/read", a.gattRead)
+	mux.HandleFunc("POST /devices/{addr}/gatt/{char}/write", a.gattWrite)
+	return mux
+}
+
+// seen records an advertisement of a device.
+func (a *apiServer) seen(s *sighting) {
+	a.devices.Seen(s.Address, s.Time, s.RSSI, hashPayload(s.Raw, s.LocalName, s.ManufacturerData, s.ServiceData), s)
+}
+
+func (a *apiServer) device(address string) apiDevice {
+	d := apiDevice{Connected: a.connections.connected(address)}
+	if r, ok := a.devices.Get(address); ok {
+		d.jsonSighting = newJSONSighting(r.Last, true)
+		d.jsonHistory = newJSONHistory(r)
+	} else {
+		d.Address = address
+	}
+	return d
+}
+
+func (a *apiServer) listDevices(w http.ResponseWriter, r *http.Request) {
+	a.devices.Expire(time.Now().Add(-apiDeviceTTL), a.connections.connected)
+	devices := []apiDevice{}
+	for _, d := range a.devices.List() {
+		devices = append(devices, a.device(d.Address))
+	}
+	// Connected devices that no longer advertise are still listed.
+	for _, address := range a.connections.addresses() {
+		if _, ok := a.devices.Get(address); !ok {
+			devices = append(devices, a.device(address))
+		}
+	}
+	slices.SortFunc(devices, func(a, b apiDevice) int { return strings.Compare(a.Address, b.Address) })
+	writeJSON(w, http.StatusOK, devices)
+}
+
+func (a *apiServer) getDevice(w http.ResponseWriter, r *http.Request) {
+	address, err := parseAddress(r.PathValue("addr"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	_, seen := a.devices.Get(address.String())
+	if !seen && !a.connections.connected(address.String()) {
+		writeError(w, http.StatusNotFound, fmt.Errorf("device %s not seen", address.String()))
+		return
+	}
+	writeJSON(w, http.StatusOK, a.device(address.String()))
+}
+
+func (a *apiServer) connectDevice(w http.ResponseWriter, r *http.Request) {
+	address, err := parseAddress(r.PathValue("addr"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if _, err := a.connections.connect(address); errors.Is(err, gattclient.ErrTimeout) {
+		writeError(w, http.StatusGatewayTimeout, err)
+		return
+	} else if err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, a.device(address.String()))
+}
+
+func (a *apiServer) disconnectDevice(w http.ResponseWriter, r *http.Request) {
+	address, err := parseAddress(r.PathValue("addr"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := a.connections.disconnect(address); errors.Is(err, errNotConnected) {
+		writeError(w, http.StatusConflict, fmt.Errorf("%w to %s", err, address.String()))
+		return
+	} else if err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// connectedDevice returns the connected device of a request, or writes an
+// error response.
+func (a *apiServer) connectedDevice(w http.ResponseWriter, r *http.Request) (gattclient.Device, bool) {
+	address, err := parseAddress(r.PathValue("addr"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return nil, false
+	}
+	device, ok := a.connections.get(address)
+	if !ok {
+		writeError(w, http.StatusConflict, fmt.Errorf("%w to %s", errNotConnected, address.String()))
+	}
+	return device, ok
+}
+
+// requestCharacteristic finds the characteristic of a GATT request. The
+// service can be given with the service query parameter; otherwise all
+// services of the device are searched.
+func (a *apiServer) requestCharacteristic(w http.ResponseWriter, r *http.Request) (gattclient.Device, bluetooth.UUID, gattclient.Characteristic, bool) {
+	device, ok := a.connectedDevice(w, r)
+	if !ok {
+		return nil, bluetooth.UUID{}, nil, false
+	}
+	charUUID, err := bluetooth.ParseUUID(r.PathValue("char"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid characteristic UUID: %w", err))
+		return nil, bluetooth.UUID{}, nil, false
+	}
+	var serviceUUID bluetooth.UUID
+	if s := r.URL.Query().Get("service"); s != "" {
+		if serviceUUID, err = bluetooth.ParseUUID(s); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid service UUID: %w", err))
+			return nil, bluetooth.UUID{}, nil, false
+		}
+	}
+	serviceUUID, char, err := gattclient.FindAnyCharacteristic(device, serviceUUID, charUUID)
+	if errors.Is(err, gattclient.ErrCharacteristicNotFound) {
+		writeError(w, http.StatusNotFound, err)
+		return nil, bluetooth.UUID{}, nil, false
+	} else if err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return nil, bluetooth.UUID{}, nil, false
+	}
+	return device, serviceUUID, char, true
+}
+
+func (a *apiServer) gattRead(w http.ResponseWriter, r *http.Request) {
+	_, _, char, ok := a.requestCharacteristic(w, r)
+	if !ok {
+		return
+	}
+	value, err := gattclient.Read(char)
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	v := apiValue{Hex: hex.EncodeToString(value), String: printableUTF8(value)}
+	if m, ok := decode.Characteristic(char.UUID(), value); ok {
+		v.Decoded = m.String()
+	}
+	writeJSON(w, http.StatusOK, v)
+}
+
+func (a *apiServer) gattWrite(w http.ResponseWriter, r *http.Request) {
+	var v apiValue
+	if err := json.NewDecoder(r.Body).Decode(&v); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	value := []byte(v.String)
+	if v.Hex != "" {
+		var err error
+		if value, err = hex.DecodeString(v.Hex); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid hex value: %w", err))
+			return
+		}
+	}
+	device, serviceUUID, char, ok := a.requestCharacteristic(w, r)
+	if !ok {
+		return
+	}
+	if err := writeCharacteristic(device, serviceUUID, char, value, !v.WithoutResponse); err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeError writes an error response, as {"error": "..."}.
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
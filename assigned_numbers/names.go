@@ -0,0 +1,90 @@
+// Package assignednumbers looks up the names of numbers assigned by the
+// Bluetooth SIG and the IEEE, from tables embedded into the binary.
+package assignednumbers
+
+import (
+	_ "embed"
+	"encoding/json"
+	"sync"
+
+	"tinygo.org/x/bluetooth"
+)
+
+var (
+	//go:embed company_ids.json
+	companyIDsJSON []byte
+	//go:embed service_uuids.json
+	serviceUUIDsJSON []byte
+	//go:embed characteristic_uuids.json
+	characteristicUUIDsJSON []byte
+	//go:embed descriptor_uuids.json
+	descriptorUUIDsJSON []byte
+)
+
+// OUI is the IEEE MA-L registry CSV (oui.csv), with the columns Registry,
+// Assignment, Organization Name and Organization Address.
+//
+//go:embed oui.csv
+var OUI []byte
+
+var companyNames = sync.OnceValue(func() map[uint16]string {
+	var list []struct {
+		Code uint16 `json:"code"`
+		Name string `json:"name"`
+	}
+	if err := json.Unmarshal(companyIDsJSON, &list); err != nil {
+		panic("invalid embedded company table: " + err.Error())
+	}
+	names := make(map[uint16]string, len(list))
+	for _, company := range list {
+		names[company.Code] = company.Name
+	}
+	return names
+})
+
+// CompanyName returns the name of the company with the given Bluetooth SIG
+// company identifier, or the empty string if it isn't known.
+func CompanyName(id uint16) string {
+	return companyNames()[id]
+}
+
+var (
+	serviceNames        = sync.OnceValue(func() map[bluetooth.UUID]string { return loadUUIDNames(serviceUUIDsJSON) })
+	characteristicNames = sync.OnceValue(func() map[bluetooth.UUID]string { return loadUUIDNames(characteristicUUIDsJSON) })
+	descriptorNames     = sync.OnceValue(func() map[bluetooth.UUID]string { return loadUUIDNames(descriptorUUIDsJSON) })
+)
+
+func loadUUIDNames(data []byte) map[bluetooth.UUID]string {
+	var list []struct {
+		Name string `json:"name"`
+		UUID string `json:"uuid"`
+	}
+	if err := json.Unmarshal(data, &list); err != nil {
+		panic("invalid embedded UUID table: " + err.Error())
+	}
+	names := make(map[bluetooth.UUID]string, len(list))
+	for _, entry := range list {
+		uuid, err := bluetooth.ParseUUID(entry.UUID)
+		if err != nil {
+			continue
+		}
+		names[uuid] = entry.Name
+	}
+	return names
+}
+
+// ServiceName returns the name of a known service, such as "Battery Service",
+// or the empty string.
+func ServiceName(uuid bluetooth.UUID) string {
+	return serviceNames()[uuid]
+}
+
+// CharacteristicName returns the name of a known characteristic.
+func CharacteristicName(uuid bluetooth.UUID) string {
+	return characteristicNames()[uuid]
+}
+
+// DescriptorName returns the name of a known descriptor.
+func DescriptorName(uuid bluetooth.UUID) string {
+	return descriptorNames()[uuid]
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// An audit connects to the devices of a fleet, listed in a YAML file, and
+// reads their firmware revision from the Device Information Service to find
+// those that need an update:
+//
+//	# The current firmware of each model, by its DIS model number.
+//	latest:
+//	  Thingy:52: 2.4.0
+//	devices:
+//	  - address: A4:C1:38:00:00:01
+//	    name: kitchen
+//	  - address: garden-sensor
+//	    # The firmware this device should run, instead of the latest of
+//	    # its model.
+//	    firmware: 1.9.2
+//
+// Addresses can be aliases from the configuration file.
+
+type auditFile struct {
+	Latest  map[string]string `yaml:"latest"`
+	Devices []struct {
+		Address  string `yaml:"address"`
+		Name     string `yaml:"name"`
+		Firmware string `yaml:"firmware"`
+	} `yaml:"devices"`
+}
+
+// auditResult is a line of the report.
+type auditResult struct {
+	Address  string `json:"address"`
+	Name     string `json:"name,omitempty"`
+	Model    string `json:"model,omitempty"`
+	Firmware string `json:"firmware,omitempty"`
+	Expected string `json:"expected,omitempty"`
+	// Status is ok, outdated, unknown (no firmware revision or nothing to
+	// compare it with) or unreachable.
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+func runAudit(args []string) error {
+	fs := newFlagSet("audit", "")
+	var conn connectFlags
+	conn.registerFlags(fs)
+	from := fs.String("from", "", "YAML file listing the devices and their expected firmware (required)")
+	format := fs.String("output", "text", "output format: text or json")
+	parseFlags(fs, args)
+	if *from == "" || fs.NArg() != 0 {
+		fs.Usage()
+		return errors.New("expected -from and no arguments")
+	}
+	if *format != "text" && *format != "json" {
+		return fmt.Errorf("unknown output format %q", *format)
+	}
+	if err := conn.validate(); err != nil {
+		return err
+	}
+	data, err := os.ReadFile(*from)
+	if err != nil {
+		return err
+	}
+	var fleet auditFile
+	if err := yaml.Unmarshal(data, &fleet); err != nil {
+		return fmt.Errorf("%s: %w", *from, err)
+	}
+	if len(fleet.Devices) == 0 {
+		return fmt.Errorf("%s: no devices", *from)
+	}
+	for i, d := range fleet.Devices {
+		if _, err := parseAddress(d.Address); err != nil {
+			return fmt.Errorf("%s: device %d: %w", *from, i+1, err)
+		}
+	}
+
+	if err := enableAdapter(); err != nil {
+		return err
+	}
+	var results []auditResult
+	for _, d := range fleet.Devices {
+		address, _ := parseAddress(d.Address)
+		r := auditResult{Address: address.String(), Name: d.Name}
+		device, err := conn.connect(address)
+		if err != nil {
+			r.Status, r.Error = "unreachable", err.Error()
+			results = append(results, r)
+			continue
+		}
+		info, err := readDeviceInfo(device)
+		device.Disconnect()
+		if err != nil {
+			r.Error = err.Error()
+		}
+		r.Model, r.Firmware = info["model"], info["firmware"]
+		r.Expected = fleet.Latest[r.Model]
+		if d.Firmware != "" {
+			r.Expected = d.Firmware
+		}
+		switch {
+		case r.Firmware == "" || r.Expected == "":
+			r.Status = "unknown"
+		case compareVersions(r.Firmware, r.Expected) < 0:
+			r.Status = "outdated"
+		default:
+			r.Status = "ok"
+		}
+		gattLog.Info("audited", "address", r.Address, "firmware", r.Firmware, "status", r.Status)
+		results = append(results, r)
+	}
+
+	if *format == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(results); err != nil {
+			return err
+		}
+	} else {
+		fmt.Printf("%-17s %-16s %-16s %-12s %-12s %s\n", "ADDRESS", "NAME", "MODEL", "FIRMWARE", "EXPECTED", "STATUS")
+		for _, r := range results {
+			fmt.Printf("%-17s %-16s %-16s %-12s %-12s %s\n", r.Address, r.Name, r.Model, r.Firmware, r.Expected, r.Status)
+		}
+	}
+
+	// The report is the output, but scripts can tell from the exit code
+	// whether the fleet needs attention.
+	counts := make(map[string]int)
+	for _, r := range results {
+		counts[r.Status]++
+	}
+	if counts["outdated"] != 0 || counts["unreachable"] != 0 {
+		return fmt.Errorf("%d of %d devices run outdated firmware, %d unreachable", counts["outdated"], len(results), counts["unreachable"])
+	}
+	return nil
+}
+
+// compareVersions compares two firmware versions such as 1.10.2 and v1.9,
+// part by part, numerically where both parts are numbers. Missing parts
+// count as 0.
+func compareVersions(a, b string) int {
+	split := func(v string) []string {
+		v = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(v)), "v")
+		return strings.FieldsFunc(v, func(r rune) bool { return r == '.' || r == '-' || r == '_' || r == ' ' })
+	}
+	pa, pb := split(a), split(b)
+	for i := range max(len(pa), len(pb)) {
+		x, y := "0", "0"
+		if i < len(pa) {
+			x = pa[i]
+		}
+		if i < len(pb) {
+			y = pb[i]
+		}
+		nx, errx := strconv.Atoi(x)
+		ny, erry := strconv.Atoi(y)
+		switch {
+		case errx == nil && erry == nil:
+			if nx != ny {
+				return nx - ny
+			}
+		case x != y:
+			return strings.Compare(x, y)
+		}
+	}
+	return 0
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"example.com/m/gattclient"
+	"tinygo.org/x/bluetooth"
+)
+
+func runBattery(args []string) error {
+	fs := newFlagSet("battery", "<address> | -all | -tag TAG")
+	var conn connectFlags
+	conn.registerFlags(fs)
+	var reconnect reconnectFlags
+	reconnect.registerFlags(fs)
+	all := fs.Bool("all", false, "read the battery level of every paired device")
+	var tags tagsFlag
+	fs.Var(&tags, "tag", "read the battery level of the devices with this tag in the configuration file (repeatable)")
+	notify := fs.Bool("notify", false, "stay connected and report every change of the battery level")
+	parseFlags(fs, args)
+	given := fs.NArg()
+	if *all {
+		given++
+	}
+	if len(tags) > 0 {
+		given++
+	}
+	if given != 1 {
+		fs.Usage()
+		return errors.New("expected either a device address, -all or -tag")
+	}
+	addresses, err := tags.addresses()
+	if err != nil {
+		return fmt.Errorf("-tag: %w", err)
+	}
+
+	if err := enableAdapter(); err != nil {
+		return err
+	}
+	if *all {
+		bonds, err := listBonds()
+		if err != nil {
+			return err
+		}
+		for _, b := range bonds {
+			address, err := parseAddress(b.address)
+			if err != nil {
+				return err
+			}
+			addresses = append(addresses, address)
+		}
+		if len(addresses) == 0 {
+			return errors.New("no paired devices")
+		}
+	} else if fs.NArg() == 1 {
+		address, err := parseAddress(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		addresses = append(addresses, address)
+	}
+
+	if *notify {
+		ctx, stop := shutdownContext()
+		defer stop()
+		pool := newConnPool(&conn, &reconnect, len(addresses))
+		for _, address := range addresses {
+			pool.add(ctx, address, func(device gattclient.Device) (func(), error) {
+				char, err := readBatteryLevel(device)
+				if err != nil {
+					return nil, err
+				}
+				addr := device.Address().String()
+				err = char.EnableNotifications(func(value []byte) {
+					printBatteryLevel(addr, value)
+				})
+				if err != nil {
+					return nil, fmt.Errorf("battery level notifications: %w", err)
+				}
+				return func() { char.EnableNotifications(nil) }, nil
+			})
+		}
+		return pool.wait()
+	}
+
+	// Read the devices one by one, carrying on past those that are out of
+	// range.
+	var errs []error
+	for _, address := range addresses {
+		device, err := conn.connect(address)
+		if err == nil {
+			_, err = readBatteryLevel(device)
+			device.Disconnect()
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", address.String(), err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// readBatteryLevel reads and prints the battery level of a connected device,
+// and returns the Battery Level characteristic.
+func readBatteryLevel(device gattclient.Device) (gattclient.Characteristic, error) {
+	char, err := gattclient.FindCharacteristic(device, bluetooth.ServiceUUIDBattery, bluetooth.CharacteristicUUIDBatteryLevel)
+	if err != nil {
+		return char, err
+	}
+	buf := make([]byte, 1)
+	n, err := char.Read(buf)
+	if err != nil {
+		return char, err
+	}
+	printBatteryLevel(device.Address().String(), buf[:n])
+	return char, nil
+}
+
+// printBatteryLevel prints a Battery Level value, a percentage in one byte.
+func printBatteryLevel(address string, value []byte) {
+	if len(value) != 1 || value[0] > 100 {
+		gattLog.Warn("invalid battery level", "address", address, "value", fmt.Sprintf("%x", value))
+		return
+	}
+	notificationMu.Lock()
+	defer notificationMu.Unlock()
+	fmt.Printf("%s %d%%\n", deviceLabel(address), value[0])
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"example.com/m/decode"
+	"gopkg.in/yaml.v3"
+	"tinygo.org/x/bluetooth"
+)
+
+// None of the platforms let the radio's transmit power be set, so -tx-power
+// is the calibrated power the beacon claims, which receivers use to estimate
+// their distance to it.
+
+var beaconCommands = []command{
+	{"ibeacon", "advertise an iBeacon", runBeaconIBeacon},
+	{"eddystone-url", "advertise an Eddystone-URL beacon", runBeaconEddystoneURL},
+	{"rotate", "advertise the frames of a file in turn, such as iBeacon and Eddystone-TLM", runBeaconRotate},
+}
+
+func runBeacon(args []string) error {
+	return runSubcommand("beacon", beaconCommands, args)
+}
+
+func runBeaconIBeacon(args []string) error {
+	fs := newFlagSet("beacon ibeacon", "")
+	var beacon decode.IBeacon
+	fs.StringVar(&beacon.UUID, "uuid", "", "proximity UUID, e.g. 2f234454-cf6d-4a0f-adf2-f4911ba9ffa6")
+	major := fs.Uint("major", 0, "major number, 0-65535")
+	minor := fs.Uint("minor", 0, "minor number, 0-65535")
+	txPower := fs.Int("tx-power", -59, "calibrated RSSI at 1 m, in dBm")
+	parseFlags(fs, args)
+	if beacon.UUID == "" {
+		fs.Usage()
+		return errors.New("-uuid is required")
+	}
+	if *major > 0xFFFF || *minor > 0xFFFF {
+		return errors.New("-major and -minor must be between 0 and 65535")
+	}
+	if *txPower < -128 || *txPower > 127 {
+		return errors.New("-tx-power must be between -128 and 127")
+	}
+	beacon.Major, beacon.Minor, beacon.MeasuredPower = uint16(*major), uint16(*minor), int8(*txPower)
+	data, err := beacon.Encode()
+	if err != nil {
+		return err
+	}
+
+	if err := enableAdapter(); err != nil {
+		return err
+	}
+	peripheralLog.Info("advertising", "beacon", beacon.String())
+	return advertise(bluetooth.AdvertisementOptions{
+		AdvertisementType: bluetooth.AdvertisingTypeNonConnInd,
+		ManufacturerData:  []bluetooth.ManufacturerDataElement{{CompanyID: decode.CompanyApple, Data: data}},
+	})
+}
+
+func runBeaconEddystoneURL(args []string) error {
+	fs := newFlagSet("beacon eddystone-url", "")
+	url := fs.String("url", "", "URL to advertise, e.g. https://example.com")
+	txPower := fs.Int("tx-power", -20, "calibrated TX power at 0 m, in dBm")
+	parseFlags(fs, args)
+	if *url == "" {
+		fs.Usage()
+		return errors.New("-url is required")
+	}
+	if *txPower < -100 || *txPower > 20 {
+		return errors.New("-tx-power must be between -100 and 20")
+	}
+	data, err := decode.EncodeEddystoneURL(*url, int8(*txPower))
+	if err != nil {
+		return err
+	}
+
+	if err := enableAdapter(); err != nil {
+		return err
+	}
+	peripheralLog.Info("advertising Eddystone-URL", "url", *url)
+	return advertise(bluetooth.AdvertisementOptions{
+		AdvertisementType: bluetooth.AdvertisingTypeNonConnInd,
+		ServiceUUIDs:      []bluetooth.UUID{decode.EddystoneUUID},
+		ServiceData:       []bluetooth.ServiceDataElement{{UUID: decode.EddystoneUUID, Data: data}},
+	})
+}
+
+// ble beacon rotate advertises several frames in turn, each for -every or
+// the time it gives, as beacons do that alternate between an iBeacon and
+// Eddystone-TLM, or to cycle through sensor values. The frames are read from
+// a YAML file:
+//
+//	frames:
+//	  - ibeacon: {uuid: 2f234454-cf6d-4a0f-adf2-f4911ba9ffa6, major: 1, minor: 2}
+//	  - eddystone-tlm: {battery-mv: 3000, temperature: 21.5}
+//	    for: 500ms
+//	  - eddystone-url: {url: https://example.com}
+//	  - eddystone-uid: {namespace: 0102030405060708090a, instance: 0a0b0c0d0e0f}
+//	  - name: Sensor
+//	    manufacturer: ["0xFFFF:0102"]
+//	    service-data: ["fcd2:40020a0b"]
+//
+// The advertisement count of Eddystone-TLM frames is the number of frames
+// advertised so far, and the uptime that of the command.
+
+type beaconRotateFile struct {
+	Frames []beaconRotateFrame `yaml:"frames"`
+}
+
+type beaconRotateFrame struct {
+	IBeacon *struct {
+		UUID    string `yaml:"uuid"`
+		Major   uint16 `yaml:"major"`
+		Minor   uint16 `yaml:"minor"`
+		TxPower *int8  `yaml:"tx-power"`
+	} `yaml:"ibeacon"`
+	EddystoneURL *struct {
+		URL     string `yaml:"url"`
+		TxPower *int8  `yaml:"tx-power"`
+	} `yaml:"eddystone-url"`
+	EddystoneUID *struct {
+		Namespace string `yaml:"namespace"`
+		Instance  string `yaml:"instance"`
+		TxPower   *int8  `yaml:"tx-power"`
+	} `yaml:"eddystone-uid"`
+	EddystoneTLM *struct {
+		BatteryMV   uint16   `yaml:"battery-mv"`
+		Temperature *float64 `yaml:"temperature"`
+	} `yaml:"eddystone-tlm"`
+	Name         string        `yaml:"name"`
+	Service      []string      `yaml:"service"`
+	Manufacturer []string      `yaml:"manufacturer"`
+	ServiceData  []string      `yaml:"service-data"`
+	For          time.Duration `yaml:"for"`
+}
+
+func runBeaconRotate(args []string) error {
+	fs := newFlagSet("beacon rotate", "<file>")
+	every := fs.Duration("every", time.Second, "advertise each frame this long, unless it gives a time of its own")
+	parseFlags(fs, args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("expected a file of frames")
+	}
+	if *every <= 0 {
+		return errors.New("-every must be positive")
+	}
+	frames, err := loadBeaconFrames(fs.Arg(0), *every)
+	if err != nil {
+		return err
+	}
+
+	if err := enableAdapter(); err != nil {
+		return err
+	}
+	return advertiseFrames(frames)
+}
+
+// loadBeaconFrames reads the frames of a file, and checks that they can be
+// encoded.
+func loadBeaconFrames(path string, every time.Duration) ([]advertFrame, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	var file beaconRotateFile
+	if err := dec.Decode(&file); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if len(file.Frames) == 0 {
+		return nil, fmt.Errorf("%s: no frames", path)
+	}
+	started := time.Now()
+	var advertised uint32
+	frames := make([]advertFrame, len(file.Frames))
+	for i, f := range file.Frames {
+		if f.For < 0 {
+			return nil, fmt.Errorf("%s: frame %d: for must not be negative", path, i+1)
+		}
+		frame, err := f.frame(started, &advertised)
+		if err != nil {
+			return nil, fmt.Errorf("%s: frame %d: %w", path, i+1, err)
+		}
+		frame.name = fmt.Sprintf("frame %d (%s)", i+1, frame.name)
+		frame.duration = cmp.Or(f.For, every)
+		frames[i] = frame
+	}
+	return frames, nil
+}
+
+// frame returns the advertisement of a frame of the file. Eddystone-TLM
+// frames count the frames advertised.
+func (f *beaconRotateFrame) frame(started time.Time, advertised *uint32) (advertFrame, error) {
+	custom := f.Name != "" || f.Service != nil || f.Manufacturer != nil || f.ServiceData != nil
+	set := 0
+	for _, ok := range []bool{f.IBeacon != nil, f.EddystoneURL != nil, f.EddystoneUID != nil, f.EddystoneTLM != nil, custom} {
+		if ok {
+			set++
+		}
+	}
+	if set != 1 {
+		return advertFrame{}, errors.New("expected one of ibeacon, eddystone-url, eddystone-uid, eddystone-tlm, or name, service, manufacturer and service-data")
+	}
+	txPower := func(power *int8, otherwise int8) int8 {
+		if power == nil {
+			return otherwise
+		}
+		return *power
+	}
+	fixed := func(name string, opts bluetooth.AdvertisementOptions) advertFrame {
+		return advertFrame{name: name, options: func() (bluetooth.AdvertisementOptions, error) {
+			*advertised++
+			return opts, nil
+		}}
+	}
+	eddystone := func(data []byte) bluetooth.AdvertisementOptions {
+		return bluetooth.AdvertisementOptions{
+			AdvertisementType: bluetooth.AdvertisingTypeNonConnInd,
+			ServiceUUIDs:      []bluetooth.UUID{decode.EddystoneUUID},
+			ServiceData:       []bluetooth.ServiceDataElement{{UUID: decode.EddystoneUUID, Data: data}},
+		}
+	}
+	switch {
+	case f.IBeacon != nil:
+		beacon := decode.IBeacon{UUID: f.IBeacon.UUID, Major: f.IBeacon.Major, Minor: f.IBeacon.Minor, MeasuredPower: txPower(f.IBeacon.TxPower, -59)}
+		data, err := beacon.Encode()
+		if err != nil {
+			return advertFrame{}, err
+		}
+		return fixed("ibeacon", bluetooth.AdvertisementOptions{
+			AdvertisementType: bluetooth.AdvertisingTypeNonConnInd,
+			ManufacturerData:  []bluetooth.ManufacturerDataElement{{CompanyID: decode.CompanyApple, Data: data}},
+		}), nil
+	case f.EddystoneURL != nil:
+		data, err := decode.EncodeEddystoneURL(f.EddystoneURL.URL, txPower(f.EddystoneURL.TxPower, -20))
+		if err != nil {
+			return advertFrame{}, err
+		}
+		return fixed("eddystone-url", eddystone(data)), nil
+	case f.EddystoneUID != nil:
+		uid := decode.EddystoneUID{Namespace: f.EddystoneUID.Namespace, Instance: f.EddystoneUID.Instance, TxPower: txPower(f.EddystoneUID.TxPower, -20)}
+		data, err := uid.Encode()
+		if err != nil {
+			return advertFrame{}, err
+		}
+		return fixed("eddystone-uid", eddystone(data)), nil
+	case f.EddystoneTLM != nil:
+		tlm := decode.EddystoneTLM{BatteryVoltage: f.EddystoneTLM.BatteryMV, Temperature: f.EddystoneTLM.Temperature}
+		return advertFrame{name: "eddystone-tlm", options: func() (bluetooth.AdvertisementOptions, error) {
+			*advertised++
+			tlm.AdvertisementCount, tlm.Uptime = *advertised, time.Since(started)
+			return eddystone(tlm.Encode()), nil
+		}}, nil
+	}
+	opts := bluetooth.AdvertisementOptions{LocalName: f.Name}
+	for _, s := range f.Service {
+		uuid, err := bluetooth.ParseUUID(s)
+		if err != nil {
+			return advertFrame{}, fmt.Errorf("service: %w", err)
+		}
+		opts.ServiceUUIDs = append(opts.ServiceUUIDs, uuid)
+	}
+	for _, s := range f.Manufacturer {
+		element, err := parseManufacturerData(s)
+		if err != nil {
+			return advertFrame{}, fmt.Errorf("manufacturer: %w", err)
+		}
+		opts.ManufacturerData = append(opts.ManufacturerData, element)
+	}
+	for _, s := range f.ServiceData {
+		element, err := parseServiceData(s)
+		if err != nil {
+			return advertFrame{}, fmt.Errorf("service-data: %w", err)
+		}
+		opts.ServiceData = append(opts.ServiceData, element)
+	}
+	return fixed(cmp.Or(f.Name, "custom"), opts), nil
+}
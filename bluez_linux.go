@@ -0,0 +1,299 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"example.com/m/gattclient"
+	"github.com/godbus/dbus/v5"
+	"tinygo.org/x/bluetooth"
+)
+
+// The bluetooth package doesn't expose everything BlueZ knows about a device,
+// so some information is read from BlueZ over D-Bus directly. This uses the
+// same (shared) system bus connection as the bluetooth package.
+
+// adapterID is the BlueZ adapter in use, as in /org/bluez/hci0, and
+// scanAdapterID the one that scans.
+var (
+	adapterID     = "hci0"
+	scanAdapterID = "hci0"
+)
+
+// selectAdapter makes the adapter with the given ID the one in use, for
+// scanning too unless selectScanAdapter picks another one.
+func selectAdapter(id string) (*bluetooth.Adapter, error) {
+	id, err := bluezAdapterID(id)
+	if err != nil {
+		return nil, err
+	}
+	adapterID, scanAdapterID = id, id
+	return bluetooth.NewAdapter(id), nil
+}
+
+func selectScanAdapter(id string) (*bluetooth.Adapter, error) {
+	id, err := bluezAdapterID(id)
+	if err != nil {
+		return nil, err
+	}
+	scanAdapterID = id
+	return bluetooth.NewAdapter(id), nil
+}
+
+// bluezAdapterID returns the ID of an adapter given as its ID, such as hci1,
+// or as its object path, such as /org/bluez/hci1.
+func bluezAdapterID(s string) (string, error) {
+	id := strings.TrimPrefix(s, "/org/bluez/")
+	if id == "" || strings.Contains(id, "/") {
+		return "", fmt.Errorf("invalid adapter %q: expected an ID such as hci1, or a BlueZ object path such as /org/bluez/hci1", s)
+	}
+	return id, nil
+}
+
+// powerCycleScanAdapter turns the scan adapter off and on again, which
+// resets the controller and the discovery state of BlueZ.
+func powerCycleScanAdapter() error {
+	bus, err := dbus.SystemBus()
+	if err != nil {
+		return err
+	}
+	obj := bus.Object("org.bluez", dbus.ObjectPath("/org/bluez/"+scanAdapterID))
+	for _, powered := range []bool{false, true} {
+		if err := obj.SetProperty("org.bluez.Adapter1.Powered", dbus.MakeVariant(powered)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// connectUnknownDevice connects to a device that the adapter in use hasn't
+// discovered, because another adapter scans. BlueZ only connects to devices
+// it knows of on the same adapter, except with ConnectDevice, which is
+// experimental (bluetoothd -E). If that fails, connecting fails as usual.
+func connectUnknownDevice(address bluetooth.Address) {
+	if scanAdapter == adapter {
+		return
+	}
+	bus, err := dbus.SystemBus()
+	if err != nil {
+		return
+	}
+	if _, err := bus.Object("org.bluez", devicePath(address)).GetProperty("org.bluez.Device1.Address"); err == nil {
+		return
+	}
+	addressType := "public"
+	if address.IsRandom() {
+		addressType = "random"
+	}
+	err = bus.Object("org.bluez", dbus.ObjectPath("/org/bluez/"+adapterID)).Call("org.bluez.Adapter1.ConnectDevice", 0, map[string]dbus.Variant{
+		"Address":     dbus.MakeVariant(address.MAC.String()),
+		"AddressType": dbus.MakeVariant(addressType),
+	}).Err
+	if err != nil {
+		gattLog.Debug("ConnectDevice failed", "address", address.String(), "err", err)
+	}
+}
+
+// gattDetail is what BlueZ reports about a characteristic beyond its UUID.
+type gattDetail struct {
+	flags       []string         // e.g. "read", "notify"
+	descriptors []bluetooth.UUID // in handle order
+}
+
+// gattKey identifies a characteristic by its service and characteristic UUID.
+type gattKey struct {
+	service, characteristic bluetooth.UUID
+}
+
+func devicePath(address bluetooth.Address) dbus.ObjectPath {
+	return dbus.ObjectPath("/org/bluez/" + adapterID + "/dev_" + strings.ReplaceAll(address.MAC.String(), ":", "_"))
+}
+
+func managedObjects() (map[dbus.ObjectPath]map[string]map[string]dbus.Variant, error) {
+	bus, err := dbus.SystemBus()
+	if err != nil {
+		return nil, err
+	}
+	var objects map[dbus.ObjectPath]map[string]map[string]dbus.Variant
+	err = bus.Object("org.bluez", "/").Call("org.freedesktop.DBus.ObjectManager.GetManagedObjects", 0).Store(&objects)
+	return objects, err
+}
+
+// gattDetails returns the flags and descriptors of all characteristics of a
+// connected device whose services have been resolved.
+func gattDetails(address bluetooth.Address) (map[gattKey]*gattDetail, error) {
+	objects, err := managedObjects()
+	if err != nil {
+		return nil, err
+	}
+	prefix := string(devicePath(address)) + "/"
+
+	uuidOf := func(props map[string]dbus.Variant) bluetooth.UUID {
+		s, _ := props["UUID"].Value().(string)
+		uuid, _ := bluetooth.ParseUUID(s)
+		return uuid
+	}
+	services := make(map[dbus.ObjectPath]bluetooth.UUID)
+	chars := make(map[dbus.ObjectPath]gattKey)
+	for path, ifaces := range objects {
+		if props, ok := ifaces["org.bluez.GattService1"]; ok && strings.HasPrefix(string(path), prefix) {
+			services[path] = uuidOf(props)
+		}
+	}
+
+	details := make(map[gattKey]*gattDetail)
+	for path, ifaces := range objects {
+		props, ok := ifaces["org.bluez.GattCharacteristic1"]
+		if !ok || !strings.HasPrefix(string(path), prefix) {
+			continue
+		}
+		servicePath, _ := props["Service"].Value().(dbus.ObjectPath)
+		key := gattKey{services[servicePath], uuidOf(props)}
+		flags, _ := props["Flags"].Value().([]string)
+		chars[path] = key
+		details[key] = &gattDetail{flags: flags}
+	}
+
+	// Object paths sort in handle order, which is the order descriptors
+	// should be listed in.
+	var descriptorPaths []string
+	for path, ifaces := range objects {
+		if _, ok := ifaces["org.bluez.GattDescriptor1"]; ok && strings.HasPrefix(string(path), prefix) {
+			descriptorPaths = append(descriptorPaths, string(path))
+		}
+	}
+	slices.Sort(descriptorPaths)
+	for _, path := range descriptorPaths {
+		props := objects[dbus.ObjectPath(path)]["org.bluez.GattDescriptor1"]
+		charPath, _ := props["Characteristic"].Value().(dbus.ObjectPath)
+		if key, ok := chars[charPath]; ok {
+			details[key].descriptors = append(details[key].descriptors, uuidOf(props))
+		}
+	}
+	return details, nil
+}
+
+// characteristicPath finds the object path of a characteristic of a connected
+// device.
+func characteristicPath(address bluetooth.Address, serviceUUID, charUUID bluetooth.UUID) (dbus.ObjectPath, error) {
+	objects, err := managedObjects()
+	if err != nil {
+		return "", err
+	}
+	prefix := string(devicePath(address)) + "/"
+	for path, ifaces := range objects {
+		props, ok := ifaces["org.bluez.GattCharacteristic1"]
+		if !ok || !strings.HasPrefix(string(path), prefix) {
+			continue
+		}
+		if uuid, _ := props["UUID"].Value().(string); !strings.EqualFold(uuid, charUUID.String()) {
+			continue
+		}
+		servicePath, _ := props["Service"].Value().(dbus.ObjectPath)
+		if uuid, _ := objects[servicePath]["org.bluez.GattService1"]["UUID"].Value().(string); strings.EqualFold(uuid, serviceUUID.String()) {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("characteristic %s not found", charUUID.String())
+}
+
+// writeCharacteristic writes a value either as a write request (with
+// response) or as a write command (without response). The bluetooth package
+// only supports the latter on Linux, and leaves the choice to BlueZ.
+// Simulated devices aren't known to BlueZ, and are written directly.
+func writeCharacteristic(device gattclient.Device, serviceUUID bluetooth.UUID, char gattclient.Characteristic, value []byte, withResponse bool) error {
+	if !gattclient.IsBluetooth(device) {
+		return writeValue(char, value, withResponse)
+	}
+	path, err := characteristicPath(device.Address(), serviceUUID, char.UUID())
+	if err != nil {
+		return err
+	}
+	bus, err := dbus.SystemBus()
+	if err != nil {
+		return err
+	}
+	writeType := "command"
+	if withResponse {
+		writeType = "request"
+	}
+	options := map[string]dbus.Variant{"type": dbus.MakeVariant(writeType)}
+	return bus.Object("org.bluez", path).Call("org.bluez.GattCharacteristic1.WriteValue", 0, value, options).Err
+}
+
+// disconnected returns a channel that is closed when BlueZ reports the device
+// as no longer connected. The bluetooth package only reports disconnects it
+// initiated itself on Linux, so the Connected property is polled. Simulated
+// devices only disconnect when told to, and never report it.
+func disconnected(device gattclient.Device) <-chan struct{} {
+	done := make(chan struct{})
+	if !gattclient.IsBluetooth(device) {
+		return done
+	}
+	go func() {
+		defer close(done)
+		bus, err := dbus.SystemBus()
+		if err != nil {
+			return
+		}
+		obj := bus.Object("org.bluez", devicePath(device.Address()))
+		for {
+			time.Sleep(time.Second)
+			connected, err := obj.GetProperty("org.bluez.Device1.Connected")
+			if err != nil {
+				return
+			}
+			if c, _ := connected.Value().(bool); !c {
+				return
+			}
+		}
+	}()
+	return done
+}
+
+// dbusError returns the D-Bus error in the chain of err, if there is one.
+// The bluetooth package passes on both values and pointers.
+func dbusError(err error) (dbus.Error, bool) {
+	var value dbus.Error
+	if errors.As(err, &value) {
+		return value, true
+	}
+	var pointer *dbus.Error
+	if errors.As(err, &pointer) {
+		return *pointer, true
+	}
+	return dbus.Error{}, false
+}
+
+// platformErrorName returns the name of the D-Bus error of err, such as
+// org.bluez.Error.Failed.
+func platformErrorName(err error) string {
+	dbusErr, _ := dbusError(err)
+	return dbusErr.Name
+}
+
+// classifyPlatformError returns the kind of failure of the errors BlueZ and
+// D-Bus report.
+func classifyPlatformError(err error) error {
+	dbusErr, ok := dbusError(err)
+	if !ok {
+		return nil
+	}
+	switch dbusErr.Name {
+	case "org.freedesktop.DBus.Error.ServiceUnknown", // bluetoothd isn't running
+		"org.bluez.Error.NotReady": // the adapter is powered off
+		return errAdapterUnavailable
+	case "org.freedesktop.DBus.Error.AccessDenied", "org.bluez.Error.NotAuthorized", "org.bluez.Error.NotPermitted":
+		return errPermissionDenied
+	case "org.freedesktop.DBus.Error.NoReply", "org.freedesktop.DBus.Error.Timeout", "org.freedesktop.DBus.Error.TimedOut":
+		return errTimeout
+	case "org.freedesktop.DBus.Error.UnknownObject", "org.bluez.Error.DoesNotExist":
+		return errDeviceNotFound
+	}
+	return nil
+}
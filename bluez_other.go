@@ -0,0 +1,114 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"example.com/m/gattclient"
+	"example.com/m/scanner"
+	"tinygo.org/x/bluetooth"
+)
+
+// Only BlueZ lets the adapter be chosen: elsewhere there is just the default
+// adapter.
+var errAdapterSelection = errors.New("choosing an adapter is only supported on Linux")
+
+func selectAdapter(id string) (*bluetooth.Adapter, error) {
+	return nil, errAdapterSelection
+}
+
+func selectScanAdapter(id string) (*bluetooth.Adapter, error) {
+	return nil, errAdapterSelection
+}
+
+// powerCycleScanAdapter is only implemented for BlueZ, so elsewhere the
+// watchdog can only restart the scan.
+func powerCycleScanAdapter() error {
+	return errors.ErrUnsupported
+}
+
+func connectUnknownDevice(address bluetooth.Address) {}
+
+// setScanParameters is only implemented for BlueZ: elsewhere the scan
+// parameters can't be chosen.
+func setScanParameters(interval, window time.Duration) (restore func(), err error) {
+	return nil, errors.New("scan parameters can only be set on Linux")
+}
+
+// scanCodedPHY is only implemented for BlueZ.
+func scanCodedPHY() (restore func(), err error) {
+	return nil, errors.New("scanning on the Coded PHY is only supported on Linux")
+}
+
+// requestPHY is only implemented for BlueZ.
+func requestPHY(address bluetooth.Address, phy string) (tx, rx string, err error) {
+	return "", "", errors.New("choosing the PHY is only supported on Linux")
+}
+
+// startExtendedAdvertisement is only implemented for BlueZ: elsewhere the
+// bluetooth package only has legacy advertisements.
+func startExtendedAdvertisement(opts bluetooth.AdvertisementOptions, secondaryPHY string) (stop func(), err error) {
+	return nil, errors.New("extended advertising is only supported on Linux")
+}
+
+// startScanResponseAdvertisement is only implemented for BlueZ: elsewhere
+// the bluetooth package doesn't set scan response data.
+func startScanResponseAdvertisement(opts, response bluetooth.AdvertisementOptions) (stop func(), err error) {
+	return nil, errors.New("scan response data is only supported on Linux")
+}
+
+// passiveBackend is only implemented for BlueZ: elsewhere the bluetooth
+// package always scans actively.
+func passiveBackend(a *bluetooth.Adapter) (scanner.Backend, error) {
+	return nil, errors.New("passive scanning is only supported on Linux")
+}
+
+// acceptListBackend is only implemented for BlueZ, whose kernel manages the
+// accept list of the controller.
+func acceptListBackend(a *bluetooth.Adapter, addresses []bluetooth.MAC) (scanner.Backend, error) {
+	return nil, errors.New("the accept list of the controller can only be used on Linux")
+}
+
+type gattDetail struct {
+	flags       []string
+	descriptors []bluetooth.UUID
+}
+
+type gattKey struct {
+	service, characteristic bluetooth.UUID
+}
+
+// gattDetails is only implemented for BlueZ. Elsewhere there are no details.
+func gattDetails(address bluetooth.Address) (map[gattKey]*gattDetail, error) {
+	return nil, nil
+}
+
+func writeCharacteristic(device gattclient.Device, serviceUUID bluetooth.UUID, char gattclient.Characteristic, value []byte, withResponse bool) error {
+	return writeValue(char, value, withResponse)
+}
+
+// disconnected returns a channel that is closed when the adapter reports the
+// device as disconnected. It replaces the adapter's connect handler.
+func disconnected(device gattclient.Device) <-chan struct{} {
+	done := make(chan struct{})
+	var once sync.Once
+	adapter.SetConnectHandler(func(d bluetooth.Device, connected bool) {
+		if !connected && d.Address == device.Address() {
+			once.Do(func() { close(done) })
+		}
+	})
+	return done
+}
+
+// platformErrorName and classifyPlatformError only know BlueZ errors.
+// Elsewhere errors have no name and no platform specific kind.
+func platformErrorName(err error) string {
+	return ""
+}
+
+func classifyPlatformError(err error) error {
+	return nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+)
+
+// Bonding keys are stored by the operating system (with BlueZ, under
+// /var/lib/bluetooth), so a paired device stays paired across runs. These
+// commands manage that store.
+
+// bond is a paired device known to the operating system.
+type bond struct {
+	address string
+	name    string
+	bonded  bool // keys are stored, not just kept for this connection
+	trusted bool
+}
+
+var errBondsUnsupported = errors.New("managing bonds is not supported on this platform")
+
+var bondCommands = []command{
+	{"list", "list paired devices", runBondsList},
+	{"remove", "remove a paired device and its keys", runBondsRemove},
+	{"keys", "print the IRKs of bonded devices, for -irk-file", runBondsKeys},
+}
+
+func runBonds(args []string) error {
+	return runSubcommand("bonds", bondCommands, args)
+}
+
+func runBondsList(args []string) error {
+	fs := newFlagSet("bonds list", "")
+	parseFlags(fs, args)
+
+	if err := enableAdapter(); err != nil {
+		return err
+	}
+	bonds, err := listBonds()
+	if err != nil {
+		return err
+	}
+	for _, b := range bonds {
+		var flags []string
+		if b.bonded {
+			flags = append(flags, "bonded")
+		}
+		if b.trusted {
+			flags = append(flags, "trusted")
+		}
+		fmt.Printf("%s %-20q %v\n", b.address, b.name, flags)
+	}
+	return nil
+}
+
+func runBondsRemove(args []string) error {
+	fs := newFlagSet("bonds remove", "<address>")
+	parseFlags(fs, args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("expected exactly one device address")
+	}
+	address, err := parseAddress(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	if err := enableAdapter(); err != nil {
+		return err
+	}
+	if err := removeBond(address); err != nil {
+		return err
+	}
+	gattLog.Info("removed bond", "address", address.String())
+	return nil
+}
+
+func runBondsKeys(args []string) error {
+	fs := newFlagSet("bonds keys", "")
+	parseFlags(fs, args)
+
+	irks, err := bondedIRKs()
+	if err != nil {
+		return err
+	}
+	identities := make([]string, 0, len(irks))
+	for identity := range irks {
+		identities = append(identities, identity)
+	}
+	slices.Sort(identities)
+	for _, identity := range identities {
+		fmt.Printf("%s=%x\n", identity, irks[identity])
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// A UART bridge connects the Nordic UART Service of a device to TCP, for
+// serial tools that talk to a host and port (as with ser2net or a terminal
+// server) rather than to BLE: ble uart -listen serves one client at a time,
+// and -dial connects out, reconnecting when the connection closes. Bytes are
+// passed on as they are, without line handling.
+
+// tcpBridge is the TCP end of a UART bridge. What the device sends goes to
+// the current connection, and is dropped while there is none.
+type tcpBridge struct {
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+func (b *tcpBridge) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.conn == nil {
+		gattLog.Debug("no TCP connection, dropping UART data", "bytes", len(p))
+		return len(p), nil
+	}
+	if _, err := b.conn.Write(p); err != nil {
+		// The reading side notices and ends the connection.
+		gattLog.Debug("writing to the TCP connection", "err", err)
+	}
+	return len(p), nil
+}
+
+// run bridges until ctx is done or sending to the device fails: with listen,
+// to the clients that connect to it, and otherwise to dial.
+func (b *tcpBridge) run(ctx context.Context, listen, dial string, send func([]byte) error) error {
+	if listen != "" {
+		return b.serve(ctx, listen, send)
+	}
+	backoff := initialBackoff
+	for {
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, "tcp", dial)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			delay := jitter(backoff)
+			gattLog.Warn("could not connect, retrying", "address", dial, "err", err, "in", delay.Round(time.Millisecond))
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return nil
+			}
+			backoff = nextBackoff(backoff, time.Minute)
+			continue
+		}
+		backoff = initialBackoff
+		gattLog.Info("bridging to TCP", "address", dial)
+		if err := b.bridge(ctx, conn, send); err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+		gattLog.Info("TCP connection closed, reconnecting", "address", dial)
+		select {
+		case <-time.After(initialBackoff):
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// serve bridges to the clients that connect to addr. A new client replaces
+// the one before it, whose connection may well be dead.
+func (b *tcpBridge) serve(ctx context.Context, addr string, send func([]byte) error) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	stop := context.AfterFunc(ctx, func() { l.Close() })
+	defer stop()
+	defer l.Close()
+	gattLog.Info("bridging to TCP clients, press Ctrl-C to stop", "address", l.Addr().String())
+	failed := make(chan error, 1)
+	for {
+		conn, err := l.Accept()
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			select {
+			case err := <-failed:
+				return err
+			default:
+			}
+			return err
+		}
+		gattLog.Info("TCP client connected", "address", conn.RemoteAddr().String())
+		go func() {
+			if err := b.bridge(ctx, conn, send); err != nil {
+				select {
+				case failed <- err:
+				default:
+				}
+				l.Close()
+			}
+		}()
+	}
+}
+
+// bridge sends what arrives on conn to the device until conn closes, and
+// makes conn the one that the device's data goes to meanwhile. It only
+// returns an error if sending fails.
+func (b *tcpBridge) bridge(ctx context.Context, conn net.Conn, send func([]byte) error) error {
+	b.mu.Lock()
+	if b.conn != nil {
+		gattLog.Info("replacing the TCP client", "address", b.conn.RemoteAddr().String())
+		b.conn.Close()
+	}
+	b.conn = conn
+	b.mu.Unlock()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	defer func() {
+		b.mu.Lock()
+		if b.conn == conn {
+			b.conn = nil
+		}
+		b.mu.Unlock()
+		conn.Close()
+	}()
+
+	buf := make([]byte, 512)
+	for {
+		n, err := conn.Read(buf)
+		if n > 0 {
+			if err := send(buf[:n]); err != nil {
+				return err
+			}
+		}
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				gattLog.Debug("TCP connection ended", "address", conn.RemoteAddr().String(), "err", err)
+			}
+			return nil
+		}
+	}
+}
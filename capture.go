@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"example.com/m/scanner"
+	"tinygo.org/x/bluetooth"
+)
+
+// A capture (.blecap) records scan results, so that they can be replayed
+// without an adapter through everything a scan feeds, e.g. to reproduce a
+// decoder bug. It is a header line followed by a JSON line per advertisement.
+// Where the platform provides the raw advertising data, that is recorded;
+// otherwise (as with BlueZ) the structured fields are.
+
+const captureFormat = "blecap"
+
+type captureHeader struct {
+	Format  string    `json:"format"`
+	Version int       `json:"version"`
+	Started time.Time `json:"started"`
+}
+
+type captureRecord struct {
+	Time             time.Time        `json:"time"`
+	Address          string           `json:"address"`
+	Random           bool             `json:"random,omitempty"`
+	RSSI             int16            `json:"rssi"`
+	Raw              string           `json:"raw,omitempty"`
+	LocalName        string           `json:"local_name,omitempty"`
+	ServiceUUIDs     []string         `json:"service_uuids,omitempty"`
+	ManufacturerData []captureElement `json:"manufacturer_data,omitempty"`
+	ServiceData      []captureElement `json:"service_data,omitempty"`
+}
+
+// captureElement is a manufacturer data element, whose ID is the company ID
+// such as 0x004C, or a service data element, whose ID is the service UUID.
+type captureElement struct {
+	ID   string `json:"id"`
+	Data string `json:"data"`
+}
+
+func newCaptureRecord(result bluetooth.ScanResult, now time.Time) captureRecord {
+	r := captureRecord{
+		Time:    now,
+		Address: result.Address.String(),
+		Random:  result.Address.IsRandom(),
+		RSSI:    result.RSSI,
+	}
+	if raw := result.Bytes(); raw != nil {
+		r.Raw = hex.EncodeToString(raw)
+		return r
+	}
+	r.LocalName = result.LocalName()
+	for _, uuid := range serviceUUIDs(result.AdvertisementPayload) {
+		r.ServiceUUIDs = append(r.ServiceUUIDs, uuid.String())
+	}
+	for _, element := range result.ManufacturerData() {
+		r.ManufacturerData = append(r.ManufacturerData, captureElement{fmt.Sprintf("0x%04X", element.CompanyID), hex.EncodeToString(element.Data)})
+	}
+	for _, element := range result.ServiceData() {
+		r.ServiceData = append(r.ServiceData, captureElement{element.UUID.String(), hex.EncodeToString(element.Data)})
+	}
+	return r
+}
+
+// serviceUUIDs returns the service UUIDs of a payload without raw data. The
+// bluetooth package only lets them be tested for, so those of its own
+// payloads are read with reflection.
+func serviceUUIDs(payload bluetooth.AdvertisementPayload) []bluetooth.UUID {
+	if p, ok := payload.(*scanner.Payload); ok {
+		return p.Fields.ServiceUUIDs
+	}
+	v := reflect.ValueOf(payload)
+	for v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface {
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return nil
+	}
+	field := v.FieldByName("ServiceUUIDs")
+	if !field.IsValid() || !field.CanInterface() {
+		return nil
+	}
+	uuids, _ := field.Interface().([]bluetooth.UUID)
+	return uuids
+}
+
+// result makes the scan result of a record.
+func (r *captureRecord) result() (bluetooth.ScanResult, error) {
+	mac, err := bluetooth.ParseMAC(r.Address)
+	if err != nil {
+		return bluetooth.ScanResult{}, err
+	}
+	address := bluetooth.Address{MACAddress: bluetooth.MACAddress{MAC: mac}}
+	address.SetRandom(r.Random)
+	if r.Raw != "" {
+		raw, err := hex.DecodeString(r.Raw)
+		if err != nil {
+			return bluetooth.ScanResult{}, fmt.Errorf("raw: %w", err)
+		}
+		return bluetooth.ScanResult{Address: address, RSSI: r.RSSI, AdvertisementPayload: scanner.RawPayload(raw)}, nil
+	}
+	payload := &scanner.Payload{}
+	payload.Fields.LocalName = r.LocalName
+	for _, s := range r.ServiceUUIDs {
+		uuid, err := bluetooth.ParseUUID(s)
+		if err != nil {
+			return bluetooth.ScanResult{}, err
+		}
+		payload.Fields.ServiceUUIDs = append(payload.Fields.ServiceUUIDs, uuid)
+	}
+	for _, e := range r.ManufacturerData {
+		id, err := strconv.ParseUint(e.ID, 0, 16)
+		if err != nil {
+			return bluetooth.ScanResult{}, fmt.Errorf("company ID %q: %w", e.ID, err)
+		}
+		data, err := hex.DecodeString(e.Data)
+		if err != nil {
+			return bluetooth.ScanResult{}, err
+		}
+		payload.Fields.ManufacturerData = append(payload.Fields.ManufacturerData, bluetooth.ManufacturerDataElement{CompanyID: uint16(id), Data: data})
+	}
+	for _, e := range r.ServiceData {
+		uuid, err := bluetooth.ParseUUID(e.ID)
+		if err != nil {
+			return bluetooth.ScanResult{}, err
+		}
+		data, err := hex.DecodeString(e.Data)
+		if err != nil {
+			return bluetooth.ScanResult{}, err
+		}
+		payload.Fields.ServiceData = append(payload.Fields.ServiceData, bluetooth.ServiceDataElement{UUID: uuid, Data: data})
+	}
+	return bluetooth.ScanResult{Address: address, RSSI: r.RSSI, AdvertisementPayload: payload}, nil
+}
+
+func runRecord(args []string) error {
+	fs := newFlagSet("record", "")
+	var filter scanFilter
+	filter.registerFlags(fs)
+	out := fs.String("out", "", "write the capture to this file, e.g. session.blecap (required)")
+	duration := fs.Duration("duration", 0, "stop recording after this long (0 records until interrupted)")
+	var scanning scanFlags
+	scanning.registerFlags(fs)
+	parseFlags(fs, args)
+	if *out == "" {
+		fs.Usage()
+		return errors.New("expected -out")
+	}
+	if err := scanning.setup(); err != nil {
+		return err
+	}
+	if err := filter.setup(); err != nil {
+		return err
+	}
+	w, err := openOutputFile(*out)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(captureHeader{Format: captureFormat, Version: 1, Started: time.Now()}); err != nil {
+		w.Close()
+		return err
+	}
+
+	if err := enableAdapter(); err != nil {
+		w.Close()
+		return err
+	}
+	if *duration > 0 {
+		timer := time.AfterFunc(*duration, stopScan)
+		defer timer.Stop()
+	}
+	ctx, stop := shutdownContext()
+	defer stop()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			stopScan()
+		case <-done:
+		}
+	}()
+
+	count := 0
+	var writeErr error
+	scanLog.Info("recording", "file", *out)
+	err = scan(func(adapter *bluetooth.Adapter, result bluetooth.ScanResult) {
+		metrics.scanCallback()
+		if writeErr != nil || !filter.match(result) {
+			return
+		}
+		if writeErr = enc.Encode(newCaptureRecord(result, time.Now())); writeErr != nil {
+			stopScan()
+			return
+		}
+		count++
+	})
+	if closeErr := w.Close(); writeErr == nil {
+		writeErr = closeErr
+	}
+	scanLog.Info("recorded", "advertisements", count)
+	return errors.Join(err, writeErr)
+}
+
+// runReplay is ble scan -replay, with the capture as the first argument.
+func runReplay(args []string) error {
+	if completing != nil {
+		return runScan(nil)
+	}
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		fmt.Fprintln(os.Stderr, "usage: ble replay <capture> [scan flags]")
+		return errors.New("expected a capture")
+	}
+	return runScan(append([]string{"-replay", args[0]}, args[1:]...))
+}
+
+// replaying is the capture that scans replay, if any.
+var replaying *replayScan
+
+// scanTime returns the time of the advertisement a scan callback reports:
+// now, or when it was recorded if it is replayed, so that a replay keeps the
+// times of the capture.
+func scanTime() time.Time {
+	if replaying != nil {
+		return replaying.last
+	}
+	return time.Now()
+}
+
+// replayScan is a scanner.Backend that replays a capture. It carries on
+// where it stopped when scanning again, such as after a pause, and ends the
+// scan at the end of the capture.
+type replayScan struct {
+	speed float64 // 0 replays as fast as possible
+
+	dec  *json.Decoder
+	next *captureRecord // read but not replayed yet
+	last time.Time      // of the last record replayed
+
+	mu     sync.Mutex
+	cancel chan struct{} // non-nil while scanning
+}
+
+func replayBackend(path string, speed float64) (*replayScan, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bufio.NewReader(f))
+	var header captureHeader
+	if err := dec.Decode(&header); err != nil || header.Format != captureFormat {
+		f.Close()
+		return nil, fmt.Errorf("%s is not a capture", path)
+	}
+	if header.Version != 1 {
+		f.Close()
+		return nil, fmt.Errorf("%s: unsupported capture version %d", path, header.Version)
+	}
+	// The file stays open for as long as the command runs.
+	return &replayScan{speed: speed, dec: dec}, nil
+}
+
+func (r *replayScan) Scan(callback func(*bluetooth.Adapter, bluetooth.ScanResult)) error {
+	r.mu.Lock()
+	if r.cancel != nil {
+		r.mu.Unlock()
+		return errors.New("already scanning")
+	}
+	cancel := make(chan struct{})
+	r.cancel = cancel
+	r.mu.Unlock()
+	defer func() {
+		r.mu.Lock()
+		r.cancel = nil
+		r.mu.Unlock()
+	}()
+
+	for {
+		select {
+		case <-cancel:
+			return nil
+		default:
+		}
+		if r.next == nil {
+			var record captureRecord
+			if err := r.dec.Decode(&record); err == io.EOF {
+				scanLog.Info("end of the capture")
+				return nil
+			} else if err != nil {
+				return fmt.Errorf("reading the capture: %w", err)
+			}
+			r.next = &record
+		}
+		record := r.next
+		result, err := record.result()
+		if err != nil {
+			return fmt.Errorf("capture record of %s: %w", record.Address, err)
+		}
+		if r.speed > 0 && !r.last.IsZero() {
+			select {
+			case <-time.After(time.Duration(float64(record.Time.Sub(r.last)) / r.speed)):
+			case <-cancel:
+				return nil
+			}
+		}
+		r.next, r.last = nil, record.Time
+		callback(scanAdapter, result)
+	}
+}
+
+func (r *replayScan) StopScan() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.cancel == nil {
+		return errors.New("not scanning")
+	}
+	close(r.cancel)
+	r.cancel = nil
+	return nil
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"example.com/m/ad"
+)
+
+// With -only-changes, a device is reported when it is first seen and then
+// only when its advertising data differs from the last it advertised, with
+// the AD structures that were added, removed or changed, and the bytes of
+// those that changed. Watching which bytes move while a device does its thing
+// is much of reverse engineering a proprietary beacon.
+
+// adChange is a change to an AD structure between two advertisements.
+type adChange struct {
+	Change string // added, removed or changed
+	Old    *ad.Structure
+	New    *ad.Structure
+	Bytes  string // offsets into the data that changed, company ID or service UUID included, as in 3-4,7
+}
+
+func (c adChange) String() string {
+	switch c.Change {
+	case "added":
+		return "added " + c.New.String()
+	case "removed":
+		return "removed " + c.Old.String()
+	}
+	return fmt.Sprintf("changed %s: %s -> %s (bytes %s)", c.New.Type, valueOf(*c.Old), valueOf(*c.New), c.Bytes)
+}
+
+// valueOf returns the value of a structure as Structure.String formats it.
+func valueOf(s ad.Structure) string {
+	return strings.TrimPrefix(s.String(), s.Type.String()+": ")
+}
+
+// changeTracker keeps the last payload of every device. It is only used from
+// the scan callback, so it does no locking.
+type changeTracker struct {
+	last map[string]trackedPayload
+}
+
+type trackedPayload struct {
+	hash    uint64
+	payload ad.Payload
+}
+
+func newChangeTracker() *changeTracker {
+	return &changeTracker{last: make(map[string]trackedPayload)}
+}
+
+// changes returns the changes since the device of a sighting was last
+// reported, which are none when it is new, and whether to report it. Devices
+// are told apart by -fingerprint and resolved addresses where there are any.
+func (t *changeTracker) changes(s *sighting) ([]adChange, bool) {
+	key := cmp.Or(s.DeviceID, s.Identity, s.Address)
+	hash := hashPayload(s.Raw, s.LocalName, s.ManufacturerData, s.ServiceData)
+	last, ok := t.last[key]
+	if ok && last.hash == hash {
+		return nil, false
+	}
+	// A malformed tail is left out, as in the verbose output.
+	payload, _ := s.payload()
+	if !ok && len(t.last) >= 10000 {
+		// Random addresses come and go; forget them rather than grow.
+		clear(t.last)
+	}
+	t.last[key] = trackedPayload{hash, payload}
+	if !ok {
+		return nil, true
+	}
+	// Structures that only moved don't count.
+	changes := diffPayloads(last.payload, payload)
+	return changes, len(changes) != 0
+}
+
+// diffPayloads returns the changes from one payload to another. Structures
+// are matched by type, and by company ID or service UUID for manufacturer and
+// service data, as BlueZ doesn't report them in a stable order.
+func diffPayloads(old, new ad.Payload) []adChange {
+	olds := structureKeys(old)
+	news := structureKeys(new)
+	var changes []adChange
+	for i, key := range news {
+		j := slices.Index(olds, key)
+		if j < 0 {
+			changes = append(changes, adChange{Change: "added", New: &new[i]})
+			continue
+		}
+		if bytes := changedBytes(old[j].Data, new[i].Data); bytes != "" {
+			changes = append(changes, adChange{Change: "changed", Old: &old[j], New: &new[i], Bytes: bytes})
+		}
+	}
+	for j, key := range olds {
+		if slices.Index(news, key) < 0 {
+			changes = append(changes, adChange{Change: "removed", Old: &old[j]})
+		}
+	}
+	return changes
+}
+
+// structureKeys returns the keys that structures are matched by. A key that
+// comes up again gets a number, so that the second structure of a kind is
+// matched with the second.
+func structureKeys(payload ad.Payload) []string {
+	keys := make([]string, len(payload))
+	seen := make(map[string]int)
+	for i, s := range payload {
+		prefix := 0
+		switch s.Type {
+		case ad.ManufacturerData, ad.ServiceData16:
+			prefix = 2
+		case ad.ServiceData32:
+			prefix = 4
+		case ad.ServiceData128:
+			prefix = 16
+		}
+		key := fmt.Sprintf("%02x:%x", uint8(s.Type), s.Data[:min(prefix, len(s.Data))])
+		seen[key]++
+		keys[i] = key + "#" + strconv.Itoa(seen[key])
+	}
+	return keys
+}
+
+// changedBytes returns the ranges of offsets at which a and b differ, or are
+// only in one of them, or "" if they are the same.
+func changedBytes(a, b []byte) string {
+	var ranges []string
+	start := -1
+	end := max(len(a), len(b))
+	for i := 0; i <= end; i++ {
+		differs := i < end && (i >= len(a) || i >= len(b) || a[i] != b[i])
+		switch {
+		case differs && start < 0:
+			start = i
+		case !differs && start >= 0:
+			if i-1 == start {
+				ranges = append(ranges, strconv.Itoa(start))
+			} else {
+				ranges = append(ranges, strconv.Itoa(start)+"-"+strconv.Itoa(i-1))
+			}
+			start = -1
+		}
+	}
+	return strings.Join(ranges, ",")
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"runtime"
+	"slices"
+	"strings"
+
+	"tinygo.org/x/bluetooth"
+)
+
+// Shell completion is done by the ble binary itself: the scripts pass the
+// words of the command line to the hidden __complete command, which prints
+// the candidates for the last one. The flags of a command are found by
+// running it with completing set, which makes parseFlags (or runSubcommand)
+// hand over its flag set instead of parsing.
+
+// completing is set while completing a command line. It receives the flag
+// set of the command, or the subcommands of a command with subcommands.
+var completing func(fs *flag.FlagSet, subcommands []command)
+
+var completionScripts = map[string]string{
+	"bash": `# bash completion for ble; add to ~/.bashrc: source <(ble completion bash)
+_ble() {
+	local line=${COMP_LINE:0:COMP_POINT} words
+	read -ra words <<<"$line"
+	[[ $line == *' ' ]] && words+=('')
+	local cur=${words[${#words[@]}-1]} IFS=$'\n'
+	COMPREPLY=($(command ble __complete "${words[@]:1}" 2>/dev/null))
+	# Bash completes only after the last colon of an address.
+	if [[ $cur == *:* ]]; then
+		local prefix=${cur%"${cur##*:}"}
+		COMPREPLY=("${COMPREPLY[@]#"$prefix"}")
+	fi
+}
+complete -o default -F _ble ble
+`,
+	"zsh": `#compdef ble
+# zsh completion for ble; add to ~/.zshrc: source <(ble completion zsh)
+_ble() {
+	local -a candidates
+	candidates=(${(f)"$(command ble __complete "${(@)words[2,CURRENT]}" 2>/dev/null)"})
+	if (( ${#candidates} )); then
+		compadd -- "${candidates[@]}"
+	else
+		_files
+	fi
+}
+if [[ $funcstack[1] == _ble ]]; then
+	_ble "$@"
+else
+	compdef _ble ble
+fi
+`,
+	"fish": `# fish completion for ble; save as ~/.config/fish/completions/ble.fish:
+# ble completion fish > ~/.config/fish/completions/ble.fish
+function __ble_complete
+	set -l tokens (commandline -opc) (commandline -ct)
+	command ble __complete $tokens[2..-1] 2>/dev/null
+end
+complete -c ble -f -a '(__ble_complete)'
+`,
+}
+
+func runCompletion(args []string) error {
+	fs := newFlagSet("completion", "bash|zsh|fish")
+	parseFlags(fs, args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("expected a shell")
+	}
+	script, ok := completionScripts[fs.Arg(0)]
+	if !ok {
+		return fmt.Errorf("unknown shell %q (known: bash, zsh, fish)", fs.Arg(0))
+	}
+	fmt.Print(script)
+	return nil
+}
+
+// complete prints the completions of the last word of a command line, given
+// without the program name.
+func complete(words []string) {
+	if len(words) == 0 {
+		words = []string{""}
+	}
+	cur, words := words[len(words)-1], words[:len(words)-1]
+	i, value := skipFlags(flag.CommandLine, words)
+	switch {
+	case value:
+		return
+	case i == len(words) && strings.HasPrefix(cur, "-"):
+		printFlags(flag.CommandLine, cur)
+		return
+	case i == len(words):
+		for _, cmd := range commands {
+			printCompletion(cmd.name, cur)
+		}
+		return
+	}
+	index := slices.IndexFunc(commands, func(cmd command) bool { return cmd.name == words[i] })
+	if index < 0 {
+		return
+	}
+	args := words[i+1:]
+	fs, subcommands := commandFlags(commands[index], args)
+	switch {
+	case subcommands != nil:
+		for _, cmd := range subcommands {
+			printCompletion(cmd.name, cur)
+		}
+	case fs == nil:
+	case strings.HasPrefix(cur, "-"):
+		printFlags(fs, cur)
+	default:
+		if len(args) > 0 && takesValue(fs, args[len(args)-1]) {
+			return
+		}
+		// The configuration file has the aliases.
+		applyConfig(fs)
+		for _, device := range knownDevices() {
+			printCompletion(device, cur)
+		}
+	}
+}
+
+// commandFlags returns the flag set of a command given its arguments, or
+// its subcommands.
+func commandFlags(cmd command, args []string) (fs *flag.FlagSet, subcommands []command) {
+	completing = func(f *flag.FlagSet, s []command) {
+		fs, subcommands = f, s
+		runtime.Goexit()
+	}
+	defer func() { completing = nil }()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		cmd.run(args)
+	}()
+	<-done
+	return fs, subcommands
+}
+
+// skipFlags returns the index of the first argument that isn't a flag, and
+// whether the last argument is a flag missing its value.
+func skipFlags(fs *flag.FlagSet, args []string) (int, bool) {
+	for i := 0; i < len(args); i++ {
+		if !strings.HasPrefix(args[i], "-") || args[i] == "-" {
+			return i, false
+		}
+		if args[i] == "--" {
+			return i + 1, false
+		}
+		if takesValue(fs, args[i]) {
+			if i == len(args)-1 {
+				return len(args), true
+			}
+			i++
+		}
+	}
+	return len(args), false
+}
+
+// takesValue returns true if arg is a flag of fs that takes its value from
+// the next argument.
+func takesValue(fs *flag.FlagSet, arg string) bool {
+	name := strings.TrimLeft(arg, "-")
+	if !strings.HasPrefix(arg, "-") || strings.Contains(name, "=") {
+		return false
+	}
+	f := fs.Lookup(name)
+	if f == nil {
+		return false
+	}
+	if b, ok := f.Value.(interface{ IsBoolFlag() bool }); ok && b.IsBoolFlag() {
+		return false
+	}
+	return true
+}
+
+func printFlags(fs *flag.FlagSet, cur string) {
+	fs.VisitAll(func(f *flag.Flag) {
+		printCompletion("-"+f.Name, cur)
+	})
+}
+
+func printCompletion(candidate, cur string) {
+	if strings.HasPrefix(candidate, cur) {
+		fmt.Println(candidate)
+	}
+}
+
+// knownDevices returns the addresses and aliases of the devices ble knows
+// of, for completing addresses.
+func knownDevices() []string {
+	var devices []string
+	for key, alias := range deviceAliases {
+		devices = append(devices, alias)
+		if _, err := bluetooth.ParseMAC(key); err == nil {
+			devices = append(devices, key)
+		}
+	}
+	if bonds, err := listBonds(); err == nil {
+		for _, b := range bonds {
+			devices = append(devices, b.address)
+		}
+	}
+	slices.Sort(devices)
+	return slices.Compact(devices)
+}
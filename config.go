@@ -0,0 +1,193 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// A configuration file sets flags, so that a deployment doesn't need a giant
+// command line. Top-level keys set the flags of every command that has them,
+// and sections named after a command (and subcommand) set the flags of just
+// that command:
+//
+//	min-rssi: -80
+//	mqtt: tcp://localhost:1883
+//	bthome-key:
+//	  A4:C1:38:00:00:01: 231d39c1d7cc1ab1aee224cd096db932
+//	scan:
+//	  output: json
+//	  dedup: 10s
+//	gatt:
+//	  read:
+//	    conn-timeout: 5s
+//	aliases:
+//	  A4:C1:38:00:00:01: kitchen-thermometer
+//	tags:
+//	  sensors: [kitchen-thermometer]
+//
+// Lists set a repeatable flag once per element and mappings once per
+// KEY=VALUE pair. Flags can also be set with environment variables named
+// BLE_ and the flag name in upper case with underscores, such as
+// BLE_MQTT_TOPIC. The command line takes precedence over the environment,
+// and the environment over the file.
+
+// configFlag registers the -config flag of a command.
+func configFlag(fs *flag.FlagSet) {
+	fs.String("config", os.Getenv("BLE_CONFIG"), "read flags from this YAML file (default: $BLE_CONFIG, or ble.yaml in the user configuration directory if it exists)")
+}
+
+// defaultConfigPath returns the configuration file that is read when there
+// is no -config, in the user's configuration directory.
+func defaultConfigPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "ble", "ble.yaml")
+}
+
+// parseFlags parses the command line of a command, then sets the flags that
+// weren't given from the environment and the configuration file. Like the
+// flag set itself, it exits on errors.
+func parseFlags(fs *flag.FlagSet, args []string) {
+	if completing != nil {
+		completing(fs, nil)
+	}
+	if dryRun {
+		recordFlags(fs)
+	}
+	fs.Parse(args)
+	if err := applyConfig(fs); err != nil {
+		fmt.Fprintf(fs.Output(), "%s: %v\n", fs.Name(), err)
+		os.Exit(exitUsage)
+	}
+	parsedFlags = fs
+}
+
+func applyConfig(fs *flag.FlagSet) error {
+	given := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { given[f.Name] = true })
+
+	path, explicit := fs.Lookup("config").Value.String(), true
+	if path == "" {
+		path, explicit = defaultConfigPath(), false
+	}
+	var config map[string]any
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if errors.Is(err, os.ErrNotExist) && !explicit {
+			// No configuration file is fine.
+		} else if err != nil {
+			return err
+		} else if err := yaml.Unmarshal(data, &config); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	}
+
+	values, err := configValues(fs, config)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	if err := loadAliases(config["aliases"]); err != nil {
+		return fmt.Errorf("%s: aliases: %w", path, err)
+	}
+	if err := loadTags(config["tags"]); err != nil {
+		return fmt.Errorf("%s: tags: %w", path, err)
+	}
+
+	var errs []error
+	fs.VisitAll(func(f *flag.Flag) {
+		if given[f.Name] || f.Name == "config" {
+			return
+		}
+		env := "BLE_" + strings.ToUpper(strings.ReplaceAll(f.Name, "-", "_"))
+		if value, ok := os.LookupEnv(env); ok {
+			if err := fs.Set(f.Name, value); err != nil {
+				errs = append(errs, fmt.Errorf("$%s: %w", env, err))
+			}
+			return
+		}
+		for _, value := range values[f.Name] {
+			if err := fs.Set(f.Name, value); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %s: %w", path, f.Name, err))
+			}
+		}
+	})
+	return errors.Join(errs...)
+}
+
+// configValues returns the values the configuration sets the flags of a
+// command to, with those of the command's section replacing the top-level
+// ones.
+func configValues(fs *flag.FlagSet, config map[string]any) (map[string][]string, error) {
+	values := make(map[string][]string)
+	names := strings.Fields(strings.TrimPrefix(fs.Name(), "ble "))
+	section := config
+	for depth := 0; section != nil; depth++ {
+		leaf := depth == len(names)
+		for key, value := range section {
+			if key == "config" || fs.Lookup(key) == nil {
+				// The other keys are sections and the flags of other
+				// commands, unless this is the command's own section.
+				if leaf {
+					return nil, fmt.Errorf("%s: unknown flag %q", strings.Join(names, " "), key)
+				}
+				continue
+			}
+			v, err := flagValues(value)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", key, err)
+			}
+			values[key] = v
+		}
+		if leaf {
+			break
+		}
+		section, _ = section[names[depth]].(map[string]any)
+	}
+	return values, nil
+}
+
+// flagValues converts a configuration value to the values to set a flag to.
+func flagValues(value any) ([]string, error) {
+	switch value := value.(type) {
+	case nil:
+		return nil, errors.New("missing value")
+	case []any:
+		var values []string
+		for _, element := range value {
+			v, err := flagValues(element)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, v...)
+		}
+		return values, nil
+	case map[string]any:
+		keys := make([]string, 0, len(value))
+		for key := range value {
+			keys = append(keys, key)
+		}
+		slices.Sort(keys)
+		var values []string
+		for _, key := range keys {
+			v, err := flagValues(value[key])
+			if err != nil {
+				return nil, err
+			}
+			for _, v := range v {
+				values = append(values, key+"="+v)
+			}
+		}
+		return values, nil
+	default:
+		return []string{fmt.Sprint(value)}, nil
+	}
+}
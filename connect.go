@@ -0,0 +1,286 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"strconv"
+	"time"
+
+	"example.com/m/gattclient"
+	"tinygo.org/x/bluetooth"
+)
+
+func runConnect(args []string) error {
+	fs := newFlagSet("connect", "<address>")
+	var conn connectFlags
+	conn.registerFlags(fs)
+	var reconnect reconnectFlags
+	reconnect.registerFlags(fs)
+	tree := fs.Bool("tree", true, "print the GATT services and characteristics of the device after connecting")
+	metricsAddr := metricsFlag(fs)
+	parseFlags(fs, args)
+	if err := serveMetrics(*metricsAddr); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("expected exactly one device address")
+	}
+	address, err := parseAddress(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := shutdownContext()
+	defer stop()
+
+	if err := enableAdapter(); err != nil {
+		return err
+	}
+	first := true
+	s := &supervisor{conn: &conn, reconnect: &reconnect, address: address}
+	s.setup = func(device gattclient.Device) (func(), error) {
+		if first {
+			gattLog.Info("pairing state", "address", device.Address().String(), "state", pairingState(device))
+		}
+		if first && *tree {
+			if err := printGATTTree(device); err != nil {
+				return nil, err
+			}
+		}
+		if char, ok := anyCharacteristic(device); ok {
+			conn.reportMTU(char)
+		}
+		if first {
+			// Keep the connection open until interrupted.
+			gattLog.Info("connected, press Ctrl-C to disconnect")
+		}
+		first = false
+		return func() {}, nil
+	}
+	err = s.run(ctx)
+	if err == nil {
+		gattLog.Info("disconnected", "address", address.String())
+	}
+	return err
+}
+
+// connectFlags are the flags shared by all commands that connect to a device.
+type connectFlags struct {
+	timeout time.Duration
+	retries int
+	mtu     int
+
+	// Connection parameters. Zero values leave the choice to the stack.
+	minInterval        time.Duration
+	maxInterval        time.Duration
+	supervisionTimeout time.Duration
+	latency            int
+
+	pair         bool
+	ioCapability string
+
+	// phy is the PHY to request after connecting, empty to leave it.
+	phy string
+}
+
+// ioCapabilities maps the values of -io-capability to BlueZ agent
+// capabilities, which decide the pairing method.
+var ioCapabilities = map[string]string{
+	"just-works":       "NoInputNoOutput",
+	"display":          "DisplayOnly",
+	"keyboard":         "KeyboardOnly",
+	"keyboard-display": "KeyboardDisplay",
+}
+
+func (c *connectFlags) registerFlags(fs *flag.FlagSet) {
+	fs.DurationVar(&c.timeout, "timeout", 10*time.Second, "give up a connection attempt after this long")
+	fs.IntVar(&c.retries, "retries", 3, "number of times to retry a failed connection attempt")
+	fs.IntVar(&c.mtu, "mtu", 0, "required ATT MTU; warn if the negotiated MTU is smaller (0 just reports it)")
+	fs.Func("conn-min-interval", "minimum connection interval, 7.5ms-4s (plain numbers are ms)", durationFlag(&c.minInterval))
+	fs.Func("conn-max-interval", "maximum connection interval, 7.5ms-4s (plain numbers are ms)", durationFlag(&c.maxInterval))
+	fs.Func("conn-timeout", "connection supervision timeout, 100ms-32s (plain numbers are ms)", durationFlag(&c.supervisionTimeout))
+	fs.IntVar(&c.latency, "slave-latency", 0, "peripheral latency in connection events, 0-499")
+	fs.BoolVar(&c.pair, "pair", false, "pair with the device after connecting, if it isn't paired yet")
+	fs.StringVar(&c.phy, "phy", "", "after connecting, request this PHY: 2M for twice the throughput, 1M or Coded; the negotiated PHY is reported (Linux only, needs CAP_NET_RAW)")
+	fs.StringVar(&c.ioCapability, "io-capability", "keyboard-display", "pairing IO capability: just-works, display (show a passkey), keyboard (enter a passkey) or keyboard-display")
+}
+
+// durationFlag returns a flag setter for a duration that, unlike
+// flag.Duration, treats a plain number as milliseconds.
+func durationFlag(d *time.Duration) func(string) error {
+	return func(s string) error {
+		if ms, err := strconv.ParseFloat(s, 64); err == nil {
+			*d = time.Duration(ms * float64(time.Millisecond))
+			return nil
+		}
+		v, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		*d = v
+		return nil
+	}
+}
+
+// validate checks the connection parameters against the limits of the Core
+// Specification (Vol 6, Part B, 4.5.1 and 4.5.2).
+func (c *connectFlags) validate() error {
+	for _, interval := range []struct {
+		name  string
+		value time.Duration
+	}{{"-conn-min-interval", c.minInterval}, {"-conn-max-interval", c.maxInterval}} {
+		if interval.value != 0 && (interval.value < 7500*time.Microsecond || interval.value > 4*time.Second) {
+			return fmt.Errorf("%s must be between 7.5ms and 4s", interval.name)
+		}
+	}
+	if c.minInterval != 0 && c.maxInterval != 0 && c.minInterval > c.maxInterval {
+		return errors.New("-conn-min-interval is larger than -conn-max-interval")
+	}
+	if c.supervisionTimeout != 0 && (c.supervisionTimeout < 100*time.Millisecond || c.supervisionTimeout > 32*time.Second) {
+		return errors.New("-conn-timeout must be between 100ms and 32s")
+	}
+	if _, ok := ioCapabilities[c.ioCapability]; !ok {
+		return fmt.Errorf("unknown -io-capability %q", c.ioCapability)
+	}
+	if c.phy != "" && c.phy != "1M" && c.phy != "2M" && c.phy != "Coded" {
+		return fmt.Errorf("unknown -phy %q (known: 1M, 2M, Coded)", c.phy)
+	}
+	if c.latency < 0 || c.latency > 499 {
+		return errors.New("-slave-latency must be between 0 and 499")
+	}
+	// The supervision timeout must allow a few missed connection events.
+	if c.supervisionTimeout != 0 && c.maxInterval != 0 {
+		if minimum := 2 * time.Duration(1+c.latency) * c.maxInterval; c.supervisionTimeout <= minimum {
+			return fmt.Errorf("-conn-timeout must be larger than %s with these intervals and latency", minimum)
+		}
+	}
+	return nil
+}
+
+// reportMTU prints the ATT MTU negotiated for the connection of a
+// characteristic.
+//
+// None of the platforms let an application pick the MTU: the stack exchanges
+// the largest MTU it supports when connecting (with BlueZ, see ExchangeMTU in
+// the [GATT] section of /etc/bluetooth/main.conf). So -mtu can only check that
+// the negotiated MTU is large enough.
+func (c *connectFlags) reportMTU(char gattclient.Characteristic) {
+	mtu, err := char.GetMTU()
+	if err != nil {
+		gattLog.Warn("could not read MTU", "err", err)
+		return
+	}
+	gattLog.Info("negotiated MTU", "mtu", mtu)
+	if c.mtu > 0 && int(mtu) < c.mtu {
+		gattLog.Warn("negotiated MTU is smaller than -mtu, longer values will be truncated", "mtu", mtu, "want", c.mtu, "max_value_length", mtu-3)
+	}
+}
+
+// params returns the connection parameters to pass to adapter.Connect. The
+// bluetooth package has no field for the peripheral latency, so -slave-latency
+// is only used for validation.
+func (c *connectFlags) params() bluetooth.ConnectionParams {
+	return bluetooth.ConnectionParams{
+		ConnectionTimeout: bluetooth.NewDuration(c.timeout),
+		MinInterval:       bluetooth.NewDuration(c.minInterval),
+		MaxInterval:       bluetooth.NewDuration(c.maxInterval),
+		Timeout:           bluetooth.NewDuration(c.supervisionTimeout),
+	}
+}
+
+// connect connects to the device, retrying failed attempts. Each attempt and
+// its error is reported on stderr.
+func (c *connectFlags) connect(address bluetooth.Address) (gattclient.Device, error) {
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	if c.latency != 0 {
+		gattLog.Warn("-slave-latency can't be requested on this platform and is ignored")
+	}
+	var err error
+	for attempt := 0; attempt <= c.retries; attempt++ {
+		if attempt > 0 {
+			gattLog.Info("retrying in 1s")
+			time.Sleep(time.Second)
+		}
+		gattLog.Info("connecting", "address", address.String())
+		var device gattclient.Device
+		device, err = connectTimeout(address, c.params(), c.timeout)
+		if err == nil {
+			gattLog.Info("connected", "address", device.Address().String())
+			if c.pair {
+				if err := pair(device, ioCapabilities[c.ioCapability]); err != nil {
+					device.Disconnect()
+					return nil, err
+				}
+			}
+			if c.phy != "" {
+				c.requestPHY(device)
+			}
+			return device, nil
+		}
+		gattLog.Warn("connection failed", "address", address.String(), "err", err)
+	}
+	return nil, wrapError(fmt.Sprintf("connect to %s (%d attempts)", address.String(), c.retries+1), err)
+}
+
+// requestPHY requests -phy for a connection and reports the outcome. The
+// connection works on the old PHY if it fails, so that is only a warning.
+func (c *connectFlags) requestPHY(device gattclient.Device) {
+	tx, rx, err := requestPHY(device.Address(), c.phy)
+	if err != nil {
+		gattLog.Warn("could not request the PHY", "phy", c.phy, "err", err)
+		return
+	}
+	if tx != c.phy || rx != c.phy {
+		gattLog.Warn("the device didn't agree to the PHY", "phy", c.phy, "tx", tx, "rx", rx)
+		return
+	}
+	gattLog.Info("negotiated PHY", "tx", tx, "rx", rx)
+}
+
+var errDisconnected = errors.New("device disconnected")
+
+// connectBackend, if set, is what connections are made with instead of the
+// adapter: the simulator of -simulate.
+var connectBackend gattclient.Adapter
+
+// connectTimeout makes a single connection attempt with a timeout.
+func connectTimeout(address bluetooth.Address, params bluetooth.ConnectionParams, timeout time.Duration) (gattclient.Device, error) {
+	dialer := gattclient.Dialer{Adapter: gattclient.Bluetooth(adapter), Params: params, Timeout: timeout, Prepare: connectUnknownDevice}
+	if connectBackend != nil {
+		dialer.Adapter, dialer.Prepare = connectBackend, nil
+	}
+	return dialer.Connect(address)
+}
+
+// anyCharacteristic returns the first characteristic of the device, for
+// reading the connection MTU (which is only exposed per characteristic).
+func anyCharacteristic(device gattclient.Device) (gattclient.Characteristic, bool) {
+	services, err := device.DiscoverServices(nil)
+	if err != nil {
+		return nil, false
+	}
+	for _, service := range services {
+		chars, err := service.DiscoverCharacteristics(nil)
+		if err == nil && len(chars) > 0 {
+			return chars[0], true
+		}
+	}
+	return nil, false
+}
+
+// parseAddress parses a device address given on the command line, in the
+// usual 11:22:33:44:55:66 notation, or the alias of a device.
+func parseAddress(s string) (bluetooth.Address, error) {
+	if address, ok := aliasAddress(s); ok {
+		s = address
+	}
+	mac, err := bluetooth.ParseMAC(s)
+	if err != nil {
+		return bluetooth.Address{}, err
+	}
+	return bluetooth.Address{MACAddress: bluetooth.MACAddress{MAC: mac}}, nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"sync"
+
+	"example.com/m/gattclient"
+	"tinygo.org/x/bluetooth"
+)
+
+var errNotConnected = errors.New("not connected")
+
+// connections keeps track of the devices a server is connected to on behalf
+// of its clients. Devices that disconnect on their own are forgotten.
+type connections struct {
+	conn *connectFlags
+
+	mu      sync.Mutex
+	devices map[string]*connection
+}
+
+type connection struct {
+	device gattclient.Device
+	gone   <-chan struct{}
+}
+
+func newConnections(conn *connectFlags) *connections {
+	return &connections{conn: conn, devices: make(map[string]*connection)}
+}
+
+// connect connects to a device, unless it is connected already.
+func (c *connections) connect(address bluetooth.Address) (gattclient.Device, error) {
+	if device, ok := c.get(address); ok {
+		return device, nil
+	}
+	device, err := c.conn.connect(address)
+	if err != nil {
+		return nil, err
+	}
+	gone := disconnected(device)
+	c.mu.Lock()
+	c.devices[address.String()] = &connection{device, gone}
+	c.mu.Unlock()
+	go func() {
+		<-gone
+		if c.forget(device) {
+			gattLog.Info("disconnected", "address", device.Address().String())
+		}
+	}()
+	return device, nil
+}
+
+// get returns the connected device with the given address.
+func (c *connections) get(address bluetooth.Address) (gattclient.Device, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if conn, ok := c.devices[address.String()]; ok {
+		return conn.device, true
+	}
+	return nil, false
+}
+
+// gone returns a channel that is closed when a connected device disconnects.
+// For a device that isn't connected, the channel is closed already.
+func (c *connections) gone(device gattclient.Device) <-chan struct{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if conn, ok := c.devices[device.Address().String()]; ok && conn.device == device {
+		return conn.gone
+	}
+	closed := make(chan struct{})
+	close(closed)
+	return closed
+}
+
+// connected returns whether the device with the given address (in string
+// form) is connected.
+func (c *connections) connected(address string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.devices[address]
+	return ok
+}
+
+// addresses returns the addresses of all connected devices.
+func (c *connections) addresses() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var addresses []string
+	for address := range c.devices {
+		addresses = append(addresses, address)
+	}
+	return addresses
+}
+
+func (c *connections) disconnect(address bluetooth.Address) error {
+	device, ok := c.get(address)
+	if !ok {
+		return errNotConnected
+	}
+	c.forget(device)
+	return device.Disconnect()
+}
+
+// forget removes a device from the connected devices, unless it has been
+// replaced by a new connection in the meantime. It returns whether the device
+// was removed.
+func (c *connections) forget(device gattclient.Device) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if conn, ok := c.devices[device.Address().String()]; ok && conn.device == device {
+		delete(c.devices, device.Address().String())
+		return true
+	}
+	return false
+}
+
+func (c *connections) disconnectAll() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for address, conn := range c.devices {
+		conn.device.Disconnect()
+		delete(c.devices, address)
+	}
+}
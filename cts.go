@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"time"
+
+	"tinygo.org/x/bluetooth"
+)
+
+// Current Time Service characteristics.
+var (
+	ctsCurrentTime   = bluetooth.New16BitUUID(0x2A2B)
+	ctsLocalTimeInfo = bluetooth.New16BitUUID(0x2A0F)
+)
+
+// Adjust Reason flags of the Current Time characteristic.
+const (
+	adjustManual    = 1 << 0
+	adjustTimeZone  = 1 << 2
+	adjustDSTChange = 1 << 3
+)
+
+// clockJumpThreshold is how far the system clock has to move to count as
+// adjusted.
+const clockJumpThreshold = time.Second
+
+func runTimeServer(args []string) error {
+	fs := newFlagSet("time-server", "")
+	name := fs.String("name", "Go Clock", "local name to advertise")
+	acceptFlag(fs)
+	parseFlags(fs, args)
+
+	if err := enableAdapter(); err != nil {
+		return err
+	}
+	now := time.Now()
+	var current, local bluetooth.Characteristic
+	err := adapter.AddService(&bluetooth.Service{
+		UUID: bluetooth.ServiceUUIDCurrentTime,
+		Characteristics: []bluetooth.CharacteristicConfig{
+			{
+				Handle: &current,
+				UUID:   ctsCurrentTime,
+				Value:  currentTime(now, 0),
+				Flags:  bluetooth.CharacteristicReadPermission | bluetooth.CharacteristicNotifyPermission,
+			},
+			{
+				Handle: &local,
+				UUID:   ctsLocalTimeInfo,
+				Value:  localTimeInfo(now),
+				Flags:  bluetooth.CharacteristicReadPermission,
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := shutdownContext()
+	defer stop()
+	go serveTime(ctx, &current, &local)
+
+	return advertise(bluetooth.AdvertisementOptions{
+		LocalName:    *name,
+		ServiceUUIDs: []bluetooth.UUID{bluetooth.ServiceUUIDCurrentTime},
+	})
+}
+
+// serveTime keeps the characteristic values current until ctx is done.
+//
+// The bluetooth package can't compute a value when it is read, so the value
+// is updated every second, which subscribed clients see as a notification
+// every second. When the system clock or time zone changes, the update says
+// so in its adjust reason.
+func serveTime(ctx context.Context, current, local *bluetooth.Characteristic) {
+	last := time.Now()
+	lastInfo := localTimeInfo(last)
+	for {
+		// Update right after the second changes, so that clients reading the
+		// value are never more than a second behind.
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Until(last.Truncate(time.Second).Add(time.Second))):
+		}
+		now := time.Now()
+
+		// The monotonic clock keeps running when the wall clock is set, so
+		// a difference between the two means the clock was adjusted.
+		var reason byte
+		if jump := now.Round(0).Sub(last.Round(0)) - now.Sub(last); jump > clockJumpThreshold || jump < -clockJumpThreshold {
+			peripheralLog.Info("system clock adjusted", "by", jump.Round(time.Millisecond))
+			reason |= adjustManual
+		}
+		if info := localTimeInfo(now); string(info) != string(lastInfo) {
+			if info[0] != lastInfo[0] {
+				reason |= adjustTimeZone
+			}
+			if info[1] != lastInfo[1] {
+				reason |= adjustDSTChange
+			}
+			local.Write(info)
+			lastInfo = info
+		}
+		if _, err := current.Write(currentTime(now, reason)); err != nil {
+			peripheralLog.Warn("could not update the current time", "err", err)
+		}
+		last = now
+	}
+}
+
+// currentTime encodes the Current Time characteristic: an Exact Time 256
+// (date, time, day of week and 1/256 fractions of a second) followed by the
+// adjust reason.
+func currentTime(t time.Time, adjustReason byte) []byte {
+	b := make([]byte, 10)
+	binary.LittleEndian.PutUint16(b, uint16(t.Year()))
+	b[2] = byte(t.Month())
+	b[3] = byte(t.Day())
+	b[4] = byte(t.Hour())
+	b[5] = byte(t.Minute())
+	b[6] = byte(t.Second())
+	// Monday is 1 and Sunday 7.
+	b[7] = byte((int(t.Weekday())+6)%7 + 1)
+	b[8] = byte(t.Nanosecond() / (1e9 / 256))
+	b[9] = adjustReason
+	return b
+}
+
+// localTimeInfo encodes the Local Time Information characteristic: the time
+// zone (the standard offset from UTC in 15 minute steps) and the DST offset.
+// Go only knows the total offset, so DST is assumed to add an hour.
+func localTimeInfo(t time.Time) []byte {
+	_, offset := t.Zone()
+	dst := byte(0)
+	if t.IsDST() {
+		offset -= 3600
+		dst = 4 // one hour, in 15 minute steps
+	}
+	return []byte{byte(int8(offset / (15 * 60))), dst}
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"example.com/m/decode"
+	"tinygo.org/x/bluetooth"
+)
+
+// ble daemon is the always-on gateway: it scans until it is stopped and
+// writes what it finds to the configured sinks, typically under systemd with
+// a configuration file. A scan that fails is started again with backoff, and
+// -health serves the endpoints that a supervisor or load balancer probes.
+
+func runDaemon(args []string) error {
+	fs := newFlagSet("daemon", "")
+	var filter scanFilter
+	filter.registerFlags(fs)
+	dedup := fs.Duration("dedup", 0, "report each device at most once per this window (0 disables)")
+	dedupOnChange := fs.Bool("dedup-on-change", false, "with -dedup, report a device again when its payload changes")
+	fs.Var(decode.BTHomeKeys, "bthome-key", "decrypt BTHome advertisements of a device, as ADDRESS=KEY (repeatable)")
+	fs.Var(decode.MiBeaconKeys, "mibeacon-key", "decrypt Xiaomi MiBeacon advertisements of a device with its bind key, as ADDRESS=KEY (repeatable)")
+	var mqttSink mqttFlags
+	mqttSink.registerFlags(fs)
+	var influxSink influxFlags
+	influxSink.registerFlags(fs)
+	dbPath := fs.String("db", "", "record sightings and decoded measurements in this SQLite database, e.g. ble.db")
+	udpAddr := fs.String("udp", "", "send decoded sensor values as JSON datagrams to this HOST:PORT, e.g. 255.255.255.255:9999 to broadcast")
+	format := fs.String("output", "", "also write sightings to -out-file (or stdout) in this format: text, json or csv (default: only the sinks)")
+	outFile := fs.String("out-file", "", "with -output, write to this file instead of stdout")
+	var rotation rotateFlags
+	rotation.registerFlags(fs)
+	buffer := fs.Int("buffer", 1024, "sightings to buffer for the sinks; beyond that, sightings are dropped rather than stalling the scan")
+	metricsAddr := metricsFlag(fs)
+	alerts := alertsFlag(fs)
+	healthAddr := fs.String("health", "", "serve health checks at http://ADDR/healthz and http://ADDR/readyz, e.g. :9102")
+	stale := fs.Duration("stale", 10*time.Minute, "report unhealthy when no advertisement has been received for this long (0 disables)")
+	pidFile := fs.String("pid-file", "", "write the process ID to this file while running")
+	maxBackoff := fs.Duration("max-backoff", time.Minute, "maximum delay between attempts to scan again after the scan fails")
+	var scanning scanFlags
+	scanning.registerFlags(fs)
+	// A gateway should recover from a stalled adapter without anyone
+	// noticing, so the watchdog is on by default.
+	scanning.watchdog = 5 * time.Minute
+	fs.Lookup("watchdog").DefValue = scanning.watchdog.String()
+	var scheduling scheduleFlags
+	scheduling.registerFlags(fs)
+	parseFlags(fs, args)
+	if fs.NArg() != 0 {
+		fs.Usage()
+		return errors.New("expected no arguments")
+	}
+	if *buffer < 1 {
+		return errors.New("-buffer must be at least 1")
+	}
+	if *stale < 0 {
+		return errors.New("-stale must not be negative")
+	}
+	if *outFile != "" && *format == "" {
+		return errors.New("-out-file needs -output")
+	}
+	if err := rotation.validate(*outFile); err != nil {
+		return err
+	}
+	if *format == "" && mqttSink.broker == "" && !influxSink.enabled() && *dbPath == "" && *udpAddr == "" && *metricsAddr == "" && *alerts == "" {
+		return errors.New("no sinks configured: give -mqtt, -influx, -db, -udp, -metrics, -alerts or -output")
+	}
+	if err := scanning.setup(); err != nil {
+		return err
+	}
+	sched, err := scheduling.setup()
+	if err != nil {
+		return err
+	}
+	if err := filter.setup(); err != nil {
+		return err
+	}
+	if err := serveMetrics(*metricsAddr); err != nil {
+		return err
+	}
+	health := &daemonHealth{stale: *stale}
+	if err := health.serve(*healthAddr); err != nil {
+		return err
+	}
+
+	output, err := openSinks(&mqttSink, &influxSink, *dbPath, *udpAddr)
+	if err != nil {
+		return err
+	}
+	if *alerts != "" {
+		a, err := newAlertOutput(*alerts, sinkMQTTClient(output), &mqttSink)
+		if err != nil {
+			output.close()
+			return err
+		}
+		output = append(output, a)
+	}
+	if *format != "" {
+		o, err := openScanOutput(*format, *outFile, false, &rotation)
+		if err != nil {
+			output.close()
+			return err
+		}
+		output = append(output, o)
+	}
+	var cache *dedupCache
+	if *dedup > 0 {
+		cache = newDedupCache(*dedup, *dedupOnChange)
+	}
+	var cycle *cycleAggregate
+	if sched != nil {
+		cycle = newCycleAggregate()
+	}
+
+	if err := enableAdapter(); err != nil {
+		output.close()
+		return err
+	}
+	if *pidFile != "" {
+		if err := writePIDFile(*pidFile); err != nil {
+			output.close()
+			return err
+		}
+		defer os.Remove(*pidFile)
+	}
+
+	ctx, stop := shutdownContext()
+	defer stop()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			stopScan()
+		case <-done:
+		}
+	}()
+
+	pipeline := newScanPipeline(*buffer, output.write)
+	callback := func(adapter *bluetooth.Adapter, device bluetooth.ScanResult) {
+		now := scanTime()
+		health.seen(now)
+		metrics.scanCallback()
+		if !filter.match(device) {
+			return
+		}
+		var s *sighting
+		if metrics != nil {
+			// Metrics count every advertisement, before deduplication.
+			s = newSighting(device, now)
+			metrics.observe(s)
+		}
+		if cache != nil && !cache.report(device, now) {
+			return
+		}
+		if s == nil {
+			s = newSighting(device, now)
+		}
+		if cycle != nil {
+			cycle.add(s)
+		} else {
+			pipeline.push(s)
+		}
+	}
+
+	backoff := initialBackoff
+	for {
+		scanLog.Info("scanning")
+		health.scanning(true)
+		if sched != nil {
+			err = sched.scan(ctx, callback, func(start bool) bool {
+				health.cycle(start)
+				if !start {
+					cycle.flush(pipeline.push)
+				}
+				return !pipeline.failed.Load()
+			})
+		} else {
+			err = scan(callback)
+		}
+		health.scanning(false)
+		// The scan stops without an error when the daemon is stopped or
+		// a sink fails, which the pipeline reports.
+		if err == nil || ctx.Err() != nil {
+			err = nil
+			break
+		}
+		delay := jitter(backoff)
+		scanLog.Warn("scan failed, scanning again", "err", err, "in", delay.Round(time.Millisecond))
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		backoff = nextBackoff(backoff, *maxBackoff)
+	}
+	if writeErr := pipeline.close(); err == nil {
+		err = writeErr
+	}
+	if closeErr := output.close(); err == nil {
+		err = closeErr
+	}
+	if dropped := pipeline.dropped.Load(); dropped > 0 {
+		scanLog.Warn("dropped sightings, as the sinks couldn't keep up (see -buffer)", "dropped", dropped)
+	}
+	return err
+}
+
+// daemonHealth is the state that the health checks of ble daemon report.
+type daemonHealth struct {
+	stale    time.Duration
+	ready    atomic.Bool
+	between  atomic.Bool  // between the cycles of a schedule
+	started  atomic.Int64 // Unix nanoseconds when the current scan started
+	lastSeen atomic.Int64 // Unix nanoseconds of the last advertisement
+}
+
+func (h *daemonHealth) scanning(scanning bool) {
+	if scanning {
+		h.started.Store(time.Now().UnixNano())
+	}
+	h.ready.Store(scanning)
+}
+
+// cycle notes the start or end of a scan cycle. Between cycles, the daemon
+// isn't expected to receive anything.
+func (h *daemonHealth) cycle(start bool) {
+	if start {
+		h.started.Store(time.Now().UnixNano())
+	}
+	h.between.Store(!start)
+}
+
+func (h *daemonHealth) seen(now time.Time) {
+	h.lastSeen.Store(now.UnixNano())
+}
+
+// check returns why the daemon is unhealthy, or "" if it is healthy, which
+// it is unless it has been scanning for -stale without receiving an
+// advertisement in a scan (cycle). While it isn't scanning, it is starting or
+// recovering, which /readyz reports.
+func (h *daemonHealth) check(now time.Time) string {
+	if h.stale == 0 || !h.ready.Load() || h.between.Load() {
+		return ""
+	}
+	last := time.Unix(0, max(h.lastSeen.Load(), h.started.Load()))
+	if since := now.Sub(last); since > h.stale {
+		return fmt.Sprintf("no advertisements for %s", since.Round(time.Second))
+	}
+	return ""
+}
+
+// serve serves the health checks on addr, if it is not empty: /healthz
+// fails when the scan has stalled, and /readyz while the daemon isn't
+// scanning, as when it is starting or waiting to scan again after a failure.
+func (h *daemonHealth) serve(addr string) error {
+	if addr == "" {
+		return nil
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		if problem := h.check(time.Now()); problem != "" {
+			http.Error(w, problem, http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if !h.ready.Load() {
+			http.Error(w, "not scanning", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	go http.Serve(l, mux)
+	apiLog.Info("serving health checks", "url", "http://"+l.Addr().String()+"/healthz")
+	return nil
+}
+
+// writePIDFile writes the process ID to path, unless the file names a
+// process that is still running, which is most likely another daemon. A file
+// left behind by a daemon that died is replaced.
+func writePIDFile(path string) error {
+	if data, err := os.ReadFile(path); err == nil {
+		pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+		if err == nil && pid != os.Getpid() && processRunning(pid) {
+			return fmt.Errorf("%s: ble daemon is already running as process %d", path, pid)
+		}
+	}
+	return os.WriteFile(path, []byte(strconv.Itoa(os.Getpid())+"\n"), 0o644)
+}
+
+// processRunning returns whether a process exists. Where signals aren't
+// supported, as on Windows, it reports that it doesn't.
+func processRunning(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	err = p.Signal(syscall.Signal(0))
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
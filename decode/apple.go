@@ -0,0 +1,102 @@
+package decode
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Apple Continuity message types, the first byte of each TLV element in Apple
+// manufacturer data.
+var appleMessageTypes = map[byte]string{
+	0x02: "iBeacon",
+	0x03: "AirPrint",
+	0x05: "AirDrop",
+	0x06: "HomeKit",
+	0x07: "Proximity Pairing",
+	0x08: "Hey Siri",
+	0x09: "AirPlay Target",
+	0x0A: "AirPlay Source",
+	0x0B: "Magic Switch",
+	0x0C: "Handoff",
+	0x0D: "Tethering Target",
+	0x0E: "Tethering Source",
+	0x0F: "Nearby Action",
+	0x10: "Nearby Info",
+	0x12: "Find My",
+}
+
+// AppleContinuity classifies the messages in Apple manufacturer data.
+type AppleContinuity struct {
+	Messages []AppleMessage `json:"messages"`
+}
+
+// AppleMessage is a single Continuity message.
+type AppleMessage struct {
+	Type  uint8  `json:"type"`
+	Name  string `json:"name"`
+	Label string `json:"label,omitempty"` // more specific description, if known
+}
+
+// decodeAppleContinuity splits Apple manufacturer data into its Continuity
+// messages, each encoded as <type:1> <length:1> <value>.
+func decodeAppleContinuity(companyID uint16, data []byte) (*AppleContinuity, bool) {
+	if companyID != CompanyApple {
+		return nil, false
+	}
+	a := &AppleContinuity{}
+	for len(data) >= 2 {
+		messageType, length := data[0], int(data[1])
+		if len(data) < 2+length {
+			break
+		}
+		name, ok := appleMessageTypes[messageType]
+		if !ok {
+			name = fmt.Sprintf("Unknown (0x%02X)", messageType)
+		}
+		a.Messages = append(a.Messages, AppleMessage{
+			Type:  messageType,
+			Name:  name,
+			Label: appleMessageLabel(messageType, data[2:2+length]),
+		})
+		data = data[2+length:]
+	}
+	if len(a.Messages) == 0 {
+		return nil, false
+	}
+	return a, true
+}
+
+// appleMessageLabel gives a more specific description for messages that are
+// good at identifying the kind of device.
+func appleMessageLabel(messageType byte, value []byte) string {
+	switch messageType {
+	case 0x12:
+		// A full offline finding payload carries the public key and is sent
+		// by AirTags and other Find My accessories away from their owner.
+		if len(value) == 25 {
+			return "Find My accessory separated from owner"
+		}
+		return "Find My device near owner"
+	case 0x07:
+		return "AirPods or Beats"
+	case 0x10, 0x0C:
+		return "iPhone, iPad, Mac or Apple Watch"
+	}
+	return ""
+}
+
+func (a *AppleContinuity) Kind() string {
+	return "apple"
+}
+
+func (a *AppleContinuity) String() string {
+	var parts []string
+	for _, m := range a.Messages {
+		if m.Label != "" {
+			parts = append(parts, m.Name+" ("+m.Label+")")
+		} else {
+			parts = append(parts, m.Name)
+		}
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,233 @@
+package decode
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"tinygo.org/x/bluetooth"
+)
+
+var bthomeUUID = bluetooth.New16BitUUID(0xFCD2)
+
+// BTHome is a decoded BTHome v2 service data frame. See https://bthome.io/format/.
+type BTHome struct {
+	Encrypted    bool          `json:"encrypted"`
+	TriggerBased bool          `json:"trigger_based"`
+	PacketID     *int          `json:"packet_id,omitempty"`
+	Values       []Measurement `json:"measurements"`
+
+	// Error is set when the payload couldn't be decrypted or was only
+	// partially decoded.
+	Error string `json:"error,omitempty"`
+}
+
+func (b *BTHome) Kind() string {
+	return "bthome"
+}
+
+func (b *BTHome) String() string {
+	s := formatMeasurements(b.Values)
+	if b.Error != "" {
+		s += " (" + b.Error + ")"
+	}
+	return s
+}
+
+func (b *BTHome) DecodeError() string {
+	return b.Error
+}
+
+func (b *BTHome) Measurements() []Measurement {
+	return b.Values
+}
+
+// bthomeObject describes how to decode a BTHome object ID.
+type bthomeObject struct {
+	name   string
+	size   int
+	signed bool
+	factor float64
+	unit   string
+}
+
+// bthomeObjects lists the object IDs of the BTHome v2 format. Objects with
+// unknown IDs can't be skipped (their size isn't known), so decoding stops
+// at the first one.
+var bthomeObjects = map[byte]bthomeObject{
+	0x01: {"battery", 1, false, 1, "%"},
+	0x02: {"temperature", 2, true, 0.01, "°C"},
+	0x03: {"humidity", 2, false, 0.01, "%"},
+	0x04: {"pressure", 3, false, 0.01, "hPa"},
+	0x05: {"illuminance", 3, false, 0.01, "lx"},
+	0x06: {"mass", 2, false, 0.01, "kg"},
+	0x07: {"mass", 2, false, 0.01, "lb"},
+	0x08: {"dewpoint", 2, true, 0.01, "°C"},
+	0x09: {"count", 1, false, 1, ""},
+	0x0A: {"energy", 3, false, 0.001, "kWh"},
+	0x0B: {"power", 3, false, 0.01, "W"},
+	0x0C: {"voltage", 2, false, 0.001, "V"},
+	0x0D: {"pm2_5", 2, false, 1, "µg/m³"},
+	0x0E: {"pm10", 2, false, 1, "µg/m³"},
+	0x0F: {"generic_boolean", 1, false, 1, ""},
+	0x10: {"power_on", 1, false, 1, ""},
+	0x11: {"opening", 1, false, 1, ""},
+	0x12: {"co2", 2, false, 1, "ppm"},
+	0x13: {"tvoc", 2, false, 1, "µg/m³"},
+	0x14: {"moisture", 2, false, 0.01, "%"},
+	0x15: {"battery_low", 1, false, 1, ""},
+	0x16: {"battery_charging", 1, false, 1, ""},
+	0x17: {"carbon_monoxide", 1, false, 1, ""},
+	0x18: {"cold", 1, false, 1, ""},
+	0x19: {"connectivity", 1, false, 1, ""},
+	0x1A: {"door", 1, false, 1, ""},
+	0x1B: {"garage_door", 1, false, 1, ""},
+	0x1C: {"gas", 1, false, 1, ""},
+	0x1D: {"heat", 1, false, 1, ""},
+	0x1E: {"light", 1, false, 1, ""},
+	0x1F: {"lock", 1, false, 1, ""},
+	0x20: {"moisture_detected", 1, false, 1, ""},
+	0x21: {"motion", 1, false, 1, ""},
+	0x22: {"moving", 1, false, 1, ""},
+	0x23: {"occupancy", 1, false, 1, ""},
+	0x24: {"plug", 1, false, 1, ""},
+	0x25: {"presence", 1, false, 1, ""},
+	0x26: {"problem", 1, false, 1, ""},
+	0x27: {"running", 1, false, 1, ""},
+	0x28: {"safety", 1, false, 1, ""},
+	0x29: {"smoke", 1, false, 1, ""},
+	0x2A: {"sound", 1, false, 1, ""},
+	0x2B: {"tamper", 1, false, 1, ""},
+	0x2C: {"vibration", 1, false, 1, ""},
+	0x2D: {"window", 1, false, 1, ""},
+	0x2E: {"humidity", 1, false, 1, "%"},
+	0x2F: {"moisture", 1, false, 1, "%"},
+	0x3A: {"button", 1, false, 1, ""},
+	0x3C: {"dimmer", 2, false, 1, ""},
+	0x3D: {"count", 2, false, 1, ""},
+	0x3E: {"count", 4, false, 1, ""},
+	0x3F: {"rotation", 2, true, 0.1, "°"},
+	0x40: {"distance", 2, false, 1, "mm"},
+	0x41: {"distance", 2, false, 0.1, "m"},
+	0x42: {"duration", 3, false, 0.001, "s"},
+	0x43: {"current", 2, false, 0.001, "A"},
+	0x44: {"speed", 2, false, 0.01, "m/s"},
+	0x45: {"temperature", 2, true, 0.1, "°C"},
+	0x46: {"uv_index", 1, false, 0.1, ""},
+	0x47: {"volume", 2, false, 0.1, "L"},
+	0x48: {"volume", 2, false, 1, "mL"},
+	0x49: {"volume_flow_rate", 2, false, 0.001, "m³/h"},
+	0x4A: {"voltage", 2, false, 0.1, "V"},
+	0x4B: {"gas", 3, false, 0.001, "m³"},
+	0x4C: {"gas", 4, false, 0.001, "m³"},
+	0x4D: {"energy", 4, false, 0.001, "kWh"},
+	0x4E: {"volume", 4, false, 0.001, "L"},
+	0x4F: {"water", 4, false, 0.001, "L"},
+	0x50: {"timestamp", 4, false, 1, "s"},
+	0x51: {"acceleration", 2, false, 0.001, "m/s²"},
+	0x52: {"gyroscope", 2, false, 0.001, "°/s"},
+	0x55: {"volume_storage", 4, false, 0.001, "L"},
+	0x56: {"conductivity", 2, false, 1, "µS/cm"},
+	0x57: {"temperature", 1, true, 1, "°C"},
+	0x58: {"temperature", 1, true, 0.35, "°C"},
+	0x59: {"count", 1, true, 1, ""},
+	0x5A: {"count", 2, true, 1, ""},
+	0x5B: {"count", 4, true, 1, ""},
+	0x5C: {"power", 4, true, 0.01, "W"},
+	0x5D: {"current", 2, true, 0.001, "A"},
+	0x5E: {"direction", 2, false, 0.01, "°"},
+	0x5F: {"precipitation", 2, false, 0.1, "mm"},
+	0x60: {"channel", 1, false, 1, ""},
+	0x61: {"rotational_speed", 2, false, 1, "rpm"},
+	0xF0: {"device_type_id", 2, false, 1, ""},
+	0xF1: {"firmware_version", 4, false, 1, ""},
+	0xF2: {"firmware_version", 3, false, 1, ""},
+}
+
+// decodeBTHome decodes BTHome v2 service data (UUID 0xFCD2). Encrypted
+// payloads are decrypted with the key from -bthome-key, if there is one.
+func decodeBTHome(addr string, uuid bluetooth.UUID, data []byte) (*BTHome, bool) {
+	if uuid != bthomeUUID || len(data) < 1 {
+		return nil, false
+	}
+	info := data[0]
+	if info>>5 != 2 {
+		return nil, false // only version 2 is supported
+	}
+	b := &BTHome{
+		Encrypted:    info&0x01 != 0,
+		TriggerBased: info&0x04 != 0,
+	}
+	objects := data[1:]
+	if b.Encrypted {
+		key, ok := BTHomeKeys[addr]
+		if !ok {
+			b.Error = "encrypted, no key"
+			return b, true
+		}
+		// <ciphertext> <counter:4> <mic:4>
+		if len(objects) < 8 {
+			b.Error = "encrypted payload too short"
+			return b, true
+		}
+		ciphertext := objects[:len(objects)-8]
+		counter := objects[len(objects)-8 : len(objects)-4]
+		mic := objects[len(objects)-4:]
+		nonce := append(macBytes(addr), 0xD2, 0xFC, info)
+		nonce = append(nonce, counter...)
+		plaintext, err := ccmOpen(key, nonce, ciphertext, mic, nil)
+		if err != nil {
+			b.Error = "decryption failed"
+			return b, true
+		}
+		objects = plaintext
+	}
+
+	for len(objects) > 0 {
+		id := objects[0]
+		objects = objects[1:]
+		if id == 0x00 { // packet ID
+			if len(objects) < 1 {
+				break
+			}
+			b.PacketID = ptr(int(objects[0]))
+			objects = objects[1:]
+			continue
+		}
+		if id == 0x53 || id == 0x54 { // text and raw: length prefixed
+			if len(objects) < 1 || len(objects) < 1+int(objects[0]) {
+				b.Error = "truncated object"
+				break
+			}
+			objects = objects[1+int(objects[0]):]
+			continue
+		}
+		object, ok := bthomeObjects[id]
+		if !ok {
+			b.Error = fmt.Sprintf("unknown object ID 0x%02X", id)
+			break
+		}
+		if len(objects) < object.size {
+			b.Error = "truncated object"
+			break
+		}
+		b.Values = append(b.Values, Measurement{
+			Name:  object.name,
+			Value: float64(readInt(objects[:object.size], object.signed)) * object.factor,
+			Unit:  object.unit,
+		})
+		objects = objects[object.size:]
+	}
+	return b, true
+}
+
+// readInt reads a little-endian integer of 1 to 4 bytes.
+func readInt(b []byte, signed bool) int64 {
+	var buf [8]byte
+	copy(buf[:], b)
+	v := binary.LittleEndian.Uint64(buf[:])
+	if signed {
+		shift := 64 - 8*len(b)
+		return int64(v<<shift) >> shift
+	}
+	return int64(v)
+}
@@ -0,0 +1,69 @@
+package decode
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/subtle"
+	"errors"
+)
+
+var errCCMAuth = errors.New("ccm: message authentication failed")
+
+// ccmOpen decrypts and authenticates a message encrypted with AES-CCM (RFC
+// 3610), as used by several encrypted advertisement formats. The standard
+// library doesn't implement CCM. The nonce must be 7 to 13 bytes long.
+func ccmOpen(key, nonce, ciphertext, tag, aad []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) < 7 || len(nonce) > 13 {
+		return nil, errors.New("ccm: invalid nonce length")
+	}
+	if len(tag) < 4 || len(tag) > 16 || len(tag)%2 != 0 {
+		return nil, errors.New("ccm: invalid tag length")
+	}
+	l := 15 - len(nonce) // size of the length field
+
+	// Decrypt with CTR mode. Counter block 0 is reserved for the tag.
+	var ctr [16]byte
+	ctr[0] = byte(l - 1)
+	copy(ctr[1:], nonce)
+	var s0 [16]byte
+	block.Encrypt(s0[:], ctr[:])
+	ctr[15] = 1
+	plaintext := make([]byte, len(ciphertext))
+	cipher.NewCTR(block, ctr[:]).XORKeyStream(plaintext, ciphertext)
+
+	// Compute the CBC-MAC over the header, additional data and plaintext.
+	var b [16]byte
+	b[0] = byte(len(tag)-2)/2<<3 | byte(l-1)
+	if len(aad) > 0 {
+		b[0] |= 0x40
+	}
+	copy(b[1:], nonce)
+	for i, n := 15, len(plaintext); i > len(nonce); i, n = i-1, n>>8 {
+		b[i] = byte(n)
+	}
+	var mac [16]byte
+	block.Encrypt(mac[:], b[:])
+	update := func(data []byte) {
+		for len(data) > 0 {
+			n := subtle.XORBytes(mac[:], mac[:], data)
+			block.Encrypt(mac[:], mac[:])
+			data = data[n:]
+		}
+	}
+	if len(aad) > 0 {
+		// Only short additional data (< 0xFF00 bytes) is supported.
+		update(append([]byte{byte(len(aad) >> 8), byte(len(aad))}, aad...))
+	}
+	update(plaintext)
+
+	var expected [16]byte
+	subtle.XORBytes(expected[:], mac[:], s0[:])
+	if subtle.ConstantTimeCompare(expected[:len(tag)], tag) != 1 {
+		return nil, errCCMAuth
+	}
+	return plaintext, nil
+}
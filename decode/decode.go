@@ -0,0 +1,87 @@
+// Package decode decodes the advertisements of common beacons and sensors,
+// and the values of standard characteristics.
+package decode
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"tinygo.org/x/bluetooth"
+)
+
+// Frame is a decoded part of an advertisement, such as an iBeacon frame.
+type Frame interface {
+	// Kind names the frame format, e.g. "ibeacon". It is used as the key in
+	// structured output.
+	Kind() string
+
+	// String returns a short human-readable description of the frame.
+	String() string
+}
+
+// Advertisement is the part of an advertisement that frames are decoded
+// from.
+type Advertisement struct {
+	// Address is the address of the advertiser in the usual
+	// 11:22:33:44:55:66 notation, to look up decryption keys.
+	Address          string
+	ManufacturerData []bluetooth.ManufacturerDataElement
+	ServiceData      []bluetooth.ServiceDataElement
+
+	// Length is the length of the advertising data in bytes, at most 31
+	// for legacy advertisements and up to 1650 for the extended
+	// advertisements of Bluetooth 5.
+	Length int
+}
+
+// Frames decodes everything the enabled decoders recognize in an
+// advertisement.
+func Frames(a Advertisement) []Frame {
+	var frames []Frame
+	for _, element := range a.ManufacturerData {
+		frames = decodeElement(frames, Element{Address: a.Address, Manufacturer: true, CompanyID: element.CompanyID, Data: element.Data, AdvertisementLength: a.Length})
+	}
+	for _, element := range a.ServiceData {
+		frames = decodeElement(frames, Element{Address: a.Address, UUID: element.UUID, Data: element.Data, AdvertisementLength: a.Length})
+	}
+	return frames
+}
+
+// formatUUID formats 16 big-endian bytes in the usual 8-4-4-4-12 notation.
+func formatUUID(b []byte) string {
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// Measurement is a single sensor value decoded from an advertisement.
+type Measurement struct {
+	Name  string  `json:"name"` // e.g. "temperature"
+	Value float64 `json:"value"`
+	Unit  string  `json:"unit,omitempty"` // e.g. "°C"
+}
+
+func (m Measurement) String() string {
+	return strconv.FormatFloat(m.Value, 'f', -1, 64) + m.Unit
+}
+
+// SensorFrame is a frame that carries sensor measurements.
+type SensorFrame interface {
+	Frame
+	Measurements() []Measurement
+}
+
+// FailableFrame is a frame that was recognized but could only be partly
+// decoded, e.g. because it is encrypted with an unknown key.
+type FailableFrame interface {
+	Frame
+	DecodeError() string // empty if decoding succeeded
+}
+
+// formatMeasurements formats measurements as space separated name=value pairs.
+func formatMeasurements(measurements []Measurement) string {
+	var parts []string
+	for _, m := range measurements {
+		parts = append(parts, m.Name+"="+m.String())
+	}
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,263 @@
+package decode
+
+import (
+	"bufio"
+	"cmp"
+	"encoding/hex"
+	"encoding/json"
+	"maps"
+	"math"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"example.com/m/ad"
+	"tinygo.org/x/bluetooth"
+)
+
+const fuzzAddress = "A4:C1:38:8D:3A:01"
+
+// readCorpus reads the payloads of the ad package's testdata/payloads.txt.
+func readCorpus(tb testing.TB, path string) [][]byte {
+	tb.Helper()
+	var payloads [][]byte
+	for _, p := range readNamedCorpus(tb, path) {
+		payloads = append(payloads, p.payload)
+	}
+	return payloads
+}
+
+// namedPayload is a payload of the corpus with the name its comment gives it.
+type namedPayload struct {
+	name    string
+	payload []byte
+}
+
+func readNamedCorpus(tb testing.TB, path string) []namedPayload {
+	tb.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer f.Close()
+	var payloads []namedPayload
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line, name, _ := strings.Cut(scanner.Text(), "#")
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		payload, err := hex.DecodeString(line)
+		if err != nil {
+			tb.Fatalf("%s: %q: %v", path, line, err)
+		}
+		payloads = append(payloads, namedPayload{strings.TrimSpace(name), payload})
+	}
+	if err := scanner.Err(); err != nil {
+		tb.Fatal(err)
+	}
+	return payloads
+}
+
+// checkFrames uses everything a scan's outputs use of the frames.
+func checkFrames(t *testing.T, frames []Frame) {
+	t.Helper()
+	for _, f := range frames {
+		_ = f.Kind()
+		_ = f.String()
+		if s, ok := f.(SensorFrame); ok {
+			for _, m := range s.Measurements() {
+				_ = m.String()
+			}
+		}
+		if e, ok := f.(FailableFrame); ok {
+			_ = e.DecodeError()
+		}
+		if _, err := json.Marshal(f); err != nil {
+			t.Errorf("%s frame: %v", f.Kind(), err)
+		}
+	}
+}
+
+// setFuzzKeys has the encrypted formats decrypt with a key, so that their
+// decryption is fuzzed as well.
+func setFuzzKeys(tb testing.TB) {
+	for _, keys := range []DeviceKeys{BTHomeKeys, MiBeaconKeys} {
+		if err := keys.Set(fuzzAddress + "=231d39c1d7cc1ab1aee224cd096db932"); err != nil {
+			tb.Fatal(err)
+		}
+	}
+}
+
+// TestKnownAdvertisements decodes payloads of the corpus whose values are
+// known, worked out by hand from the specifications of their formats or
+// published with them.
+func TestKnownAdvertisements(t *testing.T) {
+	setFuzzKeys(t)
+	if err := BTHomeKeys.Set("54:48:E6:8F:80:A5=231d39c1d7cc1ab1aee224cd096db932"); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string // in the corpus
+		address string // fuzzAddress if empty
+		want    Frame
+	}{
+		{"iBeacon", "", &IBeacon{UUID: "fda50693-a4e2-4fb1-afcf-c6eb07647825", Major: 10001, Minor: 19641, MeasuredPower: -59}},
+		{"Eddystone-UID", "", &EddystoneUID{TxPower: -24, Namespace: "edd5ad1e0b6e6d3b1a00", Instance: "000000000001"}},
+		{"Eddystone-URL", "", &EddystoneURL{TxPower: -21, URL: "https://example.com"}},
+		{"Eddystone-TLM", "", &EddystoneTLM{BatteryVoltage: 3000, Temperature: ptr(24.5), AdvertisementCount: 1234, Uptime: 66600 * time.Millisecond}},
+		{"RuuviTag RAWv2", "", &RuuviTag{
+			Temperature:   ptr(24.3),
+			Humidity:      ptr(53.49),
+			Pressure:      ptr(1000.44),
+			AccelerationX: ptr(0.004),
+			AccelerationY: ptr(-0.004),
+			AccelerationZ: ptr(1.036),
+			Battery:       ptr(2.977),
+			TxPower:       ptr(4),
+			Movement:      ptr(66),
+			Sequence:      ptr(205),
+			MAC:           "CB:B8:33:4C:88:4F",
+		}},
+		{"BTHome v2 temperature and humidity", "", &BTHome{Values: []Measurement{
+			{Name: "temperature", Value: 25, Unit: "°C"},
+			{Name: "humidity", Value: 50.55, Unit: "%"},
+		}}},
+		{"BTHome v2 encrypted temperature and humidity", "54:48:E6:8F:80:A5", &BTHome{Encrypted: true, Values: []Measurement{
+			{Name: "temperature", Value: 25.06, Unit: "°C"},
+			{Name: "humidity", Value: 50.55, Unit: "%"},
+		}}},
+		{"MiBeacon temperature", "", &MiBeacon{ProductID: 0x01aa, Counter: 218, Values: []Measurement{
+			{Name: "temperature", Value: 22, Unit: "°C"},
+			{Name: "humidity", Value: 54.9, Unit: "%"},
+		}}},
+		{"MiBeacon v5 encrypted temperature", "", &MiBeacon{ProductID: 0x055b, Counter: 0x32, Encrypted: true, Values: []Measurement{
+			{Name: "temperature", Value: 22, Unit: "°C"},
+		}}},
+		{"Govee H5075", "", &Govee{Model: "H5075", Temperature: 24.3, Humidity: 15.1, Battery: 100}},
+	}
+	corpus := make(map[string][]byte)
+	for _, p := range readNamedCorpus(t, "../ad/testdata/payloads.txt") {
+		corpus[p.name] = p.payload
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload, ok := corpus[tt.name]
+			if !ok {
+				t.Fatalf("no payload named %q in the corpus", tt.name)
+			}
+			p, err := ad.Parse(payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			frames := Frames(Advertisement{
+				Address:          cmp.Or(tt.address, fuzzAddress),
+				ManufacturerData: p.ManufacturerData(),
+				ServiceData:      p.ServiceData(),
+				Length:           len(payload),
+			})
+			i := slices.IndexFunc(frames, func(f Frame) bool { return f.Kind() == tt.want.Kind() })
+			if i < 0 {
+				t.Fatalf("no %s frame in %d frames", tt.want.Kind(), len(frames))
+			}
+			got, want := jsonValue(t, frames[i]), jsonValue(t, tt.want)
+			if !closeEnough(got, want) {
+				t.Errorf("got %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+// jsonValue returns a frame as the outputs see it, decoded from its JSON.
+func jsonValue(t *testing.T, f Frame) any {
+	t.Helper()
+	b, err := json.Marshal(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v any
+	if err := json.Unmarshal(b, &v); err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+// closeEnough reports whether two decoded JSON values are equal, but for
+// the rounding errors of scaling fixed-point numbers.
+func closeEnough(a, b any) bool {
+	switch a := a.(type) {
+	case float64:
+		b, ok := b.(float64)
+		return ok && math.Abs(a-b) <= 1e-9*max(1, math.Abs(b))
+	case []any:
+		b, ok := b.([]any)
+		return ok && slices.EqualFunc(a, b, closeEnough)
+	case map[string]any:
+		b, ok := b.(map[string]any)
+		return ok && maps.EqualFunc(a, b, closeEnough)
+	}
+	return a == b
+}
+
+// FuzzAdvertisement decodes whole advertisements, parsed as a scan does.
+func FuzzAdvertisement(f *testing.F) {
+	for _, payload := range readCorpus(f, "../ad/testdata/payloads.txt") {
+		f.Add(payload)
+	}
+	setFuzzKeys(f)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		p, _ := ad.Parse(data)
+		checkFrames(t, Frames(Advertisement{
+			Address:          fuzzAddress,
+			ManufacturerData: p.ManufacturerData(),
+			ServiceData:      p.ServiceData(),
+			Length:           len(data),
+		}))
+	})
+}
+
+// FuzzElement decodes single manufacturer and service data elements with
+// every decoder, so that the fuzzer doesn't have to find the AD structure
+// around them.
+func FuzzElement(f *testing.F) {
+	for _, payload := range readCorpus(f, "../ad/testdata/payloads.txt") {
+		p, _ := ad.Parse(payload)
+		for _, element := range p.ManufacturerData() {
+			f.Add(true, element.CompanyID, element.Data)
+		}
+		for _, element := range p.ServiceData() {
+			if element.UUID.Is16Bit() {
+				f.Add(false, element.UUID.Get16Bit(), element.Data)
+			}
+		}
+	}
+	setFuzzKeys(f)
+	f.Fuzz(func(t *testing.T, manufacturer bool, id uint16, data []byte) {
+		a := Advertisement{Address: fuzzAddress, Length: len(data) + 4}
+		if manufacturer {
+			a.ManufacturerData = []bluetooth.ManufacturerDataElement{{CompanyID: id, Data: data}}
+		} else {
+			a.ServiceData = []bluetooth.ServiceDataElement{{UUID: bluetooth.New16BitUUID(id), Data: data}}
+		}
+		checkFrames(t, Frames(a))
+	})
+}
+
+func FuzzCharacteristic(f *testing.F) {
+	f.Add(uint16(0x2a6e), []byte{0xc4, 0x09})
+	f.Add(uint16(0x2a6d), []byte{0x10, 0x75, 0x0f, 0x00})
+	f.Add(uint16(0x2a37), []byte{0x16, 0x48, 0x03, 0x02})
+	f.Fuzz(func(t *testing.T, uuid uint16, value []byte) {
+		if m, ok := Characteristic(bluetooth.New16BitUUID(uuid), value); ok {
+			_ = m.String()
+		}
+		if hr, err := ParseHeartRate(value); err == nil {
+			if _, err := json.Marshal(hr); err != nil {
+				t.Error(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,201 @@
+package decode
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"tinygo.org/x/bluetooth"
+)
+
+// EddystoneUUID is the service UUID of Eddystone frames.
+var EddystoneUUID = bluetooth.New16BitUUID(0xFEAA)
+
+// Eddystone frame types, the first byte of the service data.
+const (
+	eddystoneUID = 0x00
+	eddystoneURL = 0x10
+	eddystoneTLM = 0x20
+)
+
+// EddystoneUID is a decoded Eddystone-UID frame.
+type EddystoneUID struct {
+	TxPower   int8   `json:"tx_power"` // at 0 m, in dBm
+	Namespace string `json:"namespace"`
+	Instance  string `json:"instance"`
+}
+
+func (f *EddystoneUID) Kind() string {
+	return "eddystone-uid"
+}
+
+func (f *EddystoneUID) String() string {
+	return fmt.Sprintf("namespace=%s instance=%s tx=%ddBm", f.Namespace, f.Instance, f.TxPower)
+}
+
+// EddystoneURL is a decoded Eddystone-URL frame.
+type EddystoneURL struct {
+	TxPower int8   `json:"tx_power"` // at 0 m, in dBm
+	URL     string `json:"url"`
+}
+
+func (f *EddystoneURL) Kind() string {
+	return "eddystone-url"
+}
+
+func (f *EddystoneURL) String() string {
+	return fmt.Sprintf("url=%s tx=%ddBm", f.URL, f.TxPower)
+}
+
+// EddystoneTLM is a decoded unencrypted Eddystone-TLM frame.
+type EddystoneTLM struct {
+	BatteryVoltage uint16 `json:"battery_mv"` // 0 if not supported
+
+	// Temperature in °C. Nil if the beacon doesn't support it.
+	Temperature *float64 `json:"temperature,omitempty"`
+
+	AdvertisementCount uint32        `json:"adv_count"`
+	Uptime             time.Duration `json:"uptime_ns"`
+}
+
+func (f *EddystoneTLM) Kind() string {
+	return "eddystone-tlm"
+}
+
+func (f *EddystoneTLM) String() string {
+	temperature := "n/a"
+	if f.Temperature != nil {
+		temperature = fmt.Sprintf("%.2f°C", *f.Temperature)
+	}
+	return fmt.Sprintf("battery=%dmV temp=%s adv=%d uptime=%s", f.BatteryVoltage, temperature, f.AdvertisementCount, f.Uptime)
+}
+
+var eddystoneURLSchemes = []string{"http://www.", "https://www.", "http://", "https://"}
+
+var eddystoneURLExpansions = []string{
+	".com/", ".org/", ".edu/", ".net/", ".info/", ".biz/", ".gov/",
+	".com", ".org", ".edu", ".net", ".info", ".biz", ".gov",
+}
+
+// decodeEddystone decodes Eddystone service data (UUID 0xFEAA).
+func decodeEddystone(uuid bluetooth.UUID, data []byte) (Frame, bool) {
+	if uuid != EddystoneUUID || len(data) < 2 {
+		return nil, false
+	}
+	switch data[0] {
+	case eddystoneUID:
+		if len(data) < 18 {
+			return nil, false
+		}
+		return &EddystoneUID{
+			TxPower:   int8(data[1]),
+			Namespace: fmt.Sprintf("%x", data[2:12]),
+			Instance:  fmt.Sprintf("%x", data[12:18]),
+		}, true
+	case eddystoneURL:
+		if len(data) < 3 || int(data[2]) >= len(eddystoneURLSchemes) {
+			return nil, false
+		}
+		var url strings.Builder
+		url.WriteString(eddystoneURLSchemes[data[2]])
+		for _, c := range data[3:] {
+			if int(c) < len(eddystoneURLExpansions) {
+				url.WriteString(eddystoneURLExpansions[c])
+			} else if c > 0x20 && c < 0x7f {
+				url.WriteByte(c)
+			} else {
+				return nil, false
+			}
+		}
+		return &EddystoneURL{TxPower: int8(data[1]), URL: url.String()}, true
+	case eddystoneTLM:
+		// Only version 0 (unencrypted) TLM frames can be decoded.
+		if len(data) < 14 || data[1] != 0 {
+			return nil, false
+		}
+		f := &EddystoneTLM{
+			BatteryVoltage:     binary.BigEndian.Uint16(data[2:4]),
+			AdvertisementCount: binary.BigEndian.Uint32(data[6:10]),
+			Uptime:             time.Duration(binary.BigEndian.Uint32(data[10:14])) * 100 * time.Millisecond,
+		}
+		// Signed 8.8 fixed point, 0x8000 means not supported.
+		if raw := binary.BigEndian.Uint16(data[4:6]); raw != 0x8000 {
+			temperature := float64(int16(raw)) / 256
+			f.Temperature = &temperature
+		}
+		return f, true
+	}
+	return nil, false
+}
+
+// EncodeEddystoneURL builds the service data of an Eddystone-URL frame, using
+// the scheme and expansion codes to compress the URL.
+func EncodeEddystoneURL(url string, txPower int8) ([]byte, error) {
+	data := []byte{eddystoneURL, byte(txPower)}
+	scheme := -1
+	for i, prefix := range eddystoneURLSchemes {
+		if strings.HasPrefix(url, prefix) {
+			scheme = i
+			url = url[len(prefix):]
+			break
+		}
+	}
+	if scheme < 0 {
+		return nil, fmt.Errorf("URL must start with one of %s", strings.Join(eddystoneURLSchemes, ", "))
+	}
+	data = append(data, byte(scheme))
+
+next:
+	for len(url) > 0 {
+		for i, expansion := range eddystoneURLExpansions {
+			if strings.HasPrefix(url, expansion) {
+				data = append(data, byte(i))
+				url = url[len(expansion):]
+				continue next
+			}
+		}
+		if c := url[0]; c <= 0x20 || c >= 0x7f {
+			return nil, fmt.Errorf("URL contains a character that can't be encoded: %q", c)
+		}
+		data = append(data, url[0])
+		url = url[1:]
+	}
+	// The encoded URL can be at most 17 bytes.
+	if len(data) > 3+17 {
+		return nil, fmt.Errorf("URL is %d bytes too long, even after compression", len(data)-3-17)
+	}
+	return data, nil
+}
+
+// Encode builds the service data of the Eddystone-UID frame, from a namespace
+// of 10 bytes and an instance of 6 bytes in hex.
+func (f *EddystoneUID) Encode() ([]byte, error) {
+	namespace, err := hex.DecodeString(f.Namespace)
+	if err != nil || len(namespace) != 10 {
+		return nil, fmt.Errorf("invalid namespace %q, expected 10 bytes in hex", f.Namespace)
+	}
+	instance, err := hex.DecodeString(f.Instance)
+	if err != nil || len(instance) != 6 {
+		return nil, fmt.Errorf("invalid instance %q, expected 6 bytes in hex", f.Instance)
+	}
+	data := append([]byte{eddystoneUID, byte(f.TxPower)}, namespace...)
+	data = append(data, instance...)
+	// Reserved for future use.
+	return append(data, 0, 0), nil
+}
+
+// Encode builds the service data of the unencrypted Eddystone-TLM frame.
+func (f *EddystoneTLM) Encode() []byte {
+	data := []byte{eddystoneTLM, 0}
+	data = binary.BigEndian.AppendUint16(data, f.BatteryVoltage)
+	temperature := uint16(0x8000)
+	if f.Temperature != nil {
+		temperature = uint16(int16(math.Round(min(max(*f.Temperature, -128), 127.99) * 256)))
+	}
+	data = binary.BigEndian.AppendUint16(data, temperature)
+	data = binary.BigEndian.AppendUint32(data, f.AdvertisementCount)
+	return binary.BigEndian.AppendUint32(data, uint32(f.Uptime/(100*time.Millisecond)))
+}
@@ -0,0 +1,45 @@
+package decode
+
+import (
+	"encoding/binary"
+
+	"tinygo.org/x/bluetooth"
+)
+
+// essCharacteristics decode the characteristics of the Environmental Sensing
+// Service, as defined in the GATT Specification Supplement. Values outside of
+// what the specification allows, or the "value is not known" value, don't
+// decode.
+var essCharacteristics = map[bluetooth.UUID]func([]byte) (Measurement, bool){
+	// Temperature: sint16 in 0.01 °C.
+	bluetooth.New16BitUUID(0x2A6E): func(b []byte) (Measurement, bool) {
+		if len(b) != 2 || b[0] == 0x00 && b[1] == 0x80 {
+			return Measurement{}, false
+		}
+		return Measurement{"temperature", float64(int16(binary.LittleEndian.Uint16(b))) / 100, "°C"}, true
+	},
+	// Humidity: uint16 in 0.01 %.
+	bluetooth.New16BitUUID(0x2A6F): func(b []byte) (Measurement, bool) {
+		if len(b) != 2 || b[0] == 0xFF && b[1] == 0xFF {
+			return Measurement{}, false
+		}
+		return Measurement{"humidity", float64(binary.LittleEndian.Uint16(b)) / 100, "%"}, true
+	},
+	// Pressure: uint32 in 0.1 Pa, converted to hPa like the advertised
+	// sensor values.
+	bluetooth.New16BitUUID(0x2A6D): func(b []byte) (Measurement, bool) {
+		if len(b) != 4 {
+			return Measurement{}, false
+		}
+		return Measurement{"pressure", float64(binary.LittleEndian.Uint32(b)) / 1000, "hPa"}, true
+	},
+}
+
+// Characteristic decodes the value of a characteristic with a known
+// format.
+func Characteristic(uuid bluetooth.UUID, value []byte) (Measurement, bool) {
+	if decode, ok := essCharacteristics[uuid]; ok {
+		return decode(value)
+	}
+	return Measurement{}, false
+}
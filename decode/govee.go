@@ -0,0 +1,71 @@
+package decode
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Govee thermometers advertise with this manufacturer ID, which isn't actually
+// assigned to Govee.
+const companyGovee = 0xEC88
+
+// Govee is a decoded Govee H5074/H5075 thermometer-hygrometer frame.
+type Govee struct {
+	Model       string  `json:"model"`
+	Temperature float64 `json:"temperature"` // °C
+	Humidity    float64 `json:"humidity"`    // %RH
+	Battery     int     `json:"battery"`     // %
+}
+
+// decodeGovee decodes the manufacturer data of Govee H5074 and H5075 (and the
+// H5072 which uses the same format as the H5075). The models are told apart
+// by the length of the data.
+func decodeGovee(companyID uint16, data []byte) (*Govee, bool) {
+	if companyID != companyGovee {
+		return nil, false
+	}
+	switch len(data) {
+	case 6:
+		// 00 <temperature and humidity:3 BE> <battery> 00
+		// The 24-bit value is temperature*10000 + humidity*10, with the top
+		// bit set for negative temperatures.
+		v := uint32(data[1])<<16 | uint32(data[2])<<8 | uint32(data[3])
+		negative := v&0x800000 != 0
+		v &^= 0x800000
+		temperature := float64(v/1000) / 10
+		if negative {
+			temperature = -temperature
+		}
+		return &Govee{
+			Model:       "H5075",
+			Temperature: temperature,
+			Humidity:    float64(v%1000) / 10,
+			Battery:     int(data[4]),
+		}, true
+	case 7:
+		// 00 <temperature:2 LE signed, 0.01 °C> <humidity:2 LE, 0.01 %> <battery> 02
+		return &Govee{
+			Model:       "H5074",
+			Temperature: float64(int16(binary.LittleEndian.Uint16(data[1:]))) / 100,
+			Humidity:    float64(binary.LittleEndian.Uint16(data[3:])) / 100,
+			Battery:     int(data[5]),
+		}, true
+	}
+	return nil, false
+}
+
+func (g *Govee) Kind() string {
+	return "govee"
+}
+
+func (g *Govee) String() string {
+	return fmt.Sprintf("model=%s %s", g.Model, formatMeasurements(g.Measurements()))
+}
+
+func (g *Govee) Measurements() []Measurement {
+	return []Measurement{
+		{"temperature", g.Temperature, "°C"},
+		{"humidity", g.Humidity, "%"},
+		{"battery", float64(g.Battery), "%"},
+	}
+}
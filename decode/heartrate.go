@@ -0,0 +1,81 @@
+package decode
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// HeartRateMeasurement is a Heart Rate Measurement (0x2A37) value, as defined
+// in the Heart Rate Service specification, 3.1.
+type HeartRateMeasurement struct {
+	BPM uint16 `json:"bpm"`
+	// Contact is nil if the sensor can't detect skin contact.
+	Contact        *bool     `json:"contact,omitempty"`
+	EnergyExpended *uint16   `json:"energy_expended_kj,omitempty"`
+	RRIntervals    []float64 `json:"rr_intervals_ms,omitempty"`
+}
+
+// Heart Rate Measurement flags.
+const (
+	hrFormatUint16     = 1 << 0
+	hrContactDetected  = 1 << 1
+	hrContactSupported = 1 << 2
+	hrEnergyExpended   = 1 << 3
+	hrRRIntervals      = 1 << 4
+)
+
+// ErrHeartRateTruncated is returned for a value that is too short for its flags.
+var ErrHeartRateTruncated = errors.New("truncated heart rate measurement")
+
+// ParseHeartRate decodes a Heart Rate Measurement value.
+func ParseHeartRate(b []byte) (HeartRateMeasurement, error) {
+	var m HeartRateMeasurement
+	if len(b) < 2 {
+		return m, ErrHeartRateTruncated
+	}
+	flags, b := b[0], b[1:]
+	if flags&hrFormatUint16 != 0 {
+		if len(b) < 2 {
+			return m, ErrHeartRateTruncated
+		}
+		m.BPM, b = binary.LittleEndian.Uint16(b), b[2:]
+	} else {
+		m.BPM, b = uint16(b[0]), b[1:]
+	}
+	if flags&hrContactSupported != 0 {
+		m.Contact = ptr(flags&hrContactDetected != 0)
+	}
+	if flags&hrEnergyExpended != 0 {
+		if len(b) < 2 {
+			return m, ErrHeartRateTruncated
+		}
+		m.EnergyExpended, b = ptr(binary.LittleEndian.Uint16(b)), b[2:]
+	}
+	if flags&hrRRIntervals != 0 {
+		// RR intervals are in units of 1/1024 s.
+		for ; len(b) >= 2; b = b[2:] {
+			m.RRIntervals = append(m.RRIntervals, float64(binary.LittleEndian.Uint16(b))*1000/1024)
+		}
+	}
+	return m, nil
+}
+
+func (m HeartRateMeasurement) String() string {
+	s := fmt.Sprintf("%d bpm", m.BPM)
+	if m.Contact != nil && !*m.Contact {
+		s += " (no contact)"
+	}
+	if m.EnergyExpended != nil {
+		s += fmt.Sprintf(" energy=%d kJ", *m.EnergyExpended)
+	}
+	if len(m.RRIntervals) > 0 {
+		var rr []string
+		for _, interval := range m.RRIntervals {
+			rr = append(rr, fmt.Sprintf("%.0f", interval))
+		}
+		s += " rr=" + strings.Join(rr, ",") + " ms"
+	}
+	return s
+}
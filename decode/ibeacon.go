@@ -0,0 +1,62 @@
+package decode
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// CompanyApple is the company identifier of Apple, which iBeacons use.
+const CompanyApple = 0x004C
+
+const (
+	ibeaconType   = 0x02
+	ibeaconLength = 0x15
+)
+
+// IBeacon is a decoded Apple iBeacon frame.
+type IBeacon struct {
+	UUID  string `json:"uuid"`
+	Major uint16 `json:"major"`
+	Minor uint16 `json:"minor"`
+
+	// MeasuredPower is the calibrated RSSI at 1 m, in dBm.
+	MeasuredPower int8 `json:"measured_power"`
+}
+
+// decodeIBeacon decodes Apple manufacturer data of type 0x02:
+//
+//	02 15 <uuid:16> <major:2> <minor:2> <power:1>
+func decodeIBeacon(companyID uint16, data []byte) (*IBeacon, bool) {
+	if companyID != CompanyApple || len(data) < 23 || data[0] != ibeaconType || data[1] != ibeaconLength {
+		return nil, false
+	}
+	return &IBeacon{
+		UUID:          formatUUID(data[2:18]),
+		Major:         binary.BigEndian.Uint16(data[18:20]),
+		Minor:         binary.BigEndian.Uint16(data[20:22]),
+		MeasuredPower: int8(data[22]),
+	}, true
+}
+
+func (b *IBeacon) Kind() string {
+	return "ibeacon"
+}
+
+func (b *IBeacon) String() string {
+	return fmt.Sprintf("uuid=%s major=%d minor=%d power=%ddBm", b.UUID, b.Major, b.Minor, b.MeasuredPower)
+}
+
+// Encode builds the manufacturer data of the iBeacon frame, without the
+// company ID.
+func (b *IBeacon) Encode() ([]byte, error) {
+	uuid, err := hex.DecodeString(strings.ReplaceAll(b.UUID, "-", ""))
+	if err != nil || len(uuid) != 16 {
+		return nil, fmt.Errorf("invalid proximity UUID %q", b.UUID)
+	}
+	data := append([]byte{ibeaconType, ibeaconLength}, uuid...)
+	data = binary.BigEndian.AppendUint16(data, b.Major)
+	data = binary.BigEndian.AppendUint16(data, b.Minor)
+	return append(data, byte(b.MeasuredPower)), nil
+}
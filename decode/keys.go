@@ -0,0 +1,48 @@
+package decode
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"tinygo.org/x/bluetooth"
+)
+
+// DeviceKeys maps device addresses to decryption keys for encrypted
+// advertisement formats. It implements flag.Value, accepting ADDRESS=HEXKEY.
+type DeviceKeys map[string][]byte
+
+// The keys that encrypted BTHome and MiBeacon advertisements are decrypted
+// with.
+var (
+	BTHomeKeys   = DeviceKeys{}
+	MiBeaconKeys = DeviceKeys{}
+)
+
+func (k DeviceKeys) String() string {
+	return fmt.Sprintf("%d keys", len(k))
+}
+
+func (k DeviceKeys) Set(s string) error {
+	addr, keyHex, ok := strings.Cut(s, "=")
+	if !ok {
+		return fmt.Errorf("expected ADDRESS=KEY, got %q", s)
+	}
+	mac, err := bluetooth.ParseMAC(addr)
+	if err != nil {
+		return fmt.Errorf("invalid address %q: %w", addr, err)
+	}
+	key, err := hex.DecodeString(keyHex)
+	if err != nil || len(key) != 16 {
+		return fmt.Errorf("key for %s must be 32 hex digits", addr)
+	}
+	k[mac.String()] = key
+	return nil
+}
+
+// macBytes returns the 6 bytes of an address in the order it is written in,
+// most significant byte first. This is the order used in most nonces.
+func macBytes(addr string) []byte {
+	b, _ := hex.DecodeString(strings.ReplaceAll(addr, ":", ""))
+	return b
+}
@@ -0,0 +1,46 @@
+package decode
+
+import (
+	_ "embed"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	assignednumbers "example.com/m/assigned_numbers"
+)
+
+// ManufacturerData is a manufacturer specific data element with its company
+// identifier resolved.
+type ManufacturerData struct {
+	CompanyID uint16 `json:"company_id"`
+	Company   string `json:"company,omitempty"`
+	Data      []byte `json:"-"`
+}
+
+func decodeManufacturerData(companyID uint16, data []byte) *ManufacturerData {
+	return &ManufacturerData{
+		CompanyID: companyID,
+		Company:   assignednumbers.CompanyName(companyID),
+		Data:      data,
+	}
+}
+
+func (m *ManufacturerData) Kind() string {
+	return "manufacturer"
+}
+
+func (m *ManufacturerData) String() string {
+	company := m.Company
+	if company == "" {
+		company = "unknown"
+	}
+	return fmt.Sprintf("%s (0x%04X): %x", company, m.CompanyID, m.Data)
+}
+
+func (m *ManufacturerData) MarshalJSON() ([]byte, error) {
+	type plain ManufacturerData
+	return json.Marshal(struct {
+		*plain
+		Data string `json:"data"`
+	}{(*plain)(m), hex.EncodeToString(m.Data)})
+}
@@ -0,0 +1,169 @@
+package decode
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"slices"
+
+	"tinygo.org/x/bluetooth"
+)
+
+var mibeaconUUID = bluetooth.New16BitUUID(0xFE95)
+
+// Frame control bits of a MiBeacon frame.
+const (
+	mibeaconEncrypted  = 1 << 3
+	mibeaconHasMAC     = 1 << 4
+	mibeaconHasCap     = 1 << 5
+	mibeaconHasObjects = 1 << 6
+)
+
+// MiBeacon is a decoded Xiaomi MiBeacon service data frame.
+type MiBeacon struct {
+	ProductID uint16        `json:"product_id"`
+	Counter   uint8         `json:"frame_counter"`
+	Encrypted bool          `json:"encrypted"`
+	Values    []Measurement `json:"measurements,omitempty"`
+
+	// Error is set when the objects couldn't be decrypted or decoded.
+	Error string `json:"error,omitempty"`
+}
+
+func (m *MiBeacon) Kind() string {
+	return "mibeacon"
+}
+
+func (m *MiBeacon) String() string {
+	s := fmt.Sprintf("product=0x%04X %s", m.ProductID, formatMeasurements(m.Values))
+	if m.Error != "" {
+		s += " (" + m.Error + ")"
+	}
+	return s
+}
+
+func (m *MiBeacon) DecodeError() string {
+	return m.Error
+}
+
+func (m *MiBeacon) Measurements() []Measurement {
+	return m.Values
+}
+
+// decodeMiBeacon decodes Xiaomi service data (UUID 0xFE95). Encrypted objects
+// (MiBeacon v4 and v5) are decrypted with the bind key from -mibeacon-key.
+func decodeMiBeacon(addr string, uuid bluetooth.UUID, data []byte) (*MiBeacon, bool) {
+	if uuid != mibeaconUUID || len(data) < 5 {
+		return nil, false
+	}
+	control := binary.LittleEndian.Uint16(data)
+	version := control >> 12
+	m := &MiBeacon{
+		ProductID: binary.LittleEndian.Uint16(data[2:]),
+		Counter:   data[4],
+		Encrypted: control&mibeaconEncrypted != 0,
+	}
+	header := data[:5]
+	rest := data[5:]
+
+	// The MAC is included in reverse byte order, which is also the order the
+	// nonce needs.
+	mac := macBytes(addr)
+	slices.Reverse(mac)
+	if control&mibeaconHasMAC != 0 {
+		if len(rest) < 6 {
+			return m, true
+		}
+		mac, rest = rest[:6], rest[6:]
+	}
+	if control&mibeaconHasCap != 0 {
+		if len(rest) < 1 {
+			return m, true
+		}
+		capability := rest[0]
+		rest = rest[1:]
+		if capability&0x20 != 0 { // I/O capability follows
+			if len(rest) < 2 {
+				return m, true
+			}
+			rest = rest[2:]
+		}
+	}
+	if control&mibeaconHasObjects == 0 {
+		return m, true
+	}
+
+	objects := rest
+	if m.Encrypted {
+		if version < 4 {
+			m.Error = fmt.Sprintf("encryption of MiBeacon v%d is not supported", version)
+			return m, true
+		}
+		key, ok := MiBeaconKeys[addr]
+		if !ok {
+			m.Error = "encrypted, no bind key"
+			return m, true
+		}
+		// <ciphertext> <extended counter:3> <mic:4>
+		if len(rest) < 7 {
+			m.Error = "encrypted payload too short"
+			return m, true
+		}
+		ciphertext := rest[:len(rest)-7]
+		extCounter := rest[len(rest)-7 : len(rest)-4]
+		mic := rest[len(rest)-4:]
+		nonce := slices.Concat(mac, header[2:5], extCounter)
+		plaintext, err := ccmOpen(key, nonce, ciphertext, mic, []byte{0x11})
+		if err != nil {
+			m.Error = "decryption failed"
+			return m, true
+		}
+		objects = plaintext
+	}
+
+	// Objects are <type:2> <length:1> <value>.
+	for len(objects) >= 3 {
+		objectType := binary.LittleEndian.Uint16(objects)
+		length := int(objects[2])
+		if len(objects) < 3+length {
+			m.Error = "truncated object"
+			break
+		}
+		m.Values = append(m.Values, decodeMiBeaconObject(objectType, objects[3:3+length])...)
+		objects = objects[3+length:]
+	}
+	return m, true
+}
+
+// decodeMiBeaconObject decodes the objects of common sensors. Unknown objects
+// are skipped.
+func decodeMiBeaconObject(objectType uint16, value []byte) []Measurement {
+	i16 := func(i int) float64 { return float64(int16(binary.LittleEndian.Uint16(value[i:]))) }
+	u16 := func(i int) float64 { return float64(binary.LittleEndian.Uint16(value[i:])) }
+	f32 := func() float64 { return float64(math.Float32frombits(binary.LittleEndian.Uint32(value))) }
+	switch {
+	case objectType == 0x1004 && len(value) == 2:
+		return []Measurement{{"temperature", i16(0) / 10, "°C"}}
+	case objectType == 0x1006 && len(value) == 2:
+		return []Measurement{{"humidity", u16(0) / 10, "%"}}
+	case objectType == 0x1007 && len(value) == 3:
+		return []Measurement{{"illuminance", float64(readInt(value, false)), "lx"}}
+	case objectType == 0x1008 && len(value) == 1:
+		return []Measurement{{"moisture", float64(value[0]), "%"}}
+	case objectType == 0x1009 && len(value) == 2:
+		return []Measurement{{"conductivity", u16(0), "µS/cm"}}
+	case objectType == 0x100A && len(value) == 1:
+		return []Measurement{{"battery", float64(value[0]), "%"}}
+	case objectType == 0x100D && len(value) == 4:
+		return []Measurement{{"temperature", i16(0) / 10, "°C"}, {"humidity", u16(2) / 10, "%"}}
+	case objectType == 0x4C01 && len(value) == 4:
+		return []Measurement{{"temperature", f32(), "°C"}}
+	case objectType == 0x4C02 && len(value) == 1:
+		return []Measurement{{"humidity", float64(value[0]), "%"}}
+	case objectType == 0x4C03 && len(value) == 1:
+		return []Measurement{{"battery", float64(value[0]), "%"}}
+	case objectType == 0x4C08 && len(value) == 4:
+		return []Measurement{{"humidity", f32(), "%"}}
+	}
+	return nil
+}
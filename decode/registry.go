@@ -0,0 +1,136 @@
+package decode
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+
+	"tinygo.org/x/bluetooth"
+)
+
+// Element is a manufacturer or service data element of an advertisement,
+// which frames are decoded from.
+type Element struct {
+	// Address is the address of the advertiser, as in Advertisement.
+	Address string
+
+	// Manufacturer is true for manufacturer data, which has a CompanyID,
+	// and false for service data, which has a UUID.
+	Manufacturer bool
+	CompanyID    uint16
+	UUID         bluetooth.UUID
+
+	Data []byte
+
+	// AdvertisementLength is the length of the whole advertisement, as in
+	// Advertisement.
+	AdvertisementLength int
+}
+
+// Decoder decodes a format of advertisement data. Decoders added with
+// Register are used by Frames, so that new formats can be supported from
+// other packages.
+type Decoder interface {
+	// Match reports whether the element is in the format of the decoder,
+	// as far as can be told cheaply, e.g. from its company ID.
+	Match(e Element) bool
+
+	// Decode decodes a matched element. It returns false if the element
+	// turns out not to be in the format after all, or is malformed. As
+	// the data comes from any device in range, Decode must not panic
+	// however malformed it is.
+	Decode(e Element) (Frame, bool)
+}
+
+var registry struct {
+	mu       sync.RWMutex
+	names    []string // in order of registration
+	decoders map[string]Decoder
+	disabled map[string]bool
+}
+
+// Register adds a decoder under a name, such as "ibeacon". Frames uses the
+// decoders in the order they were registered. Register panics if the name is
+// already taken; it is meant to be called from init functions.
+func Register(name string, d Decoder) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	if _, ok := registry.decoders[name]; ok {
+		panic("decode: decoder " + name + " registered twice")
+	}
+	if registry.decoders == nil {
+		registry.decoders = make(map[string]Decoder)
+		registry.disabled = make(map[string]bool)
+	}
+	registry.names = append(registry.names, name)
+	registry.decoders[name] = d
+}
+
+// Names returns the names of the registered decoders in order.
+func Names() []string {
+	registry.mu.RLock()
+	defer registry.mu.RUnlock()
+	return slices.Clone(registry.names)
+}
+
+// Enable enables or disables a registered decoder. All decoders start out
+// enabled.
+func Enable(name string, enabled bool) error {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	if _, ok := registry.decoders[name]; !ok {
+		return fmt.Errorf("unknown decoder %q (known: %s)", name, strings.Join(registry.names, ", "))
+	}
+	registry.disabled[name] = !enabled
+	return nil
+}
+
+// decodeElement decodes an element with every enabled decoder that matches.
+func decodeElement(frames []Frame, e Element) []Frame {
+	registry.mu.RLock()
+	defer registry.mu.RUnlock()
+	for _, name := range registry.names {
+		d := registry.decoders[name]
+		if registry.disabled[name] || !d.Match(e) {
+			continue
+		}
+		if f, ok := d.Decode(e); ok {
+			frames = append(frames, f)
+		}
+	}
+	return frames
+}
+
+// builtin is a Decoder of this package.
+type builtin struct {
+	match  func(e Element) bool
+	decode func(e Element) (Frame, bool)
+}
+
+func (b builtin) Match(e Element) bool           { return b.match(e) }
+func (b builtin) Decode(e Element) (Frame, bool) { return b.decode(e) }
+
+// company matches the manufacturer data of a company.
+func company(id uint16) func(e Element) bool {
+	return func(e Element) bool { return e.Manufacturer && e.CompanyID == id }
+}
+
+// service matches the service data of a service.
+func service(uuid bluetooth.UUID) func(e Element) bool {
+	return func(e Element) bool { return !e.Manufacturer && e.UUID == uuid }
+}
+
+func init() {
+	Register("manufacturer", builtin{
+		func(e Element) bool { return e.Manufacturer },
+		func(e Element) (Frame, bool) { return decodeManufacturerData(e.CompanyID, e.Data), true },
+	})
+	Register("ibeacon", builtin{company(CompanyApple), func(e Element) (Frame, bool) { return decodeIBeacon(e.CompanyID, e.Data) }})
+	Register("apple", builtin{company(CompanyApple), func(e Element) (Frame, bool) { return decodeAppleContinuity(e.CompanyID, e.Data) }})
+	Register("ruuvi", builtin{company(companyRuuvi), func(e Element) (Frame, bool) { return decodeRuuvi(e.CompanyID, e.Data) }})
+	Register("govee", builtin{company(companyGovee), func(e Element) (Frame, bool) { return decodeGovee(e.CompanyID, e.Data) }})
+	Register("eddystone", builtin{service(EddystoneUUID), func(e Element) (Frame, bool) { return decodeEddystone(e.UUID, e.Data) }})
+	Register("bthome", builtin{service(bthomeUUID), func(e Element) (Frame, bool) { return decodeBTHome(e.Address, e.UUID, e.Data) }})
+	Register("mibeacon", builtin{service(mibeaconUUID), func(e Element) (Frame, bool) { return decodeMiBeacon(e.Address, e.UUID, e.Data) }})
+}
@@ -0,0 +1,101 @@
+package decode
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+const companyRuuvi = 0x0499
+
+// RuuviTag is a decoded RuuviTag data format 5 (RAWv2) frame. Values the tag
+// reports as invalid or not available are nil.
+type RuuviTag struct {
+	Temperature   *float64 `json:"temperature,omitempty"`    // °C
+	Humidity      *float64 `json:"humidity,omitempty"`       // %RH
+	Pressure      *float64 `json:"pressure,omitempty"`       // hPa
+	AccelerationX *float64 `json:"acceleration_x,omitempty"` // g
+	AccelerationY *float64 `json:"acceleration_y,omitempty"` // g
+	AccelerationZ *float64 `json:"acceleration_z,omitempty"` // g
+	Battery       *float64 `json:"battery,omitempty"`        // V
+	TxPower       *int     `json:"tx_power,omitempty"`       // dBm
+	Movement      *int     `json:"movement_counter,omitempty"`
+	Sequence      *int     `json:"sequence,omitempty"`
+	MAC           string   `json:"mac"`
+}
+
+// decodeRuuvi decodes manufacturer data in RuuviTag data format 5. See
+// https://docs.ruuvi.com/communication/bluetooth-advertisements/data-format-5-rawv2
+func decodeRuuvi(companyID uint16, data []byte) (*RuuviTag, bool) {
+	if companyID != companyRuuvi || len(data) < 24 || data[0] != 5 {
+		return nil, false
+	}
+	i16 := func(i int) int16 { return int16(binary.BigEndian.Uint16(data[i:])) }
+	u16 := func(i int) uint16 { return binary.BigEndian.Uint16(data[i:]) }
+
+	r := &RuuviTag{MAC: fmt.Sprintf("%02X:%02X:%02X:%02X:%02X:%02X", data[18], data[19], data[20], data[21], data[22], data[23])}
+	if v := i16(1); v != -0x8000 {
+		r.Temperature = ptr(float64(v) * 0.005)
+	}
+	if v := u16(3); v != 0xFFFF {
+		r.Humidity = ptr(float64(v) * 0.0025)
+	}
+	if v := u16(5); v != 0xFFFF {
+		r.Pressure = ptr((float64(v) + 50000) / 100)
+	}
+	for i, field := range []**float64{&r.AccelerationX, &r.AccelerationY, &r.AccelerationZ} {
+		if v := i16(7 + 2*i); v != -0x8000 {
+			*field = ptr(float64(v) / 1000)
+		}
+	}
+	power := u16(13)
+	if v := power >> 5; v != 0x7FF {
+		r.Battery = ptr(float64(v+1600) / 1000)
+	}
+	if v := power & 0x1F; v != 0x1F {
+		r.TxPower = ptr(int(v)*2 - 40)
+	}
+	if v := data[15]; v != 0xFF {
+		r.Movement = ptr(int(v))
+	}
+	if v := u16(16); v != 0xFFFF {
+		r.Sequence = ptr(int(v))
+	}
+	return r, true
+}
+
+func (r *RuuviTag) Kind() string {
+	return "ruuvi"
+}
+
+func (r *RuuviTag) String() string {
+	s := formatMeasurements(r.Measurements())
+	if r.Sequence != nil {
+		s += fmt.Sprintf(" seq=%d", *r.Sequence)
+	}
+	return s
+}
+
+func (r *RuuviTag) Measurements() []Measurement {
+	var measurements []Measurement
+	add := func(name string, value *float64, unit string) {
+		if value != nil {
+			measurements = append(measurements, Measurement{name, *value, unit})
+		}
+	}
+	add("temperature", r.Temperature, "°C")
+	add("humidity", r.Humidity, "%")
+	add("pressure", r.Pressure, "hPa")
+	add("acceleration_x", r.AccelerationX, "g")
+	add("acceleration_y", r.AccelerationY, "g")
+	add("acceleration_z", r.AccelerationZ, "g")
+	// Not "battery", which is a level in % elsewhere.
+	add("battery_voltage", r.Battery, "V")
+	if r.Movement != nil {
+		measurements = append(measurements, Measurement{"movement_counter", float64(*r.Movement), ""})
+	}
+	return measurements
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
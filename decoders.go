@@ -0,0 +1,38 @@
+package main
+
+import (
+	"flag"
+	"strings"
+
+	"example.com/m/decode"
+)
+
+// decodersFlag registers the global -decoders flag.
+func decodersFlag(fs *flag.FlagSet) *string {
+	return fs.String("decoders", "", "comma separated advertisement decoders to use, or with a - prefix not to use, e.g. -mibeacon,-apple (default: all of "+strings.Join(decode.Names(), ", ")+")")
+}
+
+// setupDecoders enables the decoders given to -decoders. Naming any decoder
+// to use disables the others; naming only decoders not to use keeps the
+// others.
+func setupDecoders(spec string) error {
+	if spec == "" {
+		return nil
+	}
+	names := strings.Split(spec, ",")
+	for _, name := range names {
+		if !strings.HasPrefix(name, "-") {
+			for _, name := range decode.Names() {
+				decode.Enable(name, false)
+			}
+			break
+		}
+	}
+	for _, name := range names {
+		name, disable := strings.CutPrefix(strings.TrimSpace(name), "-")
+		if err := decode.Enable(name, !disable); err != nil {
+			return err
+		}
+	}
+	return nil
+}
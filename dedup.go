@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/fnv"
+	"sort"
+	"time"
+
+	"tinygo.org/x/bluetooth"
+)
+
+// dedupCache suppresses repeated scan results for the same address within a
+// time window. It is only used from the scan callback, so it does no locking.
+type dedupCache struct {
+	ttl      time.Duration
+	onChange bool // report again within the window when the payload changed
+	seen     map[string]dedupEntry
+	pruned   time.Time
+}
+
+type dedupEntry struct {
+	reported time.Time
+	payload  uint64
+}
+
+func newDedupCache(ttl time.Duration, onChange bool) *dedupCache {
+	return &dedupCache{
+		ttl:      ttl,
+		onChange: onChange,
+		seen:     make(map[string]dedupEntry),
+	}
+}
+
+// report returns whether the scan result should be reported, and records it
+// if so.
+func (c *dedupCache) report(result bluetooth.ScanResult, now time.Time) bool {
+	c.prune(now)
+
+	addr := result.Address.String()
+	hash := payloadHash(result)
+	entry, ok := c.seen[addr]
+	if ok && now.Sub(entry.reported) < c.ttl && (!c.onChange || entry.payload == hash) {
+		return false
+	}
+	c.seen[addr] = dedupEntry{reported: now, payload: hash}
+	return true
+}
+
+// prune drops expired entries, at most once per TTL window, so the cache
+// doesn't grow without bound in places with many short-lived addresses.
+func (c *dedupCache) prune(now time.Time) {
+	if now.Sub(c.pruned) < c.ttl {
+		return
+	}
+	c.pruned = now
+	for addr, entry := range c.seen {
+		if now.Sub(entry.reported) >= c.ttl {
+			delete(c.seen, addr)
+		}
+	}
+}
+
+// payloadHash returns a hash of the advertisement payload of a scan result.
+// The RSSI is not part of the hash. When the raw packet is not available (as on
+// Linux), the structured fields are hashed in a stable order.
+func payloadHash(result bluetooth.ScanResult) uint64 {
+	return hashPayload(result.Bytes(), result.LocalName(), result.ManufacturerData(), result.ServiceData())
+}
+
+// hashPayload hashes the raw payload of an advertisement if there is one,
+// and its structured fields otherwise.
+func hashPayload(raw []byte, localName string, manufacturerData []bluetooth.ManufacturerDataElement, serviceData []bluetooth.ServiceDataElement) uint64 {
+	h := fnv.New64a()
+	if raw != nil {
+		h.Write(raw)
+		return h.Sum64()
+	}
+
+	h.Write([]byte(localName))
+	h.Write([]byte{0})
+
+	// Sort copies: the order BlueZ reports elements in is not stable.
+	manufacturerData = append([]bluetooth.ManufacturerDataElement(nil), manufacturerData...)
+	sort.Slice(manufacturerData, func(i, j int) bool {
+		return manufacturerData[i].CompanyID < manufacturerData[j].CompanyID
+	})
+	for _, element := range manufacturerData {
+		binary.Write(h, binary.LittleEndian, element.CompanyID)
+		binary.Write(h, binary.LittleEndian, uint16(len(element.Data)))
+		h.Write(element.Data)
+	}
+
+	serviceData = append([]bluetooth.ServiceDataElement(nil), serviceData...)
+	sort.Slice(serviceData, func(i, j int) bool {
+		a, b := serviceData[i].UUID.Bytes(), serviceData[j].UUID.Bytes()
+		return bytes.Compare(a[:], b[:]) < 0
+	})
+	for _, element := range serviceData {
+		uuid := element.UUID.Bytes()
+		h.Write(uuid[:])
+		binary.Write(h, binary.LittleEndian, uint16(len(element.Data)))
+		h.Write(element.Data)
+	}
+	return h.Sum64()
+}
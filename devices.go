@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"time"
+
+	"example.com/m/registry"
+	"tinygo.org/x/bluetooth"
+)
+
+// deviceRegistry keeps the devices seen by a scan, with their last
+// sighting.
+type deviceRegistry = registry.Registry[*sighting]
+
+// jsonHistory is the JSON form of what the registry knows of a device
+// besides its last advertisement.
+type jsonHistory struct {
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+	Count     uint64    `json:"count"`
+	RSSIMin   int16     `json:"rssi_min"`
+	RSSIMax   int16     `json:"rssi_max"`
+	RSSIMean  float64   `json:"rssi_mean"`
+
+	Rate      float64       `json:"rate"` // advertisements per second
+	Intervals *jsonInterval `json:"intervals,omitempty"`
+	Variants  int           `json:"variants"`
+}
+
+// jsonInterval is the JSON form of the distribution of the times between the
+// advertisements of a device, in milliseconds. The histogram gives the number
+// of intervals up to each bound, the last one without a bound.
+type jsonInterval struct {
+	Min       float64      `json:"min_ms"`
+	Mean      float64      `json:"mean_ms"`
+	Median    float64      `json:"p50_ms"`
+	P90       float64      `json:"p90_ms"`
+	Max       float64      `json:"max_ms"`
+	Histogram []jsonBucket `json:"histogram"`
+}
+
+type jsonBucket struct {
+	Bound float64 `json:"le_ms,omitempty"`
+	Count uint64  `json:"count"`
+}
+
+func newJSONHistory(d registry.Device[*sighting]) *jsonHistory {
+	h := &jsonHistory{
+		FirstSeen: d.FirstSeen,
+		LastSeen:  d.LastSeen,
+		Count:     d.Count,
+		RSSIMin:   d.RSSIMin,
+		RSSIMax:   d.RSSIMax,
+		RSSIMean:  d.RSSIMean(),
+		Rate:      math.Round(d.Rate()*100) / 100,
+		Variants:  d.Variants,
+	}
+	if d.Count >= 2 {
+		h.Intervals = &jsonInterval{
+			Min:    milliseconds(d.IntervalMin),
+			Mean:   milliseconds(d.IntervalMean()),
+			Median: milliseconds(d.IntervalQuantile(0.5)),
+			P90:    milliseconds(d.IntervalQuantile(0.9)),
+			Max:    milliseconds(d.IntervalMax),
+		}
+		for i, count := range d.Intervals {
+			bucket := jsonBucket{Count: count}
+			if i < len(registry.IntervalBounds) {
+				bucket.Bound = milliseconds(registry.IntervalBounds[i])
+			}
+			h.Intervals.Histogram = append(h.Intervals.Histogram, bucket)
+		}
+	}
+	return h
+}
+
+// milliseconds returns a duration in milliseconds, to the tenth.
+func milliseconds(d time.Duration) float64 {
+	return math.Round(float64(d)/float64(time.Millisecond)*10) / 10
+}
+
+// jsonDevice is the JSON form of a device in the registry: its last
+// advertisement and its history.
+type jsonDevice struct {
+	jsonSighting
+	*jsonHistory
+}
+
+func runDevices(args []string) error {
+	fs := newFlagSet("devices", "")
+	var filter scanFilter
+	filter.registerFlags(fs)
+	duration := fs.Duration("duration", 10*time.Second, "how long to scan")
+	format := fs.String("output", "text", "output format: text or json")
+	verbose := fs.Bool("v", false, "include the AD structures of the last advertisement in json output")
+	var scanning scanFlags
+	scanning.registerFlags(fs)
+	parseFlags(fs, args)
+	if *format != "text" && *format != "json" {
+		return fmt.Errorf("unknown output format %q", *format)
+	}
+	if *duration <= 0 {
+		return fmt.Errorf("-duration must be positive")
+	}
+	if err := scanning.setup(); err != nil {
+		return err
+	}
+	if err := filter.setup(); err != nil {
+		return err
+	}
+
+	if err := enableAdapter(); err != nil {
+		return err
+	}
+	timer := time.AfterFunc(*duration, stopScan)
+	defer timer.Stop()
+	ctx, stop := shutdownContext()
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		stopScan()
+	}()
+
+	var devices deviceRegistry
+	scanLog.Info("scanning", "duration", *duration)
+	err := scan(func(adapter *bluetooth.Adapter, result bluetooth.ScanResult) {
+		metrics.scanCallback()
+		if !filter.match(result) {
+			return
+		}
+		s := newSighting(result, time.Now())
+		devices.Seen(s.Address, s.Time, s.RSSI, payloadHash(result), s)
+	})
+	if err != nil {
+		return err
+	}
+
+	if *format == "json" {
+		list := []jsonDevice{}
+		for _, d := range devices.List() {
+			list = append(list, jsonDevice{newJSONSighting(d.Last, *verbose), newJSONHistory(d)})
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(list)
+	}
+	fmt.Printf("%-17s %6s %4s %4s %6s %9s %9s  %s\n", "ADDRESS", "COUNT", "MIN", "MAX", "MEAN", "FIRST", "LAST", "NAME")
+	for _, d := range devices.List() {
+		name := d.Last.LocalName
+		if d.Last.Alias != "" {
+			name = d.Last.Alias
+		}
+		fmt.Printf("%-17s %6d %4d %4d %6.1f %9s %9s  %s\n", d.Address, d.Count, d.RSSIMin, d.RSSIMax, d.RSSIMean(),
+			d.FirstSeen.Format("15:04:05"), d.LastSeen.Format("15:04:05"), name)
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"example.com/m/gattclient"
+	"example.com/m/ota"
+	"tinygo.org/x/bluetooth"
+)
+
+// The update protocols are in the ota package; this is the command that
+// connects to the device for each image of a package and reports progress.
+
+func runDFU(args []string) error {
+	fs := newFlagSet("dfu", "<address> <package>")
+	var conn connectFlags
+	conn.registerFlags(fs)
+	protocolName := fs.String("protocol", "nordic", "update protocol: "+strings.Join(ota.Names(), ", ")+" (nordic: Secure DFU with an nrfutil zip package)")
+	prn := fs.Int("prn", 12, "with -protocol nordic, have the bootloader confirm the CRC every this many packets (0 only checks it after each object)")
+	parseFlags(fs, args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return errors.New("expected a device address and an update package")
+	}
+	address, err := parseAddress(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	protocol, ok := ota.Lookup(*protocolName)
+	if !ok {
+		return fmt.Errorf("unknown -protocol %q (known: %s)", *protocolName, strings.Join(ota.Names(), ", "))
+	}
+	if *prn < 0 || *prn > 0xffff {
+		return errors.New("-prn must be between 0 and 65535")
+	}
+	if nordic, ok := protocol.(*ota.Nordic); ok {
+		nordic.PRN = uint16(*prn)
+	}
+	if err := conn.validate(); err != nil {
+		return err
+	}
+	images, err := protocol.Open(fs.Arg(1))
+	if err != nil {
+		return err
+	}
+
+	if err := enableAdapter(); err != nil {
+		return err
+	}
+	for i, image := range images {
+		if i > 0 {
+			// The device restarts after each image; the connection
+			// retries cover the rest of the wait.
+			gattLog.Info("waiting for the device to restart")
+			time.Sleep(2 * time.Second)
+		}
+		if err := updateImage(&conn, address, protocol, image); err != nil {
+			return fmt.Errorf("updating the %s: %w", image.Name, err)
+		}
+	}
+	gattLog.Info("firmware updated", "address", address.String())
+	return nil
+}
+
+// updateImage connects to the device and sends it an image, logging every
+// 10% of progress.
+func updateImage(conn *connectFlags, address bluetooth.Address, protocol ota.Protocol, image ota.Image) error {
+	device, err := conn.connect(address)
+	if err != nil {
+		return err
+	}
+	defer device.Disconnect()
+	progress := -1
+	s := &ota.Session{
+		Device: device,
+		Write: func(service bluetooth.UUID, char gattclient.Characteristic, value []byte, withResponse bool) error {
+			return writeCharacteristic(device, service, char, value, withResponse)
+		},
+		Lost: disconnected(device),
+		Progress: func(image string, sent, total int) {
+			if p := 100 * sent / total; p/10 != progress/10 {
+				progress = p
+				gattLog.Info("sent", "image", image, "bytes", sent, "percent", p)
+			}
+		},
+		Logger: gattLog,
+	}
+	return protocol.Update(s, image)
+}
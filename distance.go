@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"example.com/m/decode"
+	"tinygo.org/x/bluetooth"
+)
+
+// distances estimates the distance of devices while -distance is given. It is
+// nil otherwise, which makes estimate a no-op.
+var distances *distanceModel
+
+// txPowerLoss is the path loss between 0 m and 1 m, for converting a TX power
+// (which is specified at 0 m) to a measured power at 1 m.
+const txPowerLoss = 41
+
+// distanceModel estimates distances with the log-distance path loss model:
+//
+//	d = 10 ^ ((measured power - RSSI) / (10 * n))
+//
+// where the measured power is the RSSI at 1 m and n is the path loss exponent,
+// 2 in free space and 2.5-4 indoors.
+type distanceModel struct {
+	pathLoss float64
+
+	// Measured powers recorded with "ble calibrate", by address.
+	calibration map[string]int8
+}
+
+// distanceFlags are the flags for distance estimation.
+type distanceFlags struct {
+	enabled     bool
+	pathLoss    float64
+	calibration string
+}
+
+func (f *distanceFlags) registerFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&f.enabled, "distance", false, "estimate the distance of devices that advertise their TX power or have been calibrated")
+	fs.Float64Var(&f.pathLoss, "path-loss", 2, "path loss exponent for -distance: 2 in free space, 2.5-4 indoors")
+	fs.StringVar(&f.calibration, "calibration", defaultCalibrationPath(), "file with the measured powers recorded by 'ble calibrate'")
+}
+
+// setup enables distance estimation if -distance was given.
+func (f *distanceFlags) setup() error {
+	if !f.enabled {
+		return nil
+	}
+	if f.pathLoss <= 0 {
+		return errors.New("-path-loss must be positive")
+	}
+	calibration, err := loadCalibration(f.calibration)
+	if err != nil {
+		return err
+	}
+	distances = &distanceModel{pathLoss: f.pathLoss, calibration: calibration}
+	return nil
+}
+
+// defaultCalibrationPath returns the default location of the calibration
+// file, in the user's configuration directory.
+func defaultCalibrationPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "calibration.json"
+	}
+	return filepath.Join(dir, "ble", "calibration.json")
+}
+
+// loadCalibration reads a calibration file: a JSON object mapping addresses
+// to their measured power in dBm. A missing file is no calibration.
+func loadCalibration(path string) (map[string]int8, error) {
+	calibration := make(map[string]int8)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return calibration, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &calibration); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return calibration, nil
+}
+
+// measuredPower returns the RSSI at 1 m of the device of a sighting: its
+// calibration if it has one, and otherwise from the TX power it advertises.
+func (m *distanceModel) measuredPower(s *sighting) (int8, bool) {
+	if power, ok := m.calibration[s.Address]; ok {
+		return power, true
+	}
+	for _, f := range s.Frames {
+		switch f := f.(type) {
+		case *decode.IBeacon:
+			return f.MeasuredPower, true
+		case *decode.EddystoneUID:
+			return f.TxPower - txPowerLoss, true
+		case *decode.EddystoneURL:
+			return f.TxPower - txPowerLoss, true
+		}
+	}
+	// Only raw payloads have the TX Power Level structure.
+	if payload, _ := s.payload(); payload != nil {
+		if tx, ok := payload.TxPower(); ok {
+			return tx - txPowerLoss, true
+		}
+	}
+	return 0, false
+}
+
+// estimate returns the estimated distance in meters of the device of a
+// sighting, from its smoothed RSSI, or 0 if it can't be estimated.
+func (m *distanceModel) estimate(s *sighting) float64 {
+	if m == nil || s.SmoothedRSSI == 0 {
+		return 0
+	}
+	power, ok := m.measuredPower(s)
+	if !ok {
+		return 0
+	}
+	return math.Pow(10, (float64(power)-s.SmoothedRSSI)/(10*m.pathLoss))
+}
+
+func runCalibrate(args []string) error {
+	fs := newFlagSet("calibrate", "<address>")
+	duration := fs.Duration("duration", 30*time.Second, "how long to record the RSSI for")
+	path := fs.String("calibration", defaultCalibrationPath(), "file to store the measured power in")
+	parseFlags(fs, args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("expected exactly one device address")
+	}
+	mac, err := bluetooth.ParseMAC(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	address := mac.String()
+
+	if err := enableAdapter(); err != nil {
+		return err
+	}
+	timer := time.AfterFunc(*duration, func() { stopScan() })
+	defer timer.Stop()
+	ctx, stop := shutdownContext()
+	defer stop()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			stopScan()
+		case <-done:
+		}
+	}()
+
+	scanLog.Info("place the device 1 m from the adapter", "address", address, "duration", *duration)
+	var samples []int16
+	err = scan(func(adapter *bluetooth.Adapter, result bluetooth.ScanResult) {
+		if result.Address.String() == address && result.RSSI != 0 {
+			samples = append(samples, result.RSSI)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if len(samples) == 0 {
+		return fmt.Errorf("%w: %s was not seen", errDeviceNotFound, address)
+	}
+
+	// The median, as a few reflections can throw off the mean.
+	slices.Sort(samples)
+	power := int8(samples[len(samples)/2])
+	fmt.Printf("measured power of %s: %d dBm (median of %d samples, %d to %d dBm)\n",
+		address, power, len(samples), samples[0], samples[len(samples)-1])
+
+	calibration, err := loadCalibration(*path)
+	if err != nil {
+		return err
+	}
+	calibration[address] = power
+	data, err := json.MarshalIndent(calibration, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(*path), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(*path, append(data, '\n'), 0o644)
+}
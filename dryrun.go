@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+)
+
+// With -dry-run, commands go as far as they can without Bluetooth: they check
+// their flags, the configuration file and files such as GATT scripts, and
+// connect to their sinks, and then stop where they would enable the adapter,
+// printing what they would have run. Files they would write aren't created.
+
+var dryRun bool
+
+// errDryRun is returned by enableAdapter with -dry-run. It isn't a failure.
+var errDryRun = errors.New("dry run")
+
+// parsedFlags is the flag set parseFlags parsed last, that of the command
+// that a dry run reports.
+var parsedFlags *flag.FlagSet
+
+// secretFlag returns whether a flag's value should not be printed.
+func secretFlag(name string) bool {
+	for _, s := range []string{"token", "password", "secret"} {
+		if strings.Contains(name, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// recordedValue remembers what a flag was set to, as the String of flags such
+// as repeatable ones doesn't tell.
+type recordedValue struct {
+	flag.Value
+	values []string
+}
+
+func (v *recordedValue) Set(s string) error {
+	if err := v.Value.Set(s); err != nil {
+		return err
+	}
+	v.values = append(v.values, s)
+	return nil
+}
+
+type recordedBoolValue struct {
+	*recordedValue
+}
+
+func (recordedBoolValue) IsBoolFlag() bool { return true }
+
+// recordFlags has the flags of a flag set remember their values. The usage
+// message gets the original values back, which it tells the types of the
+// flags from.
+func recordFlags(fs *flag.FlagSet) {
+	original := make(map[string]flag.Value)
+	fs.VisitAll(func(f *flag.Flag) {
+		original[f.Name] = f.Value
+		v := &recordedValue{Value: f.Value}
+		if b, ok := f.Value.(interface{ IsBoolFlag() bool }); ok && b.IsBoolFlag() {
+			f.Value = recordedBoolValue{v}
+		} else {
+			f.Value = v
+		}
+	})
+	usage := fs.Usage
+	fs.Usage = func() {
+		fs.VisitAll(func(f *flag.Flag) { f.Value = original[f.Name] })
+		usage()
+	}
+}
+
+// reportDryRun prints what a command stopped by a dry run would have done.
+func reportDryRun(name string) {
+	action := "enable the adapter and run"
+	if offline {
+		action = "run"
+	}
+	if parsedFlags == nil {
+		fmt.Printf("dry run: would %s ble %s\n", action, name)
+		return
+	}
+	fmt.Printf("dry run: would %s %s", action, parsedFlags.Name())
+	for _, arg := range parsedFlags.Args() {
+		fmt.Printf(" %q", arg)
+	}
+	fmt.Println()
+	// Flags set in the configuration file are set too.
+	parsedFlags.Visit(func(f *flag.Flag) {
+		values := []string{f.Value.String()}
+		switch v := f.Value.(type) {
+		case *recordedValue:
+			values = v.values
+		case recordedBoolValue:
+			values = v.values
+		}
+		for _, value := range values {
+			if secretFlag(f.Name) {
+				value = "(hidden)"
+			}
+			fmt.Printf("  -%s=%s\n", f.Name, value)
+		}
+	})
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+
+	"example.com/m/gattclient"
+	"tinygo.org/x/bluetooth"
+)
+
+// Exit codes, so that scripts can tell failures apart.
+const (
+	exitFailure            = 1 // any other error
+	exitUsage              = 2 // invalid flags or arguments, as with the flag package
+	exitAdapterUnavailable = 3
+	exitPermissionDenied   = 4
+	exitTimeout            = 5
+	exitNotFound           = 6
+)
+
+// The kinds of failure that have their own exit code.
+var (
+	errAdapterUnavailable = errors.New("adapter unavailable")
+	errPermissionDenied   = errors.New("permission denied")
+	errTimeout            = errors.New("timed out")
+	errDeviceNotFound     = errors.New("device not found")
+)
+
+// verbose is set by -verbose, to print the underlying error of a failed
+// operation instead of just its kind.
+var verbose bool
+
+// bleError is a failed Bluetooth operation. Unless -verbose is given, only
+// the kind of failure is printed, as the underlying HCI or D-Bus error is
+// rarely helpful to anyone but a developer.
+type bleError struct {
+	action string // e.g. "enable BLE stack"
+	kind   error  // one of the kinds of failure, or nil if unknown
+	err    error
+}
+
+// wrapError describes a failed operation, classifying its error.
+func wrapError(action string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &bleError{action: action, kind: classifyError(err), err: err}
+}
+
+func (e *bleError) Error() string {
+	if e.kind == nil {
+		return e.action + ": " + errorDetail(e.err)
+	}
+	if verbose {
+		return e.action + ": " + e.kind.Error() + ": " + errorDetail(e.err)
+	}
+	return e.action + ": " + e.kind.Error()
+}
+
+func (e *bleError) Unwrap() []error {
+	if e.kind == nil {
+		return []error{e.err}
+	}
+	return []error{e.kind, e.err}
+}
+
+// errorDetail formats the underlying error of a failed operation, with the
+// name of the D-Bus error it came from in verbose mode.
+func errorDetail(err error) string {
+	if name := platformErrorName(err); verbose && name != "" {
+		return err.Error() + " (" + name + ")"
+	}
+	return err.Error()
+}
+
+// classifyError returns the kind of failure an error is, or nil.
+func classifyError(err error) error {
+	for _, kind := range []error{errAdapterUnavailable, errPermissionDenied, errTimeout, errDeviceNotFound} {
+		if errors.Is(err, kind) {
+			return kind
+		}
+	}
+	switch {
+	case errors.Is(err, os.ErrPermission):
+		return errPermissionDenied
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, os.ErrDeadlineExceeded), errors.Is(err, gattclient.ErrTimeout):
+		return errTimeout
+	}
+	return classifyPlatformError(err)
+}
+
+// exitCode returns the exit code for a command that failed with err.
+func exitCode(err error) int {
+	switch classifyError(err) {
+	case errAdapterUnavailable:
+		return exitAdapterUnavailable
+	case errPermissionDenied:
+		return exitPermissionDenied
+	case errTimeout:
+		return exitTimeout
+	case errDeviceNotFound:
+		return exitNotFound
+	}
+	return exitFailure
+}
+
+// enableAdapter enables the BLE stack, and the scan adapter if it is another
+// adapter. Any failure to do so that isn't a lack of permissions means that
+// there is no usable adapter. With -dry-run, it stops the command instead.
+func enableAdapter() error {
+	if dryRun {
+		return errDryRun
+	}
+	if offline {
+		return nil
+	}
+	if err := enable("enable BLE stack", adapter); err != nil {
+		return err
+	}
+	if scanAdapter != adapter {
+		return enable("enable scan adapter", scanAdapter)
+	}
+	return nil
+}
+
+func enable(action string, a *bluetooth.Adapter) error {
+	err := a.Enable()
+	if err == nil {
+		return nil
+	}
+	kind := classifyError(err)
+	if kind == nil {
+		kind = errAdapterUnavailable
+	}
+	return &bleError{action: action, kind: kind, err: err}
+}
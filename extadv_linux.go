@@ -0,0 +1,245 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"example.com/m/ad"
+	"github.com/godbus/dbus/v5"
+	"tinygo.org/x/bluetooth"
+)
+
+// The advertisements of the bluetooth package are legacy ones, without scan
+// response data of their own. Extended advertisements and advertisements with
+// a scan response are registered with BlueZ directly: a SecondaryChannel
+// makes BlueZ use extended advertising PDUs, with the advertising data sent on
+// that PHY, which also allows more than 31 bytes of it.
+
+const extAdvertisementPath = dbus.ObjectPath("/org/ble/advertisement0")
+
+// extAdvertisement implements org.bluez.LEAdvertisement1.
+type extAdvertisement struct {
+	props map[string]dbus.Variant
+}
+
+func (a *extAdvertisement) Release() *dbus.Error { return nil }
+
+func (a *extAdvertisement) Get(iface, name string) (dbus.Variant, *dbus.Error) {
+	v, ok := a.props[name]
+	if iface != "org.bluez.LEAdvertisement1" || !ok {
+		return dbus.Variant{}, dbus.NewError("org.freedesktop.DBus.Error.InvalidArgs", []any{"no property " + name})
+	}
+	return v, nil
+}
+
+func (a *extAdvertisement) GetAll(iface string) (map[string]dbus.Variant, *dbus.Error) {
+	if iface != "org.bluez.LEAdvertisement1" {
+		return nil, nil
+	}
+	return a.props, nil
+}
+
+func (a *extAdvertisement) Set(iface, name string, value dbus.Variant) *dbus.Error {
+	return dbus.NewError("org.freedesktop.DBus.Error.PropertyReadOnly", []any{name})
+}
+
+// startExtendedAdvertisement advertises connectably with an extended
+// advertisement whose data is sent on the secondary PHY, "1M", "2M" or
+// "Coded", and returns a function that stops it. With "Coded", the kernel
+// sends the primary advertisement on the Coded PHY too.
+func startExtendedAdvertisement(opts bluetooth.AdvertisementOptions, secondaryPHY string) (stop func(), err error) {
+	bus, err := dbus.SystemBus()
+	if err != nil {
+		return nil, err
+	}
+	manager := bus.Object("org.bluez", dbus.ObjectPath("/org/bluez/"+adapterID))
+
+	// Flags take 3 bytes of the advertising data.
+	length := advertisingDataLength(opts) + 3
+	var capabilities map[string]dbus.Variant
+	if v, err := manager.GetProperty("org.bluez.LEAdvertisingManager1.SupportedCapabilities"); err == nil {
+		capabilities, _ = v.Value().(map[string]dbus.Variant)
+	}
+	if max, ok := capabilities["MaxAdvLen"].Value().(byte); ok && length > int(max) {
+		return nil, fmt.Errorf("the advertising data takes %d bytes, but the adapter can only advertise %d", length, max)
+	}
+	if v, err := manager.GetProperty("org.bluez.LEAdvertisingManager1.SupportedSecondaryChannels"); err == nil {
+		channels, _ := v.Value().([]string)
+		supported := false
+		for _, c := range channels {
+			supported = supported || strings.EqualFold(c, secondaryPHY)
+		}
+		if !supported {
+			return nil, fmt.Errorf("the adapter can't advertise on the %s PHY (supported: %s)", secondaryPHY, strings.Join(channels, ", "))
+		}
+	}
+
+	props := advertisementProps(opts)
+	props["SecondaryChannel"] = dbus.MakeVariant(secondaryPHY)
+	if err := registerAdvertisement(bus, manager, props); err != nil {
+		return nil, fmt.Errorf("could not start the extended advertisement: %w", err)
+	}
+	peripheralLog.Debug("extended advertisement registered", "secondary_phy", secondaryPHY, "length", length)
+	return followConnections(bus, manager), nil
+}
+
+// startScanResponseAdvertisement advertises connectably with a legacy
+// advertisement that has scan response data of its own, and returns a
+// function that stops it. BlueZ sends the local name in the scan response,
+// so it counts against the 31 bytes of the scan response rather than the
+// advertisement. The scan response properties are experimental in BlueZ,
+// which only honors them when bluetoothd runs with -E.
+func startScanResponseAdvertisement(opts, response bluetooth.AdvertisementOptions) (stop func(), err error) {
+	bus, err := dbus.SystemBus()
+	if err != nil {
+		return nil, err
+	}
+	manager := bus.Object("org.bluez", dbus.ObjectPath("/org/bluez/"+adapterID))
+
+	advertising := opts
+	advertising.LocalName, response.LocalName = "", opts.LocalName
+	// Flags take 3 bytes of the advertising data.
+	if length := advertisingDataLength(advertising) + 3; length > 31 {
+		return nil, fmt.Errorf("the advertising data takes %d bytes, more than the 31 of a legacy advertisement", length)
+	}
+	if length := advertisingDataLength(response); length > 31 {
+		return nil, fmt.Errorf("the scan response takes %d bytes, more than 31", length)
+	}
+
+	props := advertisementProps(opts)
+	for key, value := range advertisementProps(response) {
+		switch key {
+		case "ServiceUUIDs", "ManufacturerData", "ServiceData":
+			props["ScanResponse"+key] = value
+		}
+	}
+	if err := registerAdvertisement(bus, manager, props); err != nil {
+		return nil, fmt.Errorf("could not start the advertisement: %w", err)
+	}
+	peripheralLog.Debug("advertisement with scan response registered")
+	return followConnections(bus, manager), nil
+}
+
+// advertisingDataLength returns how many bytes of advertising data the
+// fields of an advertisement take, without Flags.
+func advertisingDataLength(opts bluetooth.AdvertisementOptions) int {
+	length := len(ad.FromFields(opts.LocalName, opts.ManufacturerData, opts.ServiceData).Bytes())
+	var uuids16, uuids128 int
+	for _, uuid := range opts.ServiceUUIDs {
+		if uuid.Is16Bit() {
+			uuids16++
+		} else {
+			uuids128++
+		}
+	}
+	if uuids16 > 0 {
+		length += 2 + 2*uuids16
+	}
+	if uuids128 > 0 {
+		length += 2 + 16*uuids128
+	}
+	return length
+}
+
+// advertisementProps returns the org.bluez.LEAdvertisement1 properties of a
+// connectable advertisement.
+func advertisementProps(opts bluetooth.AdvertisementOptions) map[string]dbus.Variant {
+	var serviceUUIDs []string
+	for _, uuid := range opts.ServiceUUIDs {
+		serviceUUIDs = append(serviceUUIDs, uuid.String())
+	}
+	manufacturerData := make(map[uint16]dbus.Variant)
+	for _, element := range opts.ManufacturerData {
+		manufacturerData[element.CompanyID] = dbus.MakeVariant(element.Data)
+	}
+	serviceData := make(map[string]dbus.Variant)
+	for _, element := range opts.ServiceData {
+		serviceData[element.UUID.String()] = dbus.MakeVariant(element.Data)
+	}
+	return map[string]dbus.Variant{
+		"Type":             dbus.MakeVariant("peripheral"),
+		"ServiceUUIDs":     dbus.MakeVariant(serviceUUIDs),
+		"ManufacturerData": dbus.MakeVariant(manufacturerData),
+		"ServiceData":      dbus.MakeVariant(serviceData),
+		"LocalName":        dbus.MakeVariant(opts.LocalName),
+		"Timeout":          dbus.MakeVariant(uint16(0)),
+	}
+}
+
+// registerAdvertisement exports an advertisement with the properties and
+// registers it with BlueZ.
+func registerAdvertisement(bus *dbus.Conn, manager dbus.BusObject, props map[string]dbus.Variant) error {
+	adv := &extAdvertisement{props: props}
+	if err := bus.Export(adv, extAdvertisementPath, "org.bluez.LEAdvertisement1"); err != nil {
+		return err
+	}
+	if err := bus.Export(adv, extAdvertisementPath, "org.freedesktop.DBus.Properties"); err != nil {
+		return err
+	}
+	if err := manager.Call("org.bluez.LEAdvertisingManager1.RegisterAdvertisement", 0, extAdvertisementPath, map[string]dbus.Variant{}).Err; err != nil {
+		unexportAdvertisement(bus)
+		return err
+	}
+	return nil
+}
+
+func unexportAdvertisement(bus *dbus.Conn) {
+	bus.Export(nil, extAdvertisementPath, "org.bluez.LEAdvertisement1")
+	bus.Export(nil, extAdvertisementPath, "org.freedesktop.DBus.Properties")
+}
+
+// followConnections reports the centrals that connect while the registered
+// advertisement is advertised, and returns a function that stops it. The
+// connect handler of the adapter is only called for the advertisements of
+// the bluetooth package, so connections are followed here.
+func followConnections(bus *dbus.Conn, manager dbus.BusObject) (stop func()) {
+	adapterPath := manager.Path()
+	match := []dbus.MatchOption{
+		dbus.WithMatchInterface("org.freedesktop.DBus.Properties"),
+		dbus.WithMatchMember("PropertiesChanged"),
+		dbus.WithMatchArg(0, "org.bluez.Device1"),
+		dbus.WithMatchPathNamespace(adapterPath),
+	}
+	bus.AddMatchSignal(match...)
+	signals := make(chan *dbus.Signal, 16)
+	bus.Signal(signals)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case sig := <-signals:
+				if sig.Name != "org.freedesktop.DBus.Properties.PropertiesChanged" || len(sig.Body) < 2 || !strings.HasPrefix(string(sig.Path), string(adapterPath)+"/") {
+					continue
+				}
+				changes, _ := sig.Body[1].(map[string]dbus.Variant)
+				connected, ok := changes["Connected"].Value().(bool)
+				if !ok {
+					continue
+				}
+				address := strings.ReplaceAll(strings.TrimPrefix(string(sig.Path), string(adapterPath)+"/dev_"), "_", ":")
+				if connected && !acceptCentral(address) {
+					peripheralLog.Warn("disconnecting a central that isn't accepted", "address", address)
+					go bus.Object("org.bluez", sig.Path).Call("org.bluez.Device1.Disconnect", 0)
+					continue
+				}
+				if connected {
+					peripheralLog.Info("device connected", "address", address)
+				} else {
+					peripheralLog.Info("device disconnected", "address", address)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		bus.RemoveSignal(signals)
+		bus.RemoveMatchSignal(match...)
+		manager.Call("org.bluez.LEAdvertisingManager1.UnregisterAdvertisement", 0, extAdvertisementPath)
+		unexportAdvertisement(bus)
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"tinygo.org/x/bluetooth"
+)
+
+// scanFilter decides which scan results are reported. The zero value lets
+// everything through.
+type scanFilter struct {
+	minRSSI    int16
+	hasMinRSSI bool
+
+	name      string
+	nameRegex *regexp.Regexp
+
+	// Addresses are stored in their canonical string form. An empty allow
+	// list allows every address that is not ignored.
+	allow  map[string]bool
+	ignore map[string]bool
+
+	// The devices with these tags are added to the allow list by setup.
+	tags tagsFlag
+
+	// A device matches if it advertises any of these services.
+	services []bluetooth.UUID
+
+	// acceptList puts the allowed addresses on the accept list of the
+	// controller, so that it drops the advertisements of other devices.
+	acceptList bool
+}
+
+// registerFlags adds the filter flags to a command's flag set.
+func (f *scanFilter) registerFlags(fs *flag.FlagSet) {
+	fs.Func("min-rssi", "drop devices with an RSSI below this value in dBm (e.g. -80)", func(s string) error {
+		rssi, err := strconv.ParseInt(s, 10, 16)
+		if err != nil {
+			return err
+		}
+		f.minRSSI, f.hasMinRSSI = int16(rssi), true
+		return nil
+	})
+	fs.StringVar(&f.name, "name", "", "only report devices whose local name contains this substring")
+	fs.Func("name-regex", "only report devices whose local name matches this regular expression", func(s string) (err error) {
+		f.nameRegex, err = regexp.Compile(s)
+		return err
+	})
+	fs.Func("addr", "only report this device address (repeatable)", func(s string) error {
+		return addAddress(&f.allow, s)
+	})
+	fs.Func("ignore-addr", "never report this device address (repeatable)", func(s string) error {
+		return addAddress(&f.ignore, s)
+	})
+	fs.Func("service", "only report devices advertising this 16-bit or 128-bit service UUID (repeatable)", func(s string) error {
+		uuid, err := bluetooth.ParseUUID(s)
+		if err != nil {
+			return err
+		}
+		f.services = append(f.services, uuid)
+		return nil
+	})
+	fs.Var(&f.tags, "tag", "only report the devices with this tag in the configuration file (repeatable)")
+	fs.Func("allowlist", "only report device addresses listed in this file, one per line", f.loadAllowlist)
+	fs.BoolVar(&f.acceptList, "accept-list", false, "put the -addr and -allowlist addresses on the filter accept list of the controller, which then drops the advertisements of other devices; "+
+		"scans passively instead of with -scan-mode and needs CAP_NET_ADMIN (Linux only)")
+}
+
+// setup adds the tagged devices to the allow list, and makes the scan use the
+// accept list of the controller, if asked to. It comes after the scan flags
+// are set up, as it replaces their backend.
+func (f *scanFilter) setup() error {
+	tagged, err := f.tags.addresses()
+	if err != nil {
+		return fmt.Errorf("-tag: %w", err)
+	}
+	for _, address := range tagged {
+		addAddress(&f.allow, address.String())
+	}
+	if !f.acceptList {
+		return nil
+	}
+	if len(f.allow) == 0 {
+		return errors.New("-accept-list needs -addr, -tag or -allowlist")
+	}
+	// The controller has nothing to drop advertisements from without an
+	// adapter, and replacing the backend would scan the adapter instead.
+	if replaying != nil {
+		return errors.New("-accept-list and -replay don't go together")
+	}
+	if offline {
+		return errors.New("-accept-list and -simulate don't go together")
+	}
+	var addresses []bluetooth.MAC
+	for s := range f.allow {
+		mac, _ := bluetooth.ParseMAC(s)
+		addresses = append(addresses, mac)
+	}
+	backend, err := acceptListBackend(scanAdapter, addresses)
+	if err != nil {
+		return err
+	}
+	scans.Adapter = backend
+	return nil
+}
+
+// loadAllowlist adds all addresses in the given file to the allow list. Blank
+// lines and lines starting with # are skipped.
+func (f *scanFilter) loadAllowlist(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := addAddress(&f.allow, line); err != nil {
+			return fmt.Errorf("%s:%d: %w", path, lineno, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// addAddress parses an address and adds it to the set, allocating the set if
+// needed.
+func addAddress(set *map[string]bool, s string) error {
+	mac, err := bluetooth.ParseMAC(s)
+	if err != nil {
+		return fmt.Errorf("invalid address %q: %w", s, err)
+	}
+	if *set == nil {
+		*set = make(map[string]bool)
+	}
+	(*set)[mac.String()] = true
+	return nil
+}
+
+// match returns whether the scan result passes all configured filters.
+func (f *scanFilter) match(result bluetooth.ScanResult) bool {
+	// Cheapest check first: most results in a busy environment are weak.
+	if f.hasMinRSSI && result.RSSI < f.minRSSI {
+		return false
+	}
+	addr := result.Address.String()
+	if f.ignore[addr] {
+		return false
+	}
+	if len(f.allow) != 0 && !f.allow[addr] {
+		// A private address is allowed by its identity address.
+		if identity, ok := resolvePrivateAddress(addr); !ok || !f.allow[identity] {
+			return false
+		}
+	}
+	name := result.LocalName()
+	if f.name != "" && !strings.Contains(name, f.name) {
+		return false
+	}
+	if f.nameRegex != nil && !f.nameRegex.MatchString(name) {
+		return false
+	}
+	if len(f.services) != 0 && !f.matchService(result) {
+		return false
+	}
+	return true
+}
+
+// matchService returns whether the scan result advertises one of the filter
+// services, either in its service UUID list or as a service data element.
+func (f *scanFilter) matchService(result bluetooth.ScanResult) bool {
+	for _, uuid := range f.services {
+		if result.HasServiceUUID(uuid) {
+			return true
+		}
+		for _, element := range result.ServiceData() {
+			if element.UUID == uuid {
+				return true
+			}
+		}
+	}
+	return false
+}
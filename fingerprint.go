@@ -0,0 +1,213 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"example.com/m/ad"
+	"tinygo.org/x/bluetooth"
+)
+
+// fingerprints assigns device IDs while -fingerprint is given. It is nil
+// otherwise, which makes identify return no ID.
+var fingerprints *fingerprinter
+
+const (
+	// fingerprintWindow is how long after a device was last seen a new
+	// address can still be taken to be the same device.
+	fingerprintWindow = 30 * time.Second
+
+	// fingerprintQuiet is how long a device must have been quiet for a new
+	// address to be taken to be the same device. A device that is still
+	// advertising on its old address is a different device.
+	fingerprintQuiet = 2 * time.Second
+
+	// fingerprintTTL is how long a device that is no longer seen is
+	// remembered.
+	fingerprintTTL = time.Hour
+)
+
+// fingerprintFlag registers the -fingerprint flag.
+func fingerprintFlag(fs *flag.FlagSet) *bool {
+	return fs.Bool("fingerprint", false, "assign devices an ID that stays the same when they change their random address")
+}
+
+// setupFingerprints starts assigning device IDs if enabled, with the IRKs of
+// bonded devices where they can be read.
+func setupFingerprints(enabled bool) error {
+	if !enabled {
+		return nil
+	}
+	n, err := loadBondedIdentityKeys()
+	if errors.Is(err, os.ErrPermission) {
+		scanLog.Warn("can't read the IRKs of bonded devices without root, fingerprinting without them")
+	} else if err != nil && !errors.Is(err, os.ErrNotExist) && !errors.Is(err, errBondsUnsupported) {
+		return err
+	} else if n > 0 {
+		scanLog.Info("resolving the addresses of bonded devices", "devices", n)
+	}
+	fingerprints = &fingerprinter{addresses: make(map[string]*fingerprintDevice)}
+	return nil
+}
+
+// fingerprinter assigns a stable ID to each device, across the changes of
+// its random address. Devices with a public address or whose address an IRK
+// resolves are identified by their identity address. Other devices are
+// matched by heuristics: when a new random address shows up shortly after
+// another one went quiet, it is the same device if it sends the same payload,
+// or else the same services, manufacturers and name. Ambiguous matches are
+// not made: with several iPhones around, a new address is a new device.
+type fingerprinter struct {
+	mu        sync.Mutex
+	next      int
+	addresses map[string]*fingerprintDevice // by every address of a device
+	pruned    time.Time
+}
+
+type fingerprintDevice struct {
+	id       string
+	address  string // the latest
+	random   bool
+	lastSeen time.Time
+
+	payload   uint64
+	signature string // services, manufacturers and name; empty if none
+}
+
+// identify returns the device ID of a scan result.
+func (f *fingerprinter) identify(result bluetooth.ScanResult, now time.Time) string {
+	if f == nil {
+		return ""
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.prune(now)
+
+	address := result.Address.String()
+	payload := payloadHash(result)
+	signature := advertisementSignature(result)
+	d := f.addresses[address]
+	if d == nil {
+		d = f.match(address, result.Address.IsRandom(), payload, signature, now)
+		f.addresses[address] = d
+	}
+	d.address, d.lastSeen = address, now
+	d.payload, d.signature = payload, signature
+	return d.id
+}
+
+// match finds the device a new address belongs to, or adds a new device.
+func (f *fingerprinter) match(address string, random bool, payload uint64, signature string, now time.Time) *fingerprintDevice {
+	// Public and static random addresses don't change.
+	if !random || macBytes(address)[0]>>6 == 0b11 {
+		return &fingerprintDevice{id: address}
+	}
+	if identity, ok := resolvePrivateAddress(address); ok {
+		if d := f.addresses[identity]; d != nil {
+			return d
+		}
+		d := &fingerprintDevice{id: identity, random: true}
+		f.addresses[identity] = d
+		return d
+	}
+
+	// Prefer a device that sent the very same payload, then one with the
+	// same signature.
+	var best *fingerprintDevice
+	bestScore, ambiguous := 0, false
+	for _, d := range f.devices() {
+		if !d.random || now.Sub(d.lastSeen) < fingerprintQuiet || now.Sub(d.lastSeen) > fingerprintWindow {
+			continue
+		}
+		score := 0
+		if d.payload == payload {
+			score = 2
+		} else if signature != "" && d.signature == signature {
+			score = 1
+		}
+		if score == 0 || score < bestScore {
+			continue
+		}
+		ambiguous = score == bestScore
+		best, bestScore = d, score
+	}
+	if best != nil && !ambiguous {
+		return best
+	}
+	f.next++
+	return &fingerprintDevice{id: "device-" + strconv.Itoa(f.next), random: true}
+}
+
+// devices returns each device once, though it may have several addresses.
+func (f *fingerprinter) devices() []*fingerprintDevice {
+	var devices []*fingerprintDevice
+	for address, d := range f.addresses {
+		if d.address == address {
+			devices = append(devices, d)
+		}
+	}
+	return devices
+}
+
+// prune forgets devices that haven't been seen for fingerprintTTL, at most
+// once a minute.
+func (f *fingerprinter) prune(now time.Time) {
+	if now.Sub(f.pruned) < time.Minute {
+		return
+	}
+	f.pruned = now
+	for address, d := range f.addresses {
+		if now.Sub(d.lastSeen) >= fingerprintTTL {
+			delete(f.addresses, address)
+		}
+	}
+}
+
+// advertisementSignature describes what an advertisement says about the kind
+// of device that sent it, as opposed to its contents: the services it
+// advertises, the companies of its manufacturer data and its name.
+func advertisementSignature(result bluetooth.ScanResult) string {
+	var parts []string
+	for _, uuid := range advertisedServices(result) {
+		parts = append(parts, uuid.String())
+	}
+	slices.Sort(parts)
+	var companies []string
+	for _, element := range result.ManufacturerData() {
+		companies = append(companies, fmt.Sprintf("0x%04X", element.CompanyID))
+	}
+	slices.Sort(companies)
+	parts = append(parts, companies...)
+	if name := result.LocalName(); name != "" {
+		parts = append(parts, strconv.Quote(name))
+	}
+	return strings.Join(parts, " ")
+}
+
+// advertisedServices returns the service UUIDs of an advertisement. The
+// AdvertisementPayload interface only has HasServiceUUID, so for structured
+// payloads the list is read from their AdvertisementFields.
+func advertisedServices(result bluetooth.ScanResult) []bluetooth.UUID {
+	if raw := result.Bytes(); raw != nil {
+		payload, _ := ad.Parse(raw)
+		return payload.ServiceUUIDs()
+	}
+	v := reflect.ValueOf(result.AdvertisementPayload)
+	if v.Kind() != reflect.Pointer || v.Elem().Kind() != reflect.Struct {
+		return nil
+	}
+	field := v.Elem().FieldByName("ServiceUUIDs")
+	if !field.IsValid() {
+		return nil
+	}
+	uuids, _ := field.Interface().([]bluetooth.UUID)
+	return uuids
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	assignednumbers "example.com/m/assigned_numbers"
+	"example.com/m/decode"
+	"example.com/m/gattclient"
+	"tinygo.org/x/bluetooth"
+)
+
+// gattCommands are the subcommands of "ble gatt".
+var gattCommands = []command{
+	{"read", "read a characteristic value", runGattRead},
+	{"write", "write a characteristic value", runGattWrite},
+	{"notify", "stream characteristic notifications", runGattNotify},
+	{"script", "run a script of GATT steps and report which passed", runGattScript},
+}
+
+func runGatt(args []string) error {
+	return runSubcommand("gatt", gattCommands, args)
+}
+
+func runGattRead(args []string) error {
+	fs := newFlagSet("gatt read", "<address> <service-uuid> <char-uuid>")
+	var conn connectFlags
+	conn.registerFlags(fs)
+	format := fs.String("format", "", "also print the value in this format, e.g. uint16-le or float32")
+	parseFlags(fs, args)
+	if fs.NArg() != 3 {
+		fs.Usage()
+		return errors.New("expected address, service UUID and characteristic UUID")
+	}
+	if err := checkValueFormat(*format); err != nil {
+		return err
+	}
+	address, serviceUUID, charUUID, err := parseCharacteristicArgs(fs.Args())
+	if err != nil {
+		return err
+	}
+
+	if err := enableAdapter(); err != nil {
+		return err
+	}
+	device, err := conn.connect(address)
+	if err != nil {
+		return err
+	}
+	defer device.Disconnect()
+
+	char, err := gattclient.FindCharacteristic(device, serviceUUID, charUUID)
+	if err != nil {
+		return err
+	}
+	conn.reportMTU(char)
+	value, err := gattclient.Read(char)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("hex:  ", hex.EncodeToString(value))
+	if s := printableUTF8(value); s != "" {
+		fmt.Println("utf-8:", s)
+	}
+	if m, ok := decode.Characteristic(charUUID, value); ok {
+		fmt.Printf("%s: %s\n", m.Name, m)
+	}
+	if *format != "" {
+		s, err := formatValue(*format, value)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s: %s\n", *format, s)
+	}
+	return nil
+}
+
+func runGattWrite(args []string) error {
+	fs := newFlagSet("gatt write", "<address> <service-uuid> <char-uuid> <hex-or-string>")
+	var conn connectFlags
+	conn.registerFlags(fs)
+	noResponse := fs.Bool("no-response", false, "write without response (write command), even if the characteristic supports write requests")
+	asString := fs.Bool("string", false, "always write the value as a string, even if it looks like hex")
+	parseFlags(fs, args)
+	if fs.NArg() != 4 {
+		fs.Usage()
+		return errors.New("expected address, service UUID, characteristic UUID and value")
+	}
+	address, serviceUUID, charUUID, err := parseCharacteristicArgs(fs.Args())
+	if err != nil {
+		return err
+	}
+	value := parseWriteValue(fs.Arg(3), *asString)
+
+	if err := enableAdapter(); err != nil {
+		return err
+	}
+	device, err := conn.connect(address)
+	if err != nil {
+		return err
+	}
+	defer device.Disconnect()
+
+	char, err := gattclient.FindCharacteristic(device, serviceUUID, charUUID)
+	if err != nil {
+		return err
+	}
+	conn.reportMTU(char)
+
+	// Use a write request when it's supported, unless told otherwise. If the
+	// properties are unknown, try a write request.
+	withResponse := !*noResponse
+	if details, _ := gattDetails(device.Address()); details != nil && withResponse {
+		if detail := details[gattKey{serviceUUID, charUUID}]; detail != nil {
+			withResponse = slices.Contains(detail.flags, "write")
+		}
+	}
+	if err := writeCharacteristic(device, serviceUUID, char, value, withResponse); err != nil {
+		return err
+	}
+	mode := "without response"
+	if withResponse {
+		mode = "with response"
+	}
+	fmt.Printf("wrote %d bytes %s\n", len(value), mode)
+	return nil
+}
+
+// writeValue writes a value with the bluetooth package, as a write request or
+// a write command.
+func writeValue(char gattclient.Characteristic, value []byte, withResponse bool) error {
+	var err error
+	if withResponse {
+		_, err = char.Write(value)
+	} else {
+		_, err = char.WriteWithoutResponse(value)
+	}
+	return err
+}
+
+func runGattNotify(args []string) error {
+	fs := newFlagSet("gatt notify", "(<address>[,<address>...] | -tag TAG) <service-uuid> <char-uuid>")
+	var conn connectFlags
+	conn.registerFlags(fs)
+	var reconnect reconnectFlags
+	reconnect.registerFlags(fs)
+	format := fs.String("format", "", "also print each value in this format, e.g. uint16-le or float32")
+	maxConns := fs.Int("max-conns", 4, "maximum number of devices to stay connected to at once")
+	var tags tagsFlag
+	fs.Var(&tags, "tag", "subscribe on the devices with this tag in the configuration file instead of the given addresses (repeatable)")
+	metricsAddr := metricsFlag(fs)
+	parseFlags(fs, args)
+	if err := serveMetrics(*metricsAddr); err != nil {
+		return err
+	}
+	uuidArgs := fs.Args()
+	if len(tags) == 0 && len(uuidArgs) > 0 {
+		uuidArgs = uuidArgs[1:]
+	}
+	if len(uuidArgs) != 2 {
+		fs.Usage()
+		return errors.New("expected address or -tag, service UUID and characteristic UUID")
+	}
+	if err := checkValueFormat(*format); err != nil {
+		return err
+	}
+	addresses, err := tags.addresses()
+	if err != nil {
+		return fmt.Errorf("-tag: %w", err)
+	}
+	if len(tags) == 0 {
+		if addresses, err = parseAddresses(fs.Arg(0)); err != nil {
+			return err
+		}
+	}
+	serviceUUID, charUUID, err := parseUUIDArgs(uuidArgs[0], uuidArgs[1])
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := shutdownContext()
+	defer stop()
+
+	if err := enableAdapter(); err != nil {
+		return err
+	}
+	pool := newConnPool(&conn, &reconnect, *maxConns)
+	for _, address := range addresses {
+		// Tag the values with the device they came from when there are several.
+		tag := ""
+		if len(addresses) > 1 {
+			tag = deviceLabel(address.String())
+		}
+		err := pool.add(ctx, address, func(device gattclient.Device) (func(), error) {
+			char, err := gattclient.FindCharacteristic(device, serviceUUID, charUUID)
+			if err != nil {
+				return nil, err
+			}
+			conn.reportMTU(char)
+			err = char.EnableNotifications(func(value []byte) {
+				printNotification(time.Now(), tag, charUUID, value, *format)
+			})
+			if err != nil {
+				return nil, err
+			}
+			gattLog.Info("subscribed, press Ctrl-C to stop", "address", device.Address().String())
+			return func() { char.EnableNotifications(nil) }, nil
+		})
+		if err != nil {
+			stop()
+			pool.wait()
+			return err
+		}
+	}
+	return pool.wait()
+}
+
+// notificationMu keeps the lines of notifications from several devices, which
+// arrive concurrently, from interleaving.
+var notificationMu sync.Mutex
+
+// printNotification prints a single notification value on one line, as
+// notificationLine formats it.
+func printNotification(t time.Time, tag string, uuid bluetooth.UUID, value []byte, format string) {
+	line := notificationLine(t, tag, uuid, value, format)
+	notificationMu.Lock()
+	defer notificationMu.Unlock()
+	fmt.Println(line)
+}
+
+// notificationLine formats a value as the time, the tag (if any), the value
+// in hex, and the decoded value. Without a format, values of characteristics
+// with a known format are decoded.
+func notificationLine(t time.Time, tag string, uuid bluetooth.UUID, value []byte, format string) string {
+	line := t.Format(time.RFC3339Nano)
+	if tag != "" {
+		line += " " + tag
+	}
+	line += " " + hex.EncodeToString(value)
+	if format != "" {
+		if s, err := formatValue(format, value); err == nil {
+			line += " " + s
+		} else {
+			line += " (" + err.Error() + ")"
+		}
+	} else if m, ok := decode.Characteristic(uuid, value); ok {
+		line += " " + m.Name + "=" + m.String()
+	} else if s := printableUTF8(value); s != "" {
+		line += " " + s
+	}
+	return line
+}
+
+// parseWriteValue interprets a value given on the command line: hex (with
+// an optional 0x prefix and : or space separators) if it parses as such,
+// otherwise the string itself.
+func parseWriteValue(s string, asString bool) []byte {
+	if !asString {
+		digits := strings.NewReplacer(":", "", " ", "").Replace(strings.TrimPrefix(s, "0x"))
+		if b, err := hex.DecodeString(digits); err == nil && len(b) > 0 {
+			return b
+		}
+	}
+	return []byte(s)
+}
+
+// parseCharacteristicArgs parses the <address> <service-uuid> <char-uuid>
+// arguments of the gatt subcommands.
+func parseCharacteristicArgs(args []string) (address bluetooth.Address, service, char bluetooth.UUID, err error) {
+	address, err = parseAddress(args[0])
+	if err != nil {
+		return
+	}
+	service, char, err = parseUUIDArgs(args[1], args[2])
+	return
+}
+
+// parseUUIDArgs parses a service and a characteristic UUID given on the
+// command line.
+func parseUUIDArgs(serviceArg, charArg string) (service, char bluetooth.UUID, err error) {
+	service, err = bluetooth.ParseUUID(serviceArg)
+	if err != nil {
+		err = fmt.Errorf("invalid service UUID: %w", err)
+		return
+	}
+	char, err = bluetooth.ParseUUID(charArg)
+	if err != nil {
+		err = fmt.Errorf("invalid characteristic UUID: %w", err)
+	}
+	return
+}
+
+// parseAddresses parses a comma-separated list of device addresses.
+func parseAddresses(s string) ([]bluetooth.Address, error) {
+	var addresses []bluetooth.Address
+	for _, field := range strings.Split(s, ",") {
+		address, err := parseAddress(strings.TrimSpace(field))
+		if err != nil {
+			return nil, err
+		}
+		addresses = append(addresses, address)
+	}
+	return addresses, nil
+}
+
+// printGATTTree discovers all services and characteristics of a connected
+// device and prints them as a tree, with properties and descriptors where the
+// platform reports them.
+func printGATTTree(device gattclient.Device) error {
+	services, err := device.DiscoverServices(nil)
+	if err != nil {
+		return err
+	}
+	details, err := gattDetails(device.Address())
+	if err != nil {
+		gattLog.Warn("could not read characteristic details", "err", err)
+	}
+	for _, service := range services {
+		fmt.Println("service", describeUUID(service.UUID(), assignednumbers.ServiceName(service.UUID())))
+		chars, err := service.DiscoverCharacteristics(nil)
+		if err != nil {
+			return err
+		}
+		for _, char := range chars {
+			line := "  characteristic " + describeUUID(char.UUID(), assignednumbers.CharacteristicName(char.UUID()))
+			detail := details[gattKey{service.UUID(), char.UUID()}]
+			if detail == nil {
+				fmt.Println(line)
+				continue
+			}
+			fmt.Println(line, "["+strings.Join(detail.flags, ", ")+"]")
+			for _, descriptor := range detail.descriptors {
+				fmt.Println("    descriptor", describeUUID(descriptor, assignednumbers.DescriptorName(descriptor)))
+			}
+		}
+	}
+	return nil
+}
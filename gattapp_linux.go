@@ -0,0 +1,188 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/godbus/dbus/v5"
+	"tinygo.org/x/bluetooth"
+)
+
+// gattApp is a GATT server registered with BlueZ directly. Unlike the server
+// of the bluetooth package, it supports descriptors and security flags such
+// as "encrypt-read", which profiles like HID over GATT need.
+type gattApp struct {
+	bus     *dbus.Conn
+	path    dbus.ObjectPath
+	objects map[dbus.ObjectPath]map[string]map[string]dbus.Variant
+	nextID  int
+}
+
+func newGattApp(path dbus.ObjectPath) (*gattApp, error) {
+	bus, err := dbus.SystemBus()
+	if err != nil {
+		return nil, err
+	}
+	return &gattApp{
+		bus:     bus,
+		path:    path,
+		objects: make(map[dbus.ObjectPath]map[string]map[string]dbus.Variant),
+	}, nil
+}
+
+// GetManagedObjects implements org.freedesktop.DBus.ObjectManager, through
+// which BlueZ finds the services of the application.
+func (app *gattApp) GetManagedObjects() (map[dbus.ObjectPath]map[string]map[string]dbus.Variant, *dbus.Error) {
+	return app.objects, nil
+}
+
+func (app *gattApp) childPath(parent dbus.ObjectPath, kind string) dbus.ObjectPath {
+	app.nextID++
+	return parent + dbus.ObjectPath(fmt.Sprintf("/%s%d", kind, app.nextID))
+}
+
+// addService adds a primary service and returns its path.
+func (app *gattApp) addService(uuid bluetooth.UUID) dbus.ObjectPath {
+	path := app.childPath(app.path, "service")
+	app.objects[path] = map[string]map[string]dbus.Variant{
+		"org.bluez.GattService1": {
+			"UUID":    dbus.MakeVariant(uuid.String()),
+			"Primary": dbus.MakeVariant(true),
+		},
+	}
+	return path
+}
+
+// addCharacteristic adds a characteristic to a service. The flags are those of
+// the BlueZ GattCharacteristic1 interface, e.g. "read" or "encrypt-read".
+// onWrite, if set, is called with every value a client writes; an error fails
+// the write.
+func (app *gattApp) addCharacteristic(service dbus.ObjectPath, uuid bluetooth.UUID, flags []string, value []byte, onWrite func(value []byte, withResponse bool) error) (*gattValue, error) {
+	v := &gattValue{bus: app.bus, path: app.childPath(service, "char"), value: value, onWrite: onWrite}
+	if err := app.bus.Export(v, v.path, "org.bluez.GattCharacteristic1"); err != nil {
+		return nil, err
+	}
+	app.objects[v.path] = map[string]map[string]dbus.Variant{
+		"org.bluez.GattCharacteristic1": {
+			"UUID":    dbus.MakeVariant(uuid.String()),
+			"Service": dbus.MakeVariant(service),
+			"Flags":   dbus.MakeVariant(flags),
+		},
+	}
+	return v, nil
+}
+
+// addDescriptor adds a descriptor with a fixed value to a characteristic.
+func (app *gattApp) addDescriptor(char *gattValue, uuid bluetooth.UUID, flags []string, value []byte) error {
+	v := &gattValue{bus: app.bus, path: app.childPath(char.path, "desc"), value: value}
+	if err := app.bus.Export(v, v.path, "org.bluez.GattDescriptor1"); err != nil {
+		return err
+	}
+	app.objects[v.path] = map[string]map[string]dbus.Variant{
+		"org.bluez.GattDescriptor1": {
+			"UUID":           dbus.MakeVariant(uuid.String()),
+			"Characteristic": dbus.MakeVariant(char.path),
+			"Flags":          dbus.MakeVariant(flags),
+		},
+	}
+	return nil
+}
+
+// register exports the application and registers it with the adapter in use.
+// No objects can be added after that.
+func (app *gattApp) register() error {
+	if err := app.bus.Export(app, app.path, "org.freedesktop.DBus.ObjectManager"); err != nil {
+		return err
+	}
+	manager := app.bus.Object("org.bluez", dbus.ObjectPath("/org/bluez/"+adapterID))
+	return manager.Call("org.bluez.GattManager1.RegisterApplication", 0, app.path, map[string]dbus.Variant{}).Err
+}
+
+func (app *gattApp) unregister() {
+	manager := app.bus.Object("org.bluez", dbus.ObjectPath("/org/bluez/"+adapterID))
+	manager.Call("org.bluez.GattManager1.UnregisterApplication", 0, app.path)
+}
+
+// errNotSubscribed is returned by gattValue.notify when no client subscribed
+// to notifications.
+var errNotSubscribed = errors.New("no client is subscribed")
+
+// gattValue implements org.bluez.GattCharacteristic1 or
+// org.bluez.GattDescriptor1 for a characteristic or descriptor of a gattApp.
+type gattValue struct {
+	bus     *dbus.Conn
+	path    dbus.ObjectPath
+	onWrite func(value []byte, withResponse bool) error
+
+	// onRead, if set, returns the value that clients read, instead of the
+	// value last written or notified.
+	onRead func() ([]byte, error)
+
+	mu        sync.Mutex
+	value     []byte
+	notifying bool
+}
+
+func (v *gattValue) ReadValue(options map[string]dbus.Variant) ([]byte, *dbus.Error) {
+	offset, _ := options["offset"].Value().(uint16)
+	// Long values are read in parts, at increasing offsets, which are
+	// served from the value read first.
+	if v.onRead != nil && offset == 0 {
+		value, err := v.onRead()
+		if err != nil {
+			return nil, dbus.NewError("org.bluez.Error.Failed", []any{err.Error()})
+		}
+		v.mu.Lock()
+		v.value = value
+		v.mu.Unlock()
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if int(offset) > len(v.value) {
+		return nil, dbus.NewError("org.bluez.Error.InvalidOffset", nil)
+	}
+	return v.value[offset:], nil
+}
+
+func (v *gattValue) WriteValue(value []byte, options map[string]dbus.Variant) *dbus.Error {
+	v.mu.Lock()
+	v.value = value
+	v.mu.Unlock()
+	if v.onWrite != nil {
+		writeType, _ := options["type"].Value().(string)
+		if err := v.onWrite(value, writeType != "command"); err != nil {
+			return dbus.NewError("org.bluez.Error.Failed", []any{err.Error()})
+		}
+	}
+	return nil
+}
+
+func (v *gattValue) StartNotify() *dbus.Error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.notifying = true
+	return nil
+}
+
+func (v *gattValue) StopNotify() *dbus.Error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.notifying = false
+	return nil
+}
+
+// notify sets the value and sends it to the subscribed client, or returns
+// errNotSubscribed.
+func (v *gattValue) notify(value []byte) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.value = value
+	if !v.notifying {
+		return errNotSubscribed
+	}
+	changed := map[string]dbus.Variant{"Value": dbus.MakeVariant(value)}
+	return v.bus.Emit(v.path, "org.freedesktop.DBus.Properties.PropertiesChanged", "org.bluez.GattCharacteristic1", changed, []string{})
+}
@@ -0,0 +1,77 @@
+package gattclient
+
+import "tinygo.org/x/bluetooth"
+
+// Bluetooth returns the Adapter that connects with a Bluetooth adapter.
+func Bluetooth(adapter *bluetooth.Adapter) Adapter {
+	return bluetoothAdapter{adapter}
+}
+
+// IsBluetooth reports whether a device was connected with a Bluetooth
+// adapter, as opposed to being simulated.
+func IsBluetooth(device Device) bool {
+	_, ok := device.(bluetoothDevice)
+	return ok
+}
+
+type bluetoothAdapter struct {
+	adapter *bluetooth.Adapter
+}
+
+func (a bluetoothAdapter) Connect(address bluetooth.Address, params bluetooth.ConnectionParams) (Device, error) {
+	device, err := a.adapter.Connect(address, params)
+	if err != nil {
+		return nil, err
+	}
+	return bluetoothDevice{device}, nil
+}
+
+type bluetoothDevice struct {
+	device bluetooth.Device
+}
+
+func (d bluetoothDevice) Address() bluetooth.Address {
+	return d.device.Address
+}
+
+func (d bluetoothDevice) DiscoverServices(uuids []bluetooth.UUID) ([]Service, error) {
+	services, err := d.device.DiscoverServices(uuids)
+	if err != nil {
+		return nil, err
+	}
+	wrapped := make([]Service, len(services))
+	for i, service := range services {
+		wrapped[i] = bluetoothService{service}
+	}
+	return wrapped, nil
+}
+
+func (d bluetoothDevice) Disconnect() error {
+	return d.device.Disconnect()
+}
+
+type bluetoothService struct {
+	service bluetooth.DeviceService
+}
+
+func (s bluetoothService) UUID() bluetooth.UUID {
+	return s.service.UUID()
+}
+
+func (s bluetoothService) DiscoverCharacteristics(uuids []bluetooth.UUID) ([]Characteristic, error) {
+	chars, err := s.service.DiscoverCharacteristics(uuids)
+	if err != nil {
+		return nil, err
+	}
+	wrapped := make([]Characteristic, len(chars))
+	for i := range chars {
+		wrapped[i] = bluetoothCharacteristic{&chars[i]}
+	}
+	return wrapped, nil
+}
+
+// bluetoothCharacteristic has a pointer because on Linux, subscribing keeps
+// state in the characteristic that unsubscribing needs.
+type bluetoothCharacteristic struct {
+	*bluetooth.DeviceCharacteristic
+}
@@ -0,0 +1,14 @@
+//go:build linux
+
+package gattclient
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Write is missing from the bluetooth package on Linux, where a write request
+// takes a WriteValue call to BlueZ with the "request" type option.
+func (c bluetoothCharacteristic) Write(p []byte) (int, error) {
+	return 0, fmt.Errorf("write requests: %w", errors.ErrUnsupported)
+}
@@ -0,0 +1,164 @@
+// Package gattclient connects to peripherals and finds their characteristics,
+// working around the differences between the platforms of the bluetooth
+// package.
+package gattclient
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"tinygo.org/x/bluetooth"
+)
+
+var (
+	// ErrTimeout is returned when a connection attempt times out.
+	ErrTimeout = errors.New("connection attempt timed out")
+
+	// ErrCharacteristicNotFound is returned when a device has no
+	// characteristic with the UUID.
+	ErrCharacteristicNotFound = errors.New("characteristic not found")
+)
+
+// connectMu serializes connection attempts: BlueZ fails a connection attempt
+// while another one is in progress.
+var connectMu sync.Mutex
+
+// Adapter connects to devices. Bluetooth makes one of a *bluetooth.Adapter.
+type Adapter interface {
+	Connect(address bluetooth.Address, params bluetooth.ConnectionParams) (Device, error)
+}
+
+// Device is a connected device.
+type Device interface {
+	Address() bluetooth.Address
+
+	// DiscoverServices discovers the services with the UUIDs, or all
+	// services if there are none. It fails if one of the UUIDs is missing.
+	DiscoverServices(uuids []bluetooth.UUID) ([]Service, error)
+
+	Disconnect() error
+}
+
+// Service is a service of a connected device.
+type Service interface {
+	UUID() bluetooth.UUID
+
+	// DiscoverCharacteristics discovers the characteristics with the
+	// UUIDs, or all characteristics if there are none. It fails if one of
+	// the UUIDs is missing.
+	DiscoverCharacteristics(uuids []bluetooth.UUID) ([]Characteristic, error)
+}
+
+// Characteristic is a characteristic of a connected device.
+type Characteristic interface {
+	UUID() bluetooth.UUID
+	Read(data []byte) (int, error)
+
+	// Write writes with a write request, which the device responds to,
+	// and WriteWithoutResponse with a write command.
+	Write(p []byte) (int, error)
+	WriteWithoutResponse(p []byte) (int, error)
+
+	// EnableNotifications subscribes to notifications or indications,
+	// and a nil callback unsubscribes.
+	EnableNotifications(callback func(buf []byte)) error
+
+	// GetMTU returns the MTU of the connection.
+	GetMTU() (uint16, error)
+}
+
+// Dialer connects to devices with an adapter.
+type Dialer struct {
+	Adapter Adapter
+	Params  bluetooth.ConnectionParams
+
+	// Timeout is how long a connection attempt may take. Not all platforms
+	// honor Params.ConnectionTimeout (BlueZ waits forever for the device to
+	// show up), so the timeout is enforced here as well.
+	Timeout time.Duration
+
+	// Prepare, if set, is called at the start of each connection attempt,
+	// for example to make the device known to the adapter.
+	Prepare func(address bluetooth.Address)
+}
+
+// Connect makes a single connection attempt. If it times out, the connection
+// is closed should it succeed later.
+func (d *Dialer) Connect(address bluetooth.Address) (Device, error) {
+	connectMu.Lock()
+	defer connectMu.Unlock()
+
+	type result struct {
+		device Device
+		err    error
+	}
+	done := make(chan result, 1)
+	go func() {
+		if d.Prepare != nil {
+			d.Prepare(address)
+		}
+		device, err := d.Adapter.Connect(address, d.Params)
+		done <- result{device, err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.device, r.err
+	case <-time.After(d.Timeout):
+		// The attempt can't be cancelled, but if it does succeed later the
+		// connection shouldn't linger.
+		go func() {
+			if r := <-done; r.err == nil {
+				r.device.Disconnect()
+			}
+		}()
+		return nil, ErrTimeout
+	}
+}
+
+// FindCharacteristic discovers a single characteristic of a connected device.
+func FindCharacteristic(device Device, serviceUUID, charUUID bluetooth.UUID) (Characteristic, error) {
+	services, err := device.DiscoverServices([]bluetooth.UUID{serviceUUID})
+	if err != nil {
+		return nil, fmt.Errorf("service %s: %w", serviceUUID.String(), err)
+	}
+	chars, err := services[0].DiscoverCharacteristics([]bluetooth.UUID{charUUID})
+	if err != nil {
+		return nil, fmt.Errorf("characteristic %s: %w", charUUID.String(), err)
+	}
+	return chars[0], nil
+}
+
+// FindAnyCharacteristic discovers a characteristic of a connected device by
+// its UUID, in the given service or, if the service UUID is zero, in any
+// service. It also returns the UUID of the service the characteristic was
+// found in.
+func FindAnyCharacteristic(device Device, serviceUUID, charUUID bluetooth.UUID) (bluetooth.UUID, Characteristic, error) {
+	var filter []bluetooth.UUID
+	if serviceUUID != (bluetooth.UUID{}) {
+		filter = []bluetooth.UUID{serviceUUID}
+	}
+	services, err := device.DiscoverServices(filter)
+	if err != nil {
+		return bluetooth.UUID{}, nil, err
+	}
+	for _, service := range services {
+		chars, err := service.DiscoverCharacteristics([]bluetooth.UUID{charUUID})
+		if err == nil && len(chars) > 0 {
+			return service.UUID(), chars[0], nil
+		}
+	}
+	return bluetooth.UUID{}, nil, fmt.Errorf("%w: %s", ErrCharacteristicNotFound, charUUID.String())
+}
+
+// Read reads the value of a characteristic, which is at most 512 bytes.
+func Read(char Characteristic) ([]byte, error) {
+	buf := make([]byte, 512)
+	n, err := char.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"example.com/m/gattclient"
+	"tinygo.org/x/bluetooth"
+)
+
+// A GATT script is a test of a device, such as a bring-up test, made of one
+// step per line:
+//
+//	timeout 5s                  # the timeout of the following steps
+//	connect A4:C1:38:00:00:01
+//	read 2a24                   # CHAR is a UUID, or SERVICE/CHAR
+//	expect 2a19 64              # read and compare; hex, or else a string
+//	write 180d/2a39 01
+//	notify-until 2a37 0648      # wait for a notification with the value
+//	wait 1s
+//	disconnect
+//
+// Unlike a shell script, it carries on past failed steps, and ends with a
+// summary of the steps that passed and failed. A step that times out
+// disconnects, which aborts what it was doing.
+
+var gattScriptSteps = map[string]struct {
+	args  int
+	usage string
+}{
+	"timeout":      {1, "timeout DURATION"},
+	"connect":      {1, "connect ADDRESS"},
+	"disconnect":   {0, "disconnect"},
+	"read":         {1, "read CHAR"},
+	"write":        {2, "write CHAR VALUE"},
+	"expect":       {2, "expect CHAR VALUE"},
+	"notify-until": {2, "notify-until CHAR VALUE"},
+	"wait":         {1, "wait DURATION"},
+}
+
+type gattScriptStep struct {
+	line int
+	args []string
+}
+
+// gattScript runs the steps of a script.
+type gattScript struct {
+	conn *connectFlags
+
+	mu     sync.Mutex // guards device against aborts
+	device gattclient.Device
+	chars  map[string]shellChar // by CHAR argument
+}
+
+func runGattScript(args []string) error {
+	fs := newFlagSet("gatt script", "<script>")
+	var conn connectFlags
+	conn.registerFlags(fs)
+	timeout := fs.Duration("step-timeout", 30*time.Second, "fail a step that takes longer than this, until a timeout step changes it")
+	failFast := fs.Bool("fail-fast", false, "stop at the first failed step")
+	parseFlags(fs, args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("expected a script")
+	}
+	if err := conn.validate(); err != nil {
+		return err
+	}
+	steps, err := readGattScript(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	if err := enableAdapter(); err != nil {
+		return err
+	}
+	s := &gattScript{conn: &conn, chars: make(map[string]shellChar)}
+	defer s.disconnect()
+	var passed, failed int
+	for _, step := range steps {
+		if step.args[0] == "timeout" {
+			*timeout, _ = time.ParseDuration(step.args[1])
+			continue
+		}
+		start := time.Now()
+		result, err := s.run(step.args, *timeout)
+		elapsed := time.Since(start).Round(time.Millisecond)
+		if err != nil {
+			failed++
+			fmt.Printf("FAIL %4d %s (%s): %v\n", step.line, strings.Join(step.args, " "), elapsed, err)
+			if *failFast {
+				break
+			}
+			continue
+		}
+		passed++
+		if result != "" {
+			result = ": " + result
+		}
+		fmt.Printf("PASS %4d %s (%s)%s\n", step.line, strings.Join(step.args, " "), elapsed, result)
+	}
+	fmt.Printf("%d passed, %d failed\n", passed, failed)
+	if failed != 0 {
+		return fmt.Errorf("%d of %d steps failed", failed, passed+failed)
+	}
+	return nil
+}
+
+// readGattScript reads the steps of a script, checking them before anything
+// runs.
+func readGattScript(path string) ([]gattScriptStep, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var steps []gattScriptStep
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		args := strings.Fields(strings.SplitN(scanner.Text(), "#", 2)[0])
+		if len(args) == 0 {
+			continue
+		}
+		step, ok := gattScriptSteps[args[0]]
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: unknown step %q", path, n, args[0])
+		}
+		if len(args)-1 != step.args && !(step.args == 2 && len(args) > 3) {
+			return nil, fmt.Errorf("%s:%d: usage: %s", path, n, step.usage)
+		}
+		if args[0] == "timeout" || args[0] == "wait" {
+			if d, err := time.ParseDuration(args[1]); err != nil || d <= 0 {
+				return nil, fmt.Errorf("%s:%d: invalid duration %q", path, n, args[1])
+			}
+		}
+		if step.args == 2 {
+			// Values may contain spaces.
+			args = []string{args[0], args[1], strings.Join(args[2:], " ")}
+		}
+		steps = append(steps, gattScriptStep{line: n, args: args})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(steps) == 0 {
+		return nil, fmt.Errorf("%s: no steps", path)
+	}
+	return steps, nil
+}
+
+// run runs a step with a timeout. On timeout, the device is disconnected so
+// that the step returns.
+func (s *gattScript) run(args []string, timeout time.Duration) (string, error) {
+	type outcome struct {
+		result string
+		err    error
+	}
+	stop := make(chan struct{})
+	done := make(chan outcome, 1)
+	go func() {
+		result, err := s.exec(args, stop)
+		done <- outcome{result, err}
+	}()
+	select {
+	case o := <-done:
+		return o.result, o.err
+	case <-time.After(timeout):
+	}
+	close(stop)
+	s.mu.Lock()
+	device := s.device
+	s.mu.Unlock()
+	if device != nil {
+		device.Disconnect()
+	}
+	// A connection attempt only ends by its own -timeout, so the device
+	// may have connected by now.
+	<-done
+	s.disconnect()
+	return "", fmt.Errorf("timed out after %s", timeout)
+}
+
+func (s *gattScript) exec(args []string, stop <-chan struct{}) (string, error) {
+	switch args[0] {
+	case "connect":
+		if s.device != nil {
+			return "", errors.New("already connected")
+		}
+		address, err := parseAddress(args[1])
+		if err != nil {
+			return "", err
+		}
+		device, err := s.conn.connect(address)
+		if err != nil {
+			return "", err
+		}
+		s.mu.Lock()
+		s.device = device
+		s.mu.Unlock()
+		return "", nil
+	case "disconnect":
+		if s.device == nil {
+			return "", errors.New("not connected")
+		}
+		s.disconnect()
+		return "", nil
+	case "wait":
+		d, _ := time.ParseDuration(args[1])
+		select {
+		case <-time.After(d):
+		case <-stop:
+		}
+		return "", nil
+	}
+
+	char, err := s.characteristic(args[1])
+	if err != nil {
+		return "", err
+	}
+	switch args[0] {
+	case "read":
+		value, err := gattclient.Read(char.Characteristic)
+		if err != nil {
+			return "", err
+		}
+		return describeValue(value), nil
+	case "write":
+		return "", writeCharacteristic(s.device, char.service, char.Characteristic, parseWriteValue(args[2], false), true)
+	case "expect":
+		value, err := gattclient.Read(char.Characteristic)
+		if err != nil {
+			return "", err
+		}
+		if want := parseWriteValue(args[2], false); !bytes.Equal(value, want) {
+			return "", fmt.Errorf("got %s, want %s", describeValue(value), describeValue(want))
+		}
+		return describeValue(value), nil
+	case "notify-until":
+		want := parseWriteValue(args[2], false)
+		values := make(chan []byte, 16)
+		err := char.EnableNotifications(func(value []byte) {
+			select {
+			case values <- append([]byte(nil), value...):
+			default:
+			}
+		})
+		if err != nil {
+			return "", err
+		}
+		defer char.EnableNotifications(nil)
+		for {
+			select {
+			case value := <-values:
+				if bytes.Equal(value, want) {
+					return describeValue(value), nil
+				}
+			case <-stop:
+				return "", nil
+			}
+		}
+	}
+	return "", fmt.Errorf("unknown step %q", args[0])
+}
+
+// characteristic finds a characteristic given as CHAR or SERVICE/CHAR.
+func (s *gattScript) characteristic(arg string) (shellChar, error) {
+	if s.device == nil {
+		return shellChar{}, errors.New("not connected")
+	}
+	if char, ok := s.chars[arg]; ok {
+		return char, nil
+	}
+	var serviceUUID bluetooth.UUID
+	charArg := arg
+	if service, c, ok := strings.Cut(arg, "/"); ok {
+		var err error
+		if serviceUUID, err = bluetooth.ParseUUID(service); err != nil {
+			return shellChar{}, err
+		}
+		charArg = c
+	}
+	charUUID, err := bluetooth.ParseUUID(charArg)
+	if err != nil {
+		return shellChar{}, err
+	}
+	service, char, err := gattclient.FindAnyCharacteristic(s.device, serviceUUID, charUUID)
+	if err != nil {
+		return shellChar{}, err
+	}
+	s.chars[arg] = shellChar{service, char}
+	return s.chars[arg], nil
+}
+
+func (s *gattScript) disconnect() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.device != nil {
+		s.device.Disconnect()
+	}
+	s.device = nil
+	clear(s.chars)
+}
+
+// describeValue formats a value as hex, followed by the string if it is
+// printable.
+func describeValue(value []byte) string {
+	if s := printableUTF8(value); s != "" {
+		return fmt.Sprintf("%s (%q)", hex.EncodeToString(value), s)
+	}
+	return hex.EncodeToString(value)
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	"example.com/m/blepb"
+	"example.com/m/decode"
+	"example.com/m/gattclient"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"tinygo.org/x/bluetooth"
+)
+
+func runGRPC(args []string) error {
+	fs := newFlagSet("grpc", "")
+	listen := fs.String("listen", "localhost:50051", "address to serve the gRPC API on")
+	var conn connectFlags
+	conn.registerFlags(fs)
+	fs.Var(decode.BTHomeKeys, "bthome-key", "decrypt BTHome advertisements of a device, as ADDRESS=KEY (repeatable)")
+	fs.Var(decode.MiBeaconKeys, "mibeacon-key", "decrypt Xiaomi MiBeacon advertisements of a device with its bind key, as ADDRESS=KEY (repeatable)")
+	metricsAddr := metricsFlag(fs)
+	var scanning scanFlags
+	scanning.registerFlags(fs)
+	parseFlags(fs, args)
+	if err := serveMetrics(*metricsAddr); err != nil {
+		return err
+	}
+	if err := scanning.setup(); err != nil {
+		return err
+	}
+	if err := conn.validate(); err != nil {
+		return err
+	}
+
+	l, err := net.Listen("tcp", *listen)
+	if err != nil {
+		return err
+	}
+	ctx, stop := shutdownContext()
+	defer stop()
+
+	if err := enableAdapter(); err != nil {
+		return err
+	}
+	s := &grpcServer{
+		connections: newConnections(&conn),
+		stream:      newStreamHub(),
+		subscribed:  make(map[string]bool),
+	}
+	defer s.connections.disconnectAll()
+	server := grpc.NewServer()
+	blepb.RegisterBLEServer(server, s)
+	go func() {
+		<-ctx.Done()
+		stopScan()
+		s.stream.close()
+		server.Stop()
+	}()
+
+	scanErr := scanInBackground(s.stream.publish)
+
+	apiLog.Info("serving the gRPC API, press Ctrl-C to stop", "address", l.Addr().String())
+	if err := server.Serve(l); err != nil {
+		stop()
+		return err
+	}
+	return <-scanErr
+}
+
+// grpcServer implements the BLE gRPC service, much like apiServer implements
+// the HTTP API.
+type grpcServer struct {
+	blepb.UnimplementedBLEServer
+	connections *connections
+	stream      *streamHub
+
+	mu         sync.Mutex
+	subscribed map[string]bool
+}
+
+func (g *grpcServer) Scan(req *blepb.ScanRequest, stream blepb.BLE_ScanServer) error {
+	filter := &scanFilter{name: req.Name}
+	if req.MinRssi != nil {
+		filter.minRSSI, filter.hasMinRSSI = int16(*req.MinRssi), true
+	}
+	for _, s := range req.ServiceUuids {
+		uuid, err := bluetooth.ParseUUID(s)
+		if err != nil {
+			return status.Errorf(codes.InvalidArgument, "invalid service UUID: %v", err)
+		}
+		filter.services = append(filter.services, uuid)
+	}
+
+	c := g.stream.subscribe(filter)
+	defer g.stream.unsubscribe(c)
+	for {
+		select {
+		case s := <-c.ch:
+			if err := stream.Send(advertisementProto(s)); err != nil {
+				return err
+			}
+		case <-stream.Context().Done():
+			return nil
+		case <-g.stream.done:
+			return status.Error(codes.Unavailable, "server shutting down")
+		}
+	}
+}
+
+// advertisementProto returns the protobuf form of a sighting.
+func advertisementProto(s *sighting) *blepb.Advertisement {
+	a := &blepb.Advertisement{
+		Time:      timestamppb.New(s.Time),
+		Address:   s.Address,
+		Rssi:      int32(s.RSSI),
+		LocalName: s.LocalName,
+		Raw:       s.Raw,
+	}
+	if len(s.ManufacturerData) != 0 {
+		a.ManufacturerData = make(map[uint32][]byte)
+		for _, element := range s.ManufacturerData {
+			a.ManufacturerData[uint32(element.CompanyID)] = element.Data
+		}
+	}
+	if len(s.ServiceData) != 0 {
+		a.ServiceData = make(map[string][]byte)
+		for _, element := range s.ServiceData {
+			a.ServiceData[element.UUID.String()] = element.Data
+		}
+	}
+	if len(s.Frames) != 0 {
+		a.Frames = make(map[string]string)
+		for i, key := range frameKeys(s.Frames) {
+			a.Frames[key] = s.Frames[i].String()
+		}
+	}
+	return a
+}
+
+func (g *grpcServer) Connect(ctx context.Context, req *blepb.ConnectRequest) (*blepb.ConnectResponse, error) {
+	address, err := parseAddress(req.Address)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if _, err := g.connections.connect(address); errors.Is(err, gattclient.ErrTimeout) {
+		return nil, status.Error(codes.DeadlineExceeded, err.Error())
+	} else if err != nil {
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+	return &blepb.ConnectResponse{}, nil
+}
+
+func (g *grpcServer) Disconnect(ctx context.Context, req *blepb.DisconnectRequest) (*blepb.DisconnectResponse, error) {
+	address, err := parseAddress(req.Address)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err := g.connections.disconnect(address); errors.Is(err, errNotConnected) {
+		return nil, status.Errorf(codes.FailedPrecondition, "%v to %s", err, address.String())
+	} else if err != nil {
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+	return &blepb.DisconnectResponse{}, nil
+}
+
+// characteristic finds the characteristic of a request, returning gRPC
+// status errors.
+func (g *grpcServer) characteristic(c *blepb.Characteristic) (gattclient.Device, bluetooth.UUID, gattclient.Characteristic, error) {
+	if c == nil {
+		return nil, bluetooth.UUID{}, nil, status.Error(codes.InvalidArgument, "missing characteristic")
+	}
+	address, err := parseAddress(c.Address)
+	if err != nil {
+		return nil, bluetooth.UUID{}, nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	charUUID, err := bluetooth.ParseUUID(c.Uuid)
+	if err != nil {
+		return nil, bluetooth.UUID{}, nil, status.Errorf(codes.InvalidArgument, "invalid characteristic UUID: %v", err)
+	}
+	var serviceUUID bluetooth.UUID
+	if c.ServiceUuid != "" {
+		if serviceUUID, err = bluetooth.ParseUUID(c.ServiceUuid); err != nil {
+			return nil, bluetooth.UUID{}, nil, status.Errorf(codes.InvalidArgument, "invalid service UUID: %v", err)
+		}
+	}
+	device, ok := g.connections.get(address)
+	if !ok {
+		return nil, bluetooth.UUID{}, nil, status.Errorf(codes.FailedPrecondition, "%v to %s", errNotConnected, address.String())
+	}
+	serviceUUID, char, err := gattclient.FindAnyCharacteristic(device, serviceUUID, charUUID)
+	if errors.Is(err, gattclient.ErrCharacteristicNotFound) {
+		return nil, bluetooth.UUID{}, nil, status.Error(codes.NotFound, err.Error())
+	} else if err != nil {
+		return nil, bluetooth.UUID{}, nil, status.Error(codes.Unavailable, err.Error())
+	}
+	return device, serviceUUID, char, nil
+}
+
+func (g *grpcServer) Read(ctx context.Context, req *blepb.ReadRequest) (*blepb.ReadResponse, error) {
+	_, _, char, err := g.characteristic(req.Characteristic)
+	if err != nil {
+		return nil, err
+	}
+	value, err := gattclient.Read(char)
+	if err != nil {
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+	return &blepb.ReadResponse{Value: value}, nil
+}
+
+func (g *grpcServer) Write(ctx context.Context, req *blepb.WriteRequest) (*blepb.WriteResponse, error) {
+	device, serviceUUID, char, err := g.characteristic(req.Characteristic)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeCharacteristic(device, serviceUUID, char, req.Value, !req.WithoutResponse); err != nil {
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+	return &blepb.WriteResponse{}, nil
+}
+
+// Subscribe streams the notifications of a characteristic. The bluetooth
+// package has a single notification handler per characteristic, so there can
+// only be one subscription to a characteristic at a time.
+func (g *grpcServer) Subscribe(req *blepb.SubscribeRequest, stream blepb.BLE_SubscribeServer) error {
+	device, serviceUUID, char, err := g.characteristic(req.Characteristic)
+	if err != nil {
+		return err
+	}
+	key := device.Address().String() + "/" + serviceUUID.String() + "/" + char.UUID().String()
+	g.mu.Lock()
+	if g.subscribed[key] {
+		g.mu.Unlock()
+		return status.Error(codes.AlreadyExists, "characteristic already subscribed to")
+	}
+	g.subscribed[key] = true
+	g.mu.Unlock()
+	defer func() {
+		g.mu.Lock()
+		delete(g.subscribed, key)
+		g.mu.Unlock()
+	}()
+	notifications := make(chan *blepb.Notification, streamBuffer)
+	err = char.EnableNotifications(func(value []byte) {
+		n := &blepb.Notification{Time: timestamppb.Now(), Value: bytes.Clone(value)}
+		select {
+		case notifications <- n:
+		default:
+		}
+	})
+	if err != nil {
+		return status.Error(codes.Unavailable, err.Error())
+	}
+	defer char.EnableNotifications(nil)
+
+	gone := g.connections.gone(device)
+	for {
+		select {
+		case n := <-notifications:
+			if err := stream.Send(n); err != nil {
+				return err
+			}
+		case <-gone:
+			return status.Error(codes.Unavailable, fmt.Sprintf("%v from %s", errDisconnected, device.Address().String()))
+		case <-stream.Context().Done():
+			return nil
+		case <-g.stream.done:
+			return status.Error(codes.Unavailable, "server shutting down")
+		}
+	}
+}
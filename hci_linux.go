@@ -0,0 +1,183 @@
+//go:build linux
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+	"tinygo.org/x/bluetooth"
+)
+
+// Neither BlueZ nor the management interface can change the PHY of an
+// existing connection, so that is done with HCI commands on a raw HCI socket,
+// which needs CAP_NET_RAW. The kernel keeps managing the controller; only
+// commands about the connection are sent.
+
+const (
+	hciCommandPacket = 0x01
+	hciEventPacket   = 0x04
+
+	hciEventCommandComplete = 0x0e
+	hciEventCommandStatus   = 0x0f
+	hciEventLEMeta          = 0x3e
+
+	hciLEPHYUpdateComplete = 0x0c
+
+	hciLEReadPHY = 0x2030
+	hciLESetPHY  = 0x2032
+
+	hciFilter      = 2          // the HCI_FILTER socket option
+	hciGetConnInfo = 0x800448d5 // _IOR('H', 213, int)
+	hciLELink      = 0x80
+)
+
+// phyNames names the PHYs of HCI events.
+var phyNames = map[byte]string{1: "1M", 2: "2M", 3: "Coded"}
+
+// phyBits are the PHYs as in the TX_PHYS and RX_PHYS of LE Set PHY.
+var phyBits = map[string]byte{"1M": 0x01, "2M": 0x02, "Coded": 0x04}
+
+type hciSocket struct {
+	fd int
+}
+
+func openHCI(id string) (*hciSocket, error) {
+	index, err := controllerIndex(id)
+	if err != nil {
+		return nil, err
+	}
+	fd, err := unix.Socket(unix.AF_BLUETOOTH, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.BTPROTO_HCI)
+	if err != nil {
+		return nil, fmt.Errorf("HCI socket: %w", err)
+	}
+	if err := unix.Bind(fd, &unix.SockaddrHCI{Dev: index, Channel: unix.HCI_CHANNEL_RAW}); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("HCI socket: %w", err)
+	}
+	// Receive all events: the type mask, the event mask and no opcode.
+	filter := make([]byte, 16)
+	binary.LittleEndian.PutUint32(filter, 1<<hciEventPacket)
+	binary.LittleEndian.PutUint32(filter[4:], 0xffffffff)
+	binary.LittleEndian.PutUint32(filter[8:], 0xffffffff)
+	if err := unix.SetsockoptString(fd, unix.SOL_HCI, hciFilter, string(filter)); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("HCI socket: %w", err)
+	}
+	timeout := unix.NsecToTimeval(int64(5 * time.Second))
+	if err := unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &timeout); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	return &hciSocket{fd: fd}, nil
+}
+
+func (h *hciSocket) Close() error {
+	return unix.Close(h.fd)
+}
+
+// connectionHandle returns the handle of the LE connection to a device.
+func (h *hciSocket) connectionHandle(address bluetooth.Address) (uint16, error) {
+	// struct hci_conn_info_req, followed by one struct hci_conn_info.
+	req := make([]byte, 8+16)
+	copy(req, address.MAC[:])
+	req[6] = hciLELink
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(h.fd), hciGetConnInfo, uintptr(unsafe.Pointer(&req[0]))); errno != 0 {
+		return 0, fmt.Errorf("no connection to %s: %w", address.String(), errno)
+	}
+	return binary.LittleEndian.Uint16(req[8:]), nil
+}
+
+// command sends an HCI command, and waits for the event that match accepts.
+// match is called for every event, with its code and parameters.
+func (h *hciSocket) command(opcode uint16, params []byte, match func(code byte, params []byte) (bool, error)) error {
+	packet := []byte{hciCommandPacket}
+	packet = binary.LittleEndian.AppendUint16(packet, opcode)
+	packet = append(packet, byte(len(params)))
+	if _, err := unix.Write(h.fd, append(packet, params...)); err != nil {
+		return fmt.Errorf("HCI command 0x%04x: %w", opcode, err)
+	}
+	buf := make([]byte, 260)
+	for {
+		n, err := unix.Read(h.fd, buf)
+		if err != nil {
+			return fmt.Errorf("HCI command 0x%04x: %w", opcode, err)
+		}
+		if n < 3 || buf[0] != hciEventPacket || n < 3+int(buf[2]) {
+			continue
+		}
+		if ok, err := match(buf[1], buf[3:3+int(buf[2])]); ok || err != nil {
+			return err
+		}
+	}
+}
+
+// connectionPHY returns the TX and RX PHY of the connection to a device.
+func connectionPHY(address bluetooth.Address) (tx, rx string, err error) {
+	h, err := openHCI(adapterID)
+	if err != nil {
+		return "", "", err
+	}
+	defer h.Close()
+	handle, err := h.connectionHandle(address)
+	if err != nil {
+		return "", "", err
+	}
+	err = h.command(hciLEReadPHY, binary.LittleEndian.AppendUint16(nil, handle), func(code byte, p []byte) (bool, error) {
+		if code != hciEventCommandComplete || len(p) < 3 || binary.LittleEndian.Uint16(p[1:]) != hciLEReadPHY {
+			return false, nil
+		}
+		if len(p) < 8 {
+			return true, errors.New("short LE Read PHY reply")
+		}
+		if p[3] != 0 {
+			return true, fmt.Errorf("LE Read PHY: status 0x%02x", p[3])
+		}
+		tx, rx = phyNames[p[6]], phyNames[p[7]]
+		return true, nil
+	})
+	return tx, rx, err
+}
+
+// requestPHY asks the controller to change the PHY of the connection to a
+// device, and returns the PHYs that the devices agreed on, which need not be
+// the one requested.
+func requestPHY(address bluetooth.Address, phy string) (tx, rx string, err error) {
+	h, err := openHCI(adapterID)
+	if err != nil {
+		return "", "", err
+	}
+	defer h.Close()
+	handle, err := h.connectionHandle(address)
+	if err != nil {
+		return "", "", err
+	}
+	params := binary.LittleEndian.AppendUint16(nil, handle)
+	params = append(params, 0, phyBits[phy], phyBits[phy])
+	params = binary.LittleEndian.AppendUint16(params, 0) // no preferred coding
+	err = h.command(hciLESetPHY, params, func(code byte, p []byte) (bool, error) {
+		switch {
+		case code == hciEventCommandStatus && len(p) >= 4 && binary.LittleEndian.Uint16(p[2:]) == hciLESetPHY:
+			if p[0] != 0 {
+				return true, fmt.Errorf("LE Set PHY: status 0x%02x", p[0])
+			}
+		case code == hciEventLEMeta && len(p) >= 6 && p[0] == hciLEPHYUpdateComplete && binary.LittleEndian.Uint16(p[2:]) == handle:
+			if p[1] != 0 {
+				return true, fmt.Errorf("PHY update: status 0x%02x", p[1])
+			}
+			tx, rx = phyNames[p[4]], phyNames[p[5]]
+			return true, nil
+		}
+		return false, nil
+	})
+	if errors.Is(err, unix.EAGAIN) {
+		// No PHY Update Complete: the PHY stayed as it was, which the
+		// controller may not report.
+		return connectionPHY(address)
+	}
+	return tx, rx, err
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"example.com/m/decode"
+	"example.com/m/gattclient"
+	"tinygo.org/x/bluetooth"
+)
+
+func runHeartRate(args []string) error {
+	fs := newFlagSet("heartrate", "<address>")
+	var conn connectFlags
+	conn.registerFlags(fs)
+	var reconnect reconnectFlags
+	reconnect.registerFlags(fs)
+	format := fs.String("output", "text", "output format: text or json (one object per line)")
+	parseFlags(fs, args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("expected exactly one device address")
+	}
+	if *format != "text" && *format != "json" {
+		return fmt.Errorf("unknown output format %q", *format)
+	}
+	address, err := parseAddress(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := shutdownContext()
+	defer stop()
+
+	if err := enableAdapter(); err != nil {
+		return err
+	}
+	enc := json.NewEncoder(os.Stdout)
+	s := &supervisor{conn: &conn, reconnect: &reconnect, address: address}
+	s.setup = func(device gattclient.Device) (func(), error) {
+		char, err := gattclient.FindCharacteristic(device, bluetooth.ServiceUUIDHeartRate, bluetooth.CharacteristicUUIDHeartRateMeasurement)
+		if err != nil {
+			return nil, err
+		}
+		err = char.EnableNotifications(func(value []byte) {
+			m, err := decode.ParseHeartRate(value)
+			if err != nil {
+				gattLog.Warn("invalid heart rate measurement", "err", err, "value", fmt.Sprintf("%x", value))
+				return
+			}
+			now := time.Now()
+			if *format == "json" {
+				enc.Encode(struct {
+					Time    time.Time `json:"time"`
+					Address string    `json:"address"`
+					decode.HeartRateMeasurement
+				}{now, address.String(), m})
+				return
+			}
+			fmt.Println(now.Format(time.RFC3339Nano), m)
+		})
+		if err != nil {
+			return nil, err
+		}
+		gattLog.Info("streaming heart rate, press Ctrl-C to stop")
+		return func() { char.EnableNotifications(nil) }, nil
+	}
+	return s.run(ctx)
+}
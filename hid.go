@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"tinygo.org/x/bluetooth"
+)
+
+// HID over GATT (HOGP) lets this machine act as a Bluetooth keyboard. The
+// host reads the report map to learn the format of the input reports, and
+// then subscribes to them.
+
+// Report IDs of the input reports in hidReportMap.
+const (
+	hidKeyboardReport = 1 // modifiers, reserved, 6 key usages
+	hidConsumerReport = 2 // one 16-bit consumer control usage
+)
+
+// hidReportMap is the HID report descriptor of a keyboard with consumer
+// control (media) keys.
+var hidReportMap = []byte{
+	0x05, 0x01, // Usage Page (Generic Desktop)
+	0x09, 0x06, // Usage (Keyboard)
+	0xA1, 0x01, // Collection (Application)
+	0x85, hidKeyboardReport, // Report ID
+	0x05, 0x07, //   Usage Page (Keyboard/Keypad)
+	0x19, 0xE0, //   Usage Minimum (Left Control)
+	0x29, 0xE7, //   Usage Maximum (Right GUI)
+	0x15, 0x00, //   Logical Minimum (0)
+	0x25, 0x01, //   Logical Maximum (1)
+	0x75, 0x01, //   Report Size (1)
+	0x95, 0x08, //   Report Count (8)
+	0x81, 0x02, //   Input (Data, Variable, Absolute): modifiers
+	0x95, 0x01, //   Report Count (1)
+	0x75, 0x08, //   Report Size (8)
+	0x81, 0x01, //   Input (Constant): reserved
+	0x95, 0x06, //   Report Count (6)
+	0x75, 0x08, //   Report Size (8)
+	0x15, 0x00, //   Logical Minimum (0)
+	0x25, 0x65, //   Logical Maximum (101)
+	0x19, 0x00, //   Usage Minimum (0)
+	0x29, 0x65, //   Usage Maximum (101)
+	0x81, 0x00, //   Input (Data, Array): keys
+	0xC0,       // End Collection
+	0x05, 0x0C, // Usage Page (Consumer)
+	0x09, 0x01, // Usage (Consumer Control)
+	0xA1, 0x01, // Collection (Application)
+	0x85, hidConsumerReport, // Report ID
+	0x15, 0x00, //   Logical Minimum (0)
+	0x26, 0xFF, 0x03, //   Logical Maximum (1023)
+	0x19, 0x00, //   Usage Minimum (0)
+	0x2A, 0xFF, 0x03, //   Usage Maximum (1023)
+	0x75, 0x10, //   Report Size (16)
+	0x95, 0x01, //   Report Count (1)
+	0x81, 0x00, //   Input (Data, Array)
+	0xC0, // End Collection
+}
+
+const hidLeftShift = 0x02
+
+// hidKey is a key press: a keyboard usage with modifiers, or a consumer
+// control usage.
+type hidKey struct {
+	consumer  bool
+	usage     uint16
+	modifiers byte
+}
+
+// hidChars maps the printable ASCII characters to keyboard usages on a US
+// layout. The host's keyboard layout decides what is actually typed.
+var hidChars = func() map[rune]hidKey {
+	keys := make(map[rune]hidKey)
+	for i, c := range "abcdefghijklmnopqrstuvwxyz" {
+		keys[c] = hidKey{usage: 0x04 + uint16(i)}
+		keys[c-'a'+'A'] = hidKey{usage: 0x04 + uint16(i), modifiers: hidLeftShift}
+	}
+	for i, c := range "1234567890" {
+		keys[c] = hidKey{usage: 0x1E + uint16(i)}
+	}
+	for i, c := range "!@#$%^&*()" {
+		keys[c] = hidKey{usage: 0x1E + uint16(i), modifiers: hidLeftShift}
+	}
+	for _, k := range []struct {
+		plain, shifted rune
+		usage          uint16
+	}{
+		{' ', 0, 0x2C}, {'-', '_', 0x2D}, {'=', '+', 0x2E}, {'[', '{', 0x2F},
+		{']', '}', 0x30}, {'\\', '|', 0x31}, {';', ':', 0x33}, {'\'', '"', 0x34},
+		{'`', '~', 0x35}, {',', '<', 0x36}, {'.', '>', 0x37}, {'/', '?', 0x38},
+		{'\t', 0, 0x2B},
+	} {
+		keys[k.plain] = hidKey{usage: k.usage}
+		if k.shifted != 0 {
+			keys[k.shifted] = hidKey{usage: k.usage, modifiers: hidLeftShift}
+		}
+	}
+	return keys
+}()
+
+// hidNamedKeys are the keys that can be given by name in braces, e.g. {enter}.
+var hidNamedKeys = map[string]hidKey{
+	"enter":     {usage: 0x28},
+	"esc":       {usage: 0x29},
+	"backspace": {usage: 0x2A},
+	"tab":       {usage: 0x2B},
+	"right":     {usage: 0x4F},
+	"left":      {usage: 0x50},
+	"down":      {usage: 0x51},
+	"up":        {usage: 0x52},
+	"play":      {consumer: true, usage: 0xCD},
+	"next":      {consumer: true, usage: 0xB5},
+	"prev":      {consumer: true, usage: 0xB6},
+	"mute":      {consumer: true, usage: 0xE2},
+	"volup":     {consumer: true, usage: 0xE9},
+	"voldown":   {consumer: true, usage: 0xEA},
+}
+
+// parseKeys converts text to key presses. Named keys are given in braces,
+// e.g. "hello{enter}" or "{volup}"; a literal brace is typed as {{.
+func parseKeys(text string) ([]hidKey, error) {
+	var keys []hidKey
+	for len(text) > 0 {
+		if strings.HasPrefix(text, "{{") {
+			keys = append(keys, hidChars['{'])
+			text = text[2:]
+			continue
+		}
+		if text[0] == '{' {
+			name, rest, ok := strings.Cut(text[1:], "}")
+			key, known := hidNamedKeys[name]
+			if !ok || !known {
+				return nil, fmt.Errorf("unknown key {%s}", name)
+			}
+			keys = append(keys, key)
+			text = rest
+			continue
+		}
+		c := []rune(text)[0]
+		key, ok := hidChars[c]
+		if !ok {
+			return nil, fmt.Errorf("can't type %q", c)
+		}
+		keys = append(keys, key)
+		text = text[len(string(c)):]
+	}
+	return keys, nil
+}
+
+// pressKey sends the reports for pressing and releasing a key.
+func pressKey(server *hidServer, key hidKey) error {
+	if key.consumer {
+		if err := server.send(hidConsumerReport, []byte{byte(key.usage), byte(key.usage >> 8)}); err != nil {
+			return err
+		}
+		return server.send(hidConsumerReport, make([]byte, 2))
+	}
+	if err := server.send(hidKeyboardReport, []byte{key.modifiers, 0, byte(key.usage), 0, 0, 0, 0, 0}); err != nil {
+		return err
+	}
+	return server.send(hidKeyboardReport, make([]byte, 8))
+}
+
+// typeText presses the keys of text, see parseKeys.
+func typeText(server *hidServer, text string) error {
+	keys, err := parseKeys(text)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := pressKey(server, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func runHID(args []string) error {
+	fs := newFlagSet("hid", "")
+	name := fs.String("name", "Go Keyboard", "local name to advertise")
+	enter := fs.Bool("enter", true, "press Enter at the end of every input line")
+	acceptFlag(fs)
+	parseFlags(fs, args)
+
+	if err := enableAdapter(); err != nil {
+		return err
+	}
+	server, err := startHIDServer()
+	if err != nil {
+		return err
+	}
+	defer server.stop()
+
+	// Type what comes in on stdin, one line at a time.
+	go func() {
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if *enter {
+				line += "{enter}"
+			}
+			if err := typeText(server, line); err != nil {
+				if errors.Is(err, errNotSubscribed) {
+					err = errors.New("no host connected")
+				}
+				peripheralLog.Warn("could not type line", "err", err)
+			}
+		}
+	}()
+
+	peripheralLog.Info("pair with the keyboard from the host to use it", "name", *name)
+	return advertise(bluetooth.AdvertisementOptions{
+		LocalName:    *name,
+		ServiceUUIDs: []bluetooth.UUID{bluetooth.ServiceUUIDHumanInterfaceDevice},
+	})
+}
@@ -0,0 +1,87 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/godbus/dbus/v5"
+	"tinygo.org/x/bluetooth"
+)
+
+// hidServer is the HID service, registered with BlueZ as a gattApp because
+// the Report characteristics need a Report Reference descriptor.
+type hidServer struct {
+	app     *gattApp
+	reports map[byte]*gattValue // by report ID
+
+	unregisterAgent func()
+}
+
+func startHIDServer() (*hidServer, error) {
+	app, err := newGattApp("/example/ble/hid")
+	if err != nil {
+		return nil, err
+	}
+	s := &hidServer{app: app, reports: make(map[byte]*gattValue)}
+	service := app.addService(bluetooth.ServiceUUIDHumanInterfaceDevice)
+	chars := []struct {
+		uuid  uint16
+		flags []string
+		value []byte
+	}{
+		// HID Information: HID version 1.11, no country code, normally
+		// connectable.
+		{0x2A4A, []string{"read"}, []byte{0x11, 0x01, 0x00, 0x02}},
+		// Report Map. Encrypted reads make the host pair (and bond) first.
+		{0x2A4B, []string{"encrypt-read"}, hidReportMap},
+		// HID Control Point, for suspend and exit suspend, which are ignored.
+		{0x2A4C, []string{"write-without-response"}, []byte{0}},
+		// Protocol Mode: report protocol.
+		{0x2A4E, []string{"read", "write-without-response"}, []byte{0x01}},
+	}
+	for _, c := range chars {
+		if _, err := app.addCharacteristic(service, bluetooth.New16BitUUID(c.uuid), c.flags, c.value, nil); err != nil {
+			return nil, err
+		}
+	}
+	for _, report := range []struct {
+		id   byte
+		size int
+	}{{hidKeyboardReport, 8}, {hidConsumerReport, 2}} {
+		char, err := app.addCharacteristic(service, bluetooth.New16BitUUID(0x2A4D), []string{"encrypt-read", "notify"}, make([]byte, report.size), nil)
+		if err != nil {
+			return nil, err
+		}
+		// Report Reference: the report ID, and 1 for an input report.
+		if err := app.addDescriptor(char, bluetooth.New16BitUUID(0x2908), []string{"read"}, []byte{report.id, 0x01}); err != nil {
+			return nil, err
+		}
+		s.reports[report.id] = char
+	}
+
+	// Let hosts pair without asking: stdin is for the keys to type.
+	s.unregisterAgent, err = registerAgent("NoInputNoOutput", true)
+	if err != nil {
+		return nil, err
+	}
+	obj := app.bus.Object("org.bluez", dbus.ObjectPath("/org/bluez/"+adapterID))
+	if err := obj.SetProperty("org.bluez.Adapter1.Pairable", dbus.MakeVariant(true)); err != nil {
+		peripheralLog.Warn("could not make the adapter pairable", "err", err)
+	}
+	if err := app.register(); err != nil {
+		s.unregisterAgent()
+		return nil, fmt.Errorf("register HID service: %w", err)
+	}
+	return s, nil
+}
+
+// send notifies the host of an input report.
+func (s *hidServer) send(reportID byte, report []byte) error {
+	return s.reports[reportID].notify(report)
+}
+
+func (s *hidServer) stop() {
+	s.app.unregister()
+	s.unregisterAgent()
+}
@@ -0,0 +1,21 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+var errNotSubscribed = errors.New("no client is subscribed")
+
+// hidServer is only implemented for BlueZ: the GATT server of the bluetooth
+// package can't add the descriptors HID over GATT needs.
+type hidServer struct{}
+
+func startHIDServer() (*hidServer, error) {
+	return nil, errors.New("HID over GATT is not supported on this platform")
+}
+
+func (s *hidServer) send(reportID byte, report []byte) error {
+	return errNotSubscribed
+}
+
+func (s *hidServer) stop() {}
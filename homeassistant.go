@@ -0,0 +1,146 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"slices"
+	"strings"
+
+	"example.com/m/decode"
+)
+
+// Home Assistant MQTT discovery: for every sensor value published to MQTT, a
+// retained config message tells Home Assistant about the entity, so that
+// decoded sensors show up without any configuration.
+// See https://www.home-assistant.io/integrations/mqtt/#mqtt-discovery.
+
+// haDeviceClasses maps measurement names to Home Assistant sensor device
+// classes.
+var haDeviceClasses = map[string]string{
+	"temperature":   "temperature",
+	"dewpoint":      "temperature",
+	"humidity":      "humidity",
+	"pressure":      "atmospheric_pressure",
+	"battery":       "battery",
+	"voltage":       "voltage",
+	"current":       "current",
+	"power":         "power",
+	"energy":        "energy",
+	"illuminance":   "illuminance",
+	"co2":           "carbon_dioxide",
+	"pm2_5":         "pm25",
+	"pm10":          "pm10",
+	"tvoc":          "volatile_organic_compounds",
+	"moisture":      "moisture",
+	"conductivity":  "conductivity",
+	"gas":           "gas",
+	"speed":         "speed",
+	"distance":      "distance",
+	"mass":          "weight",
+	"precipitation": "precipitation",
+}
+
+// haClassUnits are the units that Home Assistant accepts for the device
+// classes. It rejects the config of a sensor whose class doesn't fit its unit.
+var haClassUnits = map[string][]string{
+	"temperature":                {"°C", "°F", "K"},
+	"humidity":                   {"%"},
+	"atmospheric_pressure":       {"hPa", "Pa", "kPa", "mbar", "bar", "cbar", "mmHg", "inHg", "psi"},
+	"battery":                    {"%"},
+	"voltage":                    {"V", "mV", "µV", "kV"},
+	"current":                    {"A", "mA"},
+	"power":                      {"W", "kW"},
+	"energy":                     {"Wh", "kWh", "MWh"},
+	"illuminance":                {"lx"},
+	"carbon_dioxide":             {"ppm"},
+	"pm25":                       {"µg/m³"},
+	"pm10":                       {"µg/m³"},
+	"volatile_organic_compounds": {"µg/m³", "mg/m³"},
+	"moisture":                   {"%"},
+	"conductivity":               {"µS/cm", "mS/cm", "S/cm"},
+	"gas":                        {"m³", "ft³", "CCF"},
+	"speed":                      {"m/s", "km/h", "mph", "kn"},
+	"distance":                   {"km", "m", "cm", "mm", "mi", "yd", "in"},
+	"weight":                     {"kg", "g", "mg", "lb", "oz"},
+	"precipitation":              {"mm", "cm", "in"},
+}
+
+// haUnitClasses are the device classes of the units that only one class has,
+// for measurements whose name has a class in another unit.
+var haUnitClasses = map[string]string{
+	"V":     "voltage",
+	"mV":    "voltage",
+	"A":     "current",
+	"mA":    "current",
+	"W":     "power",
+	"kWh":   "energy",
+	"lx":    "illuminance",
+	"hPa":   "atmospheric_pressure",
+	"°C":    "temperature",
+	"µS/cm": "conductivity",
+}
+
+// haDeviceClass returns the device class of a measurement, that of its name
+// if its unit fits it and that of its unit otherwise, or "" if there is none.
+// A battery in V is a voltage, not a battery level.
+func haDeviceClass(m decode.Measurement) string {
+	if class := haDeviceClasses[m.Name]; slices.Contains(haClassUnits[class], m.Unit) {
+		return class
+	}
+	return haUnitClasses[m.Unit]
+}
+
+// haManufacturers are the makers of the sensors by frame kind, where the
+// format is specific to one maker.
+var haManufacturers = map[string]string{
+	"ruuvi":    "Ruuvi Innovations",
+	"govee":    "Govee",
+	"mibeacon": "Xiaomi",
+}
+
+type haDevice struct {
+	Identifiers  []string    `json:"identifiers"`
+	Connections  [][2]string `json:"connections"`
+	Name         string      `json:"name"`
+	Manufacturer string      `json:"manufacturer,omitempty"`
+	Model        string      `json:"model"`
+}
+
+type haSensorConfig struct {
+	Name              string   `json:"name"`
+	UniqueID          string   `json:"unique_id"`
+	StateTopic        string   `json:"state_topic"`
+	UnitOfMeasurement string   `json:"unit_of_measurement,omitempty"`
+	DeviceClass       string   `json:"device_class,omitempty"`
+	StateClass        string   `json:"state_class,omitempty"`
+	Device            haDevice `json:"device"`
+}
+
+// haSensor returns the discovery topic and config message for a measurement
+// of a device, whose state is published to stateTopic.
+func haSensor(prefix string, s *sighting, kind string, m decode.Measurement, stateTopic string) (string, []byte) {
+	id := "ble_" + strings.ToLower(mqttTopicAddress(s.Address))
+	name := cmp.Or(s.Alias, s.LocalName)
+	if name == "" {
+		name = kind + " " + s.Address[len(s.Address)-5:]
+	}
+	config := haSensorConfig{
+		Name:              strings.ReplaceAll(m.Name, "_", " "),
+		UniqueID:          id + "_" + m.Name,
+		StateTopic:        stateTopic,
+		UnitOfMeasurement: m.Unit,
+		DeviceClass:       haDeviceClass(m),
+		Device: haDevice{
+			Identifiers:  []string{id},
+			Connections:  [][2]string{{"bluetooth", s.Address}},
+			Name:         name,
+			Manufacturer: haManufacturers[kind],
+			Model:        kind,
+		},
+	}
+	if m.Unit != "" {
+		config.StateClass = "measurement"
+	}
+	b, _ := json.Marshal(config)
+	return prefix + "/sensor/" + id + "/" + m.Name + "/config", b
+}
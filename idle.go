@@ -0,0 +1,197 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"tinygo.org/x/bluetooth"
+)
+
+// With -idle-after, a scan that has gone that long without finding a new
+// device or a changed payload listens less: it steps down through the scan
+// profiles with less duty than its own, one step each -idle-after, as far as
+// -idle-profile. The first sign of activity brings back its own parameters.
+// That saves power on battery-powered gateways in places where little
+// happens, at the cost of finding devices later once they show up.
+
+// scanStep is a set of scan parameters to step down to.
+type scanStep struct {
+	profile          string
+	interval, window time.Duration
+}
+
+// idleAfter and idleSteps are set by -idle-after and -idle-profile.
+var (
+	idleAfter time.Duration
+	idleSteps []scanStep
+)
+
+// setupIdleBackoff sets the steps of -idle-after, down to the profile. They
+// are the profiles that listen less of the time than the scan otherwise does.
+func setupIdleBackoff(after time.Duration, profile string, interval, window time.Duration) error {
+	if after < 0 {
+		return errors.New("-idle-after must not be negative")
+	}
+	if after == 0 {
+		return nil
+	}
+	last, ok := scanProfiles[profile]
+	if !ok {
+		return fmt.Errorf("unknown -idle-profile %q (known: balanced, low-power)", profile)
+	}
+	duty := func(interval, window time.Duration) float64 { return float64(window) / float64(interval) }
+	active := 1.0
+	if interval != 0 {
+		active = duty(interval, window)
+	}
+	var steps []scanStep
+	for name, p := range scanProfiles {
+		if d := duty(p[0], p[1]); d < active && d >= duty(last[0], last[1]) {
+			steps = append(steps, scanStep{name, p[0], p[1]})
+		}
+	}
+	if len(steps) == 0 {
+		return fmt.Errorf("-idle-profile %s doesn't listen less than the scan already does", profile)
+	}
+	slices.SortFunc(steps, func(a, b scanStep) int {
+		return cmp.Compare(duty(b.interval, b.window), duty(a.interval, a.window))
+	})
+	idleAfter, idleSteps = after, steps
+	return nil
+}
+
+// idleBackoff steps the scan parameters down while the scan is idle.
+type idleBackoff struct {
+	payloads map[string]uint64 // hashes by address, only used by the scan callback
+	last     atomic.Int64      // Unix nanoseconds of the last activity
+	level    atomic.Int32      // steps down, 0 while active
+	wake     chan struct{}
+	done     chan struct{}
+	stopped  sync.WaitGroup
+
+	restore func() // of the parameters before the first step, nil if unchanged
+}
+
+// startIdleBackoff starts watching for the scan going idle.
+func startIdleBackoff() *idleBackoff {
+	i := &idleBackoff{
+		payloads: make(map[string]uint64),
+		wake:     make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+	i.last.Store(time.Now().UnixNano())
+	i.stopped.Add(1)
+	go i.run()
+	return i
+}
+
+// wrap returns a scan callback that notes activity before calling callback.
+func (i *idleBackoff) wrap(callback func(*bluetooth.Adapter, bluetooth.ScanResult)) func(*bluetooth.Adapter, bluetooth.ScanResult) {
+	return func(adapter *bluetooth.Adapter, result bluetooth.ScanResult) {
+		if i.active(result) {
+			i.last.Store(time.Now().UnixNano())
+			if i.level.Load() > 0 {
+				select {
+				case i.wake <- struct{}{}:
+				default:
+				}
+			}
+		}
+		callback(adapter, result)
+	}
+}
+
+// active returns whether a scan result is from a new device or has a payload
+// that its device didn't advertise last time.
+func (i *idleBackoff) active(result bluetooth.ScanResult) bool {
+	sum := payloadHash(result)
+	address := result.Address.String()
+	if old, ok := i.payloads[address]; ok && old == sum {
+		return false
+	}
+	if len(i.payloads) >= 10000 {
+		// Random addresses come and go; forget them rather than grow.
+		clear(i.payloads)
+	}
+	i.payloads[address] = sum
+	return true
+}
+
+func (i *idleBackoff) run() {
+	defer i.stopped.Done()
+	timer := time.NewTimer(idleAfter)
+	defer timer.Stop()
+	level := 0
+	for {
+		select {
+		case <-timer.C:
+			if since := time.Since(time.Unix(0, i.last.Load())); since < idleAfter {
+				timer.Reset(idleAfter - since)
+				continue
+			}
+			if level < len(idleSteps) {
+				level++
+				i.level.Store(int32(level))
+				i.apply(level)
+			}
+			timer.Reset(idleAfter)
+		case <-i.wake:
+			if level > 0 {
+				level = 0
+				i.level.Store(0)
+				i.apply(0)
+			}
+			timer.Reset(idleAfter)
+		case <-i.done:
+			return
+		}
+	}
+}
+
+// apply sets the scan parameters of a level and restarts the scan, for them
+// to take effect.
+func (i *idleBackoff) apply(level int) {
+	if level == 0 {
+		scanLog.Info("scan active again, restoring the scan parameters")
+	} else {
+		step := idleSteps[level-1]
+		scanLog.Info("scan idle, listening less", "profile", step.profile, "idle_for", time.Since(time.Unix(0, i.last.Load())).Round(time.Second))
+	}
+	if offline {
+		return
+	}
+	if level == 0 && scanInterval == 0 {
+		if i.restore != nil {
+			i.restore()
+			i.restore = nil
+		}
+	} else {
+		interval, window := scanInterval, scanWindow
+		if level > 0 {
+			interval, window = idleSteps[level-1].interval, idleSteps[level-1].window
+		}
+		restore, err := setScanParameters(interval, window)
+		if err != nil {
+			scanLog.Warn("could not set the scan parameters", "err", err)
+			return
+		}
+		if i.restore == nil {
+			i.restore = restore
+		}
+	}
+	scans.Restart()
+}
+
+// stop stops watching, and restores the scan parameters.
+func (i *idleBackoff) stop() {
+	close(i.done)
+	i.stopped.Wait()
+	if i.restore != nil {
+		i.restore()
+	}
+}
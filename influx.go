@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"example.com/m/decode"
+	"tinygo.org/x/bluetooth"
+)
+
+// influxFlags are the flags for writing to InfluxDB.
+type influxFlags struct {
+	url    string
+	org    string
+	bucket string
+	token  string
+	file   string
+
+	flushInterval time.Duration
+	batchSize     int
+
+	// Extra tags by device address.
+	tags map[string]map[string]string
+}
+
+func (f *influxFlags) registerFlags(fs *flag.FlagSet) {
+	fs.StringVar(&f.url, "influx", "", "write to this InfluxDB v2 server, e.g. http://localhost:8086")
+	fs.StringVar(&f.org, "influx-org", "", "InfluxDB organization")
+	fs.StringVar(&f.bucket, "influx-bucket", "ble", "InfluxDB bucket")
+	fs.StringVar(&f.token, "influx-token", os.Getenv("INFLUX_TOKEN"), "InfluxDB API token (default: $INFLUX_TOKEN)")
+	fs.StringVar(&f.file, "influx-file", "", "append InfluxDB line protocol to this file instead of writing to a server")
+	fs.DurationVar(&f.flushInterval, "influx-flush", 10*time.Second, "flush InfluxDB writes this often")
+	fs.IntVar(&f.batchSize, "influx-batch", 5000, "flush InfluxDB writes early when this many lines are waiting")
+	fs.Func("influx-tag", "add a tag to the points of a device, as ADDRESS,TAG=VALUE (repeatable)", func(s string) error {
+		address, tag, ok := strings.Cut(s, ",")
+		key, value, ok2 := strings.Cut(tag, "=")
+		if !ok || !ok2 || key == "" {
+			return errors.New("expected ADDRESS,TAG=VALUE")
+		}
+		mac, err := bluetooth.ParseMAC(address)
+		if err != nil {
+			return fmt.Errorf("invalid address %q: %w", address, err)
+		}
+		if f.tags == nil {
+			f.tags = make(map[string]map[string]string)
+		}
+		if f.tags[mac.String()] == nil {
+			f.tags[mac.String()] = make(map[string]string)
+		}
+		f.tags[mac.String()][key] = value
+		return nil
+	})
+}
+
+// enabled returns whether an InfluxDB output was asked for.
+func (f *influxFlags) enabled() bool {
+	return f.url != "" || f.file != ""
+}
+
+// influxOutput writes the RSSI and decoded sensor values of sightings as
+// InfluxDB line protocol, in batches:
+//
+//	ble_device,address=AA:BB:CC:DD:EE:FF rssi=-67i 1700000000000000000
+//	ble_sensor,address=AA:BB:CC:DD:EE:FF,kind=bthome temperature=21.5,humidity=48 1700000000000000000
+//
+// Devices with an alias are also tagged with it, as alias=kitchen-ruuvi.
+// A batch that can't be written is kept for the next flush, up to ten batches.
+type influxOutput struct {
+	flags *influxFlags
+	w     io.WriteCloser // with -influx-file
+	url   string         // otherwise
+
+	mu       sync.Mutex
+	lines    []string
+	full     chan struct{}
+	done     chan struct{}
+	finished chan struct{}
+	err      error
+}
+
+func newInfluxOutput(flags *influxFlags) (*influxOutput, error) {
+	if flags.batchSize <= 0 {
+		return nil, errors.New("-influx-batch must be positive")
+	}
+	if flags.flushInterval <= 0 {
+		return nil, errors.New("-influx-flush must be positive")
+	}
+	o := &influxOutput{
+		flags:    flags,
+		full:     make(chan struct{}, 1),
+		done:     make(chan struct{}),
+		finished: make(chan struct{}),
+	}
+	if flags.file != "" && dryRun {
+		if err := checkOutputDir(flags.file); err != nil {
+			return nil, err
+		}
+		o.w = nopWriteCloser{io.Discard}
+	} else if flags.file != "" {
+		f, err := os.OpenFile(flags.file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+		if err != nil {
+			return nil, err
+		}
+		o.w = f
+	} else {
+		u, err := url.Parse(flags.url)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -influx URL: %w", err)
+		}
+		u = u.JoinPath("api/v2/write")
+		u.RawQuery = url.Values{"org": {flags.org}, "bucket": {flags.bucket}, "precision": {"ns"}}.Encode()
+		o.url = u.String()
+		if dryRun {
+			if err := checkInfluxBucket(flags); err != nil {
+				return nil, err
+			}
+		}
+	}
+	go o.run()
+	return o, nil
+}
+
+func (o *influxOutput) write(s *sighting) error {
+	tags := "address=" + influxEscape(s.Address, ",= ")
+	if _, ok := o.flags.tags[s.Address]["alias"]; s.Alias != "" && !ok {
+		tags += ",alias=" + influxEscape(s.Alias, ",= ")
+	}
+	if extra := o.flags.tags[s.Address]; len(extra) != 0 {
+		keys := make([]string, 0, len(extra))
+		for key := range extra {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			tags += "," + influxEscape(key, ",= ") + "=" + influxEscape(extra[key], ",= ")
+		}
+	}
+	timestamp := strconv.FormatInt(s.Time.UnixNano(), 10)
+
+	lines := []string{"ble_device," + tags + " rssi=" + strconv.Itoa(int(s.RSSI)) + "i " + timestamp}
+	for _, f := range s.Frames {
+		sensor, ok := f.(decode.SensorFrame)
+		if !ok {
+			continue
+		}
+		var fields []string
+		for _, m := range sensor.Measurements() {
+			fields = append(fields, influxEscape(m.Name, ",= ")+"="+strconv.FormatFloat(m.Value, 'f', -1, 64))
+		}
+		if len(fields) != 0 {
+			lines = append(lines, "ble_sensor,"+tags+",kind="+influxEscape(f.Kind(), ",= ")+" "+strings.Join(fields, ",")+" "+timestamp)
+		}
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.lines = append(o.lines, lines...)
+	if len(o.lines) >= o.flags.batchSize {
+		select {
+		case o.full <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// influxEscape escapes the given special characters (and backslashes) with
+// backslashes, as line protocol requires for tag keys, tag values and field
+// keys.
+func influxEscape(s, special string) string {
+	if !strings.ContainsAny(s, special+`\`) {
+		return s
+	}
+	var b strings.Builder
+	for _, r := range s {
+		if r == '\\' || strings.ContainsRune(special, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// run flushes the waiting lines every flush interval, when a batch is full,
+// and once more when the output is closed.
+func (o *influxOutput) run() {
+	defer close(o.finished)
+	ticker := time.NewTicker(o.flags.flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-o.full:
+		case <-o.done:
+			o.err = o.flush()
+			return
+		}
+		if err := o.flush(); err != nil {
+			sinkLog.Error("InfluxDB write failed", "err", err)
+		}
+	}
+}
+
+func (o *influxOutput) flush() error {
+	o.mu.Lock()
+	lines := o.lines
+	o.lines = nil
+	o.mu.Unlock()
+	if len(lines) == 0 {
+		return nil
+	}
+
+	var body bytes.Buffer
+	for _, line := range lines {
+		body.WriteString(line)
+		body.WriteByte('\n')
+	}
+	err := o.send(body.Bytes())
+	if err == nil {
+		return nil
+	}
+
+	// Keep the lines for the next attempt, but don't let them pile up while
+	// the server is down.
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.lines = append(lines, o.lines...)
+	if limit := 10 * o.flags.batchSize; len(o.lines) > limit {
+		dropped := len(o.lines) - limit
+		o.lines = o.lines[dropped:]
+		return fmt.Errorf("%w (dropped %d lines)", err, dropped)
+	}
+	return err
+}
+
+// influxClient keeps a server that doesn't answer from holding up flushes
+// forever.
+var influxClient = &http.Client{Timeout: 30 * time.Second}
+
+// checkInfluxBucket checks that the server can be reached with the token and
+// has the bucket, for dry runs.
+func checkInfluxBucket(flags *influxFlags) error {
+	u, _ := url.Parse(flags.url)
+	u = u.JoinPath("api/v2/buckets")
+	query := url.Values{"name": {flags.bucket}}
+	if flags.org != "" {
+		query.Set("org", flags.org)
+	}
+	u.RawQuery = query.Encode()
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	if flags.token != "" {
+		req.Header.Set("Authorization", "Token "+flags.token)
+	}
+	resp, err := influxClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("InfluxDB: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("InfluxDB: %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	var buckets struct {
+		Buckets []struct{} `json:"buckets"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&buckets); err != nil {
+		return fmt.Errorf("InfluxDB: %w", err)
+	}
+	if len(buckets.Buckets) == 0 {
+		return fmt.Errorf("InfluxDB has no bucket %q", flags.bucket)
+	}
+	sinkLog.Info("InfluxDB bucket found", "url", flags.url, "bucket", flags.bucket)
+	return nil
+}
+
+func (o *influxOutput) send(body []byte) error {
+	if o.w != nil {
+		_, err := o.w.Write(body)
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, o.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if o.flags.token != "" {
+		req.Header.Set("Authorization", "Token "+o.flags.token)
+	}
+	resp, err := influxClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("write failed: %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// close flushes the waiting lines.
+func (o *influxOutput) close() error {
+	close(o.done)
+	<-o.finished
+	if o.w != nil {
+		if err := o.w.Close(); o.err == nil {
+			o.err = err
+		}
+	}
+	return o.err
+}
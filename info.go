@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"example.com/m/gattclient"
+	"tinygo.org/x/bluetooth"
+)
+
+// disStrings are the string characteristics of the Device Information
+// Service, in the order they are printed.
+var disStrings = []struct {
+	uuid bluetooth.UUID
+	name string
+}{
+	{bluetooth.New16BitUUID(0x2A29), "manufacturer"},
+	{bluetooth.New16BitUUID(0x2A24), "model"},
+	{bluetooth.New16BitUUID(0x2A25), "serial"},
+	{bluetooth.New16BitUUID(0x2A27), "hardware"},
+	{bluetooth.New16BitUUID(0x2A26), "firmware"},
+	{bluetooth.New16BitUUID(0x2A28), "software"},
+}
+
+func runInfo(args []string) error {
+	fs := newFlagSet("info", "<address>")
+	var conn connectFlags
+	conn.registerFlags(fs)
+	format := fs.String("output", "text", "output format: text or json")
+	parseFlags(fs, args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("expected exactly one device address")
+	}
+	if *format != "text" && *format != "json" {
+		return fmt.Errorf("unknown output format %q", *format)
+	}
+	address, err := parseAddress(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	if err := enableAdapter(); err != nil {
+		return err
+	}
+	device, err := conn.connect(address)
+	if err != nil {
+		return err
+	}
+	defer device.Disconnect()
+
+	info, err := readDeviceInfo(device)
+	if err != nil {
+		return err
+	}
+	if *format == "json" {
+		info["address"] = address.String()
+		return json.NewEncoder(os.Stdout).Encode(info)
+	}
+	for _, s := range disStrings {
+		if value, ok := info[s.name]; ok {
+			fmt.Printf("%-13s %s\n", s.name+":", value)
+		}
+	}
+	return nil
+}
+
+// readDeviceInfo reads the strings of the Device Information Service that the
+// device has, keyed by their names in disStrings.
+func readDeviceInfo(device gattclient.Device) (map[string]string, error) {
+	services, err := device.DiscoverServices([]bluetooth.UUID{bluetooth.ServiceUUIDDeviceInformation})
+	if err != nil {
+		return nil, fmt.Errorf("no Device Information Service: %w", err)
+	}
+	chars, err := services[0].DiscoverCharacteristics(nil)
+	if err != nil {
+		return nil, err
+	}
+	info := make(map[string]string)
+	buf := make([]byte, 512)
+	for _, char := range chars {
+		for _, s := range disStrings {
+			if char.UUID() != s.uuid {
+				continue
+			}
+			n, err := char.Read(buf)
+			if err != nil {
+				gattLog.Warn("could not read characteristic", "characteristic", s.name, "err", err)
+				continue
+			}
+			// Some devices pad the strings with NULs.
+			info[s.name] = strings.TrimRight(string(buf[:n]), "\x00")
+		}
+	}
+	return info, nil
+}
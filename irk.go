@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/subtle"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"example.com/m/decode"
+)
+
+// identityKeys are the Identity Resolving Keys that resolvable private
+// addresses are resolved with.
+var identityKeys struct {
+	mu   sync.Mutex
+	keys []identityKey
+}
+
+// identityKey is the IRK of a device, with the identity address it was
+// distributed with.
+type identityKey struct {
+	identity string
+	block    cipher.Block
+}
+
+// irkFlags are the flags for importing Identity Resolving Keys.
+type irkFlags struct {
+	keys   decode.DeviceKeys
+	bonded bool
+}
+
+func (f *irkFlags) registerFlags(fs *flag.FlagSet) {
+	f.keys = decode.DeviceKeys{}
+	fs.Var(f.keys, "irk", "resolve the private addresses of a device with its IRK, as IDENTITY-ADDRESS=KEY with the key most significant byte first (repeatable)")
+	fs.Func("irk-file", "read IRKs from this file, one IDENTITY-ADDRESS=KEY per line, as printed by 'ble bonds keys'", f.load)
+	fs.BoolVar(&f.bonded, "bonded-irks", false, "resolve the private addresses of bonded devices with their stored IRKs (needs root)")
+}
+
+// load adds the keys in the given file. Blank lines and lines starting with #
+// are skipped.
+func (f *irkFlags) load(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := f.keys.Set(line); err != nil {
+			return fmt.Errorf("%s:%d: %w", path, lineno, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// setup adds the imported keys to the identity keys.
+func (f *irkFlags) setup() error {
+	for identity, irk := range f.keys {
+		if err := addIdentityKey(identity, irk); err != nil {
+			return err
+		}
+	}
+	if f.bonded {
+		n, err := loadBondedIdentityKeys()
+		if err != nil {
+			return fmt.Errorf("read IRKs of bonded devices: %w", err)
+		}
+		scanLog.Info("resolving the addresses of bonded devices", "devices", n)
+	}
+	return nil
+}
+
+// loadBondedIdentityKeys adds the IRKs of the bonded devices to the identity
+// keys, and returns how many there were.
+func loadBondedIdentityKeys() (int, error) {
+	irks, err := bondedIRKs()
+	if err != nil {
+		return 0, err
+	}
+	for identity, irk := range irks {
+		if err := addIdentityKey(identity, irk); err != nil {
+			return 0, err
+		}
+	}
+	return len(irks), nil
+}
+
+// addIdentityKey adds the IRK of a device. The key is in the most significant
+// byte first order the specification uses.
+func addIdentityKey(identity string, irk []byte) error {
+	block, err := aes.NewCipher(irk)
+	if err != nil {
+		return err
+	}
+	identityKeys.mu.Lock()
+	defer identityKeys.mu.Unlock()
+	for i, k := range identityKeys.keys {
+		if k.identity == identity {
+			identityKeys.keys[i].block = block
+			return nil
+		}
+	}
+	identityKeys.keys = append(identityKeys.keys, identityKey{identity, block})
+	return nil
+}
+
+// resolvePrivateAddress returns the identity address of a resolvable private
+// address, if one of the identity keys resolves it.
+func resolvePrivateAddress(address string) (string, bool) {
+	addr := macBytes(address)
+	// Resolvable private addresses have 0b01 as their two most significant
+	// bits, followed by the 22 random bits of prand and a 24-bit hash.
+	if len(addr) != 6 || addr[0]>>6 != 0b01 {
+		return "", false
+	}
+	identityKeys.mu.Lock()
+	defer identityKeys.mu.Unlock()
+	for _, k := range identityKeys.keys {
+		hash := ah(k.block, addr[:3])
+		if subtle.ConstantTimeCompare(hash[:], addr[3:]) == 1 {
+			return k.identity, true
+		}
+	}
+	return "", false
+}
+
+// ah is the random address hash function of the specification (Vol 3, Part H,
+// 2.2.2): the least significant 24 bits of e(irk, padding || prand).
+func ah(block cipher.Block, prand []byte) [3]byte {
+	var in, out [16]byte
+	copy(in[13:], prand)
+	block.Encrypt(out[:], in[:])
+	return [3]byte(out[13:])
+}
+
+// macBytes returns the 6 bytes of an address in the order it is written in,
+// most significant byte first.
+func macBytes(addr string) []byte {
+	b, _ := hex.DecodeString(strings.ReplaceAll(addr, ":", ""))
+	return b
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// jobPool runs jobs queued from the scan callback, which must not block, on a
+// bounded number of workers. Most adapters can't connect reliably while
+// scanning, so the scan is paused while there are jobs, and resumed once the
+// queue is empty.
+type jobPool struct {
+	timeout time.Duration
+	queue   chan job
+	wg      sync.WaitGroup
+
+	mu      sync.Mutex
+	pending int // queued or running
+}
+
+// job is a unit of work such as connecting to a device and reading a
+// characteristic. It should give up when its context is done.
+type job struct {
+	name string
+	run  func(ctx context.Context) error
+}
+
+// errJobQueueFull is returned by submit when the queue is full.
+var errJobQueueFull = errors.New("job queue full")
+
+// newJobPool starts workers that run jobs, each with a timeout. At most size
+// jobs can be queued.
+func newJobPool(workers, size int, timeout time.Duration) *jobPool {
+	p := &jobPool{timeout: timeout, queue: make(chan job, size)}
+	for range workers {
+		p.wg.Add(1)
+		go p.work()
+	}
+	return p
+}
+
+// submit queues a job without blocking.
+func (p *jobPool) submit(name string, run func(ctx context.Context) error) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	select {
+	case p.queue <- job{name, run}:
+	default:
+		return errJobQueueFull
+	}
+	p.pending++
+	if p.pending == 1 {
+		scans.Pause()
+	}
+	return nil
+}
+
+func (p *jobPool) work() {
+	defer p.wg.Done()
+	for j := range p.queue {
+		ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+		start := time.Now()
+		err := j.run(ctx)
+		if err == nil && ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		cancel()
+		if err != nil {
+			gattLog.Warn("job failed", "job", j.name, "err", err, "after", time.Since(start).Round(time.Millisecond))
+		} else {
+			gattLog.Debug("job done", "job", j.name, "after", time.Since(start).Round(time.Millisecond))
+		}
+
+		p.mu.Lock()
+		p.pending--
+		if p.pending == 0 {
+			scans.Resume()
+		}
+		p.mu.Unlock()
+	}
+}
+
+// close waits for the queued jobs to finish. submit must not be called after
+// close.
+func (p *jobPool) close() {
+	close(p.queue)
+	p.wg.Wait()
+}
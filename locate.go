@@ -0,0 +1,364 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// With receivers at known coordinates, the commands that scan estimate where
+// devices are from how far each receiver thinks they are. A receiver is the
+// scan adapter of this machine, at -position, or another one running ble api
+// -distance, at -receiver, whose stream of advertisements has their estimated
+// distances:
+//
+//	ble scan -distance -position 0,0 -receiver http://pi-hall:8080,6,0 -receiver http://pi-den:8080,0,4.5
+//
+// Another local adapter is a receiver too, with a ble api of its own, as in
+// ble -scan-adapter hci1 api -distance -listen :8081. Coordinates are in
+// meters. The estimate is rough: the distances are, and walls and bodies sway
+// them by meters.
+
+// locator estimates the positions of devices while there are receivers. It
+// is nil otherwise, which makes locate a no-op.
+var locator *deviceLocator
+
+// locateFlags are the flags for estimating the positions of devices.
+type locateFlags struct {
+	position  string
+	receivers []remoteReceiver
+	window    time.Duration
+}
+
+// remoteReceiver is a ble api that receives advertisements elsewhere.
+type remoteReceiver struct {
+	url  string
+	x, y float64
+}
+
+func (f *locateFlags) registerFlags(fs *flag.FlagSet) {
+	fs.StringVar(&f.position, "position", "", "coordinates in meters of this adapter, as X,Y, to estimate the position of devices with -distance and -receiver")
+	fs.Func("receiver", "estimate the position of devices with the distances from the ble api -distance at this URL, at coordinates X,Y in meters, as URL,X,Y (repeatable)", func(s string) error {
+		rest, y, ok := cutLast(s, ",")
+		u, x, ok2 := cutLast(rest, ",")
+		if !ok || !ok2 {
+			return errors.New("expected URL,X,Y")
+		}
+		r := remoteReceiver{url: u}
+		var err error
+		if r.x, r.y, err = parseCoordinates(x + "," + y); err != nil {
+			return err
+		}
+		if parsed, err := url.Parse(u); err != nil || parsed.Host == "" {
+			return fmt.Errorf("invalid URL %q", u)
+		}
+		f.receivers = append(f.receivers, r)
+		return nil
+	})
+	fs.DurationVar(&f.window, "locate-window", 10*time.Second, "estimate positions from the distances of the receivers that saw a device within this long")
+}
+
+func cutLast(s, sep string) (before, after string, found bool) {
+	if i := strings.LastIndex(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
+	}
+	return s, "", false
+}
+
+func parseCoordinates(s string) (x, y float64, err error) {
+	xs, ys, ok := strings.Cut(s, ",")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid coordinates %q: expected X,Y", s)
+	}
+	if x, err = strconv.ParseFloat(strings.TrimSpace(xs), 64); err == nil {
+		y, err = strconv.ParseFloat(strings.TrimSpace(ys), 64)
+	}
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid coordinates %q: %w", s, err)
+	}
+	return x, y, nil
+}
+
+// setup enables estimating positions if there are receivers, and follows the
+// remote ones. It must come after the setup of distanceFlags.
+func (f *locateFlags) setup() error {
+	if f.position == "" && len(f.receivers) == 0 {
+		return nil
+	}
+	if f.window <= 0 {
+		return errors.New("-locate-window must be positive")
+	}
+	l := &deviceLocator{window: f.window, devices: make(map[string][]ranging)}
+	if f.position != "" {
+		if distances == nil {
+			return errors.New("-position needs -distance")
+		}
+		x, y, err := parseCoordinates(f.position)
+		if err != nil {
+			return fmt.Errorf("-position: %w", err)
+		}
+		l.receivers = append(l.receivers, receiver{x, y})
+		l.local = true
+	}
+	for _, r := range f.receivers {
+		l.receivers = append(l.receivers, receiver{r.x, r.y})
+	}
+	if len(l.receivers) < 2 {
+		return errors.New("estimating positions needs at least two receivers: give -position and -receiver, or more -receiver")
+	}
+	locator = l
+	if dryRun {
+		return nil
+	}
+	for i, r := range f.receivers {
+		if l.local {
+			i++
+		}
+		go l.follow(i, r.url)
+	}
+	return nil
+}
+
+// receiver is the coordinates of a receiver.
+type receiver struct {
+	x, y float64
+}
+
+// ranging is the distance of a device from a receiver.
+type ranging struct {
+	receiver int
+	distance float64
+	time     time.Time
+}
+
+// position is the estimated position of a device, in meters, and how many
+// receivers it was estimated from.
+type position struct {
+	X         float64 `json:"x"`
+	Y         float64 `json:"y"`
+	Receivers int     `json:"receivers"`
+}
+
+// deviceLocator keeps the last distance of every device from every receiver.
+type deviceLocator struct {
+	window    time.Duration
+	receivers []receiver
+	local     bool // the first receiver is the scan adapter
+
+	mu      sync.Mutex
+	devices map[string][]ranging // by address
+	pruned  time.Time
+}
+
+// locate records the distance of a sighting from the scan adapter, and
+// returns the estimated position of its device, or nil if fewer than two
+// receivers have its distance.
+func (l *deviceLocator) locate(s *sighting) *position {
+	if l == nil {
+		return nil
+	}
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.local && s.Distance > 0 {
+		l.record(s.Address, ranging{0, s.Distance, now})
+	}
+	l.prune(now)
+	var fresh []ranging
+	for _, r := range l.devices[s.Address] {
+		if now.Sub(r.time) < l.window {
+			fresh = append(fresh, r)
+		}
+	}
+	if len(fresh) < 2 {
+		return nil
+	}
+	x, y := l.trilaterate(fresh)
+	return &position{X: math.Round(x*100) / 100, Y: math.Round(y*100) / 100, Receivers: len(fresh)}
+}
+
+// record records the distance of a device from a receiver, replacing the last
+// one from that receiver. l.mu must be held.
+func (l *deviceLocator) record(address string, r ranging) {
+	rangings := l.devices[address]
+	for i := range rangings {
+		if rangings[i].receiver == r.receiver {
+			rangings[i] = r
+			return
+		}
+	}
+	l.devices[address] = append(rangings, r)
+}
+
+// prune drops the devices no receiver has seen within the window, at most
+// once per window. l.mu must be held.
+func (l *deviceLocator) prune(now time.Time) {
+	if now.Sub(l.pruned) < l.window {
+		return
+	}
+	l.pruned = now
+	for address, rangings := range l.devices {
+		latest := time.Time{}
+		for _, r := range rangings {
+			if r.time.After(latest) {
+				latest = r.time
+			}
+		}
+		if now.Sub(latest) >= l.window {
+			delete(l.devices, address)
+		}
+	}
+}
+
+// trilaterate returns the point whose distances from the receivers best
+// match the rangings, by least squares in which near receivers weigh more, as
+// RSSI says less the farther it is. From two receivers, it is the point
+// between them that divides their distance in the ratio of the rangings.
+func (l *deviceLocator) trilaterate(rangings []ranging) (x, y float64) {
+	// Start from the centroid, weighted towards the nearer receivers.
+	var total float64
+	for _, r := range rangings {
+		w := 1 / math.Max(r.distance, 0.1)
+		x += w * l.receivers[r.receiver].x
+		y += w * l.receivers[r.receiver].y
+		total += w
+	}
+	x, y = x/total, y/total
+	if len(rangings) == 2 {
+		a, b := l.receivers[rangings[0].receiver], l.receivers[rangings[1].receiver]
+		t := rangings[0].distance / (rangings[0].distance + rangings[1].distance)
+		return a.x + t*(b.x-a.x), a.y + t*(b.y-a.y)
+	}
+	// Gauss-Newton on the residuals |p - receiver| - distance, halving the
+	// steps that don't lower the error, as distances that don't agree can
+	// send it off.
+	weight := func(r ranging) float64 { return 1 / math.Max(r.distance*r.distance, 0.01) }
+	cost := func(x, y float64) float64 {
+		var sum float64
+		for _, r := range rangings {
+			residual := math.Hypot(x-l.receivers[r.receiver].x, y-l.receivers[r.receiver].y) - r.distance
+			sum += weight(r) * residual * residual
+		}
+		return sum
+	}
+	for range 20 {
+		var jtj [2][2]float64
+		var jtr [2]float64
+		for _, r := range rangings {
+			rx, ry := l.receivers[r.receiver].x, l.receivers[r.receiver].y
+			d := math.Hypot(x-rx, y-ry)
+			if d < 1e-6 {
+				continue
+			}
+			w := weight(r)
+			jx, jy, residual := (x-rx)/d, (y-ry)/d, d-r.distance
+			jtj[0][0] += w * jx * jx
+			jtj[0][1] += w * jx * jy
+			jtj[1][1] += w * jy * jy
+			jtr[0] += w * jx * residual
+			jtr[1] += w * jy * residual
+		}
+		det := jtj[0][0]*jtj[1][1] - jtj[0][1]*jtj[0][1]
+		if math.Abs(det) < 1e-12 {
+			break
+		}
+		dx := (jtj[1][1]*jtr[0] - jtj[0][1]*jtr[1]) / det
+		dy := (jtj[0][0]*jtr[1] - jtj[0][1]*jtr[0]) / det
+		before := cost(x, y)
+		for range 10 {
+			if cost(x-dx, y-dy) < before {
+				break
+			}
+			dx, dy = dx/2, dy/2
+		}
+		if cost(x-dx, y-dy) >= before {
+			break
+		}
+		x, y = x-dx, y-dy
+		if math.Hypot(dx, dy) < 0.001 {
+			break
+		}
+	}
+	// The nearest receiver's distance is the one to trust the most: the
+	// device isn't farther from it.
+	nearest := slices.MinFunc(rangings, func(a, b ranging) int { return cmp.Compare(a.distance, b.distance) })
+	rx, ry := l.receivers[nearest.receiver].x, l.receivers[nearest.receiver].y
+	if d := math.Hypot(x-rx, y-ry); d > nearest.distance {
+		x, y = rx+(x-rx)*nearest.distance/d, ry+(y-ry)*nearest.distance/d
+	}
+	return x, y
+}
+
+// follow follows the stream of advertisements of a remote receiver, recording
+// their distances, and reconnects when the stream ends.
+func (l *deviceLocator) follow(index int, base string) {
+	u, _ := url.Parse(base)
+	stream := u.JoinPath("stream").String()
+	backoff := initialBackoff
+	for {
+		err := l.followStream(index, stream, func() { backoff = initialBackoff })
+		delay := jitter(backoff)
+		scanLog.Warn("receiver stream ended, reconnecting", "url", stream, "err", err, "in", delay.Round(time.Millisecond))
+		time.Sleep(delay)
+		backoff = nextBackoff(backoff, time.Minute)
+	}
+}
+
+// followStream reads the server-sent events of a stream until it ends,
+// calling connected once it is connected.
+func (l *deviceLocator) followStream(index int, stream string, connected func()) error {
+	req, err := http.NewRequest(http.MethodGet, stream, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	connected()
+	scanLog.Info("following receiver", "url", stream)
+	lines := bufio.NewScanner(resp.Body)
+	lines.Buffer(nil, 1<<20)
+	for lines.Scan() {
+		data, ok := strings.CutPrefix(lines.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		var advertisement struct {
+			Address  string  `json:"address"`
+			Distance float64 `json:"distance_m"`
+		}
+		if err := json.Unmarshal([]byte(data), &advertisement); err != nil {
+			return err
+		}
+		if advertisement.Distance == 0 {
+			// Unknown, as the receiver doesn't know the measured
+			// power of the device.
+			continue
+		}
+		l.mu.Lock()
+		// Clocks differ, so the distance is as of when it arrived.
+		l.record(advertisement.Address, ranging{index, advertisement.Distance, time.Now()})
+		l.mu.Unlock()
+	}
+	if err := lines.Err(); err != nil {
+		return err
+	}
+	return errors.New("stream closed")
+}
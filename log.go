@@ -0,0 +1,61 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+)
+
+// Diagnostics are logged to stderr, so that they don't mix with the output
+// of commands on stdout. Each subsystem has its own logger, which adds the
+// subsystem to its records.
+var (
+	scanLog       = slog.Default()
+	gattLog       = slog.Default()
+	peripheralLog = slog.Default()
+	sinkLog       = slog.Default()
+	apiLog        = slog.Default()
+)
+
+// logLevel is the level set with -log-level, for loggers installed later.
+var logLevel = new(slog.LevelVar)
+
+// logFlags are the global flags for logging.
+type logFlags struct {
+	format string
+	level  slog.Level
+}
+
+func (f *logFlags) registerFlags(fs *flag.FlagSet) {
+	fs.StringVar(&f.format, "log-format", "text", "log format: text or json")
+	fs.TextVar(&f.level, "log-level", slog.LevelInfo, "log only messages of at least this level: debug, info, warn or error")
+}
+
+// setup installs the logger.
+func (f *logFlags) setup() error {
+	logLevel.Set(f.level)
+	opts := &slog.HandlerOptions{Level: logLevel}
+	var handler slog.Handler
+	switch f.format {
+	case "text":
+		handler = slog.NewTextHandler(os.Stderr, opts)
+	case "json":
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	default:
+		return fmt.Errorf("unknown log format %q", f.format)
+	}
+	installLogger(handler)
+	return nil
+}
+
+// installLogger makes handler handle all log messages.
+func installLogger(handler slog.Handler) {
+	logger := slog.New(handler)
+	slog.SetDefault(logger)
+	scanLog = logger.With("subsystem", "scanner")
+	gattLog = logger.With("subsystem", "gatt")
+	peripheralLog = logger.With("subsystem", "peripheral")
+	sinkLog = logger.With("subsystem", "sinks")
+	apiLog = logger.With("subsystem", "api")
+}
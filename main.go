@@ -1,64 +1,203 @@
 package main
 
 import (
-	// "context"
-	// "fmt"
-
-	"tinygo.org/x/bluetooth"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
 )
 
-var adapter = bluetooth.DefaultAdapter
+// command is a single subcommand of the ble tool. Each command parses its own
+// arguments with its own flag set.
+type command struct {
+	name    string
+	summary string
+	run     func(args []string) error
+}
+
+var commands = []command{
+	{"scan", "scan for advertising devices", runScan},
+	{"record", "record advertisements to a capture file", runRecord},
+	{"replay", "scan the advertisements of a capture file", runReplay},
+	{"daemon", "scan continuously into the configured sinks, as a gateway", runDaemon},
+	{"tui", "browse devices and their GATT services interactively", runTUI},
+	{"shell", "run commands interactively or from a script in one session", runShell},
+	{"connect", "connect to a device", runConnect},
+	{"advertise", "advertise as a peripheral", runAdvertise},
+	{"beacon", "advertise as an iBeacon or Eddystone-URL beacon", runBeacon},
+	{"serve", "run a GATT server defined in a file", runServe},
+	{"uart", "serial terminal to a Nordic UART Service peripheral", runUART},
+	{"uart-server", "bridge stdin and stdout to a Nordic UART Service peripheral", runUARTServer},
+	{"hid", "act as a Bluetooth keyboard typing stdin", runHID},
+	{"proxy", "mirror the GATT services of a device as a peripheral, relaying reads, writes and notifications", runProxy},
+	{"time-server", "serve the current time with the Current Time Service", runTimeServer},
+	{"gatt", "GATT client operations (read, write, notify)", runGatt},
+	{"info", "show the Device Information Service of a device", runInfo},
+	{"audit", "report the devices of a fleet that run outdated firmware", runAudit},
+	{"battery", "read the battery level of devices", runBattery},
+	{"heartrate", "stream heart rate measurements", runHeartRate},
+	{"dfu", "update the firmware of a device, e.g. with Nordic Secure DFU", runDFU},
+	{"bonds", "list and remove paired devices", runBonds},
+	{"history", "show the recorded sightings of a device", runHistory},
+	{"devices", "scan for a while and list the devices seen, with their RSSI and counts", runDevices},
+	{"presence", "report devices arriving and departing", runPresence},
+	{"calibrate", "record the RSSI of a device at 1 m for distance estimates", runCalibrate},
+	{"api", "serve an HTTP API for scanning and GATT operations", runAPI},
+	{"grpc", "serve a gRPC API for scanning and GATT operations", runGRPC},
+	{"completion", "print a shell completion script for bash, zsh or fish", runCompletion},
+}
 
 func main() {
-  	// Enable BLE interface.
-	must("enable BLE stack", adapter.Enable())
-	// adapter.address.String()
-	println("scanning...")
-	// opts := bluetooth.ConnectionParams{
-	// 	ConnectionTimeout: 1,
-	// 	MinInterval: 1,
-	// 	MaxInterval: 1,
-	// 	Timeout: 1,
-	// }
-	// fmt.Println("ME: ", bluetooth.)
-	adapter.Scan(func(adapter *bluetooth.Adapter, device bluetooth.ScanResult) {
-		println("found device:", device.Address.String(), device.RSSI, device.LocalName())
-		// adapter.SetConnectHandler(func (dev bluetooth.Device, connected bool) {
-		// 	fmt.Println("connected? ", connected)
-		// })
-		// peripheral, connectionErr := adapter.Connect(device.Address, opts)
-		// println("connection attempt: ", peripheral.Address.String(), connectionErr.Error())
-	})
-	// fmt.Println(err.Error())
-	// ctx, cancel := context.WithCancel(context.Background())
-	// adapter.SetConnectHandler(func(device bluetooth.Device, connected bool) {
-	// 	if connected {
-	// 		println("device connected:", device.Address.String())
-	// 		return
-	// 	}
+	flag.Usage = usage
+	flag.BoolVar(&verbose, "verbose", false, "print the underlying HCI or D-Bus error of failed operations")
+	flag.BoolVar(&dryRun, "dry-run", false, "check the flags, configuration, scripts and sinks of the command, and print what it would do without enabling Bluetooth")
+	var logging logFlags
+	logging.registerFlags(flag.CommandLine)
+	var adapters adapterFlags
+	adapters.registerFlags(flag.CommandLine)
+	decoders := decodersFlag(flag.CommandLine)
+	aliases := aliasesFlag(flag.CommandLine)
+	flag.Parse()
+	if err := logging.setup(); err != nil {
+		fmt.Fprintln(os.Stderr, "ble:", err)
+		os.Exit(exitUsage)
+	}
+	if err := adapters.setup(); err != nil {
+		fmt.Fprintln(os.Stderr, "ble:", err)
+		os.Exit(exitUsage)
+	}
+	if err := setupDecoders(*decoders); err != nil {
+		fmt.Fprintln(os.Stderr, "ble:", err)
+		os.Exit(exitUsage)
+	}
+	if err := loadAliasesFile(*aliases); err != nil {
+		fmt.Fprintln(os.Stderr, "ble: -aliases:", err)
+		os.Exit(exitUsage)
+	}
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(exitUsage)
+	}
 
-	// 	println("device disconnected:", device.Address.String())
-	// 	cancel()
-	// })
+	name, args := flag.Arg(0), flag.Args()[1:]
+	if name == "__complete" {
+		complete(args)
+		return
+	}
+	startServiceWatchdog()
+	for _, cmd := range commands {
+		if cmd.name != name {
+			continue
+		}
+		err := cmd.run(args)
+		if reloading.Load() {
+			if err := restart(); err != nil {
+				fmt.Fprintln(os.Stderr, "ble: reloading:", err)
+				os.Exit(exitFailure)
+			}
+		}
+		if errors.Is(err, errDryRun) {
+			reportDryRun(name)
+			return
+		}
+		if err != nil {
+			if logging.format == "json" {
+				// Keep stderr parseable.
+				slog.Error("command failed", "command", name, "err", err, "exit_code", exitCode(err))
+				os.Exit(exitCode(err))
+			}
+			fmt.Fprintln(os.Stderr, "ble "+name+":", err)
+			var bleErr *bleError
+			if !verbose && errors.As(err, &bleErr) && bleErr.kind != nil {
+				fmt.Fprintln(os.Stderr, "run 'ble -verbose "+name+"' for details")
+			}
+			os.Exit(exitCode(err))
+		}
+		return
+	}
+	fmt.Fprintf(os.Stderr, "ble: unknown command %q\n", name)
+	usage()
+	os.Exit(exitUsage)
+}
 
-  	// Define the peripheral device info.
-	// adv := adapter.DefaultAdvertisement()
-	// must("config adv", adv.Configure(bluetooth.AdvertisementOptions{
-	// 	LocalName: "Go Bluetooth",
-  	// }))
-  
-  	// // Start advertising
-	// must("start adv", adv.Start())
-	
-	// // Stop advertising to release resources
-	// defer adv.Stop()
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: ble [-verbose] [-dry-run] [-log-format text|json] [-log-level LEVEL] [-adapter ID] [-scan-adapter ID] [-dbus ADDRESS] [-decoders LIST] [-aliases FILE] <command> [flags] [args]")
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "commands:")
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-12s %s\n", cmd.name, cmd.summary)
+	}
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "Run 'ble <command> -h' for the flags of a command.")
+}
+
+// runSubcommand runs a subcommand of a command with subcommands, such as
+// "ble gatt read".
+func runSubcommand(name string, subcommands []command, args []string) error {
+	if len(args) == 0 {
+		if completing != nil {
+			completing(nil, subcommands)
+		}
+		subcommandUsage(name, subcommands)
+		return fmt.Errorf("missing %s subcommand", name)
+	}
+	for _, cmd := range subcommands {
+		if cmd.name == args[0] {
+			return cmd.run(args[1:])
+		}
+	}
+	if completing != nil {
+		completing(nil, nil)
+	}
+	subcommandUsage(name, subcommands)
+	return fmt.Errorf("unknown %s subcommand %q", name, args[0])
+}
 
-	// println("advertising...")
-	// <- ctx.Done()
+func subcommandUsage(name string, subcommands []command) {
+	fmt.Fprintf(os.Stderr, "usage: ble %s <subcommand> [flags] [args]\n", name)
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "subcommands:")
+	for _, cmd := range subcommands {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", cmd.name, cmd.summary)
+	}
+}
+
+// newFlagSet returns a flag set for a subcommand with a usage line that
+// describes its positional arguments. Commands parse it with parseFlags, so
+// that the configuration file applies.
+func newFlagSet(name, args string) *flag.FlagSet {
+	fs := flag.NewFlagSet("ble "+name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: ble %s [flags] %s\n", name, args)
+		fs.PrintDefaults()
+	}
+	configFlag(fs)
+	return fs
 }
 
-func must(action string, err error) {
-	if err != nil {
-		panic("failed to " + action + ": " + err.Error())
+// shutdownSignals are the signals that stop a command gracefully: scans are
+// stopped, connections closed, advertising stopped and output flushed.
+var shutdownSignals = []os.Signal{os.Interrupt, syscall.SIGTERM}
+
+// shutdownContext returns a context that is done when one of the shutdown
+// signals arrives, or a reload is asked for (see systemd_linux.go). A second
+// signal kills the process as usual, in case shutting down hangs.
+func shutdownContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	ctx, stop := signal.NotifyContext(ctx, shutdownSignals...)
+	stopReload := notifyReload(cancel)
+	go func() {
+		<-ctx.Done()
+		stop()
+		stopReload()
+	}()
+	return ctx, func() {
+		stop()
+		stopReload()
+		cancel()
 	}
-}
\ No newline at end of file
+}
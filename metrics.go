@@ -0,0 +1,203 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"example.com/m/decode"
+)
+
+// metrics collects Prometheus metrics while -metrics is serving them. It is
+// nil otherwise, which makes all of its methods no-ops.
+var metrics *metricsRegistry
+
+// metricsDeviceTTL is how long a device that is no longer seen is kept in the
+// metrics. Phones change their random address every few minutes, so without
+// this the metrics would grow without bounds.
+const metricsDeviceTTL = time.Hour
+
+type metricsRegistry struct {
+	mu            sync.Mutex
+	devices       map[string]*deviceMetrics
+	scanCallbacks uint64
+	dropped       uint64
+	decodeErrors  uint64
+	reconnects    uint64
+	recoveries    map[string]uint64 // by watchdog action
+}
+
+type deviceMetrics struct {
+	rssi           int16
+	lastSeen       time.Time
+	advertisements uint64
+	sensors        map[sensorKey]float64
+}
+
+type sensorKey struct {
+	kind, name, unit string
+}
+
+// metricsFlag registers the -metrics flag.
+func metricsFlag(fs *flag.FlagSet) *string {
+	return fs.String("metrics", "", "serve Prometheus metrics at http://ADDR/metrics, e.g. :9101")
+}
+
+// serveMetrics starts collecting metrics and serving them on addr, if it is
+// not empty.
+func serveMetrics(addr string) error {
+	if addr == "" {
+		return nil
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	metrics = &metricsRegistry{devices: make(map[string]*deviceMetrics), recoveries: make(map[string]uint64)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		metrics.write(w, time.Now())
+	})
+	go http.Serve(l, mux)
+	sinkLog.Info("serving metrics", "url", "http://"+l.Addr().String()+"/metrics")
+	return nil
+}
+
+func (m *metricsRegistry) scanCallback() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.scanCallbacks++
+}
+
+// drop counts a sighting dropped because the output couldn't keep up.
+func (m *metricsRegistry) drop() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.dropped++
+}
+
+func (m *metricsRegistry) reconnect() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.reconnects++
+}
+
+// recovery counts a recovery of the scan by the watchdog.
+func (m *metricsRegistry) recovery(action string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.recoveries[action]++
+}
+
+// observe records a sighting, before deduplication.
+func (m *metricsRegistry) observe(s *sighting) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	d := m.devices[s.Address]
+	if d == nil {
+		d = &deviceMetrics{sensors: make(map[sensorKey]float64)}
+		m.devices[s.Address] = d
+	}
+	d.rssi = s.RSSI
+	d.lastSeen = s.Time
+	d.advertisements++
+	for _, f := range s.Frames {
+		if failable, ok := f.(decode.FailableFrame); ok && failable.DecodeError() != "" {
+			m.decodeErrors++
+		}
+		if sensor, ok := f.(decode.SensorFrame); ok {
+			for _, measurement := range sensor.Measurements() {
+				d.sensors[sensorKey{f.Kind(), measurement.Name, measurement.Unit}] = measurement.Value
+			}
+		}
+	}
+}
+
+// write writes the metrics in the Prometheus text format, dropping devices
+// that haven't been seen for metricsDeviceTTL.
+func (m *metricsRegistry) write(w io.Writer, now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var addresses []string
+	for addr, d := range m.devices {
+		if now.Sub(d.lastSeen) > metricsDeviceTTL {
+			delete(m.devices, addr)
+			continue
+		}
+		addresses = append(addresses, addr)
+	}
+	slices.Sort(addresses)
+
+	header := func(name, kind, help string) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	}
+	header("ble_device_rssi_dbm", "gauge", "RSSI of the last advertisement of a device.")
+	for _, addr := range addresses {
+		fmt.Fprintf(w, "ble_device_rssi_dbm{address=%s} %d\n", label(addr), m.devices[addr].rssi)
+	}
+	header("ble_device_last_seen_timestamp_seconds", "gauge", "Time of the last advertisement of a device.")
+	for _, addr := range addresses {
+		fmt.Fprintf(w, "ble_device_last_seen_timestamp_seconds{address=%s} %.3f\n", label(addr), float64(m.devices[addr].lastSeen.UnixMilli())/1000)
+	}
+	header("ble_device_advertisements_total", "counter", "Advertisements received from a device; use rate() for the advertisement rate.")
+	for _, addr := range addresses {
+		fmt.Fprintf(w, "ble_device_advertisements_total{address=%s} %d\n", label(addr), m.devices[addr].advertisements)
+	}
+	header("ble_sensor_value", "gauge", "Last sensor value decoded from the advertisements of a device.")
+	for _, addr := range addresses {
+		d := m.devices[addr]
+		keys := make([]sensorKey, 0, len(d.sensors))
+		for key := range d.sensors {
+			keys = append(keys, key)
+		}
+		slices.SortFunc(keys, func(a, b sensorKey) int {
+			return strings.Compare(a.kind+"/"+a.name, b.kind+"/"+b.name)
+		})
+		for _, key := range keys {
+			fmt.Fprintf(w, "ble_sensor_value{address=%s,kind=%s,name=%s,unit=%s} %s\n",
+				label(addr), label(key.kind), label(key.name), label(key.unit), strconv.FormatFloat(d.sensors[key], 'g', -1, 64))
+		}
+	}
+	header("ble_scan_callbacks_total", "counter", "Scan results reported by the adapter, before filtering.")
+	fmt.Fprintf(w, "ble_scan_callbacks_total %d\n", m.scanCallbacks)
+	header("ble_scan_dropped_total", "counter", "Sightings dropped because the output couldn't keep up.")
+	fmt.Fprintf(w, "ble_scan_dropped_total %d\n", m.dropped)
+	header("ble_decode_errors_total", "counter", "Recognized advertisements that could not be decoded.")
+	fmt.Fprintf(w, "ble_decode_errors_total %d\n", m.decodeErrors)
+	header("ble_reconnects_total", "counter", "Successful reconnections to devices that disconnected.")
+	fmt.Fprintf(w, "ble_reconnects_total %d\n", m.reconnects)
+	header("ble_watchdog_recoveries_total", "counter", "Stalled or failed scans recovered by the watchdog, by action.")
+	for _, action := range []string{"restart", "power-cycle"} {
+		fmt.Fprintf(w, "ble_watchdog_recoveries_total{action=%s} %d\n", label(action), m.recoveries[action])
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// label formats a label value, quoted and escaped.
+func label(s string) string {
+	return `"` + labelEscaper.Replace(s) + `"`
+}
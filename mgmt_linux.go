@@ -0,0 +1,246 @@
+//go:build linux
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Some controller settings, such as scan parameters and PHYs, are not
+// offered by BlueZ over D-Bus, only by the management interface of the
+// kernel, which BlueZ itself uses. It is a socket that needs CAP_NET_ADMIN
+// (root, or setcap cap_net_admin+ep on the binary).
+
+const (
+	mgmtEventCommandComplete = 0x0001
+	mgmtEventCommandStatus   = 0x0002
+)
+
+// mgmtStatusNames names the common management status codes.
+var mgmtStatusNames = map[byte]string{
+	0x01: "unknown command",
+	0x03: "failed",
+	0x0a: "busy",
+	0x0c: "not supported",
+	0x0d: "invalid parameters",
+	0x0f: "not powered",
+	0x11: "invalid index",
+	0x14: "permission denied",
+}
+
+type mgmtSocket struct {
+	fd int
+}
+
+func openMgmt() (*mgmtSocket, error) {
+	fd, err := unix.Socket(unix.AF_BLUETOOTH, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.BTPROTO_HCI)
+	if err != nil {
+		return nil, fmt.Errorf("management socket: %w", err)
+	}
+	if err := unix.Bind(fd, &unix.SockaddrHCI{Dev: 0xffff, Channel: unix.HCI_CHANNEL_CONTROL}); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("management socket: %w (needs CAP_NET_ADMIN)", err)
+	}
+	timeout := unix.NsecToTimeval(int64(2 * time.Second))
+	if err := unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &timeout); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	return &mgmtSocket{fd: fd}, nil
+}
+
+func (m *mgmtSocket) Close() error {
+	return unix.Close(m.fd)
+}
+
+// command sends a command to a controller and returns the parameters of its
+// reply.
+func (m *mgmtSocket) command(opcode, index uint16, params []byte) ([]byte, error) {
+	packet := binary.LittleEndian.AppendUint16(nil, opcode)
+	packet = binary.LittleEndian.AppendUint16(packet, index)
+	packet = binary.LittleEndian.AppendUint16(packet, uint16(len(params)))
+	if _, err := unix.Write(m.fd, append(packet, params...)); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 1024)
+	for {
+		// Other events are delivered on the socket too, so read until
+		// the reply.
+		n, err := unix.Read(m.fd, buf)
+		if err != nil {
+			return nil, fmt.Errorf("management command 0x%04x: %w", opcode, err)
+		}
+		if n < 9 {
+			continue
+		}
+		event := binary.LittleEndian.Uint16(buf)
+		if (event != mgmtEventCommandComplete && event != mgmtEventCommandStatus) || binary.LittleEndian.Uint16(buf[6:]) != opcode {
+			continue
+		}
+		if status := buf[8]; status != 0 {
+			name := mgmtStatusNames[status]
+			if name == "" {
+				name = fmt.Sprintf("status 0x%02x", status)
+			}
+			return nil, fmt.Errorf("management command 0x%04x: %s", opcode, name)
+		}
+		return append([]byte(nil), buf[9:n]...), nil
+	}
+}
+
+// controllerIndex returns the management index of an adapter, e.g. 0 for
+// hci0.
+func controllerIndex(id string) (uint16, error) {
+	n, err := strconv.ParseUint(strings.TrimPrefix(id, "hci"), 10, 16)
+	if err != nil || !strings.HasPrefix(id, "hci") {
+		return 0, errors.New("adapter " + id + " has no controller index")
+	}
+	return uint16(n), nil
+}
+
+const (
+	mgmtReadDefaultSystemConfig = 0x004b
+	mgmtSetDefaultSystemConfig  = 0x004c
+)
+
+// The default system configuration parameters of the LE scan, in units of
+// 0.625 ms.
+const (
+	configScanIntervalDiscovery = 0x0011
+	configScanWindowDiscovery   = 0x0012
+	configScanIntervalMonitor   = 0x0013
+	configScanWindowMonitor     = 0x0014
+)
+
+// setScanParameters sets the LE scan interval and window of the scan adapter,
+// both for discovery and for advertisement monitors (passive scans), and
+// returns a function that restores the previous ones.
+func setScanParameters(interval, window time.Duration) (restore func(), err error) {
+	index, err := controllerIndex(scanAdapterID)
+	if err != nil {
+		return nil, err
+	}
+	m, err := openMgmt()
+	if err != nil {
+		return nil, err
+	}
+	defer m.Close()
+	current, err := m.command(mgmtReadDefaultSystemConfig, index, nil)
+	if err != nil {
+		return nil, err
+	}
+	units := func(d time.Duration) uint16 { return uint16(d / (625 * time.Microsecond)) }
+	config := map[uint16]uint16{
+		configScanIntervalDiscovery: units(interval),
+		configScanWindowDiscovery:   units(window),
+		configScanIntervalMonitor:   units(interval),
+		configScanWindowMonitor:     units(window),
+	}
+	old := make(map[uint16]uint16)
+	for tlv := current; len(tlv) >= 3 && len(tlv) >= 3+int(tlv[2]); tlv = tlv[3+int(tlv[2]):] {
+		typ := binary.LittleEndian.Uint16(tlv)
+		if _, ok := config[typ]; ok && tlv[2] == 2 {
+			old[typ] = binary.LittleEndian.Uint16(tlv[3:])
+		}
+	}
+	if err := setSystemConfig(m, index, config); err != nil {
+		return nil, err
+	}
+	scanLog.Debug("set scan parameters", "interval", interval, "window", window)
+	return func() {
+		m, err := openMgmt()
+		if err == nil {
+			err = setSystemConfig(m, index, old)
+			m.Close()
+		}
+		if err != nil {
+			scanLog.Warn("could not restore the scan parameters", "err", err)
+		}
+	}, nil
+}
+
+func setSystemConfig(m *mgmtSocket, index uint16, config map[uint16]uint16) error {
+	var params []byte
+	for typ, value := range config {
+		params = binary.LittleEndian.AppendUint16(params, typ)
+		params = append(params, 2)
+		params = binary.LittleEndian.AppendUint16(params, value)
+	}
+	_, err := m.command(mgmtSetDefaultSystemConfig, index, params)
+	return err
+}
+
+const (
+	mgmtGetPHYConfiguration = 0x0044
+	mgmtSetPHYConfiguration = 0x0045
+)
+
+// The LE PHYs of the PHY configuration.
+const (
+	phyLE1MTX    = 0x0200
+	phyLE1MRX    = 0x0400
+	phyLE2MTX    = 0x0800
+	phyLE2MRX    = 0x1000
+	phyLECodedTX = 0x2000
+	phyLECodedRX = 0x4000
+)
+
+// selectPHYs adds PHYs to the selected PHYs of an adapter, which the kernel
+// scans on and prefers for new connections, and returns a function that
+// restores the previous selection.
+func selectPHYs(id string, phys uint32) (restore func(), err error) {
+	index, err := controllerIndex(id)
+	if err != nil {
+		return nil, err
+	}
+	m, err := openMgmt()
+	if err != nil {
+		return nil, err
+	}
+	defer m.Close()
+	config, err := m.command(mgmtGetPHYConfiguration, index, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(config) < 12 {
+		return nil, errors.New("short PHY configuration")
+	}
+	supported := binary.LittleEndian.Uint32(config)
+	configurable := binary.LittleEndian.Uint32(config[4:])
+	selected := binary.LittleEndian.Uint32(config[8:])
+	if phys&supported != phys {
+		return nil, errors.New("the controller doesn't support the PHY")
+	}
+	if phys&^selected&^configurable != 0 {
+		return nil, errors.New("the PHY can't be selected on the controller")
+	}
+	if phys&^selected == 0 {
+		return func() {}, nil
+	}
+	if _, err := m.command(mgmtSetPHYConfiguration, index, binary.LittleEndian.AppendUint32(nil, selected|phys)); err != nil {
+		return nil, err
+	}
+	return func() {
+		m, err := openMgmt()
+		if err == nil {
+			_, err = m.command(mgmtSetPHYConfiguration, index, binary.LittleEndian.AppendUint32(nil, selected))
+			m.Close()
+		}
+		if err != nil {
+			gattLog.Warn("could not restore the PHY configuration", "err", err)
+		}
+	}, nil
+}
+
+// scanCodedPHY makes the scan adapter scan on the LE Coded PHY too, and
+// returns a function that stops it.
+func scanCodedPHY() (restore func(), err error) {
+	return selectPHYs(scanAdapterID, phyLECodedRX)
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"example.com/m/decode"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// mqttFlags are the flags for publishing to an MQTT broker.
+type mqttFlags struct {
+	broker   string
+	topic    string
+	clientID string
+	qos      int
+	retain   bool
+
+	username string
+	password string
+	caFile   string
+	certFile string
+	keyFile  string
+
+	discovery       bool
+	discoveryPrefix string
+}
+
+func (f *mqttFlags) registerFlags(fs *flag.FlagSet) {
+	fs.StringVar(&f.broker, "mqtt", "", "publish to this MQTT broker, e.g. tcp://localhost:1883 or ssl://broker:8883")
+	fs.StringVar(&f.topic, "mqtt-topic", "ble", "MQTT topic prefix")
+	fs.StringVar(&f.clientID, "mqtt-client-id", "", "MQTT client ID (default: random)")
+	fs.IntVar(&f.qos, "mqtt-qos", 0, "MQTT QoS level: 0, 1 or 2")
+	fs.BoolVar(&f.retain, "mqtt-retain", false, "publish retained MQTT messages")
+	fs.StringVar(&f.username, "mqtt-user", "", "MQTT user name")
+	fs.StringVar(&f.password, "mqtt-password", os.Getenv("MQTT_PASSWORD"), "MQTT password (default: $MQTT_PASSWORD)")
+	fs.StringVar(&f.caFile, "mqtt-ca", "", "PEM file with the CA certificates to verify the broker with")
+	fs.StringVar(&f.certFile, "mqtt-cert", "", "PEM file with a client certificate, for TLS client authentication")
+	fs.StringVar(&f.keyFile, "mqtt-key", "", "PEM file with the key of -mqtt-cert")
+	fs.BoolVar(&f.discovery, "mqtt-discovery", false, "announce decoded sensors to Home Assistant with MQTT discovery")
+	fs.StringVar(&f.discoveryPrefix, "mqtt-discovery-prefix", "homeassistant", "Home Assistant MQTT discovery prefix")
+}
+
+// connect connects to the broker. The client reconnects by itself when the
+// connection drops.
+func (f *mqttFlags) connect() (mqtt.Client, error) {
+	if f.qos < 0 || f.qos > 2 {
+		return nil, errors.New("-mqtt-qos must be 0, 1 or 2")
+	}
+	opts := mqtt.NewClientOptions().
+		AddBroker(f.broker).
+		SetClientID(f.clientID).
+		SetUsername(f.username).
+		SetPassword(f.password).
+		SetAutoReconnect(true).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			sinkLog.Warn("MQTT connection lost", "err", err)
+		})
+	if f.caFile != "" || f.certFile != "" {
+		config, err := f.tlsConfig()
+		if err != nil {
+			return nil, err
+		}
+		opts.SetTLSConfig(config)
+	}
+
+	client := mqtt.NewClient(opts)
+	token := client.Connect()
+	if !token.WaitTimeout(10 * time.Second) {
+		return nil, fmt.Errorf("timed out connecting to MQTT broker %s", f.broker)
+	}
+	if err := token.Error(); err != nil {
+		return nil, fmt.Errorf("connect to MQTT broker: %w", err)
+	}
+	sinkLog.Info("connected to MQTT broker", "broker", f.broker)
+	return client, nil
+}
+
+func (f *mqttFlags) tlsConfig() (*tls.Config, error) {
+	config := &tls.Config{}
+	if f.caFile != "" {
+		pem, err := os.ReadFile(f.caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", f.caFile)
+		}
+	}
+	if f.certFile != "" {
+		cert, err := tls.LoadX509KeyPair(f.certFile, f.keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// mqttOutput publishes sightings to an MQTT broker: the RSSI of every device
+// to <prefix>/<address>/rssi and its decoded sensor values to
+// <prefix>/<address>/sensor/<name>. Addresses are given without colons, e.g.
+// ble/AABBCCDDEEFF/rssi, and devices with an alias by their alias, as in
+// ble/kitchen-ruuvi/rssi.
+//
+// With -mqtt-discovery, each sensor value is announced to Home Assistant the
+// first time it is published.
+type mqttOutput struct {
+	client mqtt.Client
+	flags  *mqttFlags
+
+	announced map[string]bool // by state topic
+}
+
+func newMQTTOutput(flags *mqttFlags) (*mqttOutput, error) {
+	client, err := flags.connect()
+	if err != nil {
+		return nil, err
+	}
+	return &mqttOutput{client: client, flags: flags, announced: make(map[string]bool)}, nil
+}
+
+// mqttTopicAddress formats an address for use in MQTT topics.
+func mqttTopicAddress(address string) string {
+	return strings.ReplaceAll(address, ":", "")
+}
+
+// mqttTopicDevice returns the topic level of a device: its alias, without the
+// characters that MQTT topics reserve, or its address.
+func mqttTopicDevice(alias, address string) string {
+	if alias != "" {
+		return strings.NewReplacer("/", "_", "+", "_", "#", "_").Replace(alias)
+	}
+	return mqttTopicAddress(address)
+}
+
+// publish publishes a message without waiting for the broker: the client
+// queues messages while it is reconnecting, and scanning shouldn't stall on a
+// slow broker.
+func (o *mqttOutput) publish(topic string, payload any) {
+	o.client.Publish(topic, byte(o.flags.qos), o.flags.retain, payload)
+}
+
+func (o *mqttOutput) write(s *sighting) error {
+	base := o.flags.topic + "/" + mqttTopicDevice(s.Alias, s.Address)
+	o.publish(base+"/rssi", strconv.Itoa(int(s.RSSI)))
+	for _, f := range s.Frames {
+		sensor, ok := f.(decode.SensorFrame)
+		if !ok {
+			continue
+		}
+		for _, m := range sensor.Measurements() {
+			topic := base + "/sensor/" + m.Name
+			if o.flags.discovery && !o.announced[topic] {
+				configTopic, config := haSensor(o.flags.discoveryPrefix, s, f.Kind(), m, topic)
+				o.client.Publish(configTopic, byte(o.flags.qos), true, config)
+				o.announced[topic] = true
+			}
+			o.publish(topic, strconv.FormatFloat(m.Value, 'f', -1, 64))
+		}
+	}
+	return nil
+}
+
+func (o *mqttOutput) close() error {
+	o.client.Disconnect(250)
+	return nil
+}
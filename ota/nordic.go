@@ -0,0 +1,360 @@
+package ota
+
+import (
+	"archive/zip"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"time"
+
+	"example.com/m/gattclient"
+	"tinygo.org/x/bluetooth"
+)
+
+// Nordic Secure DFU updates the firmware of a device running a bootloader of
+// the nRF5 SDK. A package made with nrfutil is a zip file whose manifest
+// lists the images in it, each an init packet (the .dat file: signed
+// metadata the bootloader checks first) and the firmware (the .bin file).
+// Both are sent as objects: the control point creates an object, its bytes
+// are written to the packet characteristic without response, and then the
+// control point reports the CRC-32 of everything sent so far and executes
+// the object. While sending, the bootloader also reports the CRC every PRN
+// packets, so that lost packets are noticed early and the writes don't
+// overrun it.
+
+func init() {
+	Register("nordic", &Nordic{PRN: 12})
+}
+
+var (
+	nordicService      = bluetooth.New16BitUUID(0xfe59)
+	nordicControlPoint = bluetooth.CharacteristicUUIDDFUControlPoint
+	nordicPacket       = bluetooth.NewUUID([16]byte{0x8e, 0xc9, 0x00, 0x02, 0xf3, 0x15, 0x4f, 0x60, 0x9f, 0xb8, 0x83, 0x88, 0x30, 0xda, 0xea, 0x50})
+)
+
+// The opcodes of the control point.
+const (
+	dfuCreate   = 0x01
+	dfuSetPRN   = 0x02
+	dfuChecksum = 0x03
+	dfuExecute  = 0x04
+	dfuSelect   = 0x06
+	dfuResponse = 0x60
+)
+
+// The object types.
+const (
+	dfuCommandObject = 0x01
+	dfuDataObject    = 0x02
+)
+
+const (
+	dfuSuccess           = 0x01
+	dfuNotPermitted      = 0x08
+	dfuExtendedError     = 0x0b
+	dfuResponseTimeout   = 20 * time.Second
+	dfuAttemptsPerObject = 3
+)
+
+var dfuResultNames = map[byte]string{
+	0x00: "invalid opcode",
+	0x02: "opcode not supported",
+	0x03: "invalid parameter",
+	0x04: "insufficient resources",
+	0x05: "invalid object",
+	0x07: "unsupported type",
+	0x08: "operation not permitted",
+	0x0a: "operation failed",
+}
+
+var dfuExtendedErrorNames = map[byte]string{
+	0x02: "wrong command format",
+	0x03: "unknown command",
+	0x04: "invalid init command",
+	0x05: "firmware version too low",
+	0x06: "wrong hardware version",
+	0x07: "SoftDevice version not supported",
+	0x08: "signature missing",
+	0x09: "wrong hash type",
+	0x0a: "hash failed",
+	0x0b: "wrong signature type",
+	0x0c: "verification failed",
+	0x0d: "insufficient space",
+}
+
+// dfuError is an error result of the control point.
+type dfuError struct {
+	opcode, result, extended byte
+}
+
+func (e *dfuError) Error() string {
+	if e.result == dfuExtendedError {
+		name := dfuExtendedErrorNames[e.extended]
+		if name == "" {
+			name = fmt.Sprintf("extended error 0x%02x", e.extended)
+		}
+		return fmt.Sprintf("DFU opcode 0x%02x: %s", e.opcode, name)
+	}
+	name := dfuResultNames[e.result]
+	if name == "" {
+		name = fmt.Sprintf("result 0x%02x", e.result)
+	}
+	return fmt.Sprintf("DFU opcode 0x%02x: %s", e.opcode, name)
+}
+
+// Nordic is the Nordic Secure DFU protocol.
+type Nordic struct {
+	// PRN is how many packets the bootloader receives before it confirms
+	// the CRC, or zero to only check it after each object.
+	PRN uint16
+}
+
+// nordicImageOrder is the order images are sent in: the SoftDevice and the
+// bootloader before the application that needs them.
+var nordicImageOrder = []string{"softdevice_bootloader", "softdevice", "bootloader", "application"}
+
+// Open reads the images of an nrfutil package.
+func (n *Nordic) Open(path string) ([]Image, error) {
+	z, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, err
+	}
+	defer z.Close()
+	readFile := func(name string) ([]byte, error) {
+		f, err := z.Open(name)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		defer f.Close()
+		return io.ReadAll(f)
+	}
+	b, err := readFile("manifest.json")
+	if err != nil {
+		return nil, err
+	}
+	var manifest struct {
+		Manifest map[string]struct {
+			BinFile string `json:"bin_file"`
+			DatFile string `json:"dat_file"`
+		} `json:"manifest"`
+	}
+	if err := json.Unmarshal(b, &manifest); err != nil {
+		return nil, fmt.Errorf("%s: manifest.json: %w", path, err)
+	}
+	var images []Image
+	for _, name := range nordicImageOrder {
+		files, ok := manifest.Manifest[name]
+		if !ok {
+			continue
+		}
+		image := Image{Name: name}
+		if image.Init, err = readFile(files.DatFile); err != nil {
+			return nil, err
+		}
+		if image.Firmware, err = readFile(files.BinFile); err != nil {
+			return nil, err
+		}
+		images = append(images, image)
+	}
+	if len(images) == 0 {
+		return nil, fmt.Errorf("%s: the manifest lists no images", path)
+	}
+	return images, nil
+}
+
+// nordicSession is a connection to a bootloader.
+type nordicSession struct {
+	*Session
+	image           string
+	control, packet gattclient.Characteristic
+	responses       chan []byte
+	prn             uint16
+}
+
+// Update sends the init packet and the firmware of an image.
+func (n *Nordic) Update(s *Session, image Image) error {
+	d := &nordicSession{Session: s, image: image.Name, responses: make(chan []byte, 16), prn: n.PRN}
+	var err error
+	if d.control, err = gattclient.FindCharacteristic(s.Device, nordicService, nordicControlPoint); err != nil {
+		return fmt.Errorf("no Secure DFU control point, is the device in its bootloader? %w", err)
+	}
+	if d.packet, err = gattclient.FindCharacteristic(s.Device, nordicService, nordicPacket); err != nil {
+		return fmt.Errorf("no Secure DFU packet characteristic: %w", err)
+	}
+	err = d.control.EnableNotifications(func(value []byte) {
+		select {
+		case d.responses <- append([]byte(nil), value...):
+		default:
+			s.Log().Warn("dropped a DFU response")
+		}
+	})
+	if err != nil {
+		return err
+	}
+	defer d.control.EnableNotifications(nil)
+
+	s.Log().Info("sending the init packet", "image", image.Name, "bytes", len(image.Init))
+	if err := d.sendObjects(dfuCommandObject, image.Init); err != nil {
+		return err
+	}
+	s.Log().Info("sending the firmware", "image", image.Name, "bytes", len(image.Firmware))
+	return d.sendObjects(dfuDataObject, image.Firmware)
+}
+
+// request writes a command to the control point and returns the parameters
+// of its response.
+func (d *nordicSession) request(command ...byte) ([]byte, error) {
+	if err := d.Write(nordicService, d.control, command, true); err != nil {
+		return nil, err
+	}
+	return d.response(command[0])
+}
+
+// response waits for the response to an opcode. Others, such as late receipt
+// notifications, are skipped.
+func (d *nordicSession) response(opcode byte) ([]byte, error) {
+	timeout := time.After(dfuResponseTimeout)
+	for {
+		select {
+		case r := <-d.responses:
+			if len(r) < 3 || r[0] != dfuResponse || r[1] != opcode {
+				continue
+			}
+			if r[2] != dfuSuccess {
+				e := &dfuError{opcode: opcode, result: r[2]}
+				if len(r) > 3 {
+					e.extended = r[3]
+				}
+				return nil, e
+			}
+			return r[3:], nil
+		case <-d.Lost:
+			return nil, ErrDisconnected
+		case <-timeout:
+			return nil, fmt.Errorf("DFU opcode 0x%02x: no response", opcode)
+		}
+	}
+}
+
+// checksum reads the offset and CRC of the data sent so far, from a response
+// to the checksum opcode.
+func checksum(params []byte) (offset, crc uint32, err error) {
+	if len(params) < 8 {
+		return 0, 0, errors.New("short DFU checksum response")
+	}
+	return binary.LittleEndian.Uint32(params), binary.LittleEndian.Uint32(params[4:]), nil
+}
+
+// sendObjects sends data as objects of a type, resuming a transfer that the
+// bootloader already has a part of.
+func (d *nordicSession) sendObjects(typ byte, data []byte) error {
+	prn := d.prn
+	if typ == dfuCommandObject {
+		// The init packet is a single small object.
+		prn = 0
+	}
+	if _, err := d.request(binary.LittleEndian.AppendUint16([]byte{dfuSetPRN}, prn)...); err != nil {
+		return err
+	}
+	params, err := d.request(dfuSelect, typ)
+	if err != nil {
+		return err
+	}
+	if len(params) < 12 {
+		return errors.New("short DFU select response")
+	}
+	maxSize := int(binary.LittleEndian.Uint32(params))
+	offset, crc, _ := checksum(params[4:])
+	if maxSize == 0 {
+		return errors.New("the bootloader reports a maximum object size of 0")
+	}
+
+	start := 0
+	if offset > 0 && int(offset) <= len(data) && crc == crc32.ChecksumIEEE(data[:offset]) {
+		// An object the bootloader has in full may not have been
+		// executed yet; a partial one is sent again.
+		start = int(offset) - int(offset)%maxSize
+		if start == int(offset) || int(offset) == len(data) {
+			if _, err := d.request(dfuExecute); err != nil && !isDFUResult(err, dfuNotPermitted) {
+				return err
+			}
+			start = int(offset)
+		}
+		if start > 0 {
+			d.Log().Info("resuming", "image", d.image, "offset", start)
+		}
+	}
+	for start < len(data) {
+		end := min(start+maxSize, len(data))
+		var err error
+		for attempt := 1; attempt <= dfuAttemptsPerObject; attempt++ {
+			if err = d.sendObject(typ, data, start, end, prn); err == nil || errors.Is(err, ErrDisconnected) {
+				break
+			}
+			d.Log().Warn("sending an object failed", "offset", start, "attempt", attempt, "err", err)
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := d.request(dfuExecute); err != nil {
+			return err
+		}
+		start = end
+		if typ == dfuDataObject {
+			d.Report(d.image, end, len(data))
+		}
+	}
+	return nil
+}
+
+// sendObject creates an object for data[start:end] and writes it to the
+// packet characteristic, checking the CRC every prn packets and at the end.
+func (d *nordicSession) sendObject(typ byte, data []byte, start, end int, prn uint16) error {
+	create := binary.LittleEndian.AppendUint32([]byte{dfuCreate, typ}, uint32(end-start))
+	if _, err := d.request(create...); err != nil {
+		return err
+	}
+	verify := func(params []byte) error {
+		offset, crc, err := checksum(params)
+		if err != nil {
+			return err
+		}
+		if int(offset) > len(data) || crc != crc32.ChecksumIEEE(data[:offset]) {
+			return fmt.Errorf("CRC mismatch at offset %d", offset)
+		}
+		return nil
+	}
+	t := &Transfer{
+		Session: d.Session,
+		Service: nordicService,
+		Char:    d.packet,
+		Every:   int(prn),
+		Confirm: func(int) error {
+			params, err := d.response(dfuChecksum)
+			if err != nil {
+				return err
+			}
+			return verify(params)
+		},
+	}
+	if err := t.Write(data, start, end); err != nil {
+		return err
+	}
+	params, err := d.request(dfuChecksum)
+	if err != nil {
+		return err
+	}
+	if offset, _, _ := checksum(params); int(offset) != end {
+		return fmt.Errorf("the bootloader has %d bytes, expected %d", offset, end)
+	}
+	return verify(params)
+}
+
+// isDFUResult returns whether err is a control point error with a result.
+func isDFUResult(err error, result byte) bool {
+	var e *dfuError
+	return errors.As(err, &e) && e.result == result
+}
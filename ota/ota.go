@@ -0,0 +1,171 @@
+// Package ota updates the firmware of devices over GATT. Each update
+// protocol, such as Nordic Secure DFU, is a Protocol registered by name, so
+// that vendor protocols can be added from other packages. Protocols share a
+// Session, which has the connection and reports progress, and Transfer, which
+// writes an image to a characteristic in chunks from any offset, so that an
+// interrupted update can resume where the device left off.
+package ota
+
+import (
+	"errors"
+	"log/slog"
+	"slices"
+	"sync"
+
+	"example.com/m/gattclient"
+	"tinygo.org/x/bluetooth"
+)
+
+// ErrDisconnected is returned when the device disconnects during an update.
+var ErrDisconnected = errors.New("device disconnected")
+
+// Image is a firmware image of an update package.
+type Image struct {
+	// Name says what the image is, such as "application".
+	Name string
+
+	// Init is metadata the device checks before the firmware, such as the
+	// signed init packet of Nordic DFU, or nil if the protocol has none.
+	Init     []byte
+	Firmware []byte
+}
+
+// Protocol is an update protocol.
+type Protocol interface {
+	// Open reads an update package, and returns its images in the order
+	// they are sent.
+	Open(path string) ([]Image, error)
+
+	// Update sends an image to a connected device. Devices usually reset
+	// after an image, so each one is sent over a new connection.
+	Update(s *Session, image Image) error
+}
+
+var registry struct {
+	mu        sync.RWMutex
+	protocols map[string]Protocol
+}
+
+// Register adds a protocol under a name, such as "nordic". It panics if the
+// name is already taken; it is meant to be called from init functions.
+func Register(name string, p Protocol) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	if _, ok := registry.protocols[name]; ok {
+		panic("ota: protocol " + name + " registered twice")
+	}
+	if registry.protocols == nil {
+		registry.protocols = make(map[string]Protocol)
+	}
+	registry.protocols[name] = p
+}
+
+// Lookup returns the protocol registered under a name.
+func Lookup(name string) (Protocol, bool) {
+	registry.mu.RLock()
+	defer registry.mu.RUnlock()
+	p, ok := registry.protocols[name]
+	return p, ok
+}
+
+// Names returns the names of the registered protocols, sorted.
+func Names() []string {
+	registry.mu.RLock()
+	defer registry.mu.RUnlock()
+	var names []string
+	for name := range registry.protocols {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// Session is a connection to a device being updated.
+type Session struct {
+	Device gattclient.Device
+
+	// Write writes a value to a characteristic of a service, with or
+	// without response. Platforms differ in how to best do that, so it is
+	// left to the caller.
+	Write func(service bluetooth.UUID, char gattclient.Characteristic, value []byte, withResponse bool) error
+
+	// Lost is closed when the device disconnects.
+	Lost <-chan struct{}
+
+	// Progress, if set, is called as the firmware of an image is sent,
+	// with the bytes the device has so far and in total.
+	Progress func(image string, sent, total int)
+
+	// Logger logs the course of the update, or slog.Default() if it is nil.
+	Logger *slog.Logger
+}
+
+// Log returns the logger of the session.
+func (s *Session) Log() *slog.Logger {
+	if s.Logger == nil {
+		return slog.Default()
+	}
+	return s.Logger
+}
+
+// Report reports the progress of an image.
+func (s *Session) Report(image string, sent, total int) {
+	if s.Progress != nil {
+		s.Progress(image, sent, total)
+	}
+}
+
+// Transfer writes data to a characteristic in chunks.
+type Transfer struct {
+	Session *Session
+	Service bluetooth.UUID
+	Char    gattclient.Characteristic
+
+	// ChunkSize is the size of each write, or zero for the largest that
+	// the ATT MTU of the connection allows.
+	ChunkSize    int
+	WithResponse bool
+
+	// Every, if not zero, is how many chunks to write before calling
+	// Confirm with the offset reached, for protocols whose devices
+	// acknowledge the data received so far.
+	Every   int
+	Confirm func(offset int) error
+}
+
+// Write writes data[start:end]. Offsets are those of the whole image, so
+// that a transfer can resume from the offset the device reports.
+func (t *Transfer) Write(data []byte, start, end int) error {
+	size := t.ChunkSize
+	if size == 0 {
+		size = ChunkSize(t.Char)
+	}
+	chunks := 0
+	for i := start; i < end; i += size {
+		select {
+		case <-t.Session.Lost:
+			return ErrDisconnected
+		default:
+		}
+		chunk := data[i:min(i+size, end)]
+		if err := t.Session.Write(t.Service, t.Char, chunk, t.WithResponse); err != nil {
+			return err
+		}
+		if chunks++; t.Every != 0 && chunks%t.Every == 0 && t.Confirm != nil {
+			if err := t.Confirm(i + len(chunk)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ChunkSize returns the largest value that can be written to a
+// characteristic at once: the ATT MTU of the connection less the 3 bytes of
+// the write header, or 20 if the MTU isn't known.
+func ChunkSize(char gattclient.Characteristic) int {
+	if mtu, err := char.GetMTU(); err == nil && mtu > 3 {
+		return int(mtu) - 3
+	}
+	return 20
+}
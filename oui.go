@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	assignednumbers "example.com/m/assigned_numbers"
+	"tinygo.org/x/bluetooth"
+)
+
+// embeddedVendors are the organizations of the embedded IEEE MA-L table, by
+// upper case hex prefix.
+var embeddedVendors = sync.OnceValue(func() map[string]string {
+	vendors := make(map[string]string)
+	if err := loadOUI(vendors, bytes.NewReader(assignednumbers.OUI)); err != nil {
+		panic("invalid embedded OUI table: " + err.Error())
+	}
+	return vendors
+})
+
+// userVendors are the organizations loaded with -oui. When set, they replace
+// the embedded table.
+var userVendors map[string]string
+
+// ouiFlag registers the -oui flag, which loads IEEE registry files instead of
+// the embedded table. It can be repeated to also load the MA-M (mam.csv) and
+// MA-S (oui36.csv) registries.
+func ouiFlag(fs *flag.FlagSet) {
+	fs.Func("oui", "look up vendors in this IEEE registry CSV (oui.csv, mam.csv or oui36.csv) instead of the embedded table (repeatable)", func(path string) error {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if userVendors == nil {
+			userVendors = make(map[string]string)
+		}
+		if err := loadOUI(userVendors, f); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		return nil
+	})
+}
+
+// loadOUI adds the assignments of an IEEE registry CSV to vendors. The files
+// have the columns Registry, Assignment, Organization Name and Organization
+// Address, with a header row.
+func loadOUI(vendors map[string]string, r io.Reader) error {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	header, err := cr.Read()
+	if err != nil {
+		return err
+	}
+	if len(header) < 3 || header[1] != "Assignment" {
+		return errors.New("not an IEEE registry CSV")
+	}
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if len(record) < 3 {
+			continue
+		}
+		prefix := strings.ToUpper(record[1])
+		switch len(prefix) {
+		case 6, 7, 9: // MA-L, MA-M and MA-S
+			vendors[prefix] = strings.TrimSpace(record[2])
+		}
+	}
+}
+
+// vendor returns the organization that was assigned the prefix of a public
+// address, or the empty string. Random addresses have no assigned prefix.
+func vendor(address bluetooth.Address) string {
+	if address.IsRandom() {
+		return ""
+	}
+	digits := strings.ReplaceAll(address.String(), ":", "")
+	if len(digits) != 12 {
+		// Not a MAC address, such as the UUIDs macOS reports.
+		return ""
+	}
+	vendors := userVendors
+	if vendors == nil {
+		vendors = embeddedVendors()
+	}
+	// The longest prefix wins, as the MA-M and MA-S blocks are carved out of
+	// MA-L blocks registered to the IEEE itself.
+	for _, n := range []int{9, 7, 6} {
+		if name, ok := vendors[digits[:n]]; ok {
+			return name
+		}
+	}
+	return ""
+}
@@ -0,0 +1,445 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"example.com/m/decode"
+)
+
+// scanOutput writes reported sightings in some output format.
+type scanOutput interface {
+	write(s *sighting) error
+
+	// close flushes any buffered output.
+	close() error
+}
+
+// newScanOutput returns the output for the given -output format. In verbose
+// mode the AD structures of each advertisement are included.
+func newScanOutput(format string, w io.Writer, verbose bool) (scanOutput, error) {
+	switch format {
+	case "text":
+		return textOutput{w: w, verbose: verbose}, nil
+	case "json":
+		return &jsonOutput{enc: json.NewEncoder(w), verbose: verbose}, nil
+	case "csv":
+		return newCSVOutput(w)
+	case "pcapng":
+		return newPcapngOutput(w)
+	case "btsnoop":
+		return newBtsnoopOutput(w)
+	default:
+		return nil, fmt.Errorf("unknown output format %q", format)
+	}
+}
+
+// multiOutput writes sightings to several outputs.
+type multiOutput []scanOutput
+
+func (m multiOutput) write(s *sighting) error {
+	for _, o := range m {
+		if err := o.write(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m multiOutput) close() error {
+	var errs []error
+	for _, o := range m {
+		errs = append(errs, o.close())
+	}
+	return errors.Join(errs...)
+}
+
+// openSinks opens the sinks that are configured, in addition to the output of
+// a command: an MQTT broker, InfluxDB, a SQLite database and UDP datagrams.
+func openSinks(mqttSink *mqttFlags, influxSink *influxFlags, dbPath, udpAddr string) (multiOutput, error) {
+	var sinks multiOutput
+	if mqttSink.broker != "" {
+		m, err := newMQTTOutput(mqttSink)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, m)
+	}
+	if influxSink.enabled() {
+		i, err := newInfluxOutput(influxSink)
+		if err != nil {
+			sinks.close()
+			return nil, err
+		}
+		sinks = append(sinks, i)
+	}
+	if dbPath != "" {
+		store, err := newStoreOutput(dbPath)
+		if err != nil {
+			sinks.close()
+			return nil, err
+		}
+		sinks = append(sinks, store)
+	}
+	if udpAddr != "" {
+		u, err := newUDPOutput(udpAddr)
+		if err != nil {
+			sinks.close()
+			return nil, err
+		}
+		sinks = append(sinks, u)
+	}
+	return sinks, nil
+}
+
+// openOutputFile opens the file that -out-file refers to, or returns stdout if
+// no file was given. The returned writer is buffered; closing it flushes the
+// buffer. Closing stdout is a no-op. In a dry run, only the directory is
+// checked, and the output discarded.
+func openOutputFile(path string) (io.WriteCloser, error) {
+	if path == "" {
+		return nopWriteCloser{os.Stdout}, nil
+	}
+	if dryRun {
+		if err := checkOutputDir(path); err != nil {
+			return nil, err
+		}
+		return nopWriteCloser{io.Discard}, nil
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return &bufferedFile{Writer: bufio.NewWriter(f), file: f}, nil
+}
+
+// checkOutputDir checks that the directory of an output file exists, for dry
+// runs, which don't create the file.
+func checkOutputDir(path string) error {
+	dir := filepath.Dir(path)
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	return nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+type bufferedFile struct {
+	*bufio.Writer
+	file *os.File
+}
+
+func (f *bufferedFile) Close() error {
+	err := f.Flush()
+	if closeErr := f.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// textOutput is the human-readable output format.
+type textOutput struct {
+	w       io.Writer
+	verbose bool
+}
+
+func (o textOutput) write(s *sighting) error {
+	if s.Read != nil {
+		_, err := fmt.Fprintln(o.w, notificationLine(s.Time, deviceLabel(s.Address), s.Read.UUID, s.Read.Value, ""))
+		return err
+	}
+	// The sighting is written at once, so that a write error, most likely a
+	// closed pipe, is returned and stops the scan.
+	var b bytes.Buffer
+	address := s.Address
+	if s.Vendor != "" {
+		address += " (" + s.Vendor + ")"
+	}
+	fmt.Fprintln(&b, "found device:", address, s.RSSI, s.LocalName)
+	if s.Alias != "" {
+		fmt.Fprintln(&b, "  alias:", s.Alias)
+	}
+	if s.Identity != "" {
+		fmt.Fprintln(&b, "  identity:", s.Identity)
+	}
+	if s.DeviceID != "" && s.DeviceID != s.Address && s.DeviceID != s.Identity {
+		fmt.Fprintln(&b, "  device id:", s.DeviceID)
+	}
+	for _, f := range s.Frames {
+		fmt.Fprintln(&b, "  "+f.Kind()+":", f.String())
+	}
+	if smoothing != nil {
+		fmt.Fprintln(&b, "  smoothed rssi:", strconv.FormatFloat(s.SmoothedRSSI, 'f', 1, 64))
+	}
+	if s.Distance != 0 {
+		fmt.Fprintln(&b, "  distance:", strconv.FormatFloat(s.Distance, 'f', 1, 64), "m")
+	}
+	if s.Position != nil {
+		fmt.Fprintf(&b, "  position: %.1f, %.1f m (from %d receivers)\n", s.Position.X, s.Position.Y, s.Position.Receivers)
+	}
+	if s.Count != 0 {
+		fmt.Fprintln(&b, "  advertisements:", s.Count)
+	}
+	for _, c := range s.Changes {
+		fmt.Fprintln(&b, "  "+c.String())
+	}
+	if o.verbose {
+		if s.Length > 31 {
+			fmt.Fprintln(&b, "  length:", s.Length, "bytes (extended)")
+		} else {
+			fmt.Fprintln(&b, "  length:", s.Length, "bytes")
+		}
+		payload, err := s.payload()
+		for _, structure := range payload {
+			fmt.Fprintln(&b, "  ad:", structure.String())
+		}
+		if err != nil {
+			fmt.Fprintln(&b, "  ad:", err.Error())
+		}
+	}
+	_, err := o.w.Write(b.Bytes())
+	return err
+}
+
+func (textOutput) close() error {
+	return nil
+}
+
+// jsonOutput writes one JSON object per sighting (NDJSON).
+type jsonOutput struct {
+	enc     *json.Encoder
+	verbose bool
+}
+
+// jsonSighting is the JSON form of a sighting. Binary data is hex encoded and
+// keyed by company ID or service UUID.
+type jsonSighting struct {
+	Time             time.Time               `json:"time"`
+	Address          string                  `json:"address"`
+	Vendor           string                  `json:"vendor,omitempty"`
+	Alias            string                  `json:"alias,omitempty"`
+	Tags             []string                `json:"tags,omitempty"`
+	Identity         string                  `json:"identity,omitempty"`
+	DeviceID         string                  `json:"device_id,omitempty"`
+	RSSI             int16                   `json:"rssi"`
+	SmoothedRSSI     float64                 `json:"rssi_smoothed,omitempty"`
+	LocalName        string                  `json:"local_name,omitempty"`
+	Raw              string                  `json:"raw,omitempty"`
+	Length           int                     `json:"length"`
+	ManufacturerData map[string]string       `json:"manufacturer_data,omitempty"`
+	ServiceData      map[string]string       `json:"service_data,omitempty"`
+	Frames           map[string]decode.Frame `json:"frames,omitempty"`
+	Distance         float64                 `json:"distance_m,omitempty"`
+	Position         *position               `json:"position,omitempty"`
+	Count            int                     `json:"advertisements,omitempty"`
+	Changes          []jsonChange            `json:"changes,omitempty"`
+	AD               []jsonStructure         `json:"ad,omitempty"`
+}
+
+// jsonChange is the JSON form of a change to an AD structure, with the data
+// before and after it changed.
+type jsonChange struct {
+	Change string `json:"change"`
+	Type   uint8  `json:"type"`
+	Name   string `json:"name"`
+	Old    string `json:"old,omitempty"`
+	New    string `json:"new,omitempty"`
+	Bytes  string `json:"bytes,omitempty"`
+}
+
+type jsonStructure struct {
+	Type uint8  `json:"type"`
+	Name string `json:"name"`
+	Data string `json:"data"`
+}
+
+func (o *jsonOutput) write(s *sighting) error {
+	return o.enc.Encode(newJSONSighting(s, o.verbose))
+}
+
+// newJSONSighting returns the JSON form of a sighting. With verbose, it
+// includes the AD structures of the advertisement.
+func newJSONSighting(s *sighting, verbose bool) jsonSighting {
+	record := jsonSighting{
+		Time:      s.Time,
+		Address:   s.Address,
+		Vendor:    s.Vendor,
+		Alias:     s.Alias,
+		Tags:      s.Tags,
+		Identity:  s.Identity,
+		DeviceID:  s.DeviceID,
+		RSSI:      s.RSSI,
+		LocalName: s.LocalName,
+		Raw:       hex.EncodeToString(s.Raw),
+		Length:    s.Length,
+		Distance:  math.Round(s.Distance*100) / 100,
+		Position:  s.Position,
+		Count:     s.Count,
+	}
+	if smoothing != nil {
+		record.SmoothedRSSI = math.Round(s.SmoothedRSSI*10) / 10
+	}
+	if len(s.ManufacturerData) != 0 {
+		record.ManufacturerData = make(map[string]string)
+		for _, element := range s.ManufacturerData {
+			record.ManufacturerData[fmt.Sprintf("0x%04X", element.CompanyID)] = hex.EncodeToString(element.Data)
+		}
+	}
+	if len(s.ServiceData) != 0 {
+		record.ServiceData = make(map[string]string)
+		for _, element := range s.ServiceData {
+			record.ServiceData[element.UUID.String()] = hex.EncodeToString(element.Data)
+		}
+	}
+	if len(s.Frames) != 0 {
+		record.Frames = make(map[string]decode.Frame)
+		for i, key := range frameKeys(s.Frames) {
+			record.Frames[key] = s.Frames[i]
+		}
+	}
+	for _, c := range s.Changes {
+		structure := c.New
+		if structure == nil {
+			structure = c.Old
+		}
+		change := jsonChange{Change: c.Change, Type: uint8(structure.Type), Name: structure.Type.String(), Bytes: c.Bytes}
+		if c.Old != nil {
+			change.Old = hex.EncodeToString(c.Old.Data)
+		}
+		if c.New != nil {
+			change.New = hex.EncodeToString(c.New.Data)
+		}
+		record.Changes = append(record.Changes, change)
+	}
+	if verbose {
+		// A malformed tail is dropped: the raw field still has it.
+		payload, _ := s.payload()
+		for _, structure := range payload {
+			record.AD = append(record.AD, jsonStructure{
+				Type: uint8(structure.Type),
+				Name: structure.Type.String(),
+				Data: hex.EncodeToString(structure.Data),
+			})
+		}
+	}
+	return record
+}
+
+// frameKeys returns the keys of frames in the maps of the outputs: their
+// kind, numbered from the second frame of a kind on, as in manufacturer#2, so
+// that an advertisement with two frames of a kind keeps both.
+func frameKeys(frames []decode.Frame) []string {
+	keys := make([]string, len(frames))
+	seen := make(map[string]int)
+	for i, f := range frames {
+		kind := f.Kind()
+		seen[kind]++
+		keys[i] = kind
+		if seen[kind] > 1 {
+			keys[i] += "#" + strconv.Itoa(seen[kind])
+		}
+	}
+	return keys
+}
+
+func (o *jsonOutput) close() error {
+	return nil
+}
+
+// csvOutput writes one row per sighting. Manufacturer and service data are
+// written as space separated key=hex pairs.
+type csvOutput struct {
+	w *csv.Writer
+}
+
+var csvHeader = []string{"time", "address", "rssi", "local_name", "manufacturer_data", "service_data", "raw", "alias", "advertisements", "changes", "x", "y", "receivers"}
+
+func newCSVOutput(w io.Writer) (*csvOutput, error) {
+	o := &csvOutput{w: csv.NewWriter(w)}
+	if err := o.w.Write(csvHeader); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+func (o *csvOutput) write(s *sighting) error {
+	var manufacturerData, serviceData []string
+	for _, element := range s.ManufacturerData {
+		manufacturerData = append(manufacturerData, fmt.Sprintf("0x%04X=%x", element.CompanyID, element.Data))
+	}
+	for _, element := range s.ServiceData {
+		serviceData = append(serviceData, fmt.Sprintf("%s=%x", element.UUID.String(), element.Data))
+	}
+	return o.w.Write(append([]string{
+		s.Time.Format(time.RFC3339Nano),
+		s.Address,
+		strconv.Itoa(int(s.RSSI)),
+		s.LocalName,
+		strings.Join(manufacturerData, " "),
+		strings.Join(serviceData, " "),
+		hex.EncodeToString(s.Raw),
+		s.Alias,
+		countField(s.Count),
+		changesField(s.Changes),
+	}, positionFields(s.Position)...))
+}
+
+// positionFields are the x, y and receivers columns of a sighting, empty
+// without a position estimate.
+func positionFields(p *position) []string {
+	if p == nil {
+		return []string{"", "", ""}
+	}
+	return []string{
+		strconv.FormatFloat(p.X, 'f', -1, 64),
+		strconv.FormatFloat(p.Y, 'f', -1, 64),
+		strconv.Itoa(p.Receivers),
+	}
+}
+
+// countField is the advertisements column of a sighting, empty if it doesn't
+// aggregate advertisements.
+func countField(count int) string {
+	if count == 0 {
+		return ""
+	}
+	return strconv.Itoa(count)
+}
+
+// changesField is the changes column of a sighting: its changes, separated
+// by semicolons.
+func changesField(changes []adChange) string {
+	fields := make([]string, len(changes))
+	for i, c := range changes {
+		fields[i] = c.String()
+	}
+	return strings.Join(fields, "; ")
+}
+
+func (o *csvOutput) close() error {
+	o.w.Flush()
+	return o.w.Error()
+}
@@ -0,0 +1,270 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"example.com/m/gattclient"
+	"github.com/godbus/dbus/v5"
+	"tinygo.org/x/bluetooth"
+)
+
+// agentPath is where the pairing agent is exported on the bus.
+const agentPath = dbus.ObjectPath("/example/ble/agent")
+
+// pairingAgent implements the org.bluez.Agent1 interface, which BlueZ calls
+// to show or ask for passkeys while pairing. Prompts go to stderr and answers
+// are read from stdin.
+type pairingAgent struct {
+	mu sync.Mutex // one prompt at a time
+	in *bufio.Reader
+}
+
+var errRejected = dbus.NewError("org.bluez.Error.Rejected", nil)
+
+func (a *pairingAgent) prompt(question string) (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	fmt.Fprint(os.Stderr, question)
+	line, err := a.in.ReadString('\n')
+	return strings.TrimSpace(line), err
+}
+
+func (a *pairingAgent) Release() *dbus.Error { return nil }
+
+func (a *pairingAgent) RequestPinCode(device dbus.ObjectPath) (string, *dbus.Error) {
+	pin, err := a.prompt("enter the PIN code shown on the device: ")
+	if err != nil || pin == "" {
+		return "", errRejected
+	}
+	return pin, nil
+}
+
+func (a *pairingAgent) DisplayPinCode(device dbus.ObjectPath, pin string) *dbus.Error {
+	fmt.Fprintln(os.Stderr, "enter PIN code", pin, "on the device")
+	return nil
+}
+
+func (a *pairingAgent) RequestPasskey(device dbus.ObjectPath) (uint32, *dbus.Error) {
+	s, err := a.prompt("enter the passkey shown on the device: ")
+	if err != nil {
+		return 0, errRejected
+	}
+	passkey, err := strconv.ParseUint(s, 10, 32)
+	if err != nil || passkey > 999999 {
+		return 0, errRejected
+	}
+	return uint32(passkey), nil
+}
+
+func (a *pairingAgent) DisplayPasskey(device dbus.ObjectPath, passkey uint32, entered uint16) *dbus.Error {
+	if entered == 0 {
+		fmt.Fprintf(os.Stderr, "enter passkey %06d on the device\n", passkey)
+	}
+	return nil
+}
+
+func (a *pairingAgent) RequestConfirmation(device dbus.ObjectPath, passkey uint32) *dbus.Error {
+	answer, err := a.prompt(fmt.Sprintf("does the device show passkey %06d? [y/N] ", passkey))
+	if err != nil || !strings.EqualFold(answer, "y") && !strings.EqualFold(answer, "yes") {
+		return errRejected
+	}
+	return nil
+}
+
+func (a *pairingAgent) RequestAuthorization(device dbus.ObjectPath) *dbus.Error {
+	return nil
+}
+
+func (a *pairingAgent) AuthorizeService(device dbus.ObjectPath, uuid string) *dbus.Error {
+	return nil
+}
+
+func (a *pairingAgent) Cancel() *dbus.Error {
+	fmt.Fprintln(os.Stderr, "pairing cancelled by the device")
+	return nil
+}
+
+// pair pairs with a connected device, unless it is already paired. The IO
+// capability decides the pairing method: with NoInputNoOutput it is always
+// Just Works, otherwise the passkey is shown or asked for as needed.
+func pair(device gattclient.Device, capability string) error {
+	bus, err := dbus.SystemBus()
+	if err != nil {
+		return err
+	}
+	obj := bus.Object("org.bluez", devicePath(device.Address()))
+	if paired, err := obj.GetProperty("org.bluez.Device1.Paired"); err == nil && paired.Value() == true {
+		return nil
+	}
+
+	unregister, err := registerAgent(capability, false)
+	if err != nil {
+		return err
+	}
+	defer unregister()
+
+	gattLog.Info("pairing", "address", device.Address().String())
+	if err := obj.Call("org.bluez.Device1.Pair", 0).Err; err != nil {
+		return fmt.Errorf("pairing failed: %w", err)
+	}
+	// Trust the device, so that BlueZ lets it reconnect later without asking.
+	return obj.SetProperty("org.bluez.Device1.Trusted", dbus.MakeVariant(true))
+}
+
+// registerAgent registers the pairing agent with BlueZ. BlueZ uses it when
+// this process pairs; as the default agent, it is also used when centrals
+// pair with this machine.
+func registerAgent(capability string, asDefault bool) (unregister func(), err error) {
+	bus, err := dbus.SystemBus()
+	if err != nil {
+		return nil, err
+	}
+	agent := &pairingAgent{in: bufio.NewReader(os.Stdin)}
+	if err := bus.Export(agent, agentPath, "org.bluez.Agent1"); err != nil {
+		return nil, err
+	}
+	manager := bus.Object("org.bluez", "/org/bluez")
+	unregister = func() {
+		manager.Call("org.bluez.AgentManager1.UnregisterAgent", 0, agentPath)
+		bus.Export(nil, agentPath, "org.bluez.Agent1")
+	}
+	if err := manager.Call("org.bluez.AgentManager1.RegisterAgent", 0, agentPath, capability).Err; err != nil {
+		bus.Export(nil, agentPath, "org.bluez.Agent1")
+		return nil, fmt.Errorf("register pairing agent: %w", err)
+	}
+	if asDefault {
+		if err := manager.Call("org.bluez.AgentManager1.RequestDefaultAgent", 0, agentPath).Err; err != nil {
+			unregister()
+			return nil, fmt.Errorf("register default pairing agent: %w", err)
+		}
+	}
+	return unregister, nil
+}
+
+// pairingState describes the pairing state of a device as BlueZ reports it.
+func pairingState(device gattclient.Device) string {
+	bus, err := dbus.SystemBus()
+	if err != nil {
+		return "unknown"
+	}
+	obj := bus.Object("org.bluez", devicePath(device.Address()))
+	var states []string
+	// Bonded is only reported by BlueZ 5.72 and later.
+	for _, property := range []string{"Paired", "Bonded", "Trusted"} {
+		v, err := obj.GetProperty("org.bluez.Device1." + property)
+		if err != nil {
+			continue
+		}
+		if v.Value() == true {
+			states = append(states, strings.ToLower(property))
+		} else {
+			states = append(states, "not "+strings.ToLower(property))
+		}
+	}
+	if len(states) == 0 {
+		return "unknown"
+	}
+	return strings.Join(states, ", ")
+}
+
+// listBonds returns the devices BlueZ has paired with on the adapter in use.
+func listBonds() ([]bond, error) {
+	objects, err := managedObjects()
+	if err != nil {
+		return nil, err
+	}
+	prefix := "/org/bluez/" + adapterID + "/"
+	var bonds []bond
+	for path, ifaces := range objects {
+		props, ok := ifaces["org.bluez.Device1"]
+		if !ok || !strings.HasPrefix(string(path), prefix) {
+			continue
+		}
+		if paired, _ := props["Paired"].Value().(bool); !paired {
+			continue
+		}
+		b := bond{bonded: true}
+		b.address, _ = props["Address"].Value().(string)
+		b.name, _ = props["Alias"].Value().(string)
+		b.trusted, _ = props["Trusted"].Value().(bool)
+		if bonded, ok := props["Bonded"]; ok {
+			b.bonded, _ = bonded.Value().(bool)
+		}
+		bonds = append(bonds, b)
+	}
+	slices.SortFunc(bonds, func(a, b bond) int { return strings.Compare(a.address, b.address) })
+	return bonds, nil
+}
+
+// removeBond removes a device and its keys from BlueZ. It will have to pair
+// again on the next connection.
+func removeBond(address bluetooth.Address) error {
+	bus, err := dbus.SystemBus()
+	if err != nil {
+		return err
+	}
+	adapterObj := bus.Object("org.bluez", dbus.ObjectPath("/org/bluez/"+adapterID))
+	return adapterObj.Call("org.bluez.Adapter1.RemoveDevice", 0, devicePath(address)).Err
+}
+
+// bluezStorage is where BlueZ stores bonding keys, in an info file per
+// adapter and device.
+const bluezStorage = "/var/lib/bluetooth"
+
+// bondedIRKs returns the IRKs of the devices BlueZ has bonded with, by
+// identity address, most significant byte first. The storage is only readable
+// by root.
+func bondedIRKs() (map[string][]byte, error) {
+	infos, err := filepath.Glob(filepath.Join(bluezStorage, "*", "*", "info"))
+	if err != nil {
+		return nil, err
+	}
+	if len(infos) == 0 {
+		if _, err := os.ReadDir(bluezStorage); err != nil {
+			return nil, err
+		}
+	}
+	irks := make(map[string][]byte)
+	for _, path := range infos {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		keyHex, ok := iniValue(string(data), "IdentityResolvingKey", "Key")
+		if !ok {
+			continue
+		}
+		irk, err := hex.DecodeString(keyHex)
+		if err != nil || len(irk) != 16 {
+			continue
+		}
+		// BlueZ stores keys least significant byte first, as they are sent.
+		slices.Reverse(irk)
+		irks[filepath.Base(filepath.Dir(path))] = irk
+	}
+	return irks, nil
+}
+
+// iniValue returns the value of a key in a section of a BlueZ storage file.
+func iniValue(data, section, key string) (string, bool) {
+	in := false
+	for _, line := range strings.Split(data, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "[") {
+			in = line == "["+section+"]"
+		} else if k, v, ok := strings.Cut(line, "="); in && ok && k == key {
+			return v, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,32 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+
+	"example.com/m/gattclient"
+	"tinygo.org/x/bluetooth"
+)
+
+// pair is only implemented for BlueZ. Elsewhere, the operating system pairs
+// with a device when a characteristic requires it.
+func pair(device gattclient.Device, capability string) error {
+	return errors.New("pairing is not supported on this platform")
+}
+
+func pairingState(device gattclient.Device) string {
+	return "unknown"
+}
+
+func listBonds() ([]bond, error) {
+	return nil, errBondsUnsupported
+}
+
+func removeBond(address bluetooth.Address) error {
+	return errBondsUnsupported
+}
+
+func bondedIRKs() (map[string][]byte, error) {
+	return nil, errBondsUnsupported
+}
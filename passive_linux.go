@@ -0,0 +1,226 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"sync"
+
+	"example.com/m/scanner"
+	"github.com/godbus/dbus/v5"
+	"tinygo.org/x/bluetooth"
+)
+
+// BlueZ discovery always scans actively. Passive scanning is done with the
+// Advertisement Monitor API instead: while monitors are registered and no
+// discovery is running, BlueZ scans passively and reports the devices whose
+// advertisements match a monitor. Monitors match by patterns, which can't be
+// empty, so the monitor matches the Flags values advertisers use; devices
+// that advertise without Flags are not seen. The properties of a found
+// device are then followed like discovery does.
+
+const monitorRoot = dbus.ObjectPath("/org/ble/monitor")
+
+// monitorFlags are the Flags values matched by the monitor: combinations of
+// LE Limited/General Discoverable, BR/EDR Not Supported and the simultaneous
+// LE and BR/EDR bits that are seen in practice, up to the 16 patterns the
+// kernel accepts per monitor.
+var monitorFlags = []byte{0x00, 0x01, 0x02, 0x04, 0x05, 0x06, 0x08, 0x0a, 0x12, 0x16, 0x18, 0x19, 0x1a, 0x1b, 0x1e, 0x1f}
+
+// monitorPattern is an or_patterns entry: AD data of a type that contains
+// Content at Start.
+type monitorPattern struct {
+	Start   byte
+	ADType  byte
+	Content []byte
+}
+
+// passiveScan is a scanner.Backend that scans passively.
+type passiveScan struct {
+	adapter *bluetooth.Adapter
+	path    dbus.ObjectPath // of the BlueZ adapter
+
+	mu     sync.Mutex
+	cancel chan struct{} // non-nil while scanning
+}
+
+func passiveBackend(a *bluetooth.Adapter) (scanner.Backend, error) {
+	return &passiveScan{adapter: a, path: dbus.ObjectPath("/org/bluez/" + scanAdapterID)}, nil
+}
+
+// advMonitor is the exported org.bluez.AdvertisementMonitor1 object, and the
+// object manager that announces it to BlueZ.
+type advMonitor struct {
+	objects map[dbus.ObjectPath]map[string]map[string]dbus.Variant
+	events  chan monitorEvent
+}
+
+type monitorEvent struct {
+	device dbus.ObjectPath
+	lost   bool
+}
+
+func (m *advMonitor) GetManagedObjects() (map[dbus.ObjectPath]map[string]map[string]dbus.Variant, *dbus.Error) {
+	return m.objects, nil
+}
+
+func (m *advMonitor) Release() *dbus.Error  { return nil }
+func (m *advMonitor) Activate() *dbus.Error { return nil }
+
+func (m *advMonitor) DeviceFound(device dbus.ObjectPath) *dbus.Error {
+	m.events <- monitorEvent{device: device}
+	return nil
+}
+
+func (m *advMonitor) DeviceLost(device dbus.ObjectPath) *dbus.Error {
+	m.events <- monitorEvent{device: device, lost: true}
+	return nil
+}
+
+func (p *passiveScan) Scan(callback func(*bluetooth.Adapter, bluetooth.ScanResult)) error {
+	p.mu.Lock()
+	if p.cancel != nil {
+		p.mu.Unlock()
+		return errors.New("already scanning")
+	}
+	cancel := make(chan struct{})
+	p.cancel = cancel
+	p.mu.Unlock()
+	defer func() {
+		p.mu.Lock()
+		p.cancel = nil
+		p.mu.Unlock()
+	}()
+
+	bus, err := dbus.SystemBus()
+	if err != nil {
+		return err
+	}
+	var patterns []monitorPattern
+	for _, flags := range monitorFlags {
+		patterns = append(patterns, monitorPattern{0, 0x01, []byte{flags}})
+	}
+	monitorPath := monitorRoot + "/0"
+	monitor := &advMonitor{
+		objects: map[dbus.ObjectPath]map[string]map[string]dbus.Variant{
+			monitorPath: {"org.bluez.AdvertisementMonitor1": {
+				"Type":     dbus.MakeVariant("or_patterns"),
+				"Patterns": dbus.MakeVariant(patterns),
+			}},
+		},
+		// BlueZ waits for the calls to return, so they must not block
+		// on the scan loop for long.
+		events: make(chan monitorEvent, 256),
+	}
+	if err := bus.Export(monitor, monitorPath, "org.bluez.AdvertisementMonitor1"); err != nil {
+		return err
+	}
+	defer bus.Export(nil, monitorPath, "org.bluez.AdvertisementMonitor1")
+	if err := bus.Export(monitor, monitorRoot, "org.freedesktop.DBus.ObjectManager"); err != nil {
+		return err
+	}
+	defer bus.Export(nil, monitorRoot, "org.freedesktop.DBus.ObjectManager")
+
+	match := []dbus.MatchOption{
+		dbus.WithMatchInterface("org.freedesktop.DBus.Properties"),
+		dbus.WithMatchMember("PropertiesChanged"),
+		dbus.WithMatchPathNamespace(p.path),
+	}
+	if err := bus.AddMatchSignal(match...); err != nil {
+		return err
+	}
+	defer bus.RemoveMatchSignal(match...)
+	signals := make(chan *dbus.Signal, 64)
+	bus.Signal(signals)
+	defer bus.RemoveSignal(signals)
+
+	manager := bus.Object("org.bluez", p.path)
+	if err := manager.Call("org.bluez.AdvertisementMonitorManager1.RegisterMonitor", 0, monitorRoot).Err; err != nil {
+		return fmt.Errorf("registering an advertisement monitor for passive scanning: %w", err)
+	}
+	defer manager.Call("org.bluez.AdvertisementMonitorManager1.UnregisterMonitor", 0, monitorRoot)
+
+	found := make(map[dbus.ObjectPath]map[string]dbus.Variant)
+	for {
+		select {
+		case <-cancel:
+			return nil
+		case e := <-monitor.events:
+			if e.lost {
+				delete(found, e.device)
+				continue
+			}
+			var props map[string]dbus.Variant
+			err := bus.Object("org.bluez", e.device).Call("org.freedesktop.DBus.Properties.GetAll", 0, "org.bluez.Device1").Store(&props)
+			if err != nil {
+				scanLog.Debug("could not read a device found by the monitor", "device", e.device, "err", err)
+				continue
+			}
+			found[e.device] = props
+			callback(p.adapter, passiveResult(props))
+		case sig := <-signals:
+			props := found[sig.Path]
+			if props == nil || len(sig.Body) < 2 {
+				continue
+			}
+			if iface, _ := sig.Body[0].(string); iface != "org.bluez.Device1" {
+				continue
+			}
+			changes, _ := sig.Body[1].(map[string]dbus.Variant)
+			maps.Copy(props, changes)
+			_, rssi := changes["RSSI"]
+			_, manufacturerData := changes["ManufacturerData"]
+			_, serviceData := changes["ServiceData"]
+			if rssi || manufacturerData || serviceData {
+				callback(p.adapter, passiveResult(props))
+			}
+		}
+	}
+}
+
+func (p *passiveScan) StopScan() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.cancel == nil {
+		return errors.New("not scanning")
+	}
+	close(p.cancel)
+	p.cancel = nil
+	return nil
+}
+
+// passiveResult makes a scan result of the properties of a BlueZ device.
+func passiveResult(props map[string]dbus.Variant) bluetooth.ScanResult {
+	s, _ := props["Address"].Value().(string)
+	mac, _ := bluetooth.ParseMAC(s)
+	address := bluetooth.Address{MACAddress: bluetooth.MACAddress{MAC: mac}}
+	addressType, _ := props["AddressType"].Value().(string)
+	address.SetRandom(addressType == "random")
+
+	var fields bluetooth.AdvertisementFields
+	fields.LocalName, _ = props["Name"].Value().(string)
+	uuids, _ := props["UUIDs"].Value().([]string)
+	for _, s := range uuids {
+		if uuid, err := bluetooth.ParseUUID(s); err == nil {
+			fields.ServiceUUIDs = append(fields.ServiceUUIDs, uuid)
+		}
+	}
+	manufacturerData, _ := props["ManufacturerData"].Value().(map[uint16]dbus.Variant)
+	for id, v := range manufacturerData {
+		data, _ := v.Value().([]byte)
+		fields.ManufacturerData = append(fields.ManufacturerData, bluetooth.ManufacturerDataElement{CompanyID: id, Data: data})
+	}
+	serviceData, _ := props["ServiceData"].Value().(map[string]dbus.Variant)
+	for s, v := range serviceData {
+		uuid, err := bluetooth.ParseUUID(s)
+		if err != nil {
+			continue
+		}
+		data, _ := v.Value().([]byte)
+		fields.ServiceData = append(fields.ServiceData, bluetooth.ServiceDataElement{UUID: uuid, Data: data})
+	}
+	rssi, _ := props["RSSI"].Value().(int16)
+	return bluetooth.ScanResult{Address: address, RSSI: rssi, AdvertisementPayload: &scanner.Payload{Fields: fields}}
+}
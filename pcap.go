@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+
+	"tinygo.org/x/bluetooth"
+)
+
+// The pcapng and btsnoop outputs write advertisements in formats Wireshark
+// opens, e.g. ble scan -output pcapng | wireshark -k -i -, or ble replay
+// with -out-file to convert a capture. Neither platform hands over the
+// packets as received, so they are rebuilt from the address and the
+// advertising data: pcapng as link layer ADV_IND packets, btsnoop as the HCI
+// advertising reports a controller would send. The PDU type isn't known
+// either, and is always ADV_IND. GATT traffic isn't included, as the
+// bluetooth package doesn't expose the ATT packets; on Linux, btmon -w
+// records it.
+
+const (
+	// linkTypeBluetoothLELLWithPHDR is the link layer with the pseudo
+	// header that carries the RSSI.
+	linkTypeBluetoothLELLWithPHDR = 256
+
+	// advertisingAccessAddress is the access address of advertising
+	// channel packets.
+	advertisingAccessAddress = 0x8e89bed6
+
+	// The flags of the pseudo header: dewhitened, signal power valid,
+	// reference access address valid, CRC checked and CRC valid.
+	phdrFlags = 0x0001 | 0x0002 | 0x0010 | 0x0400 | 0x0800
+
+	// btsnoopDatalinkH4 is HCI packets prefixed with their UART (H4) type.
+	btsnoopDatalinkH4 = 1002
+
+	// btsnoopEpoch is the btsnoop timestamp of the Unix epoch, in
+	// microseconds.
+	btsnoopEpoch = 0x00dcddb30f2f8000
+)
+
+// advertiserAddress returns the address of a sighting in the byte order of
+// packets.
+func advertiserAddress(s *sighting) ([6]byte, error) {
+	// MAC is already little endian.
+	return bluetooth.ParseMAC(s.Address)
+}
+
+// advertisingData returns the AD payload of a sighting, truncated to length.
+func advertisingData(s *sighting, length int) []byte {
+	data := s.Raw
+	if data == nil {
+		payload, _ := s.payload()
+		data = payload.Bytes()
+	}
+	if len(data) > length {
+		data = data[:length]
+	}
+	return data
+}
+
+// pcapngOutput writes a pcapng file with one interface, whose packets are
+// advertising channel packets.
+type pcapngOutput struct {
+	w io.Writer
+}
+
+func newPcapngOutput(w io.Writer) (*pcapngOutput, error) {
+	o := &pcapngOutput{w: w}
+	// Section header block: byte order magic, version 1.0, unknown
+	// section length.
+	shb := binary.LittleEndian.AppendUint32(nil, 0x1a2b3c4d)
+	shb = binary.LittleEndian.AppendUint16(shb, 1)
+	shb = binary.LittleEndian.AppendUint16(shb, 0)
+	shb = binary.LittleEndian.AppendUint64(shb, ^uint64(0))
+	if err := o.block(0x0a0d0d0a, shb); err != nil {
+		return nil, err
+	}
+	// Interface description block: link type, reserved, no snap length.
+	idb := binary.LittleEndian.AppendUint16(nil, linkTypeBluetoothLELLWithPHDR)
+	idb = binary.LittleEndian.AppendUint16(idb, 0)
+	idb = binary.LittleEndian.AppendUint32(idb, 0)
+	if err := o.block(1, idb); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// block writes a block, padding its body to 32 bits.
+func (o *pcapngOutput) block(typ uint32, body []byte) error {
+	for len(body)%4 != 0 {
+		body = append(body, 0)
+	}
+	length := uint32(12 + len(body))
+	b := binary.LittleEndian.AppendUint32(nil, typ)
+	b = binary.LittleEndian.AppendUint32(b, length)
+	b = append(b, body...)
+	b = binary.LittleEndian.AppendUint32(b, length)
+	_, err := o.w.Write(b)
+	return err
+}
+
+func (o *pcapngOutput) write(s *sighting) error {
+	address, err := advertiserAddress(s)
+	if err != nil {
+		return err
+	}
+	// The length of an advertising channel PDU is a byte, which includes
+	// the address.
+	data := advertisingData(s, 255-6)
+
+	// The pseudo header: RF channel 0 (advertising channel 37), the
+	// signal power, no noise power or access address offenses, and the
+	// reference access address.
+	packet := []byte{0, byte(int8(max(min(s.RSSI, 127), -128))), 0, 0}
+	packet = binary.LittleEndian.AppendUint32(packet, advertisingAccessAddress)
+	packet = binary.LittleEndian.AppendUint16(packet, phdrFlags)
+
+	pdu := []byte{0x00, byte(6 + len(data))} // ADV_IND
+	if s.Random {
+		pdu[0] |= 0x40 // TxAdd
+	}
+	pdu = append(pdu, address[:]...)
+	pdu = append(pdu, data...)
+	packet = binary.LittleEndian.AppendUint32(packet, advertisingAccessAddress)
+	packet = append(packet, pdu...)
+	crc := linkLayerCRC(pdu)
+	packet = append(packet, byte(crc), byte(crc>>8), byte(crc>>16))
+
+	// Enhanced packet block: interface 0, the timestamp in microseconds
+	// (the default resolution), and the packet.
+	timestamp := uint64(s.Time.UnixMicro())
+	epb := binary.LittleEndian.AppendUint32(nil, 0)
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(timestamp>>32))
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(timestamp))
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(len(packet)))
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(len(packet)))
+	epb = append(epb, packet...)
+	return o.block(6, epb)
+}
+
+func (o *pcapngOutput) close() error {
+	return nil
+}
+
+// linkLayerCRC returns the CRC of an advertising channel PDU, in the order
+// its bytes are sent. The register is kept bit reversed, so that the bits,
+// which are sent least significant first, can be shifted in from the right.
+func linkLayerCRC(pdu []byte) uint32 {
+	state := uint32(0xaaaaaa) // 0x555555 reversed
+	for _, b := range pdu {
+		for range 8 {
+			bit := (state ^ uint32(b)) & 1
+			b >>= 1
+			state >>= 1
+			if bit != 0 {
+				state |= 1 << 23
+				state ^= 0x5a6000
+			}
+		}
+	}
+	return state
+}
+
+// btsnoopOutput writes a btsnoop file of HCI LE advertising report events.
+type btsnoopOutput struct {
+	w io.Writer
+}
+
+func newBtsnoopOutput(w io.Writer) (*btsnoopOutput, error) {
+	header := append([]byte("btsnoop\x00"), 0, 0, 0, 1)
+	header = binary.BigEndian.AppendUint32(header, btsnoopDatalinkH4)
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return &btsnoopOutput{w: w}, nil
+}
+
+func (o *btsnoopOutput) write(s *sighting) error {
+	address, err := advertiserAddress(s)
+	if err != nil {
+		return err
+	}
+	var addressType byte
+	if s.Random {
+		addressType = 1
+	}
+	rssi := byte(int8(max(min(s.RSSI, 127), -128)))
+
+	// An LE Meta event: a legacy advertising report for up to 31 bytes of
+	// data, else an extended one.
+	var params []byte
+	if data := advertisingData(s, 229); len(data) <= 31 {
+		params = []byte{0x02, 1, 0x00, addressType} // ADV_IND
+		params = append(params, address[:]...)
+		params = append(params, byte(len(data)))
+		params = append(params, data...)
+		params = append(params, rssi)
+	} else {
+		// Event type 0 is a complete, undirected extended
+		// advertisement; then the primary PHY LE 1M, no secondary PHY
+		// or SID, the TX power not available, the RSSI, no periodic
+		// advertising and no direct address.
+		params = []byte{0x0d, 1, 0x00, 0x00, addressType}
+		params = append(params, address[:]...)
+		params = append(params, 1, 0, 0xff, 0x7f, rssi, 0, 0, 0, 0, 0, 0, 0, 0, 0)
+		params = append(params, byte(len(data)))
+		params = append(params, data...)
+	}
+	packet := append([]byte{0x04, 0x3e, byte(len(params))}, params...)
+
+	// The record: its lengths, the flags of a received event, no dropped
+	// packets and the timestamp.
+	record := binary.BigEndian.AppendUint32(nil, uint32(len(packet)))
+	record = binary.BigEndian.AppendUint32(record, uint32(len(packet)))
+	record = binary.BigEndian.AppendUint32(record, 0x3)
+	record = binary.BigEndian.AppendUint32(record, 0)
+	record = binary.BigEndian.AppendUint64(record, uint64(s.Time.UnixMicro()+btsnoopEpoch))
+	record = append(record, packet...)
+	_, err = o.w.Write(record)
+	return err
+}
+
+func (o *btsnoopOutput) close() error {
+	return nil
+}
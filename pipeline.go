@@ -0,0 +1,57 @@
+package main
+
+import (
+	"sync/atomic"
+)
+
+// scanPipeline hands sightings from the scan callback to a worker goroutine,
+// so that slow output (a stalled pipe, a slow broker) doesn't hold up the
+// callback, which makes the adapter drop events. When the buffer is full,
+// sightings are dropped and counted instead.
+type scanPipeline struct {
+	queue   chan *sighting
+	done    chan struct{}
+	err     error // of process, valid once done is closed
+	failed  atomic.Bool
+	dropped atomic.Uint64
+}
+
+// newScanPipeline starts a worker that calls process for every sighting
+// pushed. After process fails, the scan is stopped and the remaining
+// sightings are discarded.
+func newScanPipeline(size int, process func(*sighting) error) *scanPipeline {
+	p := &scanPipeline{queue: make(chan *sighting, size), done: make(chan struct{})}
+	go func() {
+		defer close(p.done)
+		for s := range p.queue {
+			if p.err != nil {
+				continue
+			}
+			if p.err = process(s); p.err != nil {
+				p.failed.Store(true)
+				stopScan()
+			}
+		}
+	}()
+	return p
+}
+
+// push queues a sighting, or drops it if the queue is full.
+func (p *scanPipeline) push(s *sighting) {
+	select {
+	case p.queue <- s:
+	default:
+		if p.dropped.Add(1) == 1 {
+			scanLog.Warn("output can't keep up, dropping sightings", "buffer", cap(p.queue))
+		}
+		metrics.drop()
+	}
+}
+
+// close waits for the worker to process the queued sightings, and returns the
+// error of process. push must not be called after close.
+func (p *scanPipeline) close() error {
+	close(p.queue)
+	<-p.done
+	return p.err
+}
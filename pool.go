@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"example.com/m/gattclient"
+	"tinygo.org/x/bluetooth"
+)
+
+// connPool holds connections to several devices at once, each kept open by
+// its own supervisor.
+type connPool struct {
+	conn      *connectFlags
+	reconnect *reconnectFlags
+	max       int
+
+	wg     sync.WaitGroup
+	mu     sync.Mutex
+	states map[string]connState
+	errs   []error
+}
+
+func newConnPool(conn *connectFlags, reconnect *reconnectFlags, max int) *connPool {
+	return &connPool{
+		conn:      conn,
+		reconnect: reconnect,
+		max:       max,
+		states:    make(map[string]connState),
+	}
+}
+
+// add starts connecting to a device, and keeps the connection open until ctx
+// is done. setup is called after every (re)connect with the device.
+func (p *connPool) add(ctx context.Context, address bluetooth.Address, setup func(gattclient.Device) (func(), error)) error {
+	addr := address.String()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.states[addr]; ok {
+		return fmt.Errorf("already connecting to %s", addr)
+	}
+	if len(p.states) >= p.max {
+		return fmt.Errorf("connection pool is full (%d connections)", p.max)
+	}
+	p.states[addr] = stateConnecting
+
+	s := &supervisor{
+		conn:      p.conn,
+		reconnect: p.reconnect,
+		address:   address,
+		setup:     setup,
+		onState:   func(state connState) { p.setState(addr, state) },
+	}
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		if err := s.run(ctx); err != nil {
+			p.mu.Lock()
+			p.errs = append(p.errs, fmt.Errorf("%s: %w", addr, err))
+			p.mu.Unlock()
+		}
+	}()
+	return nil
+}
+
+// setState records the state of a connection and, if the pool holds more than
+// one, prints how many are connected.
+func (p *connPool) setState(addr string, state connState) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.states[addr] = state
+	if len(p.states) > 1 {
+		gattLog.Info("connection state", "address", addr, "state", state.String(), "connected", p.count(stateConnected), "devices", len(p.states))
+	}
+}
+
+// count returns the number of connections in the given state. p.mu must be
+// held.
+func (p *connPool) count(state connState) int {
+	n := 0
+	for _, s := range p.states {
+		if s == state {
+			n++
+		}
+	}
+	return n
+}
+
+// wait waits until all connections are closed, and returns the errors that
+// closed them.
+func (p *connPool) wait() error {
+	p.wg.Wait()
+	return errors.Join(p.errs...)
+}
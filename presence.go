@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"tinygo.org/x/bluetooth"
+)
+
+func runPresence(args []string) error {
+	fs := newFlagSet("presence", "")
+	var filter scanFilter
+	filter.registerFlags(fs)
+	arriveAfter := fs.Duration("arrive-after", 0, "report a device as arrived once it has been seen for this long")
+	departAfter := fs.Duration("depart-after", 2*time.Minute, "report a device as departed once it hasn't been seen for this long")
+	format := fs.String("output", "text", "output format: text or json")
+	var webhookURLs []string
+	fs.Func("webhook", "POST each event as JSON to this URL (repeatable)", func(s string) error {
+		webhookURLs = append(webhookURLs, s)
+		return nil
+	})
+	var smooth smoothFlags
+	smooth.registerFlags(fs)
+	var irks irkFlags
+	irks.registerFlags(fs)
+	fingerprint := fingerprintFlag(fs)
+	var mqttSink mqttFlags
+	mqttSink.registerFlags(fs)
+	var scanning scanFlags
+	scanning.registerFlags(fs)
+	parseFlags(fs, args)
+	if err := smooth.setup(); err != nil {
+		return err
+	}
+	if err := scanning.setup(); err != nil {
+		return err
+	}
+	if err := filter.setup(); err != nil {
+		return err
+	}
+	if err := irks.setup(); err != nil {
+		return err
+	}
+	if err := setupFingerprints(*fingerprint); err != nil {
+		return err
+	}
+	if *format != "text" && *format != "json" {
+		return fmt.Errorf("unknown output format %q", *format)
+	}
+	if *departAfter <= 0 {
+		return errors.New("-depart-after must be positive")
+	}
+
+	sinks := []func(presenceEvent){printPresenceEvent(*format)}
+	var webhooks sync.WaitGroup
+	for _, url := range webhookURLs {
+		sinks = append(sinks, postPresenceEvent(url, &webhooks))
+	}
+	if mqttSink.broker != "" {
+		client, err := mqttSink.connect()
+		if err != nil {
+			return err
+		}
+		defer client.Disconnect(250)
+		sinks = append(sinks, publishPresenceEvent(client, &mqttSink))
+	}
+	// Events come from both the scan callback and the departure ticker.
+	var emitMu sync.Mutex
+	emit := func(events []presenceEvent) {
+		emitMu.Lock()
+		defer emitMu.Unlock()
+		for _, e := range events {
+			for _, sink := range sinks {
+				sink(e)
+			}
+		}
+	}
+
+	tracker := newPresenceTracker(*arriveAfter, *departAfter)
+	if err := enableAdapter(); err != nil {
+		return err
+	}
+
+	ctx, stop := shutdownContext()
+	defer stop()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				emit(tracker.expire(now))
+			case <-ctx.Done():
+				stopScan()
+				return
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	// With smoothing, -min-rssi applies to the smoothed RSSI, so that a
+	// single weak advertisement doesn't count as the device leaving.
+	minRSSI, hasMinRSSI := filter.minRSSI, filter.hasMinRSSI
+	if smoothing != nil {
+		filter.hasMinRSSI = false
+	}
+
+	scanLog.Info("watching for devices, press Ctrl-C to stop")
+	err := scan(func(adapter *bluetooth.Adapter, result bluetooth.ScanResult) {
+		if !filter.match(result) {
+			return
+		}
+		now := time.Now()
+		address := result.Address.String()
+		// A device is tracked by its ID with -fingerprint, or else by its
+		// identity address if an IRK resolves it, so that it doesn't
+		// depart and arrive again when it changes its address.
+		id := fingerprints.identify(result, now)
+		if id == "" {
+			id = address
+			if identity, ok := resolvePrivateAddress(address); ok {
+				id = identity
+			}
+		}
+		rssi := int16(math.Round(smoothing.smooth(id, result.RSSI)))
+		if hasMinRSSI && rssi < minRSSI {
+			return
+		}
+		emit(tracker.seen(id, address, result.LocalName(), rssi, now))
+	})
+	// Deliver the last events before exiting.
+	webhooks.Wait()
+	return err
+}
+
+// presenceEvent reports a device arriving or departing.
+type presenceEvent struct {
+	Time     time.Time `json:"time"`
+	Event    string    `json:"event"`   // "arrived" or "departed"
+	Address  string    `json:"address"` // the latest
+	DeviceID string    `json:"device_id,omitempty"`
+	Name     string    `json:"name,omitempty"`
+	Alias    string    `json:"alias,omitempty"`
+	RSSI     int16     `json:"rssi"` // of the last advertisement
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// presenceTracker decides when devices arrive and depart. A device arrives
+// once it has been seen for arriveAfter without a gap of departAfter, and
+// departs once it hasn't been seen for departAfter.
+type presenceTracker struct {
+	arriveAfter time.Duration
+	departAfter time.Duration
+
+	mu      sync.Mutex
+	devices map[string]*presenceState
+}
+
+type presenceState struct {
+	firstSeen time.Time
+	lastSeen  time.Time
+	address   string
+	name      string
+	rssi      int16
+	present   bool
+}
+
+func newPresenceTracker(arriveAfter, departAfter time.Duration) *presenceTracker {
+	return &presenceTracker{
+		arriveAfter: arriveAfter,
+		departAfter: departAfter,
+		devices:     make(map[string]*presenceState),
+	}
+}
+
+// seen records an advertisement of a device, identified by its address or its
+// device ID, returning an arrival event if the device has now arrived.
+func (t *presenceTracker) seen(id, address, name string, rssi int16, now time.Time) []presenceEvent {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	state := t.devices[id]
+	if state == nil || now.Sub(state.lastSeen) >= t.departAfter {
+		state = &presenceState{firstSeen: now}
+		t.devices[id] = state
+	}
+	state.lastSeen = now
+	state.address = address
+	state.rssi = rssi
+	if name != "" {
+		state.name = name
+	}
+	if state.present || now.Sub(state.firstSeen) < t.arriveAfter {
+		return nil
+	}
+	state.present = true
+	return []presenceEvent{state.event("arrived", id, now)}
+}
+
+// expire returns departure events for the devices that haven't been seen for
+// departAfter, and forgets them.
+func (t *presenceTracker) expire(now time.Time) []presenceEvent {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var events []presenceEvent
+	for id, state := range t.devices {
+		if now.Sub(state.lastSeen) < t.departAfter {
+			continue
+		}
+		if state.present {
+			events = append(events, state.event("departed", id, now))
+		}
+		delete(t.devices, id)
+	}
+	return events
+}
+
+func (s *presenceState) event(kind, id string, now time.Time) presenceEvent {
+	e := presenceEvent{Time: now, Event: kind, Address: s.address, Name: s.name, RSSI: s.rssi, LastSeen: s.lastSeen}
+	if id != s.address {
+		e.DeviceID = id
+	}
+	e.Alias = deviceAlias(s.address, id)
+	return e
+}
+
+func printPresenceEvent(format string) func(presenceEvent) {
+	if format == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		return func(e presenceEvent) { enc.Encode(e) }
+	}
+	return func(e presenceEvent) {
+		line := e.Time.Format(time.RFC3339) + " " + e.Event + " " + cmp.Or(e.Alias, e.Address)
+		if e.DeviceID != "" {
+			line += " (" + e.DeviceID + ")"
+		}
+		if e.Name != "" {
+			line += " " + e.Name
+		}
+		fmt.Println(line)
+	}
+}
+
+// webhookClient keeps a webhook that doesn't answer from piling up requests.
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// postPresenceEvent posts events to a webhook, in the background so that a
+// slow webhook doesn't hold up the scan. The posts in flight are added to
+// pending.
+func postPresenceEvent(url string, pending *sync.WaitGroup) func(presenceEvent) {
+	return func(e presenceEvent) {
+		body, _ := json.Marshal(e)
+		postWebhook(url, body, pending)
+	}
+}
+
+// postWebhook posts a JSON body to a webhook in the background, adding the
+// post to pending.
+func postWebhook(url string, body []byte, pending *sync.WaitGroup) {
+	pending.Add(1)
+	go func() {
+		defer pending.Done()
+		resp, err := webhookClient.Post(url, "application/json", bytes.NewReader(body))
+		if err != nil {
+			sinkLog.Error("webhook failed", "err", err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			sinkLog.Error("webhook failed", "url", url, "status", resp.Status)
+		}
+	}()
+}
+
+// publishPresenceEvent publishes events to <prefix>/<address>/presence, as
+// JSON. With -fingerprint the device ID takes the place of the address, which
+// may change, and the alias of a device takes the place of both.
+func publishPresenceEvent(client mqtt.Client, flags *mqttFlags) func(presenceEvent) {
+	return func(e presenceEvent) {
+		body, _ := json.Marshal(e)
+		id := e.Address
+		if e.DeviceID != "" {
+			id = e.DeviceID
+		}
+		topic := flags.topic + "/" + mqttTopicDevice(e.Alias, id) + "/presence"
+		client.Publish(topic, byte(flags.qos), flags.retain, body)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+
+	"tinygo.org/x/bluetooth"
+)
+
+// ble proxy connects to a device as a central and serves a mirror of its GATT
+// services as a peripheral: what centrals read from and write to the mirror
+// is relayed to the device, and its notifications are relayed back. Every
+// relayed value is logged, which shows what an app does with a device; with
+// the proxy in between, it also extends the range of the device. The GAP and
+// GATT services are the adapter's own and descriptors aren't mirrored, as
+// BlueZ provides those itself.
+
+func runProxy(args []string) error {
+	fs := newFlagSet("proxy", "<address>")
+	var conn connectFlags
+	conn.registerFlags(fs)
+	name := fs.String("name", "", "local name to advertise (default: that of the device)")
+	acceptFlag(fs)
+	parseFlags(fs, args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("expected an address")
+	}
+	address, err := parseAddress(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	if err := conn.validate(); err != nil {
+		return err
+	}
+
+	if err := enableAdapter(); err != nil {
+		return err
+	}
+	device, err := conn.connect(address)
+	if err != nil {
+		return err
+	}
+	defer device.Disconnect()
+	proxy, err := startGattProxy(device)
+	if err != nil {
+		return err
+	}
+	defer proxy.stop()
+
+	opts := bluetooth.AdvertisementOptions{
+		LocalName:    cmp.Or(*name, proxy.name),
+		ServiceUUIDs: fitServiceUUIDs(proxy.services),
+	}
+	stopAdvertising, err := startAdvertisement(opts)
+	if err != nil {
+		return err
+	}
+	defer stopAdvertising()
+
+	ctx, stop := shutdownContext()
+	defer stop()
+	notifyReady()
+	peripheralLog.Info("proxying, press Ctrl-C to stop", "address", address.String(), "services", len(proxy.services))
+	select {
+	case <-ctx.Done():
+		return nil
+	case <-disconnected(device):
+		return errors.New("the device disconnected")
+	}
+}
+
+// fitServiceUUIDs returns the service UUIDs that fit in a legacy
+// advertisement, after its Flags: the 16-bit ones first, then as many of the
+// others as there is room for.
+func fitServiceUUIDs(uuids []bluetooth.UUID) []bluetooth.UUID {
+	room := 31 - 3
+	var fit []bluetooth.UUID
+	for _, short := range []bool{true, false} {
+		size, first := 16, true
+		if short {
+			size = 2
+		}
+		for _, uuid := range uuids {
+			if uuid.Is16Bit() != short {
+				continue
+			}
+			need := size
+			if first {
+				need += 2 // the length and type of the list
+			}
+			if room < need {
+				break
+			}
+			fit, room, first = append(fit, uuid), room-need, false
+		}
+	}
+	return fit
+}
@@ -0,0 +1,154 @@
+//go:build linux
+
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"example.com/m/assigned_numbers"
+	"example.com/m/gattclient"
+	"github.com/godbus/dbus/v5"
+	"tinygo.org/x/bluetooth"
+)
+
+// gattProxy is the mirror of the GATT services of a device, registered with
+// BlueZ as a gattApp, whose characteristics read from and write to those of
+// the device.
+type gattProxy struct {
+	app      *gattApp
+	name     string           // of the device, if BlueZ knows it
+	services []bluetooth.UUID // mirrored
+
+	unsubscribe []func()
+}
+
+// proxiedFlags are the characteristic flags that the mirror has where the
+// characteristic of the device has them or a variant with security, such as
+// encrypt-read. Security is between the proxy and the device, so the mirror
+// doesn't ask it of centrals.
+var proxiedFlags = []string{"read", "write", "write-without-response", "notify", "indicate"}
+
+func startGattProxy(device gattclient.Device) (*gattProxy, error) {
+	services, err := device.DiscoverServices(nil)
+	if err != nil {
+		return nil, err
+	}
+	details, err := gattDetails(device.Address())
+	if err != nil {
+		return nil, fmt.Errorf("reading the characteristic flags: %w", err)
+	}
+	app, err := newGattApp("/example/ble/proxy")
+	if err != nil {
+		return nil, err
+	}
+	p := &gattProxy{app: app}
+	for _, service := range services {
+		uuid := service.UUID()
+		if uuid == bluetooth.ServiceUUIDGenericAccess || uuid == bluetooth.ServiceUUIDGenericAttribute {
+			continue
+		}
+		chars, err := service.DiscoverCharacteristics(nil)
+		if err != nil {
+			p.stop()
+			return nil, fmt.Errorf("service %s: %w", uuid.String(), err)
+		}
+		path := app.addService(uuid)
+		p.services = append(p.services, uuid)
+		peripheralLog.Info("mirroring", "service", describeUUID(uuid, assignednumbers.ServiceName(uuid)))
+		for _, char := range chars {
+			var flags []string
+			if detail := details[gattKey{uuid, char.UUID()}]; detail != nil {
+				for _, flag := range detail.flags {
+					flag = strings.TrimPrefix(strings.TrimPrefix(strings.TrimPrefix(flag, "secure-"), "encrypt-"), "authenticated-")
+					if slices.Contains(proxiedFlags, flag) && !slices.Contains(flags, flag) {
+						flags = append(flags, flag)
+					}
+				}
+			}
+			if len(flags) == 0 {
+				continue
+			}
+			if err := p.relay(device, uuid, char, path, flags); err != nil {
+				p.stop()
+				return nil, err
+			}
+		}
+	}
+	if len(p.services) == 0 {
+		p.stop()
+		return nil, errors.New("the device has no services to mirror")
+	}
+	if err := app.register(); err != nil {
+		p.stop()
+		return nil, fmt.Errorf("register the mirrored services: %w", err)
+	}
+	bus, err := dbus.SystemBus()
+	if err == nil {
+		alias, _ := bus.Object("org.bluez", devicePath(device.Address())).GetProperty("org.bluez.Device1.Alias")
+		p.name, _ = alias.Value().(string)
+	}
+	return p, nil
+}
+
+// relay adds the mirror of a characteristic, relaying reads and writes to it
+// and its notifications.
+func (p *gattProxy) relay(device gattclient.Device, service bluetooth.UUID, char gattclient.Characteristic, path dbus.ObjectPath, flags []string) error {
+	uuid := char.UUID()
+	label := describeUUID(uuid, assignednumbers.CharacteristicName(uuid))
+	var onWrite func([]byte, bool) error
+	if slices.Contains(flags, "write") || slices.Contains(flags, "write-without-response") {
+		onWrite = func(value []byte, withResponse bool) error {
+			err := writeCharacteristic(device, service, char, value, withResponse && slices.Contains(flags, "write"))
+			if err != nil {
+				peripheralLog.Warn("relaying write", "characteristic", label, "err", err)
+				return err
+			}
+			peripheralLog.Info("write", "characteristic", label, "value", hex.EncodeToString(value))
+			return nil
+		}
+	}
+	mirror, err := p.app.addCharacteristic(path, uuid, flags, nil, onWrite)
+	if err != nil {
+		return err
+	}
+	if slices.Contains(flags, "read") {
+		mirror.onRead = func() ([]byte, error) {
+			value, err := gattclient.Read(char)
+			if err != nil {
+				peripheralLog.Warn("relaying read", "characteristic", label, "err", err)
+				return nil, err
+			}
+			peripheralLog.Info("read", "characteristic", label, "value", hex.EncodeToString(value))
+			return value, nil
+		}
+	}
+	if slices.Contains(flags, "notify") || slices.Contains(flags, "indicate") {
+		// The device is subscribed to for as long as the proxy runs, and
+		// its notifications go to the centrals that subscribed to the
+		// mirror, if any.
+		err := char.EnableNotifications(func(value []byte) {
+			err := mirror.notify(value)
+			if err != nil && !errors.Is(err, errNotSubscribed) {
+				peripheralLog.Warn("relaying notification", "characteristic", label, "err", err)
+				return
+			}
+			peripheralLog.Info("notification", "characteristic", label, "value", hex.EncodeToString(value), "relayed", err == nil)
+		})
+		if err != nil {
+			return fmt.Errorf("subscribe to %s: %w", label, err)
+		}
+		p.unsubscribe = append(p.unsubscribe, func() { char.EnableNotifications(nil) })
+	}
+	return nil
+}
+
+func (p *gattProxy) stop() {
+	for _, unsubscribe := range p.unsubscribe {
+		unsubscribe()
+	}
+	p.app.unregister()
+}
@@ -0,0 +1,23 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+
+	"example.com/m/gattclient"
+	"tinygo.org/x/bluetooth"
+)
+
+// gattProxy is only implemented for BlueZ: the GATT server of the bluetooth
+// package can't relay reads.
+type gattProxy struct {
+	name     string
+	services []bluetooth.UUID
+}
+
+func startGattProxy(device gattclient.Device) (*gattProxy, error) {
+	return nil, errors.New("the GATT proxy is only supported on Linux")
+}
+
+func (p *gattProxy) stop() {}
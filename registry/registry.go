@@ -0,0 +1,185 @@
+// Package registry keeps track of the devices seen by a scan: when they were
+// first and last seen, how often and how regularly, how strongly, how many
+// different payloads they advertised, and what they advertised last.
+package registry
+
+import (
+	"cmp"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Device is what is known about a device. Last is the last advertisement, in
+// whatever form the registry keeps.
+type Device[T any] struct {
+	Address   string
+	FirstSeen time.Time
+	LastSeen  time.Time
+	Count     uint64 // advertisements seen
+	RSSIMin   int16
+	RSSIMax   int16
+	Last      T
+
+	// IntervalMin and IntervalMax are the shortest and longest time between
+	// two advertisements, and Intervals counts the times between them by
+	// IntervalBounds: Intervals[i] those up to IntervalBounds[i], and the
+	// last those longer than all of them.
+	IntervalMin time.Duration
+	IntervalMax time.Duration
+	Intervals   [len(IntervalBounds) + 1]uint64
+
+	// Variants is the number of different payloads advertised, up to
+	// MaxVariants.
+	Variants int
+
+	rssiSum     int64
+	intervalSum time.Duration
+	payloads    map[uint64]bool
+}
+
+// IntervalBounds are the upper bounds of the buckets of Device.Intervals.
+// Advertising intervals range from 20 ms to over 10 s.
+var IntervalBounds = [...]time.Duration{
+	20 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	200 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2 * time.Second,
+	5 * time.Second,
+	10 * time.Second,
+}
+
+// MaxVariants is the most payloads of a device that are told apart. Devices
+// that count something in their advertisements have a new payload for every
+// one.
+const MaxVariants = 1000
+
+// RSSIMean returns the mean RSSI of the advertisements seen.
+func (d *Device[T]) RSSIMean() float64 {
+	if d.Count == 0 {
+		return 0
+	}
+	return float64(d.rssiSum) / float64(d.Count)
+}
+
+// Rate returns the advertisements seen per second, or 0 if there weren't two
+// to tell.
+func (d *Device[T]) Rate() float64 {
+	span := d.LastSeen.Sub(d.FirstSeen)
+	if d.Count < 2 || span <= 0 {
+		return 0
+	}
+	return float64(d.Count-1) / span.Seconds()
+}
+
+// IntervalMean returns the mean time between advertisements.
+func (d *Device[T]) IntervalMean() time.Duration {
+	if d.Count < 2 {
+		return 0
+	}
+	return d.intervalSum / time.Duration(d.Count-1)
+}
+
+// IntervalQuantile estimates a quantile of the times between advertisements,
+// such as 0.5 for the median, as the upper bound of the bucket it falls in.
+func (d *Device[T]) IntervalQuantile(q float64) time.Duration {
+	if d.Count < 2 {
+		return 0
+	}
+	rank := uint64(q * float64(d.Count-1))
+	var n uint64
+	for i, count := range d.Intervals[:len(IntervalBounds)] {
+		if n += count; n > rank {
+			return min(IntervalBounds[i], d.IntervalMax)
+		}
+	}
+	return d.IntervalMax
+}
+
+// Registry is a registry of devices, safe for concurrent use. The zero value
+// is an empty registry.
+type Registry[T any] struct {
+	mu      sync.Mutex
+	devices map[string]*Device[T]
+}
+
+// Seen records an advertisement of a device, with a hash of its payload.
+func (r *Registry[T]) Seen(address string, t time.Time, rssi int16, payload uint64, last T) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	d := r.devices[address]
+	if d == nil {
+		if r.devices == nil {
+			r.devices = make(map[string]*Device[T])
+		}
+		d = &Device[T]{Address: address, FirstSeen: t, LastSeen: t, RSSIMin: rssi, RSSIMax: rssi, payloads: make(map[uint64]bool)}
+		r.devices[address] = d
+	} else {
+		interval := max(t.Sub(d.LastSeen), 0)
+		if d.Count == 1 || interval < d.IntervalMin {
+			d.IntervalMin = interval
+		}
+		d.IntervalMax = max(d.IntervalMax, interval)
+		d.intervalSum += interval
+		i := 0
+		for i < len(IntervalBounds) && interval > IntervalBounds[i] {
+			i++
+		}
+		d.Intervals[i]++
+	}
+	if !d.payloads[payload] && len(d.payloads) < MaxVariants {
+		d.payloads[payload] = true
+		d.Variants = len(d.payloads)
+	}
+	d.LastSeen = t
+	d.Count++
+	d.RSSIMin = min(d.RSSIMin, rssi)
+	d.RSSIMax = max(d.RSSIMax, rssi)
+	d.rssiSum += int64(rssi)
+	d.Last = last
+}
+
+// Get returns a device by address.
+func (r *Registry[T]) Get(address string) (Device[T], bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	d := r.devices[address]
+	if d == nil {
+		return Device[T]{}, false
+	}
+	return *d, true
+}
+
+// List returns all devices, sorted by address.
+func (r *Registry[T]) List() []Device[T] {
+	r.mu.Lock()
+	devices := make([]Device[T], 0, len(r.devices))
+	for _, d := range r.devices {
+		devices = append(devices, *d)
+	}
+	r.mu.Unlock()
+	slices.SortFunc(devices, func(a, b Device[T]) int { return cmp.Compare(a.Address, b.Address) })
+	return devices
+}
+
+// Len returns the number of devices.
+func (r *Registry[T]) Len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.devices)
+}
+
+// Expire forgets the devices last seen before a time, unless keep returns
+// true for them. keep may be nil.
+func (r *Registry[T]) Expire(before time.Time, keep func(address string) bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for address, d := range r.devices {
+		if d.LastSeen.Before(before) && (keep == nil || !keep(address)) {
+			delete(r.devices, address)
+		}
+	}
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"compress/gzip"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Output files can be rotated, so that long capture sessions don't end up in
+// one giant file: the file that -out-file names is always the current one,
+// and rotated files get the time they were started in their name, as in
+// scan-20240102-150405.json. Every file is complete in its format, with the
+// CSV header or pcapng section header of its own.
+
+// rotateFlags are the flags for rotating output files.
+type rotateFlags struct {
+	size  int64
+	every time.Duration
+	gzip  bool
+	keep  int
+}
+
+func (f *rotateFlags) registerFlags(fs *flag.FlagSet) {
+	fs.Func("rotate-size", "with -out-file, start a new file when it reaches about this size, e.g. 100M (plain numbers are bytes)", sizeFlag(&f.size))
+	fs.DurationVar(&f.every, "rotate-every", 0, "with -out-file, start a new file at multiples of this, e.g. 24h for midnight UTC (0 disables)")
+	fs.BoolVar(&f.gzip, "rotate-gzip", false, "compress rotated files with gzip")
+	fs.IntVar(&f.keep, "rotate-keep", 0, "keep only this many rotated files, deleting the oldest (0 keeps all)")
+}
+
+func (f *rotateFlags) enabled() bool {
+	return f.size > 0 || f.every > 0
+}
+
+func (f *rotateFlags) validate(outFile string) error {
+	if f.every < 0 {
+		return errors.New("-rotate-every must not be negative")
+	}
+	if f.keep < 0 {
+		return errors.New("-rotate-keep must not be negative")
+	}
+	if f.enabled() && outFile == "" {
+		return errors.New("-rotate-size and -rotate-every need -out-file")
+	}
+	return nil
+}
+
+// sizeFlag parses a size in bytes, with an optional K, M or G suffix for
+// powers of 1024, as in 512K or 100MB.
+func sizeFlag(size *int64) func(string) error {
+	return func(s string) error {
+		number := strings.TrimSuffix(strings.TrimSuffix(strings.ToUpper(s), "B"), "I")
+		unit := int64(1)
+		if n := len(number); n > 0 {
+			switch number[n-1] {
+			case 'K':
+				unit = 1 << 10
+			case 'M':
+				unit = 1 << 20
+			case 'G':
+				unit = 1 << 30
+			}
+			if unit > 1 {
+				number = number[:n-1]
+			}
+		}
+		v, err := strconv.ParseFloat(number, 64)
+		if err != nil || v < 0 {
+			return fmt.Errorf("invalid size %q", s)
+		}
+		*size = int64(v * float64(unit))
+		return nil
+	}
+}
+
+// openScanOutput opens the output of a scan in a format, written to a file or
+// stdout, and rotated if rotation is enabled. Closing it closes the file.
+func openScanOutput(format, path string, verbose bool, rotation *rotateFlags) (scanOutput, error) {
+	open := func(w io.Writer) (scanOutput, error) {
+		return newScanOutput(format, w, verbose)
+	}
+	if path != "" && rotation.enabled() && !dryRun {
+		return newRotatingOutput(path, rotation, open)
+	}
+	w, err := openOutputFile(path)
+	if err != nil {
+		return nil, err
+	}
+	output, err := open(w)
+	if err != nil {
+		w.Close()
+		return nil, err
+	}
+	return fileOutput{output, w}, nil
+}
+
+// fileOutput is an output that closes the file it writes to.
+type fileOutput struct {
+	scanOutput
+	file io.Closer
+}
+
+func (o fileOutput) close() error {
+	err := o.scanOutput.close()
+	if closeErr := o.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// rotatingOutput writes to a file that it replaces with a new one when the
+// file is due for rotation. Rotated files are compressed and pruned in the
+// background, so as not to hold up the scan.
+type rotatingOutput struct {
+	path     string
+	rotation *rotateFlags
+	open     func(io.Writer) (scanOutput, error)
+
+	output  scanOutput
+	file    io.WriteCloser
+	written *countingWriter
+	started time.Time
+
+	background sync.Mutex // held while compressing and pruning
+	pending    sync.WaitGroup
+}
+
+func newRotatingOutput(path string, rotation *rotateFlags, open func(io.Writer) (scanOutput, error)) (*rotatingOutput, error) {
+	r := &rotatingOutput{path: path, rotation: rotation, open: open}
+	// The file of an earlier session is rotated rather than overwritten, as
+	// when a daemon restarts.
+	if info, err := os.Stat(path); err == nil && info.Size() > 0 {
+		r.retire(info.ModTime())
+	}
+	if err := r.openFile(time.Now()); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingOutput) openFile(now time.Time) error {
+	f, err := openOutputFile(r.path)
+	if err != nil {
+		return err
+	}
+	r.written = &countingWriter{w: f}
+	output, err := r.open(r.written)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.output, r.file, r.started = output, f, now
+	return nil
+}
+
+// due returns whether the current file is to be rotated.
+func (r *rotatingOutput) due(now time.Time) bool {
+	if r.rotation.size > 0 && r.written.n >= r.rotation.size {
+		return true
+	}
+	return r.rotation.every > 0 && !now.Before(r.started.Truncate(r.rotation.every).Add(r.rotation.every))
+}
+
+func (r *rotatingOutput) write(s *sighting) error {
+	if now := time.Now(); r.due(now) {
+		if err := r.closeFile(); err != nil {
+			return err
+		}
+		r.retire(r.started)
+		if err := r.openFile(now); err != nil {
+			return err
+		}
+		sinkLog.Debug("rotated output file", "file", r.path)
+	}
+	return r.output.write(s)
+}
+
+func (r *rotatingOutput) closeFile() error {
+	err := r.output.close()
+	if closeErr := r.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// retire renames the file at path to its rotated name, then compresses it and
+// prunes the rotated files in the background.
+func (r *rotatingOutput) retire(started time.Time) {
+	name := r.rotatedName(started)
+	if err := os.Rename(r.path, name); err != nil {
+		sinkLog.Warn("rotating output file", "file", r.path, "err", err)
+		return
+	}
+	r.pending.Add(1)
+	go func() {
+		defer r.pending.Done()
+		r.background.Lock()
+		defer r.background.Unlock()
+		if r.rotation.gzip {
+			if err := gzipFile(name); err != nil {
+				sinkLog.Warn("compressing rotated output file", "file", name, "err", err)
+			}
+		}
+		if r.rotation.keep > 0 {
+			r.prune()
+		}
+	}()
+}
+
+// rotatedName returns the name of a rotated file started at a time, which
+// sorts by that time: the name of the file with the time inserted before its
+// extension. Should that name be taken, a number is added.
+func (r *rotatingOutput) rotatedName(started time.Time) string {
+	ext := filepath.Ext(r.path)
+	base := strings.TrimSuffix(r.path, ext) + "-" + started.Format("20060102-150405")
+	name := base + ext
+	for i := 2; exists(name) || exists(name+".gz"); i++ {
+		name = base + "-" + strconv.Itoa(i) + ext
+	}
+	return name
+}
+
+func exists(path string) bool {
+	_, err := os.Lstat(path)
+	return err == nil
+}
+
+// prune deletes the oldest rotated files beyond -rotate-keep.
+func (r *rotatingOutput) prune() {
+	ext := filepath.Ext(r.path)
+	pattern := strings.TrimSuffix(r.path, ext) + "-[0-9]*-[0-9]*" + ext
+	plain, _ := filepath.Glob(pattern)
+	compressed, _ := filepath.Glob(pattern + ".gz")
+	files := append(plain, compressed...)
+	if len(files) <= r.rotation.keep {
+		return
+	}
+	slices.SortFunc(files, func(a, b string) int {
+		return strings.Compare(strings.TrimSuffix(a, ".gz"), strings.TrimSuffix(b, ".gz"))
+	})
+	for _, name := range files[:len(files)-r.rotation.keep] {
+		if err := os.Remove(name); err != nil {
+			sinkLog.Warn("deleting rotated output file", "file", name, "err", err)
+		}
+	}
+}
+
+// close closes the current file, and waits for rotated files to be
+// compressed.
+func (r *rotatingOutput) close() error {
+	err := r.closeFile()
+	r.pending.Wait()
+	return err
+}
+
+// gzipFile compresses a file to one with .gz appended to its name, which
+// replaces it.
+func gzipFile(name string) error {
+	in, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(name + ".gz")
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	zw.Name = filepath.Base(name)
+	_, err = io.Copy(zw, in)
+	if closeErr := zw.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(name + ".gz")
+		return err
+	}
+	in.Close()
+	return os.Remove(name)
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"slices"
+	"time"
+
+	"example.com/m/decode"
+	"example.com/m/gattclient"
+	"example.com/m/registry"
+	"tinygo.org/x/bluetooth"
+)
+
+func runScan(args []string) error {
+	fs := newFlagSet("scan", "")
+	var filter scanFilter
+	filter.registerFlags(fs)
+	dedup := fs.Duration("dedup", 0, "report each device at most once per this window (0 disables)")
+	dedupOnChange := fs.Bool("dedup-on-change", false, "with -dedup, report a device again when its payload changes")
+	onlyChanges := fs.Bool("only-changes", false, "report a device when it is first seen, and then only when its advertising data changes, with the AD structures that changed")
+	duration := fs.Duration("duration", 0, "stop scanning after this long and print a summary (0 scans forever)")
+	format := fs.String("output", "text", "output format: text, json, csv, or pcapng or btsnoop for Wireshark")
+	outFile := fs.String("out-file", "", "write the output to this file instead of stdout")
+	var rotation rotateFlags
+	rotation.registerFlags(fs)
+	buffer := fs.Int("buffer", 1024, "sightings to buffer for the output; beyond that, sightings are dropped rather than stalling the scan")
+	fs.Var(decode.BTHomeKeys, "bthome-key", "decrypt BTHome advertisements of a device, as ADDRESS=KEY (repeatable)")
+	fs.Var(decode.MiBeaconKeys, "mibeacon-key", "decrypt Xiaomi MiBeacon advertisements of a device with its bind key, as ADDRESS=KEY (repeatable)")
+	verbose := fs.Bool("v", false, "include the AD structures of each advertisement in text and json output")
+	var mqttSink mqttFlags
+	mqttSink.registerFlags(fs)
+	var influxSink influxFlags
+	influxSink.registerFlags(fs)
+	read := fs.String("read", "", "connect to each device found and read this characteristic UUID, pausing the scan meanwhile (text output only)")
+	readWorkers := fs.Int("read-workers", 1, "with -read, connect to this many devices at once")
+	readTimeout := fs.Duration("read-timeout", 30*time.Second, "with -read, give up on a device after this long")
+	var conn connectFlags
+	conn.registerFlags(fs)
+	dbPath := fs.String("db", "", "record sightings and decoded measurements in this SQLite database, e.g. ble.db")
+	udpAddr := fs.String("udp", "", "send decoded sensor values as JSON datagrams to this HOST:PORT, e.g. 255.255.255.255:9999 to broadcast")
+	var smooth smoothFlags
+	smooth.registerFlags(fs)
+	var distance distanceFlags
+	distance.registerFlags(fs)
+	var locating locateFlags
+	locating.registerFlags(fs)
+	ouiFlag(fs)
+	var irks irkFlags
+	irks.registerFlags(fs)
+	fingerprint := fingerprintFlag(fs)
+	metricsAddr := metricsFlag(fs)
+	alerts := alertsFlag(fs)
+	var scanning scanFlags
+	scanning.registerFlags(fs)
+	var scheduling scheduleFlags
+	scheduling.registerFlags(fs)
+	parseFlags(fs, args)
+	if *buffer < 1 {
+		return errors.New("-buffer must be at least 1")
+	}
+	var readUUID bluetooth.UUID
+	if *read != "" {
+		var err error
+		if readUUID, err = bluetooth.ParseUUID(*read); err != nil {
+			return fmt.Errorf("-read: %w", err)
+		}
+		if *format != "text" {
+			return errors.New("-read only works with -output text")
+		}
+		if *readWorkers < 1 {
+			return errors.New("-read-workers must be at least 1")
+		}
+		if err := conn.validate(); err != nil {
+			return err
+		}
+	}
+	if err := rotation.validate(*outFile); err != nil {
+		return err
+	}
+	if err := serveMetrics(*metricsAddr); err != nil {
+		return err
+	}
+	if err := scanning.setup(); err != nil {
+		return err
+	}
+	sched, err := scheduling.setup()
+	if err != nil {
+		return err
+	}
+	if err := filter.setup(); err != nil {
+		return err
+	}
+	if err := smooth.setup(); err != nil {
+		return err
+	}
+	if err := distance.setup(); err != nil {
+		return err
+	}
+	if err := locating.setup(); err != nil {
+		return err
+	}
+	if err := irks.setup(); err != nil {
+		return err
+	}
+	if err := setupFingerprints(*fingerprint); err != nil {
+		return err
+	}
+
+	output, err := openScanOutput(*format, *outFile, *verbose, &rotation)
+	if err != nil {
+		return err
+	}
+	sinks, err := openSinks(&mqttSink, &influxSink, *dbPath, *udpAddr)
+	if err != nil {
+		output.close()
+		return err
+	}
+	if *alerts != "" {
+		a, err := newAlertOutput(*alerts, sinkMQTTClient(sinks), &mqttSink)
+		if err != nil {
+			sinks.close()
+			output.close()
+			return err
+		}
+		sinks = append(sinks, a)
+	}
+	// The values of -read only go to the output.
+	primary := output
+	if len(sinks) > 0 {
+		output = append(multiOutput{output}, sinks...)
+	}
+
+	var cache *dedupCache
+	if *dedup > 0 {
+		cache = newDedupCache(*dedup, *dedupOnChange)
+	}
+	var tracker *changeTracker
+	if *onlyChanges {
+		tracker = newChangeTracker()
+	}
+	var cycle *cycleAggregate
+	if sched != nil {
+		cycle = newCycleAggregate()
+	}
+	summary := newScanSummary()
+
+	// Enable BLE interface.
+	if err := enableAdapter(); err != nil {
+		return err
+	}
+
+	// Stop the scan on Ctrl-C instead of dying, so buffered output is flushed.
+	ctx, stop := shutdownContext()
+	defer stop()
+	if *duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *duration)
+		defer cancel()
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			stopScan()
+		case <-done:
+		}
+	}()
+
+	pipeline := newScanPipeline(*buffer, func(s *sighting) error {
+		if s.Read != nil {
+			return primary.write(s)
+		}
+		return output.write(s)
+	})
+	var jobs *jobPool
+	queued := make(map[string]bool) // devices with a -read job
+	if *read != "" {
+		jobs = newJobPool(*readWorkers, *buffer, *readTimeout)
+	}
+
+	callback := func(adapter *bluetooth.Adapter, device bluetooth.ScanResult) {
+		metrics.scanCallback()
+		if !filter.match(device) {
+			return
+		}
+		now := scanTime()
+		summary.add(device, now)
+		// Metrics count every advertisement, and smoothing and
+		// fingerprinting need every sample, so they need the sighting
+		// before deduplication.
+		var s *sighting
+		if metrics != nil || smoothing != nil || fingerprints != nil {
+			s = newSighting(device, now)
+			metrics.observe(s)
+		}
+		if cache != nil && !cache.report(device, now) {
+			return
+		}
+		if s == nil {
+			s = newSighting(device, now)
+		}
+		if tracker != nil {
+			var changed bool
+			if s.Changes, changed = tracker.changes(s); !changed {
+				return
+			}
+		}
+		if cycle != nil {
+			cycle.add(s)
+		} else {
+			pipeline.push(s)
+		}
+		if jobs != nil && !queued[s.Address] {
+			address := device.Address
+			if err := jobs.submit("read "+s.Address, func(ctx context.Context) error {
+				return readDuringScan(ctx, &conn, address, readUUID, pipeline.push)
+			}); err == nil {
+				queued[s.Address] = true
+			}
+		}
+	}
+	scanLog.Info("scanning")
+	if sched != nil {
+		err = sched.scan(ctx, callback, func(start bool) bool {
+			if !start {
+				cycle.flush(pipeline.push)
+			}
+			return !pipeline.failed.Load()
+		})
+	} else {
+		err = scan(callback)
+	}
+	if jobs != nil {
+		jobs.close()
+	}
+	// A write error is most likely a closed pipe, which stops the scan, as
+	// there is no point in scanning on.
+	if writeErr := pipeline.close(); err == nil {
+		err = writeErr
+	}
+	if closeErr := output.close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	summary.print(pipeline.dropped.Load())
+	return nil
+}
+
+// scanSummary keeps track of the devices seen during a scan session, and how
+// they advertised. The statistics of devices not seen for summaryDeviceTTL are
+// forgotten, so that a long scan among random addresses that come and go
+// doesn't grow without bound; the devices are still counted, by a hash of
+// their address.
+type scanSummary struct {
+	devices       registry.Registry[struct{}]
+	seen          map[uint64]struct{} // hashes of the addresses of all devices
+	expired       time.Time           // when the registry was last expired
+	strongestAddr string
+	strongestRSSI int16
+}
+
+// summaryDevices is the most devices listed in the summary, the ones that
+// advertised the most.
+const summaryDevices = 20
+
+// summaryDeviceTTL is how long the summary keeps the statistics of a device
+// that is no longer seen. A device seen again after that starts over.
+const summaryDeviceTTL = 10 * time.Minute
+
+func newScanSummary() *scanSummary {
+	return &scanSummary{seen: make(map[uint64]struct{})}
+}
+
+func (s *scanSummary) add(result bluetooth.ScanResult, now time.Time) {
+	addr := result.Address.String()
+	s.devices.Seen(addr, now, result.RSSI, payloadHash(result), struct{}{})
+	h := fnv.New64a()
+	h.Write([]byte(addr))
+	s.seen[h.Sum64()] = struct{}{}
+	if now.Sub(s.expired) >= time.Minute {
+		s.expired = now
+		s.devices.Expire(now.Add(-summaryDeviceTTL), nil)
+	}
+	if s.strongestAddr == "" || result.RSSI > s.strongestRSSI {
+		s.strongestAddr = addr
+		s.strongestRSSI = result.RSSI
+	}
+}
+
+// print writes the summary to stderr, so that it doesn't end up in the
+// machine-readable output formats. The median and 90th percentile intervals
+// are the upper bounds of the registry buckets they fall in.
+func (s *scanSummary) print(dropped uint64) {
+	devices := s.devices.List()
+	fmt.Fprintf(os.Stderr, "scan complete: %d devices\n", len(s.seen))
+	if s.strongestAddr != "" {
+		fmt.Fprintf(os.Stderr, "strongest: %s (%d dBm)\n", s.strongestAddr, s.strongestRSSI)
+	}
+	if dropped > 0 {
+		fmt.Fprintf(os.Stderr, "dropped: %d sightings, as the output couldn't keep up (see -buffer)\n", dropped)
+	}
+	if len(devices) == 0 {
+		return
+	}
+	slices.SortStableFunc(devices, func(a, b registry.Device[struct{}]) int { return cmp.Compare(b.Count, a.Count) })
+	ms := func(d time.Duration) string { return d.Round(time.Millisecond).String() }
+	fmt.Fprintf(os.Stderr, "\n%-17s %6s %7s %9s %9s %9s %9s %8s\n", "ADDRESS", "COUNT", "RATE/S", "MIN", "MEDIAN", "P90", "MAX", "PAYLOADS")
+	for _, d := range devices[:min(len(devices), summaryDevices)] {
+		if d.Count < 2 {
+			fmt.Fprintf(os.Stderr, "%-17s %6d %7s %9s %9s %9s %9s %8d\n", d.Address, d.Count, "-", "-", "-", "-", "-", d.Variants)
+			continue
+		}
+		fmt.Fprintf(os.Stderr, "%-17s %6d %7.2f %9s %9s %9s %9s %8d\n", d.Address, d.Count, d.Rate(),
+			ms(d.IntervalMin), ms(d.IntervalQuantile(0.5)), ms(d.IntervalQuantile(0.9)), ms(d.IntervalMax), d.Variants)
+	}
+	if len(devices) > summaryDevices {
+		fmt.Fprintf(os.Stderr, "... and %d more\n", len(devices)-summaryDevices)
+	}
+	if gone := len(s.seen) - len(devices); gone > 0 {
+		fmt.Fprintf(os.Stderr, "... and %d gone for over %.0f minutes\n", gone, summaryDeviceTTL.Minutes())
+	}
+}
+
+// characteristicValue is the value of a characteristic.
+type characteristicValue struct {
+	UUID  bluetooth.UUID
+	Value []byte
+}
+
+// readDuringScan connects to a device and reads a characteristic, for -read.
+// The value is reported as a sighting, so that it goes to the output of the
+// scan along with, and not in the middle of, the other sightings.
+func readDuringScan(ctx context.Context, conn *connectFlags, address bluetooth.Address, uuid bluetooth.UUID, report func(*sighting)) error {
+	device, err := conn.connect(address)
+	if err != nil {
+		return err
+	}
+	defer device.Disconnect()
+	// Disconnecting makes a pending discovery or read fail.
+	stop := context.AfterFunc(ctx, func() { device.Disconnect() })
+	defer stop()
+	_, char, err := gattclient.FindAnyCharacteristic(device, bluetooth.UUID{}, uuid)
+	if err != nil {
+		return err
+	}
+	value, err := gattclient.Read(char)
+	if err != nil {
+		return err
+	}
+	report(&sighting{Time: time.Now(), Address: address.String(), Read: &characteristicValue{uuid, value}})
+	return nil
+}
@@ -0,0 +1,229 @@
+package scanner
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"example.com/m/gattclient"
+	"tinygo.org/x/bluetooth"
+)
+
+// simulatedMTU is the MTU of connections to simulated devices, the largest
+// that fits a data packet of a Bluetooth 4.2 controller.
+const simulatedMTU = 247
+
+var errSimulatedDisconnect = errors.New("disconnected")
+
+// SimulatedService is a GATT service of a simulated device.
+type SimulatedService struct {
+	UUID            bluetooth.UUID
+	Characteristics []SimulatedCharacteristic
+}
+
+// SimulatedCharacteristic is a characteristic of a simulated device.
+type SimulatedCharacteristic struct {
+	UUID bluetooth.UUID
+
+	// Value returns the value at a time, which is what reads and
+	// notifications return. The characteristic can't be read if it is nil.
+	Value func(now time.Time) []byte
+
+	// Notify is how often subscribers are notified of the value. The
+	// characteristic has no notifications if it is zero, or can't be read.
+	Notify time.Duration
+
+	// Write is called with the written values, by write requests and
+	// write commands alike. The characteristic can't be written if it is
+	// nil.
+	Write func(value []byte) error
+}
+
+// Connect connects to a simulated device, which makes the Simulator a
+// gattclient.Adapter. Devices without services can't be connected to, like
+// advertisers that aren't connectable.
+func (s *Simulator) Connect(address bluetooth.Address, params bluetooth.ConnectionParams) (gattclient.Device, error) {
+	for i := range s.Devices {
+		d := &s.Devices[i]
+		if d.Address.String() != address.String() {
+			continue
+		}
+		if len(d.Services) == 0 {
+			return nil, fmt.Errorf("simulated device %s isn't connectable", address.String())
+		}
+		return &simulatedConnection{device: d, closed: make(chan struct{})}, nil
+	}
+	return nil, fmt.Errorf("no simulated device %s", address.String())
+}
+
+type simulatedConnection struct {
+	device *SimulatedDevice
+
+	mu     sync.Mutex
+	closed chan struct{} // closed by Disconnect
+}
+
+func (c *simulatedConnection) Address() bluetooth.Address {
+	return c.device.Address
+}
+
+func (c *simulatedConnection) DiscoverServices(uuids []bluetooth.UUID) ([]gattclient.Service, error) {
+	if err := c.check(); err != nil {
+		return nil, err
+	}
+	var services []gattclient.Service
+	if len(uuids) == 0 {
+		for i := range c.device.Services {
+			services = append(services, simulatedService{c, &c.device.Services[i]})
+		}
+		return services, nil
+	}
+	for _, uuid := range uuids {
+		i := slices.IndexFunc(c.device.Services, func(s SimulatedService) bool { return s.UUID == uuid })
+		if i < 0 {
+			return nil, fmt.Errorf("service %s not found", uuid.String())
+		}
+		services = append(services, simulatedService{c, &c.device.Services[i]})
+	}
+	return services, nil
+}
+
+// Disconnect ends the connection, which makes what is pending or later fail,
+// and stops notifications.
+func (c *simulatedConnection) Disconnect() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	select {
+	case <-c.closed:
+	default:
+		close(c.closed)
+	}
+	return nil
+}
+
+func (c *simulatedConnection) check() error {
+	select {
+	case <-c.closed:
+		return errSimulatedDisconnect
+	default:
+		return nil
+	}
+}
+
+type simulatedService struct {
+	conn    *simulatedConnection
+	service *SimulatedService
+}
+
+func (s simulatedService) UUID() bluetooth.UUID {
+	return s.service.UUID
+}
+
+func (s simulatedService) DiscoverCharacteristics(uuids []bluetooth.UUID) ([]gattclient.Characteristic, error) {
+	if err := s.conn.check(); err != nil {
+		return nil, err
+	}
+	var chars []gattclient.Characteristic
+	if len(uuids) == 0 {
+		for i := range s.service.Characteristics {
+			chars = append(chars, &simulatedCharacteristic{conn: s.conn, char: &s.service.Characteristics[i]})
+		}
+		return chars, nil
+	}
+	for _, uuid := range uuids {
+		i := slices.IndexFunc(s.service.Characteristics, func(c SimulatedCharacteristic) bool { return c.UUID == uuid })
+		if i < 0 {
+			return nil, fmt.Errorf("characteristic %s not found", uuid.String())
+		}
+		chars = append(chars, &simulatedCharacteristic{conn: s.conn, char: &s.service.Characteristics[i]})
+	}
+	return chars, nil
+}
+
+type simulatedCharacteristic struct {
+	conn *simulatedConnection
+	char *SimulatedCharacteristic
+
+	mu          sync.Mutex
+	unsubscribe chan struct{} // non-nil while subscribed
+}
+
+func (c *simulatedCharacteristic) UUID() bluetooth.UUID {
+	return c.char.UUID
+}
+
+func (c *simulatedCharacteristic) Read(data []byte) (int, error) {
+	if err := c.conn.check(); err != nil {
+		return 0, err
+	}
+	if c.char.Value == nil {
+		return 0, fmt.Errorf("characteristic %s can't be read", c.char.UUID.String())
+	}
+	return copy(data, c.char.Value(time.Now())), nil
+}
+
+func (c *simulatedCharacteristic) Write(p []byte) (int, error) {
+	if err := c.conn.check(); err != nil {
+		return 0, err
+	}
+	if c.char.Write == nil {
+		return 0, fmt.Errorf("characteristic %s can't be written", c.char.UUID.String())
+	}
+	if err := c.char.Write(p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *simulatedCharacteristic) WriteWithoutResponse(p []byte) (int, error) {
+	return c.Write(p)
+}
+
+// EnableNotifications subscribes to the notifications, which are sent every
+// Notify until unsubscribed or disconnected.
+func (c *simulatedCharacteristic) EnableNotifications(callback func(buf []byte)) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if callback == nil {
+		if c.unsubscribe != nil {
+			close(c.unsubscribe)
+			c.unsubscribe = nil
+		}
+		return nil
+	}
+	if err := c.conn.check(); err != nil {
+		return err
+	}
+	if c.char.Notify == 0 || c.char.Value == nil {
+		return fmt.Errorf("characteristic %s has no notifications", c.char.UUID.String())
+	}
+	if c.unsubscribe != nil {
+		return errors.New("already subscribed")
+	}
+	unsubscribe := make(chan struct{})
+	c.unsubscribe = unsubscribe
+	go func() {
+		ticker := time.NewTicker(c.char.Notify)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				callback(c.char.Value(now))
+			case <-unsubscribe:
+				return
+			case <-c.conn.closed:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+func (c *simulatedCharacteristic) GetMTU() (uint16, error) {
+	if err := c.conn.check(); err != nil {
+		return 0, err
+	}
+	return simulatedMTU, nil
+}
@@ -0,0 +1,43 @@
+package scanner
+
+import (
+	"slices"
+
+	"example.com/m/ad"
+	"tinygo.org/x/bluetooth"
+)
+
+// Payload is an advertisement payload made of structured fields, for
+// backends that don't get the raw packet.
+type Payload struct {
+	Fields bluetooth.AdvertisementFields
+	Raw    []byte // nil if unknown
+}
+
+var _ bluetooth.AdvertisementPayload = (*Payload)(nil)
+
+// RawPayload returns the payload of raw advertising data, with the fields
+// parsed from it. Malformed data gives the fields before the malformed part.
+func RawPayload(raw []byte) *Payload {
+	p := &Payload{Raw: raw}
+	structures, _ := ad.Parse(raw)
+	p.Fields.LocalName, _ = structures.LocalName()
+	p.Fields.ServiceUUIDs = structures.ServiceUUIDs()
+	p.Fields.ManufacturerData = structures.ManufacturerData()
+	p.Fields.ServiceData = structures.ServiceData()
+	return p
+}
+
+func (p *Payload) LocalName() string { return p.Fields.LocalName }
+
+func (p *Payload) HasServiceUUID(uuid bluetooth.UUID) bool {
+	return slices.Contains(p.Fields.ServiceUUIDs, uuid)
+}
+
+func (p *Payload) Bytes() []byte { return p.Raw }
+
+func (p *Payload) ManufacturerData() []bluetooth.ManufacturerDataElement {
+	return p.Fields.ManufacturerData
+}
+
+func (p *Payload) ServiceData() []bluetooth.ServiceDataElement { return p.Fields.ServiceData }
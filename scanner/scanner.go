@@ -0,0 +1,259 @@
+// Package scanner scans for advertisements with a watchdog. After hours of
+// scanning, BlueZ in particular tends to stop reporting advertisements
+// without any error, or the adapter fails outright; the watchdog notices and
+// recovers, first by restarting the scan and then by power-cycling the
+// adapter.
+package scanner
+
+import (
+	"log/slog"
+	"math/rand"
+	"sync"
+	"time"
+
+	"tinygo.org/x/bluetooth"
+)
+
+// maxTimeout caps the backoff of the stall timeout while nothing is received
+// at all, which may just be a quiet place.
+const maxTimeout = time.Hour
+
+// Backend is what a Scanner scans with. A *bluetooth.Adapter is one.
+type Backend interface {
+	Scan(callback func(*bluetooth.Adapter, bluetooth.ScanResult)) error
+	StopScan() error
+}
+
+// Scanner scans with an adapter.
+type Scanner struct {
+	Adapter Backend
+
+	// Watchdog is how long a scan may go without any advertisement before
+	// it is restarted. Zero disables the watchdog.
+	Watchdog time.Duration
+
+	// PowerCycle, if set, turns the adapter off and on again. The watchdog
+	// does that when restarting the scan doesn't help, or the scan fails.
+	PowerCycle func() error
+
+	// Logger logs recoveries, or slog.Default() if it is nil.
+	Logger *slog.Logger
+
+	// OnRecovery, if set, is called with "restart" or "power-cycle" for
+	// every recovery.
+	OnRecovery func(action string)
+
+	mu       sync.Mutex
+	stopped  bool
+	stop     chan struct{} // closed by Stop
+	paused   int           // Pause calls not yet resumed
+	resume   chan struct{} // closed when the last pause is resumed
+	last     time.Time     // of the last result, or of starting the scan
+	timeout  time.Duration // the stall timeout, backed off while nothing is received
+	quiet    int           // stalls in a row without any result
+	stalled  bool          // the scan was stopped for a stall
+	restart  bool          // the scan was stopped by Restart
+	received bool          // any result was received
+}
+
+// Scan scans until Stop is called, calling callback for every advertisement.
+// If Stop was called before, Scan returns right away.
+func (s *Scanner) Scan(callback func(*bluetooth.Adapter, bluetooth.ScanResult)) error {
+	s.mu.Lock()
+	if s.stopped {
+		s.stopped = false
+		s.mu.Unlock()
+		return nil
+	}
+	s.stop = make(chan struct{})
+	s.timeout, s.quiet, s.received = s.Watchdog, 0, false
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.stopped = false
+		s.mu.Unlock()
+	}()
+
+	if s.Watchdog > 0 {
+		done := make(chan struct{})
+		defer close(done)
+		go s.monitor(done)
+	}
+
+	backoff := time.Second
+	for {
+		s.mu.Lock()
+		for s.paused > 0 && !s.stopped {
+			resume, stop := s.resume, s.stop
+			s.mu.Unlock()
+			select {
+			case <-resume:
+			case <-stop:
+			}
+			s.mu.Lock()
+		}
+		if s.stopped {
+			s.mu.Unlock()
+			return nil
+		}
+		s.last, s.stalled, s.restart = time.Now(), false, false
+		s.mu.Unlock()
+
+		err := s.Adapter.Scan(func(a *bluetooth.Adapter, result bluetooth.ScanResult) {
+			if s.kick() {
+				// Paused before the scan had started, so StopScan
+				// had nothing to stop.
+				s.Adapter.StopScan()
+				return
+			}
+			callback(a, result)
+		})
+
+		s.mu.Lock()
+		stopped, paused, restart, stalled, received, quiet, stop := s.stopped, s.paused > 0, s.restart, s.stalled, s.received, s.quiet, s.stop
+		s.mu.Unlock()
+		switch {
+		case stopped:
+			return err
+		case paused, restart && err == nil:
+		case err != nil && (s.Watchdog == 0 || !received):
+			// Without the watchdog, or if the scan never worked (such
+			// as with a missing adapter), there is nothing to recover
+			// from.
+			return err
+		case err != nil:
+			s.logger().Warn("scan failed, power-cycling the adapter", "err", err, "retry_in", backoff)
+			s.powerCycle()
+			select {
+			case <-time.After(backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))):
+			case <-stop:
+			}
+			backoff = min(2*backoff, time.Minute)
+		case stalled && quiet > 1:
+			s.logger().Warn("scan still stalled after restarting, power-cycling the adapter")
+			s.powerCycle()
+		case stalled:
+			s.logger().Warn("scan stalled, restarting it", "after", s.Watchdog)
+			s.recovered("restart")
+		default:
+			return err
+		}
+	}
+}
+
+// Stop stops the scan.
+func (s *Scanner) Stop() {
+	s.mu.Lock()
+	if !s.stopped {
+		s.stopped = true
+		if s.stop != nil {
+			close(s.stop)
+			s.stop = nil
+		}
+	}
+	s.mu.Unlock()
+	s.Adapter.StopScan()
+}
+
+// Pause stops scanning until Resume is called, without ending Scan, e.g. to
+// connect to a device with an adapter that can't do both at once. Pauses
+// nest: scanning resumes once every Pause is matched by a Resume.
+func (s *Scanner) Pause() {
+	s.mu.Lock()
+	s.paused++
+	if s.paused == 1 {
+		s.resume = make(chan struct{})
+	}
+	s.mu.Unlock()
+	s.Adapter.StopScan()
+}
+
+// Resume undoes a Pause.
+func (s *Scanner) Resume() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.paused == 0 {
+		return
+	}
+	s.paused--
+	if s.paused == 0 {
+		close(s.resume)
+	}
+}
+
+// Restart stops the scan and starts it again, e.g. for new scan parameters to
+// take effect.
+func (s *Scanner) Restart() {
+	s.mu.Lock()
+	s.restart = true
+	s.mu.Unlock()
+	s.Adapter.StopScan()
+}
+
+// kick records that the scan is alive, and returns true if it is paused.
+func (s *Scanner) kick() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.last = time.Now()
+	s.timeout, s.quiet, s.received = s.Watchdog, 0, true
+	return s.paused > 0
+}
+
+// monitor stops the scan when it stalls, until done is closed. It also keeps
+// stopping it after Stop, in case it was restarted just then.
+func (s *Scanner) monitor(done <-chan struct{}) {
+	ticker := time.NewTicker(s.Watchdog / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			s.mu.Lock()
+			stop := s.stopped
+			if s.paused > 0 {
+				// Not scanning, so not stalled either.
+				s.last = now
+			} else if !stop && now.Sub(s.last) > s.timeout {
+				if !s.stalled {
+					s.stalled = true
+					s.quiet++
+					s.timeout = min(s.timeout*2, maxTimeout)
+				}
+				stop = true
+			}
+			s.mu.Unlock()
+			if stop {
+				s.Adapter.StopScan()
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// powerCycle power-cycles the adapter if it can, and otherwise just lets the
+// scan restart.
+func (s *Scanner) powerCycle() {
+	if s.PowerCycle == nil {
+		s.recovered("restart")
+		return
+	}
+	if err := s.PowerCycle(); err != nil {
+		s.logger().Warn("could not power-cycle the adapter, restarting the scan", "err", err)
+		s.recovered("restart")
+		return
+	}
+	s.recovered("power-cycle")
+}
+
+func (s *Scanner) recovered(action string) {
+	if s.OnRecovery != nil {
+		s.OnRecovery(action)
+	}
+}
+
+func (s *Scanner) logger() *slog.Logger {
+	if s.Logger == nil {
+		return slog.Default()
+	}
+	return s.Logger
+}
@@ -0,0 +1,105 @@
+package scanner
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+
+	"tinygo.org/x/bluetooth"
+)
+
+// Simulator is a Backend without an adapter: it makes up the advertisements
+// of simulated devices, and serves their GATT services, to test what consumes
+// scan results or connects and for demos on machines without Bluetooth.
+type Simulator struct {
+	Devices []SimulatedDevice
+
+	// Adapter is passed to the callback, and may be nil.
+	Adapter *bluetooth.Adapter
+
+	mu     sync.Mutex
+	cancel chan struct{} // non-nil while scanning
+}
+
+// SimulatedDevice is an advertiser of a Simulator.
+type SimulatedDevice struct {
+	Address bluetooth.Address
+
+	// RSSI is the mean RSSI; each advertisement is received a few dB
+	// stronger or weaker.
+	RSSI int16
+
+	// Interval is the advertising interval, which must be positive. As
+	// with real advertisers, a random delay of up to 10ms is added to
+	// each.
+	Interval time.Duration
+
+	// Data returns the advertising data to send at a time, which lets
+	// simulated sensors change their readings.
+	Data func(now time.Time) []byte
+
+	// Services are the GATT services of the device, for connections
+	// made with Connect.
+	Services []SimulatedService
+}
+
+func (s *Simulator) Scan(callback func(*bluetooth.Adapter, bluetooth.ScanResult)) error {
+	s.mu.Lock()
+	if s.cancel != nil {
+		s.mu.Unlock()
+		return errors.New("already scanning")
+	}
+	cancel := make(chan struct{})
+	s.cancel = cancel
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.cancel = nil
+		s.mu.Unlock()
+	}()
+	if len(s.Devices) == 0 {
+		<-cancel
+		return nil
+	}
+
+	// Every device starts at a random point of its interval, as they
+	// would when scanning starts.
+	next := make([]time.Time, len(s.Devices))
+	start := time.Now()
+	for i, d := range s.Devices {
+		next[i] = start.Add(time.Duration(rand.Int63n(int64(d.Interval) + 1)))
+	}
+	for {
+		i := 0
+		for j := range next {
+			if next[j].Before(next[i]) {
+				i = j
+			}
+		}
+		select {
+		case <-time.After(time.Until(next[i])):
+		case <-cancel:
+			return nil
+		}
+		d := &s.Devices[i]
+		now := time.Now()
+		next[i] = next[i].Add(d.Interval + time.Duration(rand.Int63n(int64(10*time.Millisecond))))
+		callback(s.Adapter, bluetooth.ScanResult{
+			Address:              d.Address,
+			RSSI:                 d.RSSI + int16(rand.Intn(7)) - 3,
+			AdvertisementPayload: RawPayload(d.Data(now)),
+		})
+	}
+}
+
+func (s *Simulator) StopScan() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cancel == nil {
+		return errors.New("not scanning")
+	}
+	close(s.cancel)
+	s.cancel = nil
+	return nil
+}
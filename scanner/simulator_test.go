@@ -0,0 +1,230 @@
+package scanner
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+	"time"
+
+	"example.com/m/gattclient"
+	"tinygo.org/x/bluetooth"
+)
+
+func testDevice(mac string, rssi int16, data []byte) SimulatedDevice {
+	m, _ := bluetooth.ParseMAC(mac)
+	return SimulatedDevice{
+		Address:  bluetooth.Address{MACAddress: bluetooth.MACAddress{MAC: m}},
+		RSSI:     rssi,
+		Interval: time.Millisecond,
+		Data:     func(time.Time) []byte { return data },
+	}
+}
+
+func TestSimulator(t *testing.T) {
+	devices := []SimulatedDevice{
+		testDevice("F0:0D:00:00:00:01", -60, []byte{0x02, 0x01, 0x06}),
+		testDevice("F0:0D:00:00:00:02", -80, []byte{0x05, 0x09, 'T', 'e', 's', 't'}),
+	}
+	s := &Simulator{Devices: devices}
+	seen := make(map[string]int)
+	stopped := false
+	done := make(chan error)
+	go func() {
+		done <- s.Scan(func(_ *bluetooth.Adapter, result bluetooth.ScanResult) {
+			for _, d := range devices {
+				if d.Address != result.Address {
+					continue
+				}
+				if result.RSSI < d.RSSI-3 || result.RSSI > d.RSSI+3 {
+					t.Errorf("%s: RSSI %d, want %d±3", d.Address.String(), result.RSSI, d.RSSI)
+				}
+				if want := d.Data(time.Now()); !bytes.Equal(result.Bytes(), want) {
+					t.Errorf("%s: payload %x, want %x", d.Address.String(), result.Bytes(), want)
+				}
+			}
+			seen[result.Address.String()]++
+			// The scan may deliver another advertisement that was due
+			// before it notices it was stopped.
+			if !stopped && seen["F0:0D:00:00:00:01"] >= 3 && seen["F0:0D:00:00:00:02"] >= 3 {
+				stopped = true
+				if err := s.StopScan(); err != nil {
+					t.Error(err)
+				}
+			}
+		})
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("scan didn't stop")
+	}
+	if err := s.StopScan(); err == nil {
+		t.Error("StopScan without a scan succeeded")
+	}
+}
+
+func TestSimulatorAlreadyScanning(t *testing.T) {
+	s := &Simulator{}
+	done := make(chan error)
+	go func() { done <- s.Scan(func(*bluetooth.Adapter, bluetooth.ScanResult) {}) }()
+	// Without devices, the scan waits for StopScan.
+	for {
+		s.mu.Lock()
+		scanning := s.cancel != nil
+		s.mu.Unlock()
+		if scanning {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := s.Scan(func(*bluetooth.Adapter, bluetooth.ScanResult) {}); err == nil {
+		t.Error("second Scan succeeded")
+	}
+	if err := s.StopScan(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestScannerWatchdog has the watchdog recover a scan of a simulator without
+// devices, which never receives anything: first by restarting it, then by
+// power-cycling.
+func TestScannerWatchdog(t *testing.T) {
+	var mu sync.Mutex
+	var actions []string
+	s := &Scanner{
+		Adapter:    &Simulator{},
+		Watchdog:   20 * time.Millisecond,
+		PowerCycle: func() error { return nil },
+	}
+	s.OnRecovery = func(action string) {
+		mu.Lock()
+		defer mu.Unlock()
+		actions = append(actions, action)
+		if len(actions) == 2 {
+			go s.Stop()
+		}
+	}
+	done := make(chan error)
+	go func() { done <- s.Scan(func(*bluetooth.Adapter, bluetooth.ScanResult) {}) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("scan didn't stop")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(actions) < 2 || actions[0] != "restart" || actions[1] != "power-cycle" {
+		t.Errorf("recoveries %v, want [restart power-cycle]", actions)
+	}
+}
+
+func TestScannerStop(t *testing.T) {
+	s := &Scanner{Adapter: &Simulator{Devices: []SimulatedDevice{testDevice("F0:0D:00:00:00:01", -60, []byte{0x02, 0x01, 0x06})}}}
+	results := 0
+	done := make(chan error)
+	go func() {
+		done <- s.Scan(func(*bluetooth.Adapter, bluetooth.ScanResult) {
+			results++
+			if results == 3 {
+				go s.Stop()
+			}
+		})
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("scan didn't stop")
+	}
+	if results < 3 {
+		t.Errorf("%d results, want at least 3", results)
+	}
+}
+
+func TestSimulatorGATT(t *testing.T) {
+	serviceUUID, valueUUID, controlUUID := bluetooth.New16BitUUID(0x180d), bluetooth.New16BitUUID(0x2a37), bluetooth.New16BitUUID(0x2a39)
+	var written [][]byte
+	d := testDevice("F0:0D:00:00:00:01", -60, []byte{0x02, 0x01, 0x06})
+	d.Services = []SimulatedService{{UUID: serviceUUID, Characteristics: []SimulatedCharacteristic{
+		{UUID: valueUUID, Value: func(time.Time) []byte { return []byte{0x00, 72} }, Notify: time.Millisecond},
+		{UUID: controlUUID, Write: func(value []byte) error {
+			written = append(written, value)
+			return nil
+		}},
+	}}}
+	s := &Simulator{Devices: []SimulatedDevice{d, testDevice("F0:0D:00:00:00:02", -80, nil)}}
+	dialer := gattclient.Dialer{Adapter: s, Timeout: time.Second}
+
+	device, err := dialer.Connect(d.Address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	char, err := gattclient.FindCharacteristic(device, serviceUUID, valueUUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, err := gattclient.Read(char); err != nil || !bytes.Equal(value, []byte{0x00, 72}) {
+		t.Errorf("read %x, %v; want 0048", value, err)
+	}
+	if _, err := char.Write([]byte{0x01}); err == nil {
+		t.Error("writing a characteristic without Write succeeded")
+	}
+	notified := make(chan []byte, 10)
+	if err := char.EnableNotifications(func(value []byte) {
+		select {
+		case notified <- value:
+		default:
+		}
+	}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case value := <-notified:
+		if !bytes.Equal(value, []byte{0x00, 72}) {
+			t.Errorf("notified %x, want 0048", value)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no notification")
+	}
+	if err := char.EnableNotifications(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	control, err := gattclient.FindCharacteristic(device, serviceUUID, controlUUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := control.WriteWithoutResponse([]byte{0x01}); err != nil {
+		t.Fatal(err)
+	}
+	if len(written) != 1 || !bytes.Equal(written[0], []byte{0x01}) {
+		t.Errorf("written %x, want [01]", written)
+	}
+	if _, err := gattclient.Read(control); err == nil {
+		t.Error("reading a characteristic without Value succeeded")
+	}
+	if _, err := gattclient.FindCharacteristic(device, bluetooth.New16BitUUID(0x180f), bluetooth.New16BitUUID(0x2a19)); err == nil {
+		t.Error("found a characteristic of a missing service")
+	}
+
+	if err := device.Disconnect(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := gattclient.Read(char); err == nil {
+		t.Error("read after disconnecting succeeded")
+	}
+	if _, err := dialer.Connect(s.Devices[1].Address); err == nil {
+		t.Error("connected to a device without services")
+	}
+}
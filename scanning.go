@@ -0,0 +1,165 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"flag"
+	"fmt"
+	"time"
+
+	"example.com/m/scanner"
+	"tinygo.org/x/bluetooth"
+)
+
+// scans scans with the scan adapter for every command. Its watchdog is off
+// unless -watchdog is given.
+var scans = &scanner.Scanner{
+	Adapter:    scanAdapter,
+	PowerCycle: powerCycleScanAdapter,
+	OnRecovery: func(action string) { metrics.recovery(action) },
+}
+
+// scanProfiles are the presets of -scan-profile, as interval and window. The
+// adapter listens for the window once per interval: the more of the time it
+// listens, the sooner devices are found, and the more power it takes.
+var scanProfiles = map[string][2]time.Duration{
+	"fast":      {4096 * time.Millisecond, 4096 * time.Millisecond},
+	"balanced":  {4096 * time.Millisecond, 1024 * time.Millisecond},
+	"low-power": {5120 * time.Millisecond, 512 * time.Millisecond},
+}
+
+// scanInterval and scanWindow are the scan parameters to set while scanning,
+// zero to leave them as they are. With scanCoded, the scan adapter also
+// scans on the LE Coded PHY.
+var (
+	scanInterval, scanWindow time.Duration
+	scanCoded                bool
+)
+
+// offline is set when scanning needs no adapter, as when replaying a
+// capture or simulating.
+var offline bool
+
+// scanFlags are the flags of the commands that scan, for how they scan.
+type scanFlags struct {
+	watchdog time.Duration
+	mode     string
+	profile  string
+	interval time.Duration
+	window   time.Duration
+	coded    bool
+	replay   string
+	speed    float64
+	simulate bool
+
+	idleAfter   time.Duration
+	idleProfile string
+}
+
+func (f *scanFlags) registerFlags(fs *flag.FlagSet) {
+	fs.DurationVar(&f.watchdog, "watchdog", 0, "restart the scan, or power-cycle the adapter, when no advertisement has been received for this long or the adapter fails (0 disables)")
+	fs.StringVar(&f.mode, "scan-mode", "active", "active: request scan responses, which often carry the name and more services; "+
+		"passive: only receive advertising data, without transmitting, and only from advertisements with Flags (Linux only)")
+	fs.StringVar(&f.profile, "scan-profile", "", "scan parameters: fast (always listening), balanced (25% of the time) or low-power (10%); needs CAP_NET_ADMIN (Linux only, default: leave them)")
+	fs.Func("scan-interval", "how often to start listening, 2.5ms-10.24s (plain numbers are ms), overriding -scan-profile", durationFlag(&f.interval))
+	fs.Func("scan-window", "how long to listen each -scan-interval, at most the interval (plain numbers are ms), overriding -scan-profile", durationFlag(&f.window))
+	fs.StringVar(&f.replay, "replay", "", "scan the advertisements of this capture from ble record instead of the adapter")
+	fs.Float64Var(&f.speed, "replay-speed", 1, "with -replay, replay this many times faster than recorded (0: as fast as possible)")
+	fs.BoolVar(&f.simulate, "simulate", false, "scan simulated beacons and sensors instead of the adapter, and connect to them, for demos without Bluetooth")
+	fs.DurationVar(&f.idleAfter, "idle-after", 0, "after this long without new devices or changed payloads, listen less, one scan profile down every time it passes again, until there is activity; needs CAP_NET_ADMIN (Linux only, 0 disables)")
+	fs.StringVar(&f.idleProfile, "idle-profile", "low-power", "with -idle-after, the scan profile to step down to at most: balanced or low-power")
+	fs.BoolVar(&f.coded, "coded", false, "also scan on the LE Coded PHY, for long range advertisers with S=2 or S=8 coding; needs CAP_NET_ADMIN and a Bluetooth 5 controller (Linux only)")
+}
+
+func (f *scanFlags) setup() error {
+	if f.watchdog < 0 {
+		return errors.New("-watchdog must not be negative")
+	}
+	scans.Watchdog = f.watchdog
+	if f.simulate {
+		if f.replay != "" {
+			return errors.New("-simulate and -replay don't go together")
+		}
+		simulator := simulatedDevices()
+		scans.Adapter, connectBackend, offline = simulator, simulator, true
+		return setupIdleBackoff(f.idleAfter, f.idleProfile, 0, 0)
+	}
+	if f.replay != "" {
+		if f.speed < 0 {
+			return errors.New("-replay-speed must not be negative")
+		}
+		backend, err := replayBackend(f.replay, f.speed)
+		if err != nil {
+			return err
+		}
+		scans.Adapter, offline, replaying = backend, true, backend
+		return setupIdleBackoff(f.idleAfter, f.idleProfile, 0, 0)
+	}
+	switch f.mode {
+	case "active":
+		scans.Adapter = scanAdapter
+	case "passive":
+		backend, err := passiveBackend(scanAdapter)
+		if err != nil {
+			return err
+		}
+		scans.Adapter = backend
+	default:
+		return fmt.Errorf("unknown -scan-mode %q (known: active, passive)", f.mode)
+	}
+
+	interval, window := f.interval, f.window
+	if f.profile != "" {
+		profile, ok := scanProfiles[f.profile]
+		if !ok {
+			return fmt.Errorf("unknown -scan-profile %q (known: fast, balanced, low-power)", f.profile)
+		}
+		interval, window = cmp.Or(interval, profile[0]), cmp.Or(window, profile[1])
+	}
+	scanCoded = f.coded
+	if interval == 0 && window == 0 {
+		return setupIdleBackoff(f.idleAfter, f.idleProfile, 0, 0)
+	}
+	// With only one of them given, the adapter listens all the time.
+	interval, window = cmp.Or(interval, window), cmp.Or(window, interval)
+	if interval < 2500*time.Microsecond || interval > 10240*time.Millisecond {
+		return errors.New("-scan-interval must be between 2.5ms and 10.24s")
+	}
+	if window < 2500*time.Microsecond || window > interval {
+		return errors.New("-scan-window must be between 2.5ms and -scan-interval")
+	}
+	scanInterval, scanWindow = interval, window
+	return setupIdleBackoff(f.idleAfter, f.idleProfile, interval, window)
+}
+
+// scan scans with the scan adapter until stopScan is called.
+func scan(callback func(*bluetooth.Adapter, bluetooth.ScanResult)) error {
+	// The TUI replaces the logger, so it is picked up for every scan.
+	scans.Logger = scanLog
+	if scanInterval != 0 {
+		restore, err := setScanParameters(scanInterval, scanWindow)
+		if err != nil {
+			return fmt.Errorf("setting the scan parameters: %w", err)
+		}
+		defer restore()
+	}
+	if scanCoded {
+		restore, err := scanCodedPHY()
+		if err != nil {
+			return fmt.Errorf("scanning on the Coded PHY: %w", err)
+		}
+		defer restore()
+	}
+	if idleAfter > 0 {
+		idle := startIdleBackoff()
+		defer idle.stop()
+		callback = idle.wrap(callback)
+	}
+	notifyReady()
+	return scans.Scan(callback)
+}
+
+// stopScan stops scan.
+func stopScan() {
+	scans.Stop()
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"tinygo.org/x/bluetooth"
+)
+
+// With a schedule, the commands that scan don't scan all the time, but in
+// cycles of -scan-for: one every -scan-every, or at the times of a cron
+// expression, as in the configuration file
+//
+//	schedule: "*/5 * * * *"
+//	scan-for: 20s
+//
+// The sightings of a cycle are aggregated into one per device, reported at
+// the end of the cycle: its last advertisement, with the mean RSSI and the
+// number of advertisements received. That is for gateways that run on
+// battery, and for sinks that limit how many messages they take.
+
+// scheduleFlags are the flags for scanning on a schedule.
+type scheduleFlags struct {
+	every  time.Duration
+	length time.Duration
+	cron   string
+}
+
+func (f *scheduleFlags) registerFlags(fs *flag.FlagSet) {
+	fs.DurationVar(&f.every, "scan-every", 0, "instead of scanning all the time, scan for -scan-for this often, reporting one sighting per device and cycle (0 disables)")
+	fs.DurationVar(&f.length, "scan-for", 0, "with -scan-every or -schedule, how long each scan cycle lasts")
+	fs.StringVar(&f.cron, "schedule", "", `like -scan-every, but start the cycles at the times of this cron expression in local time: minute hour day-of-month month day-of-week, as in "*/5 * * * *", or @hourly or @daily`)
+}
+
+// setup returns the schedule of the flags, or nil to scan all the time.
+func (f *scheduleFlags) setup() (*schedule, error) {
+	switch {
+	case f.every < 0 || f.length < 0:
+		return nil, errors.New("-scan-every and -scan-for must not be negative")
+	case f.every > 0 && f.cron != "":
+		return nil, errors.New("-scan-every and -schedule don't go together")
+	case f.every == 0 && f.cron == "":
+		if f.length > 0 {
+			return nil, errors.New("-scan-for needs -scan-every or -schedule")
+		}
+		return nil, nil
+	case f.length == 0:
+		return nil, errors.New("-scan-every and -schedule need -scan-for")
+	case f.every > 0 && f.length >= f.every:
+		return nil, errors.New("-scan-for must be shorter than -scan-every")
+	}
+	s := &schedule{every: f.every, length: f.length}
+	if f.cron != "" {
+		c, err := parseCron(f.cron)
+		if err != nil {
+			return nil, fmt.Errorf("-schedule: %w", err)
+		}
+		if c.next(time.Now()).IsZero() {
+			return nil, errors.New("-schedule never matches")
+		}
+		s.cron = c
+	}
+	return s, nil
+}
+
+// schedule is when to scan, for scanning in cycles.
+type schedule struct {
+	every  time.Duration
+	length time.Duration
+	cron   *cronSpec
+	last   time.Time // when the last cycle started
+}
+
+// next returns when the next cycle starts after the last one. With
+// -scan-every, the first one starts right away. Cycles that were missed, as
+// when a cycle took longer, are skipped.
+func (s *schedule) next(now time.Time) time.Time {
+	if s.cron != nil {
+		return s.cron.next(now)
+	}
+	if s.last.IsZero() {
+		return now
+	}
+	next := s.last.Add(s.every)
+	if next.Before(now) {
+		next = now.Add(s.every - now.Sub(s.last)%s.every)
+	}
+	return next
+}
+
+// scan scans in cycles until ctx is done or scanning fails. cycle is called
+// at the start and at the end of every cycle; when it returns false at the
+// end, scanning stops.
+func (s *schedule) scan(ctx context.Context, callback func(*bluetooth.Adapter, bluetooth.ScanResult), cycle func(start bool) bool) error {
+	for {
+		start := s.next(time.Now())
+		if start.IsZero() {
+			return errors.New("the schedule doesn't match any more")
+		}
+		if wait := time.Until(start); wait > 0 {
+			scanLog.Debug("waiting for the next scan cycle", "at", start.Format(time.DateTime))
+			select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+			}
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+		s.last = start
+		cycle(true)
+		scanLog.Debug("scan cycle started", "for", s.length)
+		timer := time.AfterFunc(s.length, stopScan)
+		err := scan(callback)
+		timer.Stop()
+		if !cycle(false) || err != nil || ctx.Err() != nil {
+			return err
+		}
+	}
+}
+
+// cycleAggregate aggregates the sightings of a scan cycle per device.
+type cycleAggregate struct {
+	mu      sync.Mutex
+	devices map[string]*aggregated
+	order   []string // keys of devices, in the order they were first seen
+}
+
+type aggregated struct {
+	last  *sighting
+	count int
+	rssi  int // sum of the RSSI of the advertisements
+}
+
+func newCycleAggregate() *cycleAggregate {
+	return &cycleAggregate{devices: make(map[string]*aggregated)}
+}
+
+// add adds a sighting to the sightings of its device in this cycle.
+func (a *cycleAggregate) add(s *sighting) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	key := cmp.Or(s.DeviceID, s.Identity, s.Address)
+	device, ok := a.devices[key]
+	if !ok {
+		device = &aggregated{}
+		a.devices[key] = device
+		a.order = append(a.order, key)
+	}
+	device.last = s
+	device.count++
+	device.rssi += int(s.RSSI)
+}
+
+// flush reports one sighting per device seen in the cycle, in the order they
+// were first seen, and starts a new cycle.
+func (a *cycleAggregate) flush(report func(*sighting)) {
+	a.mu.Lock()
+	devices, order := a.devices, a.order
+	a.devices, a.order = make(map[string]*aggregated), nil
+	a.mu.Unlock()
+	for _, key := range order {
+		device := devices[key]
+		s := device.last
+		s.Count = device.count
+		s.RSSI = int16(math.Round(float64(device.rssi) / float64(device.count)))
+		if smoothing == nil {
+			s.SmoothedRSSI = float64(s.RSSI)
+		}
+		report(s)
+	}
+	scanLog.Debug("scan cycle ended", "devices", len(order))
+}
+
+// cronSpec is a parsed cron expression, of the times at which a field
+// matches. Like in cron, a day matches if either the day of the month or the
+// day of the week does, unless one of them starts with *.
+type cronSpec struct {
+	minute, hour, dom, month, dow uint64 // bit sets
+	anyDOM, anyDOW                bool
+}
+
+// cronShorthands are the shorthands that cron takes for common schedules.
+var cronShorthands = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// parseCron parses a cron expression of five fields, each a list of values,
+// ranges and steps, as in 0,30 or 9-17 or */5.
+func parseCron(expr string) (*cronSpec, error) {
+	if shorthand, ok := cronShorthands[expr]; ok {
+		expr = shorthand
+	}
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("expected 5 fields (minute hour day-of-month month day-of-week), got %d", len(fields))
+	}
+	var c cronSpec
+	var err error
+	if c.minute, err = parseCronField(fields[0], 0, 59); err != nil {
+		return nil, fmt.Errorf("minute: %w", err)
+	}
+	if c.hour, err = parseCronField(fields[1], 0, 23); err != nil {
+		return nil, fmt.Errorf("hour: %w", err)
+	}
+	if c.dom, err = parseCronField(fields[2], 1, 31); err != nil {
+		return nil, fmt.Errorf("day of month: %w", err)
+	}
+	if c.month, err = parseCronField(fields[3], 1, 12); err != nil {
+		return nil, fmt.Errorf("month: %w", err)
+	}
+	if c.dow, err = parseCronField(fields[4], 0, 7); err != nil {
+		return nil, fmt.Errorf("day of week: %w", err)
+	}
+	// 7 is Sunday too.
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1
+	}
+	// As in Vixie cron, a field starting with *, as */2 does, matches any
+	// day for the OR of the day fields.
+	c.anyDOM, c.anyDOW = strings.HasPrefix(fields[2], "*"), strings.HasPrefix(fields[4], "*")
+	return &c, nil
+}
+
+func parseCronField(field string, low, high int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		values, step, hasStep := strings.Cut(part, "/")
+		every := 1
+		if hasStep {
+			n, err := strconv.Atoi(step)
+			if err != nil || n < 1 {
+				return 0, fmt.Errorf("invalid step %q", step)
+			}
+			every = n
+		}
+		first, last := low, high
+		if values != "*" {
+			from, to, isRange := strings.Cut(values, "-")
+			var err error
+			if first, err = strconv.Atoi(from); err != nil {
+				return 0, fmt.Errorf("invalid value %q", from)
+			}
+			last = first
+			if isRange {
+				if last, err = strconv.Atoi(to); err != nil {
+					return 0, fmt.Errorf("invalid value %q", to)
+				}
+			} else if hasStep {
+				last = high
+			}
+			if first < low || last > high || first > last {
+				return 0, fmt.Errorf("%s is out of range %d-%d", values, low, high)
+			}
+		}
+		for v := first; v <= last; v += every {
+			bits |= 1 << v
+		}
+	}
+	return bits, nil
+}
+
+// next returns the first time at or after now, to the minute, that the
+// expression matches, or the zero time if there is none within five years,
+// as for February 30.
+func (c *cronSpec) next(now time.Time) time.Time {
+	t := now.Truncate(time.Minute)
+	if t.Before(now) {
+		t = t.Add(time.Minute)
+	}
+	for end := t.AddDate(5, 0, 0); t.Before(end); {
+		switch {
+		case c.month&(1<<int(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !c.matchDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case c.hour&(1<<t.Hour()) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case c.minute&(1<<t.Minute()) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+func (c *cronSpec) matchDay(t time.Time) bool {
+	dom, dow := c.dom&(1<<t.Day()) != 0, c.dow&(1<<int(t.Weekday())) != 0
+	if c.anyDOM || c.anyDOW {
+		return dom && dow
+	}
+	return dom || dow
+}
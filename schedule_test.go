@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCronNext(t *testing.T) {
+	// 2024-01-01 was a Monday.
+	at := func(day, hour, minute int) time.Time { return time.Date(2024, 1, day, hour, minute, 0, 0, time.UTC) }
+	tests := []struct {
+		expr string
+		now  time.Time
+		want time.Time
+	}{
+		{"*/15 * * * *", at(1, 10, 7), at(1, 10, 15)},
+		{"*/15 * * * *", at(1, 10, 15), at(1, 10, 15)},
+		{"@daily", at(1, 13, 0), at(2, 0, 0)},
+		{"30 9 * * 1-5", at(6, 12, 0), at(8, 9, 30)},
+		{"0 12 * * 7", at(1, 0, 0), at(7, 12, 0)},
+		// Either day field matches when both are restricted.
+		{"0 0 1,15 * 5", at(2, 0, 0), at(5, 0, 0)},
+		// Both must match when one starts with *: the odd days that are
+		// Mondays.
+		{"0 0 */2 * 1", at(1, 0, 30), at(15, 0, 0)},
+		{"0 0 13 * */2", at(1, 0, 0), at(13, 0, 0)},
+	}
+	for _, tt := range tests {
+		c, err := parseCron(tt.expr)
+		if err != nil {
+			t.Errorf("%s: %v", tt.expr, err)
+			continue
+		}
+		if got := c.next(tt.now); !got.Equal(tt.want) {
+			t.Errorf("%s after %s: %s, want %s", tt.expr, tt.now.Format(time.DateTime), got.Format(time.DateTime), tt.want.Format(time.DateTime))
+		}
+	}
+}
+
+func TestParseCronErrors(t *testing.T) {
+	for _, expr := range []string{"* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "*/0 * * * *", "1-x * * * *", "@often"} {
+		if _, err := parseCron(expr); err == nil {
+			t.Errorf("%q parsed", expr)
+		}
+	}
+}
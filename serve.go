@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	assignednumbers "example.com/m/assigned_numbers"
+	"tinygo.org/x/bluetooth"
+)
+
+// serverDef is the service definition file of "ble serve", for example:
+//
+//	{
+//	  "name": "Test Sensor",
+//	  "services": [{
+//	    "uuid": "180f",
+//	    "characteristics": [
+//	      {"uuid": "2a19", "properties": ["read", "notify"], "value": "64"}
+//	    ]
+//	  }]
+//	}
+//
+// UUIDs are given as 16-bit, 32-bit or full 128-bit UUIDs. Initial values are
+// given either in hex ("value") or as a string ("string").
+type serverDef struct {
+	Name     string       `json:"name"`
+	Services []serviceDef `json:"services"`
+}
+
+type serviceDef struct {
+	UUID            bluetooth.UUID      `json:"uuid"`
+	Characteristics []characteristicDef `json:"characteristics"`
+}
+
+type characteristicDef struct {
+	UUID       bluetooth.UUID `json:"uuid"`
+	Properties []string       `json:"properties"`
+	Value      string         `json:"value"`
+	String     string         `json:"string"`
+}
+
+// characteristicProperties are the properties of a characteristic definition.
+var characteristicProperties = map[string]bluetooth.CharacteristicPermissions{
+	"broadcast":              bluetooth.CharacteristicBroadcastPermission,
+	"read":                   bluetooth.CharacteristicReadPermission,
+	"write":                  bluetooth.CharacteristicWritePermission,
+	"write-without-response": bluetooth.CharacteristicWriteWithoutResponsePermission,
+	"notify":                 bluetooth.CharacteristicNotifyPermission,
+	"indicate":               bluetooth.CharacteristicIndicatePermission,
+}
+
+func runServe(args []string) error {
+	fs := newFlagSet("serve", "<definition.json>")
+	acceptFlag(fs)
+	parseFlags(fs, args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("expected a service definition file")
+	}
+	def, err := loadServerDef(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	services, err := def.services()
+	if err != nil {
+		return err
+	}
+
+	if err := enableAdapter(); err != nil {
+		return err
+	}
+	opts := bluetooth.AdvertisementOptions{LocalName: def.Name}
+	for _, service := range services {
+		if err := adapter.AddService(service); err != nil {
+			return fmt.Errorf("add service %s: %w", service.UUID.String(), err)
+		}
+		peripheralLog.Info("serving", "service", describeUUID(service.UUID, assignednumbers.ServiceName(service.UUID)))
+		opts.ServiceUUIDs = append(opts.ServiceUUIDs, service.UUID)
+	}
+	return advertise(opts)
+}
+
+func loadServerDef(path string) (*serverDef, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var def serverDef
+	if err := json.Unmarshal(b, &def); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if len(def.Services) == 0 {
+		return nil, fmt.Errorf("%s: no services defined", path)
+	}
+	return &def, nil
+}
+
+// services converts the definition to services for adapter.AddService.
+// Writes to any of the characteristics are reported on stderr.
+func (def *serverDef) services() ([]*bluetooth.Service, error) {
+	var services []*bluetooth.Service
+	for _, s := range def.Services {
+		service := &bluetooth.Service{UUID: s.UUID}
+		for _, c := range s.Characteristics {
+			config := bluetooth.CharacteristicConfig{UUID: c.UUID}
+			for _, property := range c.Properties {
+				permission, ok := characteristicProperties[property]
+				if !ok {
+					return nil, fmt.Errorf("characteristic %s: unknown property %q", c.UUID.String(), property)
+				}
+				config.Flags |= permission
+			}
+			switch {
+			case c.Value != "" && c.String != "":
+				return nil, fmt.Errorf("characteristic %s: both value and string given", c.UUID.String())
+			case c.Value != "":
+				value, err := hex.DecodeString(c.Value)
+				if err != nil {
+					return nil, fmt.Errorf("characteristic %s: invalid value: %w", c.UUID.String(), err)
+				}
+				config.Value = value
+			default:
+				config.Value = []byte(c.String)
+			}
+			uuid := c.UUID
+			config.WriteEvent = func(client bluetooth.Connection, offset int, value []byte) {
+				peripheralLog.Info("write", "characteristic", describeUUID(uuid, assignednumbers.CharacteristicName(uuid)), "value", hex.EncodeToString(value))
+			}
+			service.Characteristics = append(service.Characteristics, config)
+		}
+		services = append(services, service)
+	}
+	return services, nil
+}
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	assignednumbers "example.com/m/assigned_numbers"
+	"example.com/m/gattclient"
+	"golang.org/x/term"
+	"tinygo.org/x/bluetooth"
+)
+
+// The shell runs commands within a single session, reading them from a
+// script or stdin, so that discovered devices and the connection are kept
+// between commands. Devices are numbered in the order they were discovered,
+// and the characteristics of the connected device as listed by "services".
+// Those numbers stand in for ATT handles, which the bluetooth package
+// doesn't expose.
+
+const shellHelp = `commands:
+  scan on|off            start or stop discovering devices
+  list                   list the discovered devices
+  connect N|ADDRESS      connect to a discovered device
+  disconnect             disconnect from the device
+  services               list the services and characteristics of the device
+  read H                 read a characteristic, by number or UUID
+  write H VALUE          write hex (or else the string) VALUE to a characteristic
+  notify H [off]         print the notifications of a characteristic
+  sleep DURATION         wait, e.g. in scripts
+  help                   show this help
+  quit                   end the session`
+
+type shellDevice struct {
+	address bluetooth.Address
+	last    *sighting
+}
+
+// shellChar is a characteristic listed by services.
+type shellChar struct {
+	service bluetooth.UUID
+	gattclient.Characteristic
+}
+
+type shell struct {
+	conn   *connectFlags
+	filter *scanFilter
+
+	mu        sync.Mutex
+	devices   []*shellDevice // in order of discovery
+	byAddress map[string]*shellDevice
+
+	scanDone  chan error // non-nil while scanning
+	device    gattclient.Device
+	chars     []shellChar // numbered from 1
+	notifying map[int]bool
+}
+
+func runShell(args []string) error {
+	fs := newFlagSet("shell", "[script]")
+	var filter scanFilter
+	filter.registerFlags(fs)
+	var conn connectFlags
+	conn.registerFlags(fs)
+	parseFlags(fs, args)
+	if fs.NArg() > 1 {
+		fs.Usage()
+		return errors.New("expected at most one script")
+	}
+	if err := conn.validate(); err != nil {
+		return err
+	}
+	if err := filter.setup(); err != nil {
+		return err
+	}
+	in := io.Reader(os.Stdin)
+	interactive := fs.NArg() == 0 && term.IsTerminal(int(os.Stdin.Fd()))
+	if fs.NArg() == 1 {
+		f, err := os.Open(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+
+	if err := enableAdapter(); err != nil {
+		return err
+	}
+	s := &shell{conn: &conn, filter: &filter, byAddress: make(map[string]*shellDevice), notifying: make(map[int]bool)}
+	defer s.close()
+
+	// Lines are read in the background, so that Ctrl-C ends the session
+	// cleanly even while waiting for input.
+	lines := make(chan string)
+	readErr := make(chan error, 1)
+	go func() {
+		scanner := bufio.NewScanner(in)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+		readErr <- scanner.Err()
+	}()
+	ctx, stop := shutdownContext()
+	defer stop()
+
+	for n := 1; ; n++ {
+		if interactive {
+			fmt.Print("ble> ")
+		}
+		var line string
+		select {
+		case line = <-lines:
+		case err := <-readErr:
+			return err
+		case <-ctx.Done():
+			return nil
+		}
+		quit, err := s.exec(strings.Fields(strings.SplitN(line, "#", 2)[0]))
+		if err != nil {
+			if !interactive {
+				// A script stops at the first error, like sh -e.
+				return fmt.Errorf("line %d: %w", n, err)
+			}
+			fmt.Fprintln(os.Stderr, "error:", err)
+		}
+		if quit {
+			return nil
+		}
+	}
+}
+
+// exec runs a command, and returns true if the session ends.
+func (s *shell) exec(args []string) (quit bool, err error) {
+	if len(args) == 0 {
+		return false, nil
+	}
+	name, args := args[0], args[1:]
+	switch name {
+	case "help":
+		fmt.Println(shellHelp)
+	case "quit", "exit":
+		return true, nil
+	case "scan":
+		if len(args) != 1 || (args[0] != "on" && args[0] != "off") {
+			return false, errors.New("usage: scan on|off")
+		}
+		if args[0] == "on" {
+			s.startScan()
+		} else {
+			return false, s.stopScan()
+		}
+	case "list":
+		s.list()
+	case "connect":
+		if len(args) != 1 {
+			return false, errors.New("usage: connect N|ADDRESS")
+		}
+		return false, s.connect(args[0])
+	case "disconnect":
+		if s.device == nil {
+			return false, errors.New("not connected")
+		}
+		s.disconnect()
+	case "services":
+		return false, s.services()
+	case "read":
+		if len(args) != 1 {
+			return false, errors.New("usage: read H")
+		}
+		return false, s.read(args[0])
+	case "write":
+		if len(args) < 2 {
+			return false, errors.New("usage: write H VALUE")
+		}
+		return false, s.write(args[0], strings.Join(args[1:], " "))
+	case "notify":
+		if len(args) != 1 && (len(args) != 2 || args[1] != "off") {
+			return false, errors.New("usage: notify H [off]")
+		}
+		return false, s.notify(args[0], len(args) == 1)
+	case "sleep":
+		if len(args) != 1 {
+			return false, errors.New("usage: sleep DURATION")
+		}
+		d, err := time.ParseDuration(args[0])
+		if err != nil {
+			return false, err
+		}
+		time.Sleep(d)
+	default:
+		return false, fmt.Errorf("unknown command %q, try help", name)
+	}
+	return false, nil
+}
+
+func (s *shell) startScan() {
+	if s.scanDone != nil {
+		return
+	}
+	s.scanDone = make(chan error, 1)
+	go func() {
+		s.scanDone <- scan(func(adapter *bluetooth.Adapter, result bluetooth.ScanResult) {
+			if !s.filter.match(result) {
+				return
+			}
+			sighting := newSighting(result, time.Now())
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			if d := s.byAddress[sighting.Address]; d != nil {
+				d.last = sighting
+				return
+			}
+			d := &shellDevice{address: result.Address, last: sighting}
+			s.devices = append(s.devices, d)
+			s.byAddress[sighting.Address] = d
+			fmt.Printf("new device %d: %s %s\n", len(s.devices), sighting.Address, sighting.LocalName)
+		})
+	}()
+}
+
+func (s *shell) stopScan() error {
+	if s.scanDone == nil {
+		return nil
+	}
+	stopScan()
+	err := <-s.scanDone
+	s.scanDone = nil
+	return err
+}
+
+func (s *shell) list() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, d := range s.devices {
+		name := d.last.LocalName
+		if d.last.Alias != "" {
+			name = d.last.Alias
+		}
+		fmt.Printf("%3d %s %4d dBm %s\n", i+1, d.last.Address, d.last.RSSI, name)
+	}
+}
+
+// connect connects to a device by number or address. Addresses that weren't
+// discovered in this session are taken to be public.
+func (s *shell) connect(arg string) error {
+	if s.device != nil {
+		return errors.New("already connected, disconnect first")
+	}
+	var address bluetooth.Address
+	if n, err := strconv.Atoi(arg); err == nil {
+		s.mu.Lock()
+		if n < 1 || n > len(s.devices) {
+			s.mu.Unlock()
+			return fmt.Errorf("no device %d", n)
+		}
+		address = s.devices[n-1].address
+		s.mu.Unlock()
+	} else if address, err = parseAddress(arg); err != nil {
+		return err
+	} else {
+		s.mu.Lock()
+		if d := s.byAddress[address.String()]; d != nil {
+			address = d.address
+		}
+		s.mu.Unlock()
+	}
+	device, err := s.conn.connect(address)
+	if err != nil {
+		return err
+	}
+	s.device = device
+	fmt.Println("connected to", address.String())
+	return nil
+}
+
+func (s *shell) disconnect() {
+	for h := range s.notifying {
+		s.chars[h-1].EnableNotifications(nil)
+	}
+	clear(s.notifying)
+	s.device.Disconnect()
+	s.device, s.chars = nil, nil
+}
+
+// services lists the services and characteristics of the device, numbering
+// the characteristics.
+func (s *shell) services() error {
+	if s.device == nil {
+		return errors.New("not connected")
+	}
+	services, err := s.device.DiscoverServices(nil)
+	if err != nil {
+		return err
+	}
+	details, _ := gattDetails(s.device.Address())
+	for h := range s.notifying {
+		s.chars[h-1].EnableNotifications(nil)
+	}
+	clear(s.notifying)
+	s.chars = nil
+	for _, service := range services {
+		fmt.Println("service", describeUUID(service.UUID(), assignednumbers.ServiceName(service.UUID())))
+		chars, err := service.DiscoverCharacteristics(nil)
+		if err != nil {
+			return err
+		}
+		for _, char := range chars {
+			s.chars = append(s.chars, shellChar{service.UUID(), char})
+			line := fmt.Sprintf("  %3d %s", len(s.chars), describeUUID(char.UUID(), assignednumbers.CharacteristicName(char.UUID())))
+			if detail := details[gattKey{service.UUID(), char.UUID()}]; detail != nil {
+				line += " [" + strings.Join(detail.flags, ", ") + "]"
+			}
+			fmt.Println(line)
+		}
+	}
+	return nil
+}
+
+// characteristic returns the number of a characteristic given by number or
+// UUID.
+func (s *shell) characteristic(arg string) (int, error) {
+	if s.device == nil {
+		return 0, errors.New("not connected")
+	}
+	if s.chars == nil {
+		return 0, errors.New("no characteristics listed, run services first")
+	}
+	if h, err := strconv.Atoi(arg); err == nil {
+		if h < 1 || h > len(s.chars) {
+			return 0, fmt.Errorf("no characteristic %d", h)
+		}
+		return h, nil
+	}
+	uuid, err := bluetooth.ParseUUID(arg)
+	if err != nil {
+		return 0, fmt.Errorf("expected a characteristic number or UUID: %w", err)
+	}
+	for i, char := range s.chars {
+		if char.UUID() == uuid {
+			return i + 1, nil
+		}
+	}
+	return 0, fmt.Errorf("no characteristic %s", uuid)
+}
+
+func (s *shell) read(arg string) error {
+	h, err := s.characteristic(arg)
+	if err != nil {
+		return err
+	}
+	char := s.chars[h-1]
+	value, err := gattclient.Read(char.Characteristic)
+	if err != nil {
+		return err
+	}
+	printNotification(time.Now(), strconv.Itoa(h), char.UUID(), value, "")
+	return nil
+}
+
+func (s *shell) write(arg, value string) error {
+	h, err := s.characteristic(arg)
+	if err != nil {
+		return err
+	}
+	char := s.chars[h-1]
+	return writeCharacteristic(s.device, char.service, char.Characteristic, parseWriteValue(value, false), true)
+}
+
+func (s *shell) notify(arg string, enable bool) error {
+	h, err := s.characteristic(arg)
+	if err != nil {
+		return err
+	}
+	char := s.chars[h-1]
+	if !enable {
+		delete(s.notifying, h)
+		return char.EnableNotifications(nil)
+	}
+	tag := strconv.Itoa(h)
+	err = char.EnableNotifications(func(value []byte) {
+		printNotification(time.Now(), tag, char.UUID(), value, "")
+	})
+	if err != nil {
+		return err
+	}
+	s.notifying[h] = true
+	return nil
+}
+
+// close ends the session: notifications, the connection and the scan are
+// stopped.
+func (s *shell) close() {
+	if s.device != nil {
+		s.disconnect()
+	}
+	s.stopScan()
+}
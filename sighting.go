@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"time"
+
+	"example.com/m/ad"
+	"example.com/m/decode"
+	"tinygo.org/x/bluetooth"
+)
+
+// sighting is a single received advertisement. Scan results are only valid
+// within the scan callback, so a sighting holds copies of everything needed to
+// report the advertisement later.
+type sighting struct {
+	Time             time.Time
+	Address          string
+	Random           bool     // the address is random
+	Vendor           string   // organization of a public address, from its OUI
+	Alias            string   // see aliases.go
+	Tags             []string // see tags.go
+	RSSI             int16
+	LocalName        string
+	Raw              []byte // raw AD payload, nil when the platform doesn't provide it
+	ManufacturerData []bluetooth.ManufacturerDataElement
+	ServiceData      []bluetooth.ServiceDataElement
+
+	// Length is the length of the advertising data in bytes. Over 31, it
+	// was an extended advertisement. Without the raw payload it is the
+	// length of the reconstructed payload, which with BlueZ includes the
+	// scan response.
+	Length int
+
+	// Identity is the identity address a resolvable private address was
+	// resolved to with an IRK, empty if it wasn't.
+	Identity string
+
+	// DeviceID identifies the device across address changes with
+	// -fingerprint, and is empty without it.
+	DeviceID string
+
+	// Frames are the parts of the advertisement that could be decoded.
+	Frames []decode.Frame
+
+	// SmoothedRSSI is the RSSI after -smooth, or the RSSI itself without it.
+	SmoothedRSSI float64
+
+	// Distance is the estimated distance in meters, 0 if unknown.
+	Distance float64
+
+	// Position is the estimated position of the device, nil if unknown.
+	// See locate.go.
+	Position *position
+
+	// Count is the number of advertisements of a scan cycle that the
+	// sighting aggregates, with RSSI their mean, and 0 without a schedule.
+	Count int
+
+	// Changes are the changes to the advertising data since the device was
+	// last reported, with -only-changes.
+	Changes []adChange
+
+	// Read is the value read from the device with -read. A sighting with
+	// one reports only that, not an advertisement, and only to the output
+	// of the scan, not to the sinks.
+	Read *characteristicValue
+}
+
+func newSighting(result bluetooth.ScanResult, now time.Time) *sighting {
+	s := &sighting{
+		Time:      now,
+		Address:   result.Address.String(),
+		Random:    result.Address.IsRandom(),
+		Vendor:    vendor(result.Address),
+		RSSI:      result.RSSI,
+		LocalName: result.LocalName(),
+		Raw:       bytes.Clone(result.Bytes()),
+	}
+	for _, element := range result.ManufacturerData() {
+		element.Data = bytes.Clone(element.Data)
+		s.ManufacturerData = append(s.ManufacturerData, element)
+	}
+	for _, element := range result.ServiceData() {
+		element.Data = bytes.Clone(element.Data)
+		s.ServiceData = append(s.ServiceData, element)
+	}
+	s.Length = len(s.Raw)
+	if s.Raw == nil {
+		s.Length = len(ad.FromFields(s.LocalName, s.ManufacturerData, s.ServiceData).Bytes())
+	}
+	s.Identity, _ = resolvePrivateAddress(s.Address)
+	s.DeviceID = fingerprints.identify(result, now)
+	s.Alias = deviceAlias(s.Address, s.Identity, s.DeviceID)
+	s.Tags = deviceTagsOf(cmp.Or(s.Identity, s.Address))
+	s.Frames = decode.Frames(decode.Advertisement{Address: s.Address, ManufacturerData: s.ManufacturerData, ServiceData: s.ServiceData, Length: s.Length})
+	s.SmoothedRSSI = smoothing.smooth(s.Address, s.RSSI)
+	s.Distance = distances.estimate(s)
+	s.Position = locator.locate(s)
+	return s
+}
+
+// payload returns the AD structures of the advertisement. Where the platform
+// doesn't provide the raw packet they are reconstructed from the structured
+// fields, so some structures (such as Flags) may be missing.
+func (s *sighting) payload() (ad.Payload, error) {
+	if s.Raw != nil {
+		return ad.Parse(s.Raw)
+	}
+	return ad.FromFields(s.LocalName, s.ManufacturerData, s.ServiceData), nil
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"time"
+
+	"example.com/m/ad"
+	"example.com/m/decode"
+	"example.com/m/scanner"
+	"tinygo.org/x/bluetooth"
+)
+
+// -simulate scans the made-up devices of simulatedDevices instead of the
+// adapter, for demos of the scanning commands on machines without Bluetooth,
+// and the tests of what processes and writes sightings scan them too. The
+// commands that scan and connect, such as scan -read, tui and serve, connect
+// to the simulated devices as well, of which the heart rate monitor has GATT
+// services.
+
+var simulationStart = time.Now()
+
+// wave returns a reading that drifts around mean by up to amplitude over the
+// course of an hour, so that simulated sensors show some change.
+func wave(now time.Time, mean, amplitude float64) float64 {
+	return mean + amplitude*math.Sin(2*math.Pi*now.Sub(simulationStart).Hours())
+}
+
+func simulatedAddress(s string, random bool) bluetooth.Address {
+	mac, _ := bluetooth.ParseMAC(s)
+	address := bluetooth.Address{MACAddress: bluetooth.MACAddress{MAC: mac}}
+	address.SetRandom(random)
+	return address
+}
+
+// constantValue returns the Value of a simulated characteristic that never
+// changes.
+func constantValue(value []byte) func(time.Time) []byte {
+	return func(time.Time) []byte { return value }
+}
+
+// withFlags prepends general discoverable, LE only Flags to AD structures.
+func withFlags(data []byte) []byte {
+	return append(ad.Append(nil, ad.Flags, []byte{0x06}), data...)
+}
+
+func simulatedDevices() *scanner.Simulator {
+	var sequence uint16
+	eddystone, _ := decode.EncodeEddystoneURL("https://example.com", -20)
+	return &scanner.Simulator{Adapter: scanAdapter, Devices: []scanner.SimulatedDevice{
+		{
+			Address:  simulatedAddress("F0:0D:00:00:00:01", false),
+			RSSI:     -58,
+			Interval: time.Second,
+			Data: func(time.Time) []byte {
+				ibeacon := []byte{0x4c, 0x00, 0x02, 0x15}
+				ibeacon = append(ibeacon, 0xe2, 0xc5, 0x6d, 0xb5, 0xdf, 0xfb, 0x48, 0xd2, 0xb0, 0x60, 0xd0, 0xf5, 0xa7, 0x10, 0x96, 0xe0)
+				ibeacon = append(ibeacon, 0x00, 0x01, 0x00, 0x2a, 0xc5) // major 1, minor 42, -59 dBm at 1m
+				return withFlags(ad.Append(nil, ad.ManufacturerData, ibeacon))
+			},
+		},
+		{
+			Address:  simulatedAddress("F0:0D:00:00:00:02", false),
+			RSSI:     -71,
+			Interval: time.Second,
+			Data: func(time.Time) []byte {
+				data := ad.Append(nil, ad.CompleteServiceUUIDs16, []byte{0xaa, 0xfe})
+				return withFlags(ad.Append(data, ad.ServiceData16, append([]byte{0xaa, 0xfe}, eddystone...)))
+			},
+		},
+		{
+			Address:  simulatedAddress("F0:0D:00:00:00:03", true),
+			RSSI:     -64,
+			Interval: time.Second,
+			Data: func(now time.Time) []byte {
+				// RuuviTag data format 5.
+				sequence++
+				data := []byte{0x99, 0x04, 0x05}
+				data = binary.BigEndian.AppendUint16(data, uint16(int16(math.Round(wave(now, 21, 2)/0.005))))
+				data = binary.BigEndian.AppendUint16(data, uint16(math.Round(wave(now, 45, 5)/0.0025)))
+				data = binary.BigEndian.AppendUint16(data, uint16(math.Round(wave(now, 101325, 200)-50000)))
+				data = binary.BigEndian.AppendUint16(data, 0)
+				data = binary.BigEndian.AppendUint16(data, 0)
+				data = binary.BigEndian.AppendUint16(data, 1000)
+				data = binary.BigEndian.AppendUint16(data, (2950-1600)<<5|(4+40)/2)
+				data = append(data, 0)
+				data = binary.BigEndian.AppendUint16(data, sequence)
+				data = append(data, 0xf0, 0x0d, 0x00, 0x00, 0x00, 0x03)
+				return withFlags(ad.Append(nil, ad.ManufacturerData, data))
+			},
+		},
+		{
+			Address:  simulatedAddress("F0:0D:00:00:00:04", false),
+			RSSI:     -80,
+			Interval: 2 * time.Second,
+			Data: func(now time.Time) []byte {
+				// BTHome v2: temperature, humidity and battery.
+				data := []byte{0xd2, 0xfc, 0x40, 0x02}
+				data = binary.LittleEndian.AppendUint16(data, uint16(int16(math.Round(wave(now, 19, 3)*100))))
+				data = append(data, 0x03)
+				data = binary.LittleEndian.AppendUint16(data, uint16(math.Round(wave(now, 60, 10)*100)))
+				data = append(data, 0x01, 93)
+				data = ad.Append(nil, ad.ServiceData16, data)
+				return withFlags(ad.Append(data, ad.CompleteLocalName, []byte("Garden sensor")))
+			},
+		},
+		{
+			Address:  simulatedAddress("F0:0D:00:00:00:05", false),
+			RSSI:     -67,
+			Interval: 500 * time.Millisecond,
+			Data: func(time.Time) []byte {
+				data := ad.Append(nil, ad.CompleteServiceUUIDs16, []byte{0x0d, 0x18, 0x0f, 0x18})
+				data = ad.Append(data, ad.Appearance, []byte{0x41, 0x03}) // heart rate belt
+				return withFlags(ad.Append(data, ad.CompleteLocalName, []byte("Simulated HRM")))
+			},
+			Services: []scanner.SimulatedService{
+				{UUID: bluetooth.ServiceUUIDDeviceInformation, Characteristics: []scanner.SimulatedCharacteristic{
+					{UUID: bluetooth.CharacteristicUUIDManufacturerNameString, Value: constantValue([]byte("Example Sports"))},
+					{UUID: bluetooth.CharacteristicUUIDModelNumberString, Value: constantValue([]byte("HRM-1"))},
+					{UUID: bluetooth.CharacteristicUUIDFirmwareRevisionString, Value: constantValue([]byte("1.0.2"))},
+				}},
+				{UUID: bluetooth.ServiceUUIDHeartRate, Characteristics: []scanner.SimulatedCharacteristic{
+					{
+						UUID: bluetooth.CharacteristicUUIDHeartRateMeasurement,
+						Value: func(now time.Time) []byte {
+							// Flags 0: the heart rate is a single byte.
+							return []byte{0x00, byte(math.Round(wave(now, 72, 8)))}
+						},
+						Notify: time.Second,
+					},
+					{
+						UUID: bluetooth.CharacteristicUUIDHeartRateControlPoint,
+						Write: func(value []byte) error {
+							// Resetting Energy Expended is the only command.
+							if !bytes.Equal(value, []byte{0x01}) {
+								return errors.New("control point command not supported")
+							}
+							return nil
+						},
+					},
+				}},
+				{UUID: bluetooth.ServiceUUIDBattery, Characteristics: []scanner.SimulatedCharacteristic{
+					{UUID: bluetooth.CharacteristicUUIDBatteryLevel, Value: constantValue([]byte{87}), Notify: time.Minute},
+				}},
+			},
+		},
+		{
+			Address:  simulatedAddress("5A:11:00:00:00:06", true),
+			RSSI:     -75,
+			Interval: 300 * time.Millisecond,
+			Data: func(time.Time) []byte {
+				// An iPhone's Nearby Info.
+				data := ad.Append(nil, ad.TxPowerLevel, []byte{0x0c})
+				return withFlags(ad.Append(data, ad.ManufacturerData, []byte{0x4c, 0x00, 0x10, 0x05, 0x1b, 0x1c, 0x8e, 0x2a, 0x5f}))
+			},
+		},
+	}}
+}
@@ -0,0 +1,455 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"maps"
+	"math"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"example.com/m/ad"
+	"example.com/m/scanner"
+	"tinygo.org/x/bluetooth"
+)
+
+// The addresses of simulatedDevices.
+const (
+	simulatedIBeacon   = "F0:0D:00:00:00:01"
+	simulatedEddystone = "F0:0D:00:00:00:02"
+	simulatedRuuviTag  = "F0:0D:00:00:00:03"
+	simulatedBTHome    = "F0:0D:00:00:00:04"
+	simulatedHRM       = "F0:0D:00:00:00:05"
+	simulatedIPhone    = "5A:11:00:00:00:06"
+)
+
+var simulatedAddresses = []string{simulatedIBeacon, simulatedEddystone, simulatedRuuviTag, simulatedBTHome, simulatedHRM, simulatedIPhone}
+
+// simulatedResults scans the devices of -simulate, made to advertise every
+// millisecond, until each has advertised n times, and returns what was
+// received in order.
+func simulatedResults(t *testing.T, n int) []bluetooth.ScanResult {
+	t.Helper()
+	simulator := simulatedDevices()
+	for i := range simulator.Devices {
+		simulator.Devices[i].Interval = time.Millisecond
+	}
+	var results []bluetooth.ScanResult
+	counts := make(map[string]int)
+	stopped := false
+	done := make(chan error)
+	go func() {
+		done <- simulator.Scan(func(_ *bluetooth.Adapter, result bluetooth.ScanResult) {
+			if stopped {
+				return
+			}
+			results = append(results, result)
+			counts[result.Address.String()]++
+			for _, address := range simulatedAddresses {
+				if counts[address] < n {
+					return
+				}
+			}
+			stopped = true
+			simulator.StopScan()
+		})
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("the simulated devices didn't all advertise")
+	}
+	return results
+}
+
+// resultsOf returns the results of a device.
+func resultsOf(results []bluetooth.ScanResult, address string) []bluetooth.ScanResult {
+	var of []bluetooth.ScanResult
+	for _, r := range results {
+		if r.Address.String() == address {
+			of = append(of, r)
+		}
+	}
+	return of
+}
+
+func TestFilterMatch(t *testing.T) {
+	results := simulatedResults(t, 2)
+	tests := []struct {
+		name   string
+		filter scanFilter
+		want   []string
+	}{
+		{"zero", scanFilter{}, simulatedAddresses},
+		{"weak min-rssi", scanFilter{minRSSI: -90, hasMinRSSI: true}, simulatedAddresses},
+		{"strong min-rssi", scanFilter{minRSSI: -40, hasMinRSSI: true}, nil},
+		{"name", scanFilter{name: "sensor"}, []string{simulatedBTHome}},
+		{"name-regex", scanFilter{nameRegex: regexp.MustCompile("^Simulated")}, []string{simulatedHRM}},
+		{"addr", scanFilter{allow: map[string]bool{simulatedIBeacon: true, simulatedIPhone: true}}, []string{simulatedIBeacon, simulatedIPhone}},
+		{"ignore-addr", scanFilter{ignore: map[string]bool{simulatedIPhone: true}}, simulatedAddresses[:5]},
+		{"addr and ignore-addr", scanFilter{allow: map[string]bool{simulatedIBeacon: true}, ignore: map[string]bool{simulatedIBeacon: true}}, nil},
+		{"service UUID", scanFilter{services: []bluetooth.UUID{bluetooth.New16BitUUID(0x180d)}}, []string{simulatedHRM}},
+		{"service data", scanFilter{services: []bluetooth.UUID{bluetooth.New16BitUUID(0xfcd2)}}, []string{simulatedBTHome}},
+		{"services", scanFilter{services: []bluetooth.UUID{bluetooth.New16BitUUID(0xfeaa), bluetooth.New16BitUUID(0x180f)}}, []string{simulatedEddystone, simulatedHRM}},
+		{"name and service", scanFilter{name: "sensor", services: []bluetooth.UUID{bluetooth.New16BitUUID(0x180d)}}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, r := range results {
+				if tt.filter.match(r) && !slices.Contains(got, r.Address.String()) {
+					got = append(got, r.Address.String())
+				}
+			}
+			slices.Sort(got)
+			want := slices.Clone(tt.want)
+			slices.Sort(want)
+			if !slices.Equal(got, want) {
+				t.Errorf("matched %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestDedupCache(t *testing.T) {
+	results := simulatedResults(t, 2)
+	// The iBeacon advertises the same every time, and the RuuviTag counts
+	// its advertisements.
+	beacon, ruuvi := resultsOf(results, simulatedIBeacon), resultsOf(results, simulatedRuuviTag)
+	now := time.Now()
+	steps := []struct {
+		result bluetooth.ScanResult
+		after  time.Duration
+		want   bool
+	}{
+		{beacon[0], 0, true},
+		{beacon[1], time.Second, false},
+		{ruuvi[0], time.Second, true},
+		{ruuvi[1], 2 * time.Second, false},
+		{beacon[1], time.Minute, true},
+		{ruuvi[1], 2 * time.Minute, true},
+	}
+	c := newDedupCache(time.Minute, false)
+	for i, step := range steps {
+		if got := c.report(step.result, now.Add(step.after)); got != step.want {
+			t.Errorf("step %d: report = %v, want %v", i, got, step.want)
+		}
+	}
+
+	// With -dedup-on-change, a changed payload is reported right away.
+	c = newDedupCache(time.Minute, true)
+	for i, step := range []struct {
+		result bluetooth.ScanResult
+		want   bool
+	}{{beacon[0], true}, {beacon[1], false}, {ruuvi[0], true}, {ruuvi[1], true}, {ruuvi[1], false}} {
+		if got := c.report(step.result, now); got != step.want {
+			t.Errorf("on change, step %d: report = %v, want %v", i, got, step.want)
+		}
+	}
+}
+
+func TestChangeTracker(t *testing.T) {
+	results := simulatedResults(t, 2)
+	now := time.Now()
+	tracker := newChangeTracker()
+	for _, address := range []string{simulatedIBeacon, simulatedRuuviTag} {
+		of := resultsOf(results, address)
+		if changes, report := tracker.changes(newSighting(of[0], now)); changes != nil || !report {
+			t.Errorf("%s: first sighting gave %v, %v, want nil, true", address, changes, report)
+		}
+	}
+	beacon := resultsOf(results, simulatedIBeacon)[1]
+	if changes, report := tracker.changes(newSighting(beacon, now)); changes != nil || report {
+		t.Errorf("unchanged iBeacon gave %v, %v, want nil, false", changes, report)
+	}
+	ruuvi := resultsOf(results, simulatedRuuviTag)[1]
+	changes, report := tracker.changes(newSighting(ruuvi, now))
+	if !report || len(changes) != 1 {
+		t.Fatalf("RuuviTag gave %v, %v, want one change", changes, report)
+	}
+	// Bytes 18-19 of its manufacturer data, company ID included, are the
+	// sequence number, which the simulated tag increments.
+	if c := changes[0]; c.Change != "changed" || c.New.Type != ad.ManufacturerData || !strings.HasSuffix(c.Bytes, "19") {
+		t.Errorf("RuuviTag changed %s", c)
+	}
+}
+
+func TestDiffPayloads(t *testing.T) {
+	old, _ := ad.Parse(withFlags(ad.Append(nil, ad.CompleteLocalName, []byte("Simulated HRM"))))
+	new, _ := ad.Parse(withFlags(ad.Append(nil, ad.TxPowerLevel, []byte{0x0c})))
+	changes := diffPayloads(old, new)
+	var got []string
+	for _, c := range changes {
+		got = append(got, c.String())
+	}
+	want := []string{"added " + new[1].String(), "removed " + old[1].String()}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestChangedBytes(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want string
+	}{
+		{"0102", "0102", ""},
+		{"010203", "010903", "1"},
+		{"0102", "010203", "2"},
+		{"010203", "01", "1-2"},
+		{"01020304", "09020909", "0,2-3"},
+		{"", "01", "0"},
+	}
+	for _, tt := range tests {
+		a, _ := hex.DecodeString(tt.a)
+		b, _ := hex.DecodeString(tt.b)
+		if got := changedBytes(a, b); got != tt.want {
+			t.Errorf("changedBytes(%s, %s) = %q, want %q", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestCycleAggregate(t *testing.T) {
+	results := simulatedResults(t, 3)
+	now := time.Now()
+	a := newCycleAggregate()
+	var order []string
+	counts := make(map[string]int)
+	sums := make(map[string]int)
+	for _, r := range results {
+		s := newSighting(r, now)
+		if counts[s.Address] == 0 {
+			order = append(order, s.Address)
+		}
+		counts[s.Address]++
+		sums[s.Address] += int(s.RSSI)
+		a.add(s)
+	}
+	var reported []string
+	a.flush(func(s *sighting) {
+		reported = append(reported, s.Address)
+		if s.Count != counts[s.Address] {
+			t.Errorf("%s: count %d, want %d", s.Address, s.Count, counts[s.Address])
+		}
+		mean := int16(math.Round(float64(sums[s.Address]) / float64(counts[s.Address])))
+		if s.RSSI != mean || s.SmoothedRSSI != float64(mean) {
+			t.Errorf("%s: RSSI %d, smoothed %.1f, want the mean %d", s.Address, s.RSSI, s.SmoothedRSSI, mean)
+		}
+	})
+	if !slices.Equal(reported, order) {
+		t.Errorf("reported %v, want one sighting per device in the order first seen, %v", reported, order)
+	}
+	a.flush(func(s *sighting) { t.Errorf("%s reported again in the next cycle", s.Address) })
+}
+
+// simulatedIBeaconSighting returns a sighting of the simulated iBeacon.
+func simulatedIBeaconSighting(t *testing.T) *sighting {
+	t.Helper()
+	s := newSighting(resultsOf(simulatedResults(t, 1), simulatedIBeacon)[0], time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC))
+	if len(s.Raw) == 0 {
+		t.Fatal("simulated sighting without a raw payload")
+	}
+	return s
+}
+
+func TestTextOutput(t *testing.T) {
+	s := simulatedIBeaconSighting(t)
+	var b bytes.Buffer
+	if err := (textOutput{w: &b, verbose: true}).write(s); err != nil {
+		t.Fatal(err)
+	}
+	out := b.String()
+	for _, want := range []string{
+		"found device: " + simulatedIBeacon,
+		"\n  ibeacon: ",
+		"\n  length: 30 bytes\n",
+		"\n  ad: ",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output doesn't have %q:\n%s", want, out)
+		}
+	}
+	if !strings.HasSuffix(strings.SplitN(out, "\n", 2)[0], strconv.Itoa(int(s.RSSI))+" ") {
+		t.Errorf("first line doesn't end with the RSSI and the empty local name: %q", out)
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) { return 0, errors.New("broken pipe") }
+
+func TestOutputWriteErrors(t *testing.T) {
+	s := simulatedIBeaconSighting(t)
+	for _, format := range []string{"text", "json"} {
+		o, err := newScanOutput(format, failingWriter{}, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := o.write(s); err == nil {
+			t.Errorf("%s output: no write error", format)
+		}
+	}
+}
+
+func TestJSONOutput(t *testing.T) {
+	s := simulatedIBeaconSighting(t)
+	var b bytes.Buffer
+	o, err := newScanOutput("json", &b, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := o.write(s); err != nil {
+		t.Fatal(err)
+	}
+	var got struct {
+		Time    time.Time `json:"time"`
+		Address string    `json:"address"`
+		RSSI    int16     `json:"rssi"`
+		Raw     string    `json:"raw"`
+		Length  int       `json:"length"`
+		Frames  struct {
+			IBeacon struct {
+				Major         uint16 `json:"major"`
+				Minor         uint16 `json:"minor"`
+				MeasuredPower int8   `json:"measured_power"`
+			} `json:"ibeacon"`
+		} `json:"frames"`
+		Position *position `json:"position"`
+	}
+	if err := json.Unmarshal(b.Bytes(), &got); err != nil {
+		t.Fatalf("%v: %s", err, b.Bytes())
+	}
+	if !got.Time.Equal(s.Time) || got.Address != simulatedIBeacon || got.RSSI != s.RSSI || got.Raw != hex.EncodeToString(s.Raw) || got.Length != 30 {
+		t.Errorf("got %+v for %s", got, b.Bytes())
+	}
+	if ib := got.Frames.IBeacon; ib.Major != 1 || ib.Minor != 42 || ib.MeasuredPower != -59 {
+		t.Errorf("iBeacon frame %+v, want major 1, minor 42 and -59 dBm", ib)
+	}
+	if got.Position != nil {
+		t.Errorf("position %+v without an estimate", got.Position)
+	}
+}
+
+func TestCSVOutput(t *testing.T) {
+	s := simulatedIBeaconSighting(t)
+	located := *s
+	located.Position = &position{X: 1.5, Y: -2, Receivers: 3}
+	var b bytes.Buffer
+	o, err := newScanOutput("csv", &b, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []*sighting{s, &located} {
+		if err := o.write(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := o.close(); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := csv.NewReader(&b).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 3 || !slices.Equal(rows[0], csvHeader) {
+		t.Fatalf("got rows %q, want the header and two rows", rows)
+	}
+	field := func(row []string, name string) string { return row[slices.Index(csvHeader, name)] }
+	for _, row := range rows[1:] {
+		if field(row, "time") != "2024-01-02T15:04:05Z" || field(row, "address") != simulatedIBeacon ||
+			field(row, "rssi") != strconv.Itoa(int(s.RSSI)) || field(row, "raw") != hex.EncodeToString(s.Raw) ||
+			!strings.HasPrefix(field(row, "manufacturer_data"), "0x004C=0215") {
+			t.Errorf("row %q", row)
+		}
+	}
+	for i, want := range [][]string{{"", "", ""}, {"1.5", "-2", "3"}} {
+		row := rows[1+i]
+		if got := []string{field(row, "x"), field(row, "y"), field(row, "receivers")}; !slices.Equal(got, want) {
+			t.Errorf("row %d: position columns %q, want %q", i+1, got, want)
+		}
+	}
+}
+
+func TestJSONOutputFramesOfAKind(t *testing.T) {
+	// Manufacturer data of two companies, each a manufacturer frame.
+	data := ad.Append(nil, ad.ManufacturerData, []byte{0x34, 0x12, 0x01})
+	data = ad.Append(data, ad.ManufacturerData, []byte{0x78, 0x56, 0x02})
+	s := newSighting(bluetooth.ScanResult{Address: simulatedAddress(simulatedIBeacon, false), AdvertisementPayload: scanner.RawPayload(withFlags(data))}, time.Now())
+	var b bytes.Buffer
+	o, err := newScanOutput("json", &b, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := o.write(s); err != nil {
+		t.Fatal(err)
+	}
+	var got struct {
+		Frames map[string]struct {
+			CompanyID uint16 `json:"company_id"`
+		} `json:"frames"`
+	}
+	if err := json.Unmarshal(b.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Frames["manufacturer"].CompanyID != 0x1234 || got.Frames["manufacturer#2"].CompanyID != 0x5678 {
+		t.Errorf("frames %s, want manufacturer and manufacturer#2", b.Bytes())
+	}
+}
+
+// TestReadDuringScan connects to the simulated heart rate monitor for -read,
+// as scan -simulate does.
+func TestReadDuringScan(t *testing.T) {
+	connectBackend = simulatedDevices()
+	defer func() { connectBackend = nil }()
+	var conn connectFlags
+	conn.registerFlags(flag.NewFlagSet("scan", flag.ContinueOnError))
+	conn.retries = 0
+	var reported []*sighting
+	report := func(s *sighting) { reported = append(reported, s) }
+
+	err := readDuringScan(context.Background(), &conn, simulatedAddress(simulatedHRM, false), bluetooth.CharacteristicUUIDManufacturerNameString, report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reported) != 1 {
+		t.Fatalf("%d sightings reported, want 1", len(reported))
+	}
+	if s := reported[0]; s.Address != simulatedHRM || s.Read == nil || string(s.Read.Value) != "Example Sports" {
+		t.Errorf("reported %s %+v, want %s \"Example Sports\"", s.Address, s.Read, simulatedHRM)
+	}
+
+	err = readDuringScan(context.Background(), &conn, simulatedAddress(simulatedIBeacon, false), bluetooth.CharacteristicUUIDManufacturerNameString, report)
+	if err == nil {
+		t.Error("read from the iBeacon, which isn't connectable, succeeded")
+	}
+}
+
+func TestReadDeviceInfo(t *testing.T) {
+	connectBackend = simulatedDevices()
+	defer func() { connectBackend = nil }()
+	device, err := connectTimeout(simulatedAddress(simulatedHRM, false), bluetooth.ConnectionParams{}, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer device.Disconnect()
+	info, err := readDeviceInfo(device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"manufacturer": "Example Sports", "model": "HRM-1", "firmware": "1.0.2"}
+	if !maps.Equal(info, want) {
+		t.Errorf("device info %v, want %v", info, want)
+	}
+}
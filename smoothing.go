@@ -0,0 +1,174 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+)
+
+// smoothing smooths the RSSI of each device while -smooth is given. It is nil
+// otherwise, which makes smooth return the raw RSSI.
+var smoothing *rssiSmoother
+
+// smoothingDeviceTTL is how long the filter of a device that is no longer
+// seen is kept. Phones change their random address every few minutes, so
+// without this the filters would grow without bounds, and samples this old say
+// nothing about the RSSI anyway.
+const smoothingDeviceTTL = 10 * time.Minute
+
+// rssiFilter smooths a series of RSSI samples.
+type rssiFilter interface {
+	// add adds a sample and returns the smoothed value.
+	add(rssi float64) float64
+}
+
+// smoothFlags are the flags for RSSI smoothing.
+type smoothFlags struct {
+	method       string
+	alpha        float64
+	window       int
+	processNoise float64
+	measureNoise float64
+}
+
+func (f *smoothFlags) registerFlags(fs *flag.FlagSet) {
+	fs.StringVar(&f.method, "smooth", "none", "smooth the RSSI of each device: none, ema (exponential moving average), median or kalman")
+	fs.Float64Var(&f.alpha, "ema-alpha", 0.3, "weight of a new sample for -smooth ema, 0-1")
+	fs.IntVar(&f.window, "median-window", 5, "number of samples for -smooth median")
+	fs.Float64Var(&f.processNoise, "kalman-process-noise", 0.1, "how fast the true RSSI is expected to change, for -smooth kalman")
+	fs.Float64Var(&f.measureNoise, "kalman-measurement-noise", 4, "variance of the RSSI samples around the true RSSI, for -smooth kalman")
+}
+
+// setup enables smoothing if -smooth was given.
+func (f *smoothFlags) setup() error {
+	var newFilter func() rssiFilter
+	switch f.method {
+	case "none":
+		return nil
+	case "ema":
+		if f.alpha <= 0 || f.alpha > 1 {
+			return errors.New("-ema-alpha must be between 0 and 1")
+		}
+		newFilter = func() rssiFilter { return &emaFilter{alpha: f.alpha} }
+	case "median":
+		if f.window < 1 {
+			return errors.New("-median-window must be at least 1")
+		}
+		newFilter = func() rssiFilter { return &medianFilter{size: f.window} }
+	case "kalman":
+		if f.processNoise <= 0 || f.measureNoise <= 0 {
+			return errors.New("-kalman-process-noise and -kalman-measurement-noise must be positive")
+		}
+		newFilter = func() rssiFilter { return &kalmanFilter{q: f.processNoise, r: f.measureNoise} }
+	default:
+		return fmt.Errorf("unknown -smooth method %q", f.method)
+	}
+	smoothing = &rssiSmoother{newFilter: newFilter, filters: make(map[string]*smoothedDevice)}
+	return nil
+}
+
+// rssiSmoother keeps a filter per device.
+type rssiSmoother struct {
+	newFilter func() rssiFilter
+
+	mu      sync.Mutex
+	filters map[string]*smoothedDevice
+	pruned  time.Time
+}
+
+type smoothedDevice struct {
+	filter   rssiFilter
+	lastSeen time.Time
+}
+
+// smooth adds an RSSI sample of a device and returns its smoothed RSSI. An
+// RSSI of 0, which some platforms report when it is unknown, is not a sample.
+func (s *rssiSmoother) smooth(address string, rssi int16) float64 {
+	if s == nil || rssi == 0 {
+		return float64(rssi)
+	}
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.prune(now)
+	d := s.filters[address]
+	if d == nil {
+		d = &smoothedDevice{filter: s.newFilter()}
+		s.filters[address] = d
+	}
+	d.lastSeen = now
+	return d.filter.add(float64(rssi))
+}
+
+// prune drops the filters of devices that haven't been seen for
+// smoothingDeviceTTL, at most once per TTL. s.mu must be held.
+func (s *rssiSmoother) prune(now time.Time) {
+	if now.Sub(s.pruned) < smoothingDeviceTTL {
+		return
+	}
+	s.pruned = now
+	for address, d := range s.filters {
+		if now.Sub(d.lastSeen) >= smoothingDeviceTTL {
+			delete(s.filters, address)
+		}
+	}
+}
+
+// emaFilter is an exponential moving average.
+type emaFilter struct {
+	alpha float64
+	value float64
+	init  bool
+}
+
+func (f *emaFilter) add(rssi float64) float64 {
+	if !f.init {
+		f.value, f.init = rssi, true
+	} else {
+		f.value += f.alpha * (rssi - f.value)
+	}
+	return f.value
+}
+
+// medianFilter is the median of the last samples, which ignores the
+// occasional outlier entirely.
+type medianFilter struct {
+	size   int
+	window []float64
+}
+
+func (f *medianFilter) add(rssi float64) float64 {
+	f.window = append(f.window, rssi)
+	if len(f.window) > f.size {
+		f.window = f.window[1:]
+	}
+	sorted := slices.Clone(f.window)
+	slices.Sort(sorted)
+	if n := len(sorted); n%2 == 0 {
+		return (sorted[n/2-1] + sorted[n/2]) / 2
+	}
+	return sorted[len(sorted)/2]
+}
+
+// kalmanFilter is a one-dimensional Kalman filter that models the RSSI as a
+// constant with process noise q, measured with noise r.
+type kalmanFilter struct {
+	q, r float64
+	x, p float64 // estimate and its variance
+	init bool
+}
+
+func (f *kalmanFilter) add(rssi float64) float64 {
+	if !f.init {
+		f.x, f.p, f.init = rssi, f.r, true
+		return f.x
+	}
+	f.p += f.q
+	k := f.p / (f.p + f.r)
+	f.x += k * (rssi - f.x)
+	f.p *= 1 - k
+	return f.x
+}
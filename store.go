@@ -0,0 +1,355 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"time"
+
+	"example.com/m/ad"
+	"example.com/m/decode"
+	_ "modernc.org/sqlite"
+	"tinygo.org/x/bluetooth"
+)
+
+// storeSchema creates the tables of the sighting store. Times are Unix
+// milliseconds. Payloads are stored once per distinct payload, keyed by the
+// hash that the sightings refer to.
+const storeSchema = `
+CREATE TABLE IF NOT EXISTS devices (
+	address    TEXT PRIMARY KEY,
+	name       TEXT NOT NULL DEFAULT '',
+	first_seen INTEGER NOT NULL,
+	last_seen  INTEGER NOT NULL
+);
+CREATE TABLE IF NOT EXISTS payloads (
+	hash TEXT PRIMARY KEY,
+	data BLOB NOT NULL
+);
+CREATE TABLE IF NOT EXISTS sightings (
+	id           INTEGER PRIMARY KEY,
+	address      TEXT NOT NULL REFERENCES devices (address),
+	time         INTEGER NOT NULL,
+	rssi         INTEGER NOT NULL,
+	payload_hash TEXT NOT NULL REFERENCES payloads (hash)
+);
+CREATE INDEX IF NOT EXISTS sightings_by_address ON sightings (address, time);
+CREATE TABLE IF NOT EXISTS measurements (
+	sighting_id INTEGER NOT NULL REFERENCES sightings (id),
+	kind        TEXT NOT NULL,
+	name        TEXT NOT NULL,
+	value       REAL NOT NULL,
+	unit        TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS measurements_by_sighting ON measurements (sighting_id);
+`
+
+// storeCommitInterval is how often the store commits. Committing every
+// sighting would make the disk the bottleneck of a busy scan.
+const storeCommitInterval = time.Second
+
+// openStore opens (and if needed creates) a sighting store.
+func openStore(path string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	// A single connection, so that the pragmas apply to every statement.
+	db.SetMaxOpenConns(1)
+	for _, stmt := range []string{"PRAGMA journal_mode = WAL", "PRAGMA synchronous = NORMAL", storeSchema} {
+		if _, err := db.Exec(stmt); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	return db, nil
+}
+
+// storeOutput records sightings and their decoded measurements in a SQLite
+// database.
+type storeOutput struct {
+	db       *sql.DB
+	tx       *sql.Tx
+	txStart  time.Time
+	payloads map[string]bool // hashes known to be stored
+}
+
+func newStoreOutput(path string) (*storeOutput, error) {
+	if dryRun {
+		// The schema is still checked.
+		if err := checkOutputDir(path); err != nil {
+			return nil, err
+		}
+		path = ":memory:"
+	}
+	db, err := openStore(path)
+	if err != nil {
+		return nil, err
+	}
+	return &storeOutput{db: db, payloads: make(map[string]bool)}, nil
+}
+
+func (o *storeOutput) write(s *sighting) error {
+	if o.tx != nil && s.Time.Sub(o.txStart) >= storeCommitInterval {
+		if err := o.commit(); err != nil {
+			return err
+		}
+	}
+	if o.tx == nil {
+		tx, err := o.db.Begin()
+		if err != nil {
+			return err
+		}
+		o.tx, o.txStart = tx, s.Time
+	}
+
+	now := s.Time.UnixMilli()
+	_, err := o.tx.Exec(`INSERT INTO devices (address, name, first_seen, last_seen) VALUES (?, ?, ?, ?)
+		ON CONFLICT (address) DO UPDATE SET last_seen = excluded.last_seen,
+			name = CASE WHEN excluded.name != '' THEN excluded.name ELSE name END`,
+		s.Address, s.LocalName, now, now)
+	if err != nil {
+		return err
+	}
+
+	hash := fmt.Sprintf("%016x", hashPayload(s.Raw, s.LocalName, s.ManufacturerData, s.ServiceData))
+	if !o.payloads[hash] {
+		data := s.Raw
+		if data == nil {
+			data = ad.FromFields(s.LocalName, s.ManufacturerData, s.ServiceData).Bytes()
+		}
+		if _, err := o.tx.Exec(`INSERT OR IGNORE INTO payloads (hash, data) VALUES (?, ?)`, hash, data); err != nil {
+			return err
+		}
+		o.payloads[hash] = true
+	}
+
+	result, err := o.tx.Exec(`INSERT INTO sightings (address, time, rssi, payload_hash) VALUES (?, ?, ?, ?)`,
+		s.Address, now, s.RSSI, hash)
+	if err != nil {
+		return err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+	for _, f := range s.Frames {
+		sensor, ok := f.(decode.SensorFrame)
+		if !ok {
+			continue
+		}
+		for _, m := range sensor.Measurements() {
+			_, err := o.tx.Exec(`INSERT INTO measurements (sighting_id, kind, name, value, unit) VALUES (?, ?, ?, ?, ?)`,
+				id, f.Kind(), m.Name, m.Value, m.Unit)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (o *storeOutput) commit() error {
+	err := o.tx.Commit()
+	o.tx = nil
+	if err != nil {
+		// A rolled back payload may be missing now.
+		clear(o.payloads)
+	}
+	return err
+}
+
+func (o *storeOutput) close() error {
+	var err error
+	if o.tx != nil {
+		err = o.commit()
+	}
+	if closeErr := o.db.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// storedSighting is a sighting as read back from the store.
+type storedSighting struct {
+	Time         time.Time            `json:"time"`
+	RSSI         int16                `json:"rssi"`
+	PayloadHash  string               `json:"payload_hash"`
+	Measurements []decode.Measurement `json:"measurements,omitempty"`
+}
+
+func runHistory(args []string) error {
+	fs := newFlagSet("history", "<address>")
+	path := fs.String("db", "ble.db", "SQLite database written by 'ble scan -db'")
+	since := fs.Duration("since", 0, "only show sightings from this long ago until now (0 shows all)")
+	limit := fs.Int("limit", 100, "show at most this many of the latest sightings (0 shows all)")
+	payloads := fs.Bool("payloads", false, "also list the distinct payloads of the device")
+	format := fs.String("output", "text", "output format: text or json")
+	parseFlags(fs, args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("expected exactly one device address")
+	}
+	if *format != "text" && *format != "json" {
+		return fmt.Errorf("unknown output format %q", *format)
+	}
+	mac, err := bluetooth.ParseMAC(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	address := mac.String()
+	if _, err := os.Stat(*path); err != nil {
+		return err
+	}
+	db, err := openStore(*path)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var name string
+	var firstSeen, lastSeen int64
+	err = db.QueryRow(`SELECT name, first_seen, last_seen FROM devices WHERE address = ?`, address).Scan(&name, &firstSeen, &lastSeen)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("%w: %s is not in %s", errDeviceNotFound, address, *path)
+	} else if err != nil {
+		return err
+	}
+
+	var from int64
+	if *since > 0 {
+		from = time.Now().Add(-*since).UnixMilli()
+	}
+	sightings, err := querySightings(db, address, from, *limit)
+	if err != nil {
+		return err
+	}
+	var distinct map[string][]byte
+	if *payloads {
+		if distinct, err = queryPayloads(db, address); err != nil {
+			return err
+		}
+	}
+
+	if *format == "json" {
+		return json.NewEncoder(os.Stdout).Encode(struct {
+			Address   string            `json:"address"`
+			Name      string            `json:"name,omitempty"`
+			FirstSeen time.Time         `json:"first_seen"`
+			LastSeen  time.Time         `json:"last_seen"`
+			Sightings []storedSighting  `json:"sightings"`
+			Payloads  map[string]string `json:"payloads,omitempty"`
+		}{address, name, time.UnixMilli(firstSeen), time.UnixMilli(lastSeen), sightings, hexValues(distinct)})
+	}
+	fmt.Println("address:   ", address)
+	if name != "" {
+		fmt.Println("name:      ", name)
+	}
+	fmt.Println("first seen:", time.UnixMilli(firstSeen).Format(time.RFC3339))
+	fmt.Println("last seen: ", time.UnixMilli(lastSeen).Format(time.RFC3339))
+	fmt.Println()
+	for _, s := range sightings {
+		line := fmt.Sprintf("%s %4d dBm %s", s.Time.Format(time.RFC3339Nano), s.RSSI, s.PayloadHash)
+		for _, m := range s.Measurements {
+			line += " " + m.Name + "=" + m.String()
+		}
+		fmt.Println(line)
+	}
+	if len(distinct) != 0 {
+		fmt.Println()
+		hashes := make([]string, 0, len(distinct))
+		for hash := range distinct {
+			hashes = append(hashes, hash)
+		}
+		slices.Sort(hashes)
+		for _, hash := range hashes {
+			fmt.Printf("%-16s %x\n", hash, distinct[hash])
+		}
+	}
+	return nil
+}
+
+// querySightings returns the latest sightings of a device since the given
+// time, oldest first, with their measurements.
+func querySightings(db *sql.DB, address string, from int64, limit int) ([]storedSighting, error) {
+	query := `SELECT id, time, rssi, payload_hash FROM sightings WHERE address = ? AND time >= ? ORDER BY time DESC`
+	if limit > 0 {
+		query += " LIMIT " + strconv.Itoa(limit)
+	}
+	rows, err := db.Query(query, address, from)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []int64
+	var sightings []storedSighting
+	for rows.Next() {
+		var id, t int64
+		var s storedSighting
+		if err := rows.Scan(&id, &t, &s.RSSI, &s.PayloadHash); err != nil {
+			return nil, err
+		}
+		s.Time = time.UnixMilli(t)
+		ids = append(ids, id)
+		sightings = append(sightings, s)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	for i, id := range ids {
+		rows, err := db.Query(`SELECT name, value, unit FROM measurements WHERE sighting_id = ?`, id)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var m decode.Measurement
+			if err := rows.Scan(&m.Name, &m.Value, &m.Unit); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			sightings[i].Measurements = append(sightings[i].Measurements, m)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	slices.Reverse(sightings)
+	return sightings, nil
+}
+
+// queryPayloads returns the distinct payloads a device has sent, by hash.
+func queryPayloads(db *sql.DB, address string) (map[string][]byte, error) {
+	rows, err := db.Query(`SELECT DISTINCT p.hash, p.data FROM sightings s JOIN payloads p ON p.hash = s.payload_hash WHERE s.address = ?`, address)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	payloads := make(map[string][]byte)
+	for rows.Next() {
+		var hash string
+		var data []byte
+		if err := rows.Scan(&hash, &data); err != nil {
+			return nil, err
+		}
+		payloads[hash] = data
+	}
+	return payloads, rows.Err()
+}
+
+func hexValues(m map[string][]byte) map[string]string {
+	if len(m) == 0 {
+		return nil
+	}
+	values := make(map[string]string, len(m))
+	for key, value := range m {
+		values[key] = fmt.Sprintf("%x", value)
+	}
+	return values
+}
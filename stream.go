@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/gorilla/websocket"
+	"tinygo.org/x/bluetooth"
+)
+
+// streamBuffer is the number of advertisements buffered per stream client.
+// Advertisements for a client that falls further behind are dropped, so that
+// a slow client can't hold up the scan.
+const streamBuffer = 64
+
+// streamHub fans scan results out to the clients of the /stream endpoint.
+type streamHub struct {
+	mu      sync.Mutex
+	clients map[*streamClient]bool
+
+	// done is closed on shutdown, to end all streams.
+	done chan struct{}
+}
+
+type streamClient struct {
+	filter  *scanFilter
+	ch      chan *sighting
+	dropped uint64
+}
+
+func newStreamHub() *streamHub {
+	return &streamHub{clients: make(map[*streamClient]bool), done: make(chan struct{})}
+}
+
+// close ends all streams.
+func (h *streamHub) close() {
+	close(h.done)
+}
+
+// publish sends the sighting of a scan result to every client whose filter
+// the result matches.
+func (h *streamHub) publish(result bluetooth.ScanResult, s *sighting) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for c := range h.clients {
+		if !c.filter.match(result) {
+			continue
+		}
+		select {
+		case c.ch <- s:
+		default:
+			c.dropped++
+		}
+	}
+}
+
+func (h *streamHub) subscribe(filter *scanFilter) *streamClient {
+	c := &streamClient{filter: filter, ch: make(chan *sighting, streamBuffer)}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.clients[c] = true
+	return c
+}
+
+// unsubscribe removes a client, reporting how many advertisements it missed
+// because it was too slow.
+func (h *streamHub) unsubscribe(c *streamClient) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.clients, c)
+	if c.dropped > 0 {
+		apiLog.Warn("stream client missed advertisements", "dropped", c.dropped)
+	}
+}
+
+// parseStreamFilter builds a filter from the query parameters of a stream
+// request: name (a substring of the local name), rssi (the minimum RSSI in
+// dBm) and service (a service UUID, repeatable).
+func parseStreamFilter(r *http.Request) (*scanFilter, error) {
+	query := r.URL.Query()
+	f := &scanFilter{name: query.Get("name")}
+	if s := query.Get("rssi"); s != "" {
+		rssi, err := strconv.ParseInt(s, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rssi: %w", err)
+		}
+		f.minRSSI, f.hasMinRSSI = int16(rssi), true
+	}
+	for _, s := range query["service"] {
+		uuid, err := bluetooth.ParseUUID(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid service UUID: %w", err)
+		}
+		f.services = append(f.services, uuid)
+	}
+	return f, nil
+}
+
+var upgrader = websocket.Upgrader{}
+
+// serveStream streams advertisements as JSON, one message per advertisement,
+// over a WebSocket if the client asks for one and as server-sent events
+// otherwise.
+func (h *streamHub) serveStream(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseStreamFilter(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if websocket.IsWebSocketUpgrade(r) {
+		h.serveWebSocket(w, r, filter)
+	} else {
+		h.serveEvents(w, r, filter)
+	}
+}
+
+func (h *streamHub) serveWebSocket(w http.ResponseWriter, r *http.Request, filter *scanFilter) {
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade has already written an error response.
+		return
+	}
+	defer ws.Close()
+
+	// Nothing is expected from the client, but reading is what notices it
+	// going away.
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := ws.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	c := h.subscribe(filter)
+	defer h.unsubscribe(c)
+	for {
+		select {
+		case s := <-c.ch:
+			if err := ws.WriteJSON(newJSONSighting(s, false)); err != nil {
+				return
+			}
+		case <-closed:
+			return
+		case <-h.done:
+			ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""))
+			return
+		}
+	}
+}
+
+func (h *streamHub) serveEvents(w http.ResponseWriter, r *http.Request, filter *scanFilter) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("streaming is not supported"))
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	c := h.subscribe(filter)
+	defer h.unsubscribe(c)
+	for {
+		select {
+		case s := <-c.ch:
+			data, err := json.Marshal(newJSONSighting(s, false))
+			if err != nil {
+				return
+			}
+			if _, err := fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		case <-h.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"math/rand"
+	"time"
+
+	"example.com/m/gattclient"
+	"tinygo.org/x/bluetooth"
+)
+
+// reconnectFlags are the flags of long-running commands that keep a
+// connection open.
+type reconnectFlags struct {
+	enabled    bool
+	maxBackoff time.Duration
+}
+
+func (r *reconnectFlags) registerFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&r.enabled, "reconnect", true, "reconnect when the device disconnects")
+	fs.DurationVar(&r.maxBackoff, "max-backoff", time.Minute, "maximum delay between reconnection attempts")
+}
+
+// initialBackoff is the delay before the first reconnection attempt.
+const initialBackoff = time.Second
+
+// nextBackoff doubles the backoff, up to max.
+func nextBackoff(backoff, max time.Duration) time.Duration {
+	backoff *= 2
+	if backoff > max {
+		backoff = max
+	}
+	return backoff
+}
+
+// jitter returns a random duration between d/2 and d, so that many devices
+// dropping at once (e.g. when the adapter resets) don't reconnect in lockstep.
+func jitter(d time.Duration) time.Duration {
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// connState is the state of a supervised connection.
+type connState int
+
+const (
+	stateConnecting connState = iota
+	stateConnected
+	stateReconnecting
+	stateClosed
+)
+
+var connStateNames = [...]string{"connecting", "connected", "reconnecting", "closed"}
+
+func (s connState) String() string {
+	return connStateNames[s]
+}
+
+// supervisor keeps a connection to a device open until its context is done.
+// After every connect, setup is called (for example to subscribe to
+// notifications); the cleanup function it returns is called when the
+// connection drops or the context is done. When the device disconnects, the
+// supervisor reconnects with exponential backoff, unless reconnecting is
+// disabled.
+type supervisor struct {
+	conn      *connectFlags
+	reconnect *reconnectFlags
+	address   bluetooth.Address
+	setup     func(gattclient.Device) (cleanup func(), err error)
+
+	// onState, if set, is called on every state change.
+	onState func(connState)
+}
+
+func (s *supervisor) setState(state connState) {
+	if s.onState != nil {
+		s.onState(state)
+	}
+}
+
+// run connects and supervises the connection. It returns nil when ctx is
+// done, or errDisconnected if the device disconnects and reconnecting is
+// disabled.
+func (s *supervisor) run(ctx context.Context) error {
+	defer s.setState(stateClosed)
+	s.setState(stateConnecting)
+	device, err := s.conn.connect(s.address)
+	if err != nil {
+		return err
+	}
+	for {
+		s.setState(stateConnected)
+		lost := disconnected(device)
+		cleanup, err := s.setup(device)
+		if err != nil {
+			device.Disconnect()
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			cleanup()
+			device.Disconnect()
+			return nil
+		case <-lost:
+			cleanup()
+		}
+		if !s.reconnect.enabled {
+			return errDisconnected
+		}
+		gattLog.Info("disconnected", "address", s.address.String())
+
+		s.setState(stateReconnecting)
+		device, err = s.reconnectBackoff(ctx)
+		if err != nil {
+			return nil // ctx is done
+		}
+	}
+}
+
+// reconnectBackoff tries to reconnect until it succeeds or ctx is done.
+func (s *supervisor) reconnectBackoff(ctx context.Context) (gattclient.Device, error) {
+	backoff := initialBackoff
+	for {
+		delay := jitter(backoff)
+		gattLog.Info("reconnecting", "address", s.address.String(), "in", delay.Round(time.Millisecond))
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
+		device, err := connectTimeout(s.address, s.conn.params(), s.conn.timeout)
+		if err == nil {
+			gattLog.Info("reconnected", "address", s.address.String())
+			metrics.reconnect()
+			return device, nil
+		}
+		gattLog.Warn("reconnection failed", "address", s.address.String(), "err", err)
+		backoff = nextBackoff(backoff, s.reconnect.maxBackoff)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// When systemd runs ble as a service, the commands that scan or advertise
+// tell it when they are up (Type=notify) and feed its watchdog (WatchdogSec=).
+// SIGHUP stops them as SIGTERM does, after which the process starts over in
+// place with the same arguments, reading the configuration file afresh
+// (Type=notify-reload, or ExecReload=kill -HUP $MAINPID).
+//
+// The watchdog pings only show that the process is alive; a scan that stops
+// receiving advertisements is what -watchdog recovers from.
+
+// sdNotify sends a state change to the service manager, if it listens for
+// them.
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	if strings.HasPrefix(socket, "@") {
+		// An abstract socket.
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+var readyOnce sync.Once
+
+// notifyReady tells the service manager that the command is up. Only the
+// first call counts.
+func notifyReady() {
+	readyOnce.Do(func() {
+		if err := sdNotify("READY=1"); err != nil {
+			slog.Warn("notifying systemd", "err", err)
+		}
+	})
+}
+
+// startServiceWatchdog feeds the watchdog of the service manager, if it
+// watches this process, at half its timeout.
+func startServiceWatchdog() {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return
+	}
+	go func() {
+		for range time.Tick(time.Duration(usec) * time.Microsecond / 2) {
+			if err := sdNotify("WATCHDOG=1"); err != nil {
+				slog.Warn("feeding the systemd watchdog", "err", err)
+			}
+		}
+	}()
+}
+
+// reloading is set when SIGHUP stopped the command, for main to start over.
+var reloading atomic.Bool
+
+// notifyReload makes SIGHUP call cancel, when systemd runs the process;
+// otherwise SIGHUP keeps its usual meaning. The returned function stops
+// that.
+func notifyReload(cancel func()) func() {
+	if os.Getenv("INVOCATION_ID") == "" && os.Getenv("NOTIFY_SOCKET") == "" {
+		return func() {}
+	}
+	hup := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		select {
+		case <-hup:
+			slog.Info("reloading")
+			reloading.Store(true)
+			cancel()
+		case <-done:
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			signal.Stop(hup)
+			close(done)
+		})
+	}
+}
+
+// restart runs the process again in its place, once the command has stopped
+// for a reload.
+func restart() error {
+	var now unix.Timespec
+	unix.ClockGettime(unix.CLOCK_MONOTONIC, &now)
+	if err := sdNotify(fmt.Sprintf("RELOADING=1\nMONOTONIC_USEC=%d", now.Nano()/1000)); err != nil {
+		slog.Warn("notifying systemd", "err", err)
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	return syscall.Exec(exe, os.Args, os.Environ())
+}
@@ -0,0 +1,22 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+// Only Linux has systemd.
+
+var reloading atomic.Bool
+
+func notifyReady() {}
+
+func startServiceWatchdog() {}
+
+func notifyReload(cancel func()) func() { return func() {} }
+
+func restart() error {
+	return errors.New("reloading is only supported on Linux")
+}
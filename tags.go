@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"tinygo.org/x/bluetooth"
+)
+
+// Tags group devices, so that commands can work on a group by name, as in
+// ble battery -tag sensors. They are listed in the tags section of the
+// configuration file, by address or alias:
+//
+//	tags:
+//	  sensors: [A4:C1:38:00:00:01, kitchen-ruuvi]
+//	  mine: [F0:0D:00:00:00:05]
+
+// deviceTags are the addresses of the devices with a tag, by tag.
+var deviceTags = map[string][]string{}
+
+// loadTags adds the tags section of the configuration to the device tags.
+func loadTags(section any) error {
+	if section == nil {
+		return nil
+	}
+	tags, ok := section.(map[string]any)
+	if !ok {
+		return errors.New("expected a mapping of tags to lists of devices")
+	}
+	for tag, devices := range tags {
+		list, ok := devices.([]any)
+		if !ok {
+			list = []any{devices}
+		}
+		for _, device := range list {
+			address, err := parseAddress(fmt.Sprint(device))
+			if err != nil {
+				return fmt.Errorf("%s: %w", tag, err)
+			}
+			if !slices.Contains(deviceTags[tag], address.String()) {
+				deviceTags[tag] = append(deviceTags[tag], address.String())
+			}
+		}
+	}
+	return nil
+}
+
+// tagsFlag is a repeatable -tag flag. The tags are looked up when they are
+// used, as the configuration file is read after the command line.
+type tagsFlag []string
+
+func (t *tagsFlag) String() string {
+	return strings.Join(*t, ",")
+}
+
+func (t *tagsFlag) Set(s string) error {
+	*t = append(*t, s)
+	return nil
+}
+
+// addresses returns the addresses of the devices with any of the tags.
+func (t tagsFlag) addresses() ([]bluetooth.Address, error) {
+	var addresses []bluetooth.Address
+	seen := make(map[string]bool)
+	for _, tag := range t {
+		devices, ok := deviceTags[tag]
+		if !ok {
+			known := make([]string, 0, len(deviceTags))
+			for tag := range deviceTags {
+				known = append(known, tag)
+			}
+			slices.Sort(known)
+			return nil, fmt.Errorf("unknown tag %q (known: %s)", tag, strings.Join(known, ", "))
+		}
+		for _, device := range devices {
+			if seen[device] {
+				continue
+			}
+			seen[device] = true
+			address, err := parseAddress(device)
+			if err != nil {
+				return nil, err
+			}
+			addresses = append(addresses, address)
+		}
+	}
+	if len(t) > 0 && len(addresses) == 0 {
+		return nil, fmt.Errorf("no devices tagged %s", t.String())
+	}
+	return addresses, nil
+}
+
+// deviceTagsOf returns the tags of a device, sorted.
+func deviceTagsOf(address string) []string {
+	var tags []string
+	for tag, devices := range deviceTags {
+		if slices.Contains(devices, address) {
+			tags = append(tags, tag)
+		}
+	}
+	slices.Sort(tags)
+	return tags
+}
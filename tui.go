@@ -0,0 +1,477 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	assignednumbers "example.com/m/assigned_numbers"
+	"example.com/m/decode"
+	"example.com/m/gattclient"
+	"golang.org/x/term"
+	"tinygo.org/x/bluetooth"
+)
+
+// The TUI is a live table of the devices being scanned, drawn with ANSI
+// escape sequences on the alternate screen of the terminal. Enter connects to
+// the selected device to browse its GATT services, and Enter on a
+// characteristic reads it.
+
+// tuiColumns are the columns the table can be sorted by.
+var tuiColumns = []string{"rssi", "name", "address", "vendor", "seen"}
+
+// tuiSparkLength is the number of RSSI samples in the sparkline of a device.
+const tuiSparkLength = 16
+
+var sparkBlocks = []rune("▁▂▃▄▅▆▇█")
+
+type tuiDevice struct {
+	address bluetooth.Address
+	last    *sighting
+	rssi    []int16 // the last tuiSparkLength samples
+}
+
+// name is the alias of the device, or else its local name.
+func (d *tuiDevice) name() string {
+	if d.last.Alias != "" {
+		return d.last.Alias
+	}
+	return d.last.LocalName
+}
+
+// tuiItem is a line of the GATT browser: a service, or a characteristic with
+// the value it was last read as.
+type tuiItem struct {
+	label string
+	char  gattclient.Characteristic
+	value string
+}
+
+type tui struct {
+	conn *connectFlags
+	out  int
+
+	mu      sync.Mutex
+	devices map[string]*tuiDevice
+	status  string
+
+	// The rest is only used by the UI goroutine.
+	sortBy   int
+	reverse  bool
+	selected string            // address of the selected device
+	device   gattclient.Device // the device being browsed, nil in the table
+	items    []tuiItem
+	item     int
+}
+
+func runTUI(args []string) error {
+	fs := newFlagSet("tui", "")
+	var filter scanFilter
+	filter.registerFlags(fs)
+	var conn connectFlags
+	conn.registerFlags(fs)
+	sortBy := fs.String("sort", "rssi", "sort the devices by this column: "+strings.Join(tuiColumns, ", "))
+	refresh := fs.Duration("refresh", 500*time.Millisecond, "redraw the table this often")
+	ouiFlag(fs)
+	var scanning scanFlags
+	scanning.registerFlags(fs)
+	parseFlags(fs, args)
+	if err := conn.validate(); err != nil {
+		return err
+	}
+	if err := scanning.setup(); err != nil {
+		return err
+	}
+	if err := filter.setup(); err != nil {
+		return err
+	}
+	t := &tui{conn: &conn, out: int(os.Stdout.Fd()), devices: make(map[string]*tuiDevice)}
+	if t.sortBy = slices.Index(tuiColumns, *sortBy); t.sortBy < 0 {
+		return fmt.Errorf("unknown sort column %q", *sortBy)
+	}
+	if *refresh <= 0 {
+		return errors.New("-refresh must be positive")
+	}
+	in := int(os.Stdin.Fd())
+	if !term.IsTerminal(in) || !term.IsTerminal(t.out) {
+		return errors.New("the TUI needs a terminal, use 'ble scan' otherwise")
+	}
+
+	if err := enableAdapter(); err != nil {
+		return err
+	}
+	state, err := term.MakeRaw(in)
+	if err != nil {
+		return err
+	}
+	defer term.Restore(in, state)
+	// Switch to the alternate screen and hide the cursor.
+	fmt.Print("\x1b[?1049h\x1b[?25l")
+	defer fmt.Print("\x1b[?25h\x1b[?1049l")
+	// Log messages would garble the screen, so the last one is shown on
+	// the status line instead.
+	defer installLogger(slog.Default().Handler())
+	installLogger(slog.NewTextHandler(tuiStatus{t}, &slog.HandlerOptions{Level: logLevel, ReplaceAttr: dropTime}))
+	scanLog.Info("scanning")
+
+	scanErr := make(chan error, 1)
+	go func() {
+		scanErr <- scan(func(adapter *bluetooth.Adapter, result bluetooth.ScanResult) {
+			if filter.match(result) {
+				t.seen(result.Address, newSighting(result, time.Now()))
+			}
+		})
+	}()
+	keys := make(chan string)
+	go readKeys(os.Stdin, keys)
+	ctx, stop := shutdownContext()
+	defer stop()
+	ticker := time.NewTicker(*refresh)
+	defer ticker.Stop()
+
+	for {
+		t.draw()
+		select {
+		case key, ok := <-keys:
+			if ok && t.key(key) {
+				continue
+			}
+		case <-ticker.C:
+			continue
+		case <-ctx.Done():
+		case err := <-scanErr:
+			t.disconnect()
+			return err
+		}
+		break
+	}
+	t.disconnect()
+	stopScan()
+	return <-scanErr
+}
+
+// tuiStatus shows log messages on the status line.
+type tuiStatus struct {
+	t *tui
+}
+
+func (s tuiStatus) Write(b []byte) (int, error) {
+	s.t.setStatus(string(bytes.TrimSpace(b)))
+	return len(b), nil
+}
+
+// dropTime removes the time from log messages, as they are shown as they
+// happen.
+func dropTime(groups []string, a slog.Attr) slog.Attr {
+	if a.Key == slog.TimeKey && len(groups) == 0 {
+		return slog.Attr{}
+	}
+	return a
+}
+
+func (t *tui) setStatus(status string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.status = status
+}
+
+func (t *tui) seen(address bluetooth.Address, s *sighting) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	d := t.devices[s.Address]
+	if d == nil {
+		d = &tuiDevice{address: address}
+		t.devices[s.Address] = d
+	}
+	d.last = s
+	d.rssi = append(d.rssi, s.RSSI)
+	if len(d.rssi) > tuiSparkLength {
+		d.rssi = d.rssi[len(d.rssi)-tuiSparkLength:]
+	}
+}
+
+// sorted returns the devices in the order of the table.
+func (t *tui) sorted() []*tuiDevice {
+	t.mu.Lock()
+	devices := make([]*tuiDevice, 0, len(t.devices))
+	for _, d := range t.devices {
+		devices = append(devices, d)
+	}
+	t.mu.Unlock()
+	slices.SortFunc(devices, func(a, b *tuiDevice) int {
+		var c int
+		switch tuiColumns[t.sortBy] {
+		case "rssi":
+			c = cmp.Compare(b.last.RSSI, a.last.RSSI)
+		case "name":
+			c = cmp.Compare(a.name(), b.name())
+		case "vendor":
+			c = cmp.Compare(a.last.Vendor, b.last.Vendor)
+		case "seen":
+			c = b.last.Time.Compare(a.last.Time)
+		}
+		if c == 0 {
+			c = cmp.Compare(a.last.Address, b.last.Address)
+		}
+		if t.reverse {
+			return -c
+		}
+		return c
+	})
+	return devices
+}
+
+// key handles a key press, and returns false to quit.
+func (t *tui) key(key string) bool {
+	if key == "q" || key == "\x03" { // Ctrl-C
+		return false
+	}
+	if t.device != nil {
+		t.browseKey(key)
+		return true
+	}
+	devices := t.sorted()
+	// Without a selection, the first device is selected.
+	i := max(0, slices.IndexFunc(devices, func(d *tuiDevice) bool { return d.last.Address == t.selected }))
+	switch key {
+	case "up", "k":
+		i--
+	case "down", "j":
+		i++
+	case "s":
+		t.sortBy = (t.sortBy + 1) % len(tuiColumns)
+	case "r":
+		t.reverse = !t.reverse
+	case "\r":
+		if len(devices) > 0 {
+			t.connect(devices[i].address)
+		}
+		return true
+	}
+	if len(devices) > 0 {
+		t.selected = devices[max(0, min(i, len(devices)-1))].last.Address
+	}
+	return true
+}
+
+// browseKey handles a key press in the GATT browser.
+func (t *tui) browseKey(key string) {
+	switch key {
+	case "up", "k":
+		t.item = max(0, t.item-1)
+	case "down", "j":
+		t.item = min(len(t.items)-1, t.item+1)
+	case "\r":
+		if len(t.items) > 0 {
+			t.read(&t.items[t.item])
+		}
+	case "\x1b", "\x7f", "h": // Esc, Backspace
+		t.disconnect()
+	}
+}
+
+// connect connects to a device and lists its services and characteristics.
+// The table isn't updated meanwhile.
+func (t *tui) connect(address bluetooth.Address) {
+	t.setStatus("connecting to " + address.String() + "...")
+	t.draw()
+	device, err := t.conn.connect(address)
+	if err != nil {
+		t.setStatus("connect: " + err.Error())
+		return
+	}
+	items, err := tuiItems(device)
+	if err != nil {
+		device.Disconnect()
+		t.setStatus("discover services: " + err.Error())
+		return
+	}
+	t.device, t.items, t.item = device, items, 0
+	t.setStatus("connected to " + address.String())
+}
+
+func (t *tui) disconnect() {
+	if t.device == nil {
+		return
+	}
+	t.device.Disconnect()
+	t.setStatus("disconnected from " + t.device.Address().String())
+	t.device, t.items = nil, nil
+}
+
+func tuiItems(device gattclient.Device) ([]tuiItem, error) {
+	services, err := device.DiscoverServices(nil)
+	if err != nil {
+		return nil, err
+	}
+	details, _ := gattDetails(device.Address())
+	var items []tuiItem
+	for _, service := range services {
+		items = append(items, tuiItem{label: "service " + describeUUID(service.UUID(), assignednumbers.ServiceName(service.UUID()))})
+		chars, err := service.DiscoverCharacteristics(nil)
+		if err != nil {
+			return nil, err
+		}
+		for i, char := range chars {
+			label := "  " + describeUUID(char.UUID(), assignednumbers.CharacteristicName(char.UUID()))
+			if detail := details[gattKey{service.UUID(), char.UUID()}]; detail != nil {
+				label += " [" + strings.Join(detail.flags, ", ") + "]"
+			}
+			items = append(items, tuiItem{label: label, char: chars[i]})
+		}
+	}
+	return items, nil
+}
+
+// read reads the value of a characteristic item.
+func (t *tui) read(item *tuiItem) {
+	if item.char == nil {
+		return
+	}
+	value, err := gattclient.Read(item.char)
+	if err != nil {
+		item.value = "error: " + err.Error()
+		return
+	}
+	item.value = hex.EncodeToString(value)
+	if s := printableUTF8(value); s != "" {
+		item.value += " " + s
+	}
+	if m, ok := decode.Characteristic(item.char.UUID(), value); ok {
+		item.value += " (" + m.Name + ": " + m.String() + ")"
+	}
+}
+
+// draw redraws the screen.
+func (t *tui) draw() {
+	width, height, err := term.GetSize(t.out)
+	if err != nil {
+		width, height = 80, 24
+	}
+	var lines []string
+	var selected int
+	if t.device != nil {
+		lines, selected = t.browserLines()
+	} else {
+		lines, selected = t.tableLines()
+	}
+	// Two lines of headings stay put, and the rest scrolls to keep the
+	// selection visible above the status line.
+	rows := max(1, height-3)
+	offset := max(0, selected-2-rows+1)
+	var b strings.Builder
+	b.WriteString("\x1b[H")
+	for i, line := range lines {
+		if i >= 2 && (i < 2+offset || i >= 2+offset+rows) {
+			continue
+		}
+		line = fit(line, width)
+		if i == selected {
+			line = "\x1b[7m" + line + "\x1b[0m"
+		}
+		b.WriteString(line + "\x1b[K\r\n")
+	}
+	t.mu.Lock()
+	status := t.status
+	t.mu.Unlock()
+	fmt.Fprintf(&b, "\x1b[J\x1b[%dH\x1b[7m%-*s\x1b[0m", height, width, fit(status, width))
+	io.WriteString(os.Stdout, b.String())
+}
+
+// tableLines returns the lines of the device table and the index of the
+// selected one, or -1.
+func (t *tui) tableLines() ([]string, int) {
+	devices := t.sorted()
+	order := "↓"
+	if t.reverse {
+		order = "↑"
+	}
+	lines := []string{
+		fmt.Sprintf("%d devices, by %s %s   ↑↓ select  Enter connect  s sort  r reverse  q quit", len(devices), tuiColumns[t.sortBy], order),
+		fmt.Sprintf("%-17s %4s %-*s %-20s %-24s %5s", "ADDRESS", "RSSI", tuiSparkLength, "", "NAME", "VENDOR", "SEEN"),
+	}
+	selected := -1
+	now := time.Now()
+	for i, d := range devices {
+		if d.last.Address == t.selected || (t.selected == "" && i == 0) {
+			selected = len(lines)
+		}
+		lines = append(lines, fmt.Sprintf("%-17s %4d %s %-20s %-24s %5s",
+			d.last.Address, d.last.RSSI, sparkline(d.rssi), fit(d.name(), 20), fit(d.last.Vendor, 24), now.Sub(d.last.Time).Round(time.Second)))
+	}
+	return lines, selected
+}
+
+// browserLines returns the lines of the GATT browser and the index of the
+// selected one.
+func (t *tui) browserLines() ([]string, int) {
+	lines := []string{
+		t.device.Address().String() + "   ↑↓ select  Enter read  Esc disconnect  q quit",
+		"",
+	}
+	for _, item := range t.items {
+		line := item.label
+		if item.value != "" {
+			line += " = " + item.value
+		}
+		lines = append(lines, line)
+	}
+	return lines, 2 + t.item
+}
+
+// sparkline draws RSSI samples from -100 to -30 dBm as block characters,
+// padded to tuiSparkLength.
+func sparkline(rssi []int16) string {
+	spark := make([]rune, 0, tuiSparkLength)
+	for _, r := range rssi {
+		level := (int(r) + 100) * len(sparkBlocks) / 70
+		spark = append(spark, sparkBlocks[max(0, min(level, len(sparkBlocks)-1))])
+	}
+	return string(spark) + strings.Repeat(" ", tuiSparkLength-len(spark))
+}
+
+// fit cuts s to at most width characters.
+func fit(s string, width int) string {
+	if r := []rune(s); len(r) > width {
+		return string(r[:width])
+	}
+	return s
+}
+
+// readKeys sends the keys pressed to keys, with the arrow keys as "up" and
+// "down", until reading fails.
+func readKeys(r io.Reader, keys chan<- string) {
+	defer close(keys)
+	buf := make([]byte, 64)
+	for {
+		n, err := r.Read(buf)
+		b := buf[:n]
+		for len(b) > 0 {
+			if len(b) >= 3 && b[0] == 0x1b && b[1] == '[' {
+				// Other escape sequences are ignored.
+				switch b[2] {
+				case 'A':
+					keys <- "up"
+				case 'B':
+					keys <- "down"
+				}
+				b = b[3:]
+				continue
+			}
+			keys <- string(b[:1])
+			b = b[1:]
+		}
+		if err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"example.com/m/gattclient"
+	"golang.org/x/term"
+	"tinygo.org/x/bluetooth"
+)
+
+// The Nordic UART Service (NUS) is the de facto standard serial port over
+// BLE: the central writes to the RX characteristic and the peripheral
+// notifies on the TX characteristic.
+var (
+	nusService = bluetooth.ServiceUUIDNordicUART
+	nusRX      = bluetooth.CharacteristicUUIDUARTRX
+	nusTX      = bluetooth.CharacteristicUUIDUARTTX
+)
+
+func runUARTServer(args []string) error {
+	fs := newFlagSet("uart-server", "")
+	name := fs.String("name", "Go UART", "local name to advertise")
+	chunkSize := fs.Int("chunk-size", 20, "maximum number of bytes per TX notification (the ATT MTU of the central minus 3)")
+	acceptFlag(fs)
+	parseFlags(fs, args)
+	if *chunkSize < 1 || *chunkSize > 512 {
+		return errors.New("-chunk-size must be between 1 and 512")
+	}
+
+	if err := enableAdapter(); err != nil {
+		return err
+	}
+	var tx bluetooth.Characteristic
+	err := adapter.AddService(&bluetooth.Service{
+		UUID: nusService,
+		Characteristics: []bluetooth.CharacteristicConfig{
+			{
+				UUID:  nusRX,
+				Flags: bluetooth.CharacteristicWritePermission | bluetooth.CharacteristicWriteWithoutResponsePermission,
+				WriteEvent: func(client bluetooth.Connection, offset int, value []byte) {
+					os.Stdout.Write(value)
+				},
+			},
+			{
+				Handle: &tx,
+				UUID:   nusTX,
+				Flags:  bluetooth.CharacteristicReadPermission | bluetooth.CharacteristicNotifyPermission,
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	// Send stdin to the central in notification-sized chunks. On EOF the
+	// server keeps running, to receive until interrupted.
+	go func() {
+		buf := make([]byte, *chunkSize)
+		for {
+			n, err := os.Stdin.Read(buf)
+			if n > 0 {
+				if _, err := tx.Write(buf[:n]); err != nil {
+					gattLog.Warn("send failed", "err", err)
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	return advertise(bluetooth.AdvertisementOptions{
+		LocalName:    *name,
+		ServiceUUIDs: []bluetooth.UUID{nusService},
+	})
+}
+
+func runUART(args []string) error {
+	fs := newFlagSet("uart", "<address>")
+	var conn connectFlags
+	conn.registerFlags(fs)
+	raw := fs.Bool("raw", false, "send input as it is typed instead of line by line (Ctrl-] quits)")
+	crlf := fs.Bool("crlf", false, "in line mode, end lines with CR LF instead of LF")
+	listen := fs.String("listen", "", "instead of the terminal, bridge the UART to the TCP clients that connect to this address, e.g. :2323")
+	dial := fs.String("dial", "", "instead of the terminal, bridge the UART to a TCP connection to this HOST:PORT, reconnecting when it closes")
+	parseFlags(fs, args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("expected exactly one device address")
+	}
+	if *listen != "" && *dial != "" {
+		return errors.New("-listen and -dial don't go together")
+	}
+	var bridge *tcpBridge
+	var out io.Writer = os.Stdout
+	if *listen != "" || *dial != "" {
+		bridge = &tcpBridge{}
+		out = bridge
+	}
+	address, err := parseAddress(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	if err := enableAdapter(); err != nil {
+		return err
+	}
+	device, err := conn.connect(address)
+	if err != nil {
+		return err
+	}
+	defer device.Disconnect()
+	lost := disconnected(device)
+
+	rx, err := gattclient.FindCharacteristic(device, nusService, nusRX)
+	if err != nil {
+		return fmt.Errorf("no Nordic UART Service: %w", err)
+	}
+	tx, err := gattclient.FindCharacteristic(device, nusService, nusTX)
+	if err != nil {
+		return fmt.Errorf("no Nordic UART Service: %w", err)
+	}
+	err = tx.EnableNotifications(func(value []byte) {
+		out.Write(value)
+	})
+	if err != nil {
+		return err
+	}
+	chunkSize := 20
+	if mtu, err := rx.GetMTU(); err == nil && mtu > 3 {
+		chunkSize = int(mtu) - 3
+	}
+	send := func(b []byte) error {
+		for len(b) > 0 {
+			n := min(len(b), chunkSize)
+			if err := writeCharacteristic(device, nusService, rx, b[:n], false); err != nil {
+				return err
+			}
+			b = b[n:]
+		}
+		return nil
+	}
+
+	ctx, stop := shutdownContext()
+	defer stop()
+	done := make(chan error, 1)
+	if bridge != nil {
+		go func() { done <- bridge.run(ctx, *listen, *dial, send) }()
+	} else if *raw {
+		// In a terminal, raw mode passes every key press on, including
+		// Ctrl-C, so Ctrl-] (as in telnet) ends the session instead.
+		if fd := int(os.Stdin.Fd()); term.IsTerminal(fd) {
+			state, err := term.MakeRaw(fd)
+			if err != nil {
+				return err
+			}
+			defer term.Restore(fd, state)
+			fmt.Fprint(os.Stderr, "connected, press Ctrl-] to quit\r\n")
+		}
+		go func() { done <- sendRaw(os.Stdin, send) }()
+	} else {
+		eol := "\n"
+		if *crlf {
+			eol = "\r\n"
+		}
+		gattLog.Info("connected, press Ctrl-C to quit")
+		go func() { done <- sendLines(os.Stdin, eol, send) }()
+	}
+
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+	case <-lost:
+		err = errDisconnected
+	}
+	tx.EnableNotifications(nil)
+	return err
+}
+
+// sendLines sends input line by line, each followed by eol.
+func sendLines(r io.Reader, eol string, send func([]byte) error) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if err := send(append(scanner.Bytes(), eol...)); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// sendRaw sends input as it is read, until EOF or Ctrl-].
+func sendRaw(r io.Reader, send func([]byte) error) error {
+	buf := make([]byte, 256)
+	for {
+		n, err := r.Read(buf)
+		for i, c := range buf[:n] {
+			if c == 0x1D { // Ctrl-]
+				return send(buf[:i])
+			}
+		}
+		if n > 0 {
+			if err := send(buf[:n]); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"time"
+
+	"example.com/m/decode"
+)
+
+// udpOutput sends the decoded sensor values of sightings as JSON datagrams,
+// one per sighting, to a broadcast, multicast or unicast address, for
+// consumers on the LAN that don't want to run an MQTT broker:
+//
+//	{"time":"2024-01-02T15:04:05Z","address":"A4:C1:38:00:00:01","alias":"kitchen-ruuvi","rssi":-67,
+//	 "sensors":{"ruuvi":{"temperature":{"value":21.5,"unit":"°C"},"humidity":{"value":48,"unit":"%"}}}}
+//
+// Sightings without sensor values aren't sent. Datagrams that can't be sent
+// are dropped: UDP makes no promises either way.
+type udpOutput struct {
+	conn    *net.UDPConn
+	addr    *net.UDPAddr
+	failing bool // the last datagram couldn't be sent, so as to log once
+}
+
+// udpSighting is the JSON form of a sighting sent by udpOutput.
+type udpSighting struct {
+	Time    time.Time                        `json:"time"`
+	Address string                           `json:"address"`
+	Alias   string                           `json:"alias,omitempty"`
+	Tags    []string                         `json:"tags,omitempty"`
+	RSSI    int16                            `json:"rssi"`
+	Sensors map[string]map[string]udpReading `json:"sensors"`
+}
+
+type udpReading struct {
+	Value float64 `json:"value"`
+	Unit  string  `json:"unit,omitempty"`
+}
+
+// newUDPOutput opens a socket to send to address, as HOST:PORT. Go allows
+// broadcast on UDP sockets, so 255.255.255.255:9999 or the broadcast address
+// of a subnet works as well as a multicast group or a single host.
+func newUDPOutput(address string) (*udpOutput, error) {
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -udp address: %w", err)
+	}
+	if addr.Port == 0 {
+		return nil, fmt.Errorf("-udp %s: missing port", address)
+	}
+	network := "udp6"
+	if addr.IP == nil || addr.IP.To4() != nil {
+		network = "udp4"
+	}
+	// An unconnected socket, as a connected one would fail later writes
+	// when a unicast host sends back port unreachable.
+	conn, err := net.ListenUDP(network, nil)
+	if err != nil {
+		return nil, err
+	}
+	sinkLog.Info("sending sensor values over UDP", "address", addr.String())
+	return &udpOutput{conn: conn, addr: addr}, nil
+}
+
+func (o *udpOutput) write(s *sighting) error {
+	record := udpSighting{
+		Time:    s.Time,
+		Address: s.Address,
+		Alias:   s.Alias,
+		Tags:    s.Tags,
+		RSSI:    s.RSSI,
+		Sensors: make(map[string]map[string]udpReading),
+	}
+	for i, key := range frameKeys(s.Frames) {
+		sensor, ok := s.Frames[i].(decode.SensorFrame)
+		if !ok {
+			continue
+		}
+		for _, m := range sensor.Measurements() {
+			if record.Sensors[key] == nil {
+				record.Sensors[key] = make(map[string]udpReading)
+			}
+			record.Sensors[key][m.Name] = udpReading{Value: m.Value, Unit: m.Unit}
+		}
+	}
+	if len(record.Sensors) == 0 {
+		return nil
+	}
+	datagram, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if dryRun {
+		return nil
+	}
+	if _, err := o.conn.WriteToUDP(datagram, o.addr); err != nil {
+		if !o.failing {
+			sinkLog.Warn("UDP send failed", "address", o.addr.String(), "err", err)
+		}
+		o.failing = true
+		return nil
+	}
+	if o.failing {
+		sinkLog.Info("UDP sends work again", "address", o.addr.String())
+		o.failing = false
+	}
+	return nil
+}
+
+func (o *udpOutput) close() error {
+	return o.conn.Close()
+}
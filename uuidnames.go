@@ -0,0 +1,14 @@
+package main
+
+import (
+	"tinygo.org/x/bluetooth"
+)
+
+// describeUUID formats a UUID followed by its name in parentheses, if there is
+// a name for it.
+func describeUUID(uuid bluetooth.UUID, name string) string {
+	if name == "" {
+		return uuid.String()
+	}
+	return uuid.String() + " (" + name + ")"
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// valueFormats are the formats accepted by -format, for interpreting
+// characteristic values.
+var valueFormats = []string{
+	"uint8", "int8",
+	"uint16-le", "uint16-be", "int16-le", "int16-be",
+	"uint32-le", "uint32-be", "int32-le", "int32-be",
+	"uint64-le", "uint64-be", "int64-le", "int64-be",
+	"float32-le", "float32-be", "float64-le", "float64-be",
+}
+
+// formatValue interprets a characteristic value in one of the valueFormats.
+// Like the GATT format types, values are little-endian unless "-be" is given.
+func formatValue(format string, b []byte) (string, error) {
+	name, endian, _ := strings.Cut(format, "-")
+	var order binary.ByteOrder = binary.LittleEndian
+	switch endian {
+	case "le", "":
+	case "be":
+		order = binary.BigEndian
+	default:
+		return "", fmt.Errorf("unknown byte order in format %q", format)
+	}
+
+	size := map[string]int{
+		"uint8": 1, "int8": 1,
+		"uint16": 2, "int16": 2,
+		"uint32": 4, "int32": 4, "float32": 4,
+		"uint64": 8, "int64": 8, "float64": 8,
+	}[name]
+	if size == 0 {
+		return "", fmt.Errorf("unknown format %q (known: %s)", format, strings.Join(valueFormats, ", "))
+	}
+	if len(b) < size {
+		return "", fmt.Errorf("value is %d bytes, %s needs %d", len(b), format, size)
+	}
+
+	var u uint64
+	switch size {
+	case 1:
+		u = uint64(b[0])
+	case 2:
+		u = uint64(order.Uint16(b))
+	case 4:
+		u = uint64(order.Uint32(b))
+	case 8:
+		u = order.Uint64(b)
+	}
+	switch name {
+	case "float32":
+		return strconv.FormatFloat(float64(math.Float32frombits(uint32(u))), 'g', -1, 32), nil
+	case "float64":
+		return strconv.FormatFloat(math.Float64frombits(u), 'g', -1, 64), nil
+	case "int8", "int16", "int32", "int64":
+		shift := 64 - 8*size
+		return strconv.FormatInt(int64(u<<shift)>>shift, 10), nil
+	}
+	return strconv.FormatUint(u, 10), nil
+}
+
+// checkValueFormat returns an error if a -format flag value is invalid, so it
+// can be reported before connecting. The empty format is valid.
+func checkValueFormat(format string) error {
+	if format == "" {
+		return nil
+	}
+	_, err := formatValue(format, make([]byte, 8))
+	return err
+}
+
+// printableUTF8 returns the value as a quoted string if it is valid UTF-8,
+// or the empty string otherwise.
+func printableUTF8(b []byte) string {
+	if len(b) == 0 || !utf8.Valid(b) {
+		return ""
+	}
+	return strconv.Quote(string(b))
+}